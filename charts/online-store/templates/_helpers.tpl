@@ -30,3 +30,25 @@ Create chart name and version as used by the chart label.
 {{- define "online-store.chart" -}}
 {{- printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" -}}
 {{- end -}}
+
+{{/*
+The environment of the order queue, shared by the app and the order workers.
+*/}}
+{{- define "online-store.orderQueueEnv" -}}
+- name: ORDER_QUEUE
+  value: {{ .Values.orderQueue.type | quote }}
+{{- if eq .Values.orderQueue.type "redis" }}
+- name: ORDER_QUEUE_STREAM
+  value: {{ .Values.orderQueue.stream | quote }}
+- name: ORDER_QUEUE_GROUP
+  value: {{ .Values.orderQueue.group | quote }}
+{{- else if eq .Values.orderQueue.type "servicebus" }}
+- name: ORDER_QUEUE_NAME
+  value: {{ .Values.orderQueue.serviceBus.queue | quote }}
+- name: SERVICEBUS_CONNECTION_STRING
+  valueFrom:
+    secretKeyRef:
+      name: {{ template "online-store.fullname" . }}-order-queue
+      key: connection-string
+{{- end }}
+{{- end -}}
@@ -0,0 +1,443 @@
+// Package appinsights exports the spans and the metrics of the online-store
+// straight to Azure Application Insights, through its ingestion API, for
+// clusters without an OpenTelemetry collector. Server spans become requests
+// and the others dependencies, under the trace ID as the operation, so the
+// end-to-end transaction view stitches them together.
+package appinsights
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultEndpoint = "https://dc.services.visualstudio.com"
+
+// Options configures an exporter.
+type Options struct {
+	// InstrumentationKey is the key of the Application Insights resource.
+	InstrumentationKey string
+	// Endpoint is the ingestion endpoint, the global one by default.
+	Endpoint string
+	// ServiceName and Instance are the cloud role and role instance of the
+	// telemetry, as the service and the pod.
+	ServiceName string
+	Instance    string
+	// FlushInterval is the most time the telemetry waits to be sent, 5s by
+	// default, and BatchSize the most items sent at once, 500 by default.
+	FlushInterval time.Duration
+	BatchSize     int
+	// OnError is called with the errors sending the telemetry, which is
+	// dropped then.
+	OnError func(error)
+}
+
+// ParseConnectionString returns the instrumentation key and the ingestion
+// endpoint of a connection string, as
+// InstrumentationKey=...;IngestionEndpoint=https://....
+func ParseConnectionString(s string) (key, endpoint string, err error) {
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "instrumentationkey":
+			key = kv[1]
+		case "ingestionendpoint":
+			endpoint = strings.TrimSuffix(kv[1], "/")
+		}
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("no InstrumentationKey in the connection string")
+	}
+	return key, endpoint, nil
+}
+
+// Exporter sends spans and metrics to Application Insights. It is a span
+// exporter and a metric exporter of the OpenTelemetry SDK.
+type Exporter struct {
+	opts   Options
+	http   *http.Client
+	prefix string
+	items  chan envelope
+	flush  chan chan struct{}
+	done   chan struct{}
+}
+
+var (
+	_ sdktrace.SpanExporter = (*Exporter)(nil)
+	_ sdkmetric.Exporter    = (*Exporter)(nil)
+)
+
+// NewExporter returns an exporter, sending in the background until Stop.
+func NewExporter(opts Options) (*Exporter, error) {
+	if opts.InstrumentationKey == "" {
+		return nil, fmt.Errorf("an instrumentation key is needed to export to application insights")
+	}
+	// Default to the global endpoint, 5s and 500 if not set
+	if opts.Endpoint == "" {
+		opts.Endpoint = defaultEndpoint
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(error) {}
+	}
+
+	e := &Exporter{
+		opts:   opts,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		prefix: "Microsoft.ApplicationInsights." + strings.Replace(opts.InstrumentationKey, "-", "", -1) + ".",
+		// Telemetry past a full buffer, as while the endpoint can't be
+		// reached, is dropped rather than slow the requests down.
+		items: make(chan envelope, 20*opts.BatchSize),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// envelope is an item of telemetry, as the ingestion API takes it.
+type envelope struct {
+	Name string            `json:"name"`
+	Time string            `json:"time"`
+	IKey string            `json:"iKey"`
+	Tags map[string]string `json:"tags"`
+	Data envelopeData      `json:"data"`
+}
+
+type envelopeData struct {
+	BaseType string      `json:"baseType"`
+	BaseData interface{} `json:"baseData"`
+}
+
+type requestData struct {
+	Ver          int               `json:"ver"`
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Duration     string            `json:"duration"`
+	ResponseCode string            `json:"responseCode"`
+	Success      bool              `json:"success"`
+	URL          string            `json:"url,omitempty"`
+	Properties   map[string]string `json:"properties,omitempty"`
+}
+
+type dependencyData struct {
+	Ver        int               `json:"ver"`
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Duration   string            `json:"duration"`
+	ResultCode string            `json:"resultCode"`
+	Success    bool              `json:"success"`
+	Data       string            `json:"data,omitempty"`
+	Type       string            `json:"type"`
+	Target     string            `json:"target,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type metricData struct {
+	Ver        int               `json:"ver"`
+	Metrics    []dataPoint       `json:"metrics"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type dataPoint struct {
+	Name  string   `json:"name"`
+	Kind  int      `json:"kind"`
+	Value float64  `json:"value"`
+	Count *int64   `json:"count,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// Kinds of data points.
+const (
+	measurement = 0
+	aggregation = 1
+)
+
+func (e *Exporter) envelope(kind string, t time.Time, data interface{}) envelope {
+	return envelope{
+		Name: e.prefix + kind,
+		Time: t.UTC().Format(time.RFC3339Nano),
+		IKey: e.opts.InstrumentationKey,
+		Tags: map[string]string{
+			"ai.cloud.role":         e.opts.ServiceName,
+			"ai.cloud.roleInstance": e.opts.Instance,
+		},
+		Data: envelopeData{BaseType: kind + "Data", BaseData: data},
+	}
+}
+
+// ExportSpans queues the spans: a request for those served, and a
+// dependency for the others.
+func (e *Exporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, span := range spans {
+		e.exportSpan(span)
+	}
+	return nil
+}
+
+func (e *Exporter) exportSpan(span sdktrace.ReadOnlySpan) {
+	attributes := span.Attributes()
+	properties := make(map[string]string, len(attributes))
+	values := make(map[attribute.Key]attribute.Value, len(attributes))
+	for _, kv := range attributes {
+		properties[string(kv.Key)] = kv.Value.Emit()
+		values[kv.Key] = kv.Value
+	}
+	// Spans without an HTTP status succeed unless their status is an error;
+	// HTTP ones unless it is 400 or more.
+	success := span.Status().Code != codes.Error
+	code := span.Status().Code.String()
+	if status, ok := values["rpc.response.status_code"]; ok {
+		code = status.Emit()
+	}
+	if status, ok := values["http.response.status_code"]; ok {
+		code = status.Emit()
+		success = status.AsInt64() < 400
+	}
+	url := values["url.full"].AsString()
+	duration := formatDuration(span.EndTime().Sub(span.StartTime()))
+
+	var item envelope
+	if span.SpanKind() == trace.SpanKindServer {
+		if url == "" {
+			url = values["url.path"].AsString()
+		}
+		item = e.envelope("Request", span.StartTime(), requestData{
+			Ver:          2,
+			ID:           span.SpanContext().SpanID().String(),
+			Name:         span.Name(),
+			Duration:     duration,
+			ResponseCode: code,
+			Success:      success,
+			URL:          url,
+			Properties:   properties,
+		})
+		item.Tags["ai.operation.name"] = span.Name()
+	} else {
+		dependencyType := "InProc"
+		if _, ok := values["http.request.method"]; ok {
+			dependencyType = "HTTP"
+		}
+		item = e.envelope("RemoteDependency", span.StartTime(), dependencyData{
+			Ver:        2,
+			ID:         span.SpanContext().SpanID().String(),
+			Name:       span.Name(),
+			Duration:   duration,
+			ResultCode: code,
+			Success:    success,
+			Data:       url,
+			Type:       dependencyType,
+			Target:     values["server.address"].AsString(),
+			Properties: properties,
+		})
+	}
+	item.Tags["ai.operation.id"] = span.SpanContext().TraceID().String()
+	if parent := span.Parent(); parent.HasSpanID() {
+		item.Tags["ai.operation.parentId"] = parent.SpanID().String()
+	}
+	e.queue(item)
+}
+
+// Temporality has the counts and sums sent as what was added since the last
+// export, and distributions as the count and sum of the values added, so
+// that they add up in Application Insights. Up-down counters are sent as
+// their current value.
+func (e *Exporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	switch kind {
+	case sdkmetric.InstrumentKindUpDownCounter, sdkmetric.InstrumentKindObservableUpDownCounter:
+		return metricdata.CumulativeTemporality
+	}
+	return metricdata.DeltaTemporality
+}
+
+// Aggregation is the default aggregation of the SDK.
+func (e *Exporter) Aggregation(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(kind)
+}
+
+// Export queues a metric for each data point of rm.
+func (e *Exporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				exportPoints(e, m.Name, data.DataPoints)
+			case metricdata.Sum[float64]:
+				exportPoints(e, m.Name, data.DataPoints)
+			case metricdata.Gauge[int64]:
+				exportPoints(e, m.Name, data.DataPoints)
+			case metricdata.Gauge[float64]:
+				exportPoints(e, m.Name, data.DataPoints)
+			case metricdata.Histogram[int64]:
+				exportHistogram(e, m.Name, data.DataPoints)
+			case metricdata.Histogram[float64]:
+				exportHistogram(e, m.Name, data.DataPoints)
+			}
+		}
+	}
+	return nil
+}
+
+func exportPoints[N int64 | float64](e *Exporter, name string, points []metricdata.DataPoint[N]) {
+	for _, p := range points {
+		e.queueMetric(p.Time, p.Attributes, dataPoint{Name: name, Kind: measurement, Value: float64(p.Value)})
+	}
+}
+
+func exportHistogram[N int64 | float64](e *Exporter, name string, points []metricdata.HistogramDataPoint[N]) {
+	for _, p := range points {
+		if p.Count == 0 {
+			continue
+		}
+		count := int64(p.Count)
+		point := dataPoint{Name: name, Kind: aggregation, Value: float64(p.Sum), Count: &count}
+		if min, ok := p.Min.Value(); ok {
+			v := float64(min)
+			point.Min = &v
+		}
+		if max, ok := p.Max.Value(); ok {
+			v := float64(max)
+			point.Max = &v
+		}
+		e.queueMetric(p.Time, p.Attributes, point)
+	}
+}
+
+func (e *Exporter) queueMetric(t time.Time, attributes attribute.Set, point dataPoint) {
+	if math.IsNaN(point.Value) || math.IsInf(point.Value, 0) {
+		return
+	}
+	properties := make(map[string]string, attributes.Len())
+	for _, kv := range attributes.ToSlice() {
+		properties[string(kv.Key)] = kv.Value.Emit()
+	}
+	e.queue(e.envelope("Metric", t, metricData{
+		Ver:        2,
+		Metrics:    []dataPoint{point},
+		Properties: properties,
+	}))
+}
+
+func (e *Exporter) queue(item envelope) {
+	select {
+	case e.items <- item:
+	default:
+	}
+}
+
+// Flush sends the telemetry queued so far.
+func (e *Exporter) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case e.flush <- flushed:
+		<-flushed
+	case <-e.done:
+	}
+}
+
+// ForceFlush sends the telemetry queued so far.
+func (e *Exporter) ForceFlush(ctx context.Context) error {
+	e.Flush()
+	return nil
+}
+
+// Shutdown sends the telemetry queued so far. The span and the metric
+// providers both shut the exporter down, so it only stops sending on Stop.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.Flush()
+	return nil
+}
+
+// Stop sends the telemetry queued so far, and stops sending.
+func (e *Exporter) Stop() {
+	e.Flush()
+	close(e.done)
+}
+
+// run sends the queued telemetry in batches, once a batch is full or each
+// flush interval.
+func (e *Exporter) run() {
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+	var batch []envelope
+	send := func() {
+		if len(batch) > 0 {
+			if err := e.send(batch); err != nil {
+				e.opts.OnError(err)
+			}
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case item := <-e.items:
+			batch = append(batch, item)
+			if len(batch) >= e.opts.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for len(e.items) > 0 {
+				batch = append(batch, <-e.items)
+				if len(batch) >= e.opts.BatchSize {
+					send()
+				}
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// send posts a batch to the ingestion API.
+func (e *Exporter) send(batch []envelope) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := e.http.Post(e.opts.Endpoint+"/v2/track", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("sending %d items to application insights: %v", len(batch), err)
+	}
+	defer resp.Body.Close()
+	// 206 means some of the items were refused, which resending wouldn't
+	// change.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("application insights returned %s for %d items", resp.Status, len(batch))
+	}
+	return nil
+}
+
+// formatDuration formats d as the ingestion API takes it, d.hh:mm:ss.ffffff.
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	micro := int64(d / time.Microsecond)
+	return fmt.Sprintf("%d.%02d:%02d:%02d.%06d",
+		micro/(24*3600e6), micro/3600e6%24, micro/60e6%60, micro/1e6%60, micro%1e6)
+}
@@ -1,89 +1,107 @@
 package main
 
 import (
-	"log"
-
 	"net/http"
 	"os"
 	"strconv"
 
 	"golang.org/x/time/rate"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"contrib.go.opencensus.io/exporter/ocagent"
-	"go.opencensus.io/plugin/ochttp"
-	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
-	"go.opencensus.io/trace"
-)
-
-var (
-	requestDurationsHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "request_durations_histogram_secs",
-		Buckets: prometheus.DefBuckets,
-		Help:    "Requests Durations, in Seconds",
-	})
+	"online-store/debug"
+	"online-store/orderqueue"
+	"online-store/tracing"
 )
 
-func init() {
-	prometheus.MustRegister(requestDurationsHistogram)
-}
-
-func instrumentHandler(
-	handler http.Handler,
-) http.Handler {
-	return http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			t := prometheus.NewTimer(requestDurationsHistogram)
-			defer t.ObserveDuration()
-			handler.ServeHTTP(w, r)
-		},
-	)
-}
-
 func main() {
+	id, err := loadIdentity()
+	setupLogging(id)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to read the node, taking it as a regular one")
+	}
+
 	rpsLimitStr := os.Getenv("RPS_THRESHOLD")
 	rpsLimit, err := strconv.ParseFloat(rpsLimitStr, 64)
 	if err != nil {
-		log.Fatalf("bad value for rps limit: %s", rpsLimitStr)
+		logger.Fatal().Msgf("bad value for rps limit: %s", rpsLimitStr)
 	}
 
 	throttledHandler := throttler(
 		rpsLimit,
 		http.FileServer(http.Dir("/app/content")),
 	)
+	if addr := os.Getenv("DEBUG_ADDRESS"); addr != "" {
+		go func() {
+			logger.Info().Str("addr", addr).Msg("serving the profiles")
+			err := debug.Serve(addr)
+			logger.Fatal().Err(err).Msg("Failed to serve the profiles")
+		}()
+	}
+	ready := &readiness{}
+	ready.startWarmUp()
+	// Crashes injected in unready mode fail the probe too.
+	http.Handle("/readyz", chaos.readiness(ready))
+	http.Handle("/loglevel", logLevelHandler())
 	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/", instrumentHandler(throttledHandler))
+	http.Handle("/whoami", withIdentity(id, whoamiHandler(id)))
+	http.Handle("/work", withIdentity(id, instrumentHandler("work", workHandler())))
+	http.Handle("/memhog", withIdentity(id, instrumentHandler("memhog", memhogHandler())))
+	handleChaos(http.DefaultServeMux)
+	carts := newCartStore()
+	queue, err := orderqueue.FromEnv(id.Pod)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to set up the order queue")
+	}
+	orders := newOrderHandler(id, queue)
+	http.Handle("/api/products", withIdentity(id, instrumentHandler("products", productsHandler())))
+	http.Handle("/api/cart", withIdentity(id, instrumentHandler("cart", &cartHandler{store: carts})))
+	http.Handle("/api/orders", withIdentity(id, instrumentHandler("orders", orders)))
+	grpcServer := newGRPCServer(&storeServer{carts: carts, orders: orders}, ready)
+	go serveGRPC(grpcServer)
+	go warmUp(ready, carts, queue)
+	http.Handle("/", withIdentity(id, instrumentHandler("content", throttledHandler)))
+
+	// The profiles are only served on $DEBUG_ADDRESS.
+	mux := debug.Hide(http.DefaultServeMux)
 
 	appInsightEnabledStr := os.Getenv("APP_INSIGHT_ENABLED")
-	var handler http.Handler
+	var (
+		handler      http.Handler
+		stopExporter func()
+	)
 	if appInsightEnabledStr == "true" {
 		serviceName := os.Getenv("SERVICE_NAME")
 		if len(serviceName) == 0 {
 			serviceName = "go-app"
 		}
-		log.Printf("new ocagent named %s", serviceName)
-		exporter, err := ocagent.NewExporter(
-			ocagent.WithInsecure(),
-			ocagent.WithServiceName(serviceName),
-		)
+		stopExporter, err = startExporter(serviceName, id)
 		if err != nil {
-			log.Fatal("Failed to create the agent exporter: %v", err)
+			logger.Fatal().Err(err).Msg("Failed to create the exporter")
 		}
 
-		trace.RegisterExporter(exporter)
-		// Always trace for this demo. In a production application, you should
-		// configure this to a trace.ProbabilitySampler set at the desired
-		// probability.
-		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
-		handler = &ochttp.Handler{
-			Propagation:      &tracecontext.HTTPFormat{},
-			IsPublicEndpoint: true,
-		}
+		// The requests are traced, and their counts, sizes and latencies go
+		// along as metrics.
+		handler = tracing.Handler(withRequestLogging(mux))
+		// And the calls made by the app carry their span context on.
+		http.DefaultClient.Transport = tracing.Transport(http.DefaultTransport)
 
 	}
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	if handler == nil {
+		handler = withRequestLogging(mux)
+	}
+	srv := &http.Server{Addr: ":8080", Handler: handler}
+	if err := serveUntilTerminated(srv, ready); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to serve")
+	}
+	grpcServer.GracefulStop()
+	if queue != nil {
+		queue.Close()
+	}
+	if stopExporter != nil {
+		// Send the spans of the last requests.
+		stopExporter()
+	}
 
 }
 
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sessionCookie holds the session the cart belongs to.
+const sessionCookie = "session"
+
+// defaultCartTTL is how long a cart is kept after it last changed, unless
+// $CART_TTL says otherwise.
+const defaultCartTTL = 24 * time.Hour
+
+// cartStore keeps the carts, by session. Every replica must see the same
+// carts, so the store is shared as soon as there is more than one.
+type cartStore interface {
+	Get(ctx context.Context, session string) ([]orderItem, error)
+	Put(ctx context.Context, session string, items []orderItem) error
+	Delete(ctx context.Context, session string) error
+}
+
+// newCartStore returns a store in Redis at $REDIS_ADDR, host:port, or, if
+// it is unset, one in memory, which only does for a single replica.
+func newCartStore() cartStore {
+	ttl := durationEnv("CART_TTL", defaultCartTTL)
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		logger.Info().Msg("REDIS_ADDR isn't set, keeping the carts in memory")
+		return newMemoryCartStore(ttl)
+	}
+
+	db := 0
+	if s := os.Getenv("REDIS_DB"); s != "" {
+		var err error
+		if db, err = strconv.Atoi(s); err != nil {
+			logger.Fatal().Msgf("bad value for REDIS_DB: %s", s)
+		}
+	}
+	maxIdle, maxActive := 10, 100
+	if s := os.Getenv("REDIS_MAX_IDLE"); s != "" {
+		var err error
+		if maxIdle, err = strconv.Atoi(s); err != nil {
+			logger.Fatal().Msgf("bad value for REDIS_MAX_IDLE: %s", s)
+		}
+	}
+	if s := os.Getenv("REDIS_MAX_ACTIVE"); s != "" {
+		var err error
+		if maxActive, err = strconv.Atoi(s); err != nil {
+			logger.Fatal().Msgf("bad value for REDIS_MAX_ACTIVE: %s", s)
+		}
+	}
+
+	logger.Info().Str("addr", addr).Msg("keeping the carts in redis")
+	return newRedisCartStore(&redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: 5 * time.Minute,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr,
+				redis.DialDatabase(db),
+				redis.DialPassword(os.Getenv("REDIS_PASSWORD")),
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}, ttl)
+}
+
+type memoryCart struct {
+	items   []orderItem
+	expires time.Time
+}
+
+// memoryCartStore keeps the carts in the process, for local development.
+type memoryCartStore struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	carts map[string]memoryCart
+}
+
+func newMemoryCartStore(ttl time.Duration) *memoryCartStore {
+	return &memoryCartStore{ttl: ttl, carts: make(map[string]memoryCart)}
+}
+
+func (s *memoryCartStore) Get(ctx context.Context, session string) ([]orderItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, ok := s.carts[session]
+	if !ok {
+		return nil, nil
+	}
+	if time.Now().After(cart.expires) {
+		delete(s.carts, session)
+		return nil, nil
+	}
+	return cart.items, nil
+}
+
+func (s *memoryCartStore) Put(ctx context.Context, session string, items []orderItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.carts[session] = memoryCart{items: items, expires: time.Now().Add(s.ttl)}
+	return nil
+}
+
+func (s *memoryCartStore) Delete(ctx context.Context, session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, session)
+	return nil
+}
+
+// redisCartStore keeps each cart as JSON under cart:<session>, expiring ttl
+// after it last changed.
+type redisCartStore struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+var redisErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "redis_errors_total",
+	Help: "Redis commands or connections that failed",
+})
+
+// newRedisCartStore returns a store using pool, and exports the state of
+// the pool.
+func newRedisCartStore(pool *redis.Pool, ttl time.Duration) *redisCartStore {
+	prometheus.MustRegister(redisErrorsCounter)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "redis_pool_active_connections",
+		Help: "Connections in the Redis pool, idle or in use",
+	}, func() float64 {
+		return float64(pool.Stats().ActiveCount)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "redis_pool_idle_connections",
+		Help: "Idle connections in the Redis pool",
+	}, func() float64 {
+		return float64(pool.Stats().IdleCount)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "redis_pool_max_active_connections",
+		Help: "Most connections the Redis pool opens",
+	}, func() float64 {
+		return float64(pool.MaxActive)
+	}))
+	return &redisCartStore{pool: pool, ttl: ttl}
+}
+
+func (s *redisCartStore) do(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		redisErrorsCounter.Inc()
+		return nil, err
+	}
+	defer conn.Close()
+	reply, err := conn.Do(command, args...)
+	if err != nil {
+		redisErrorsCounter.Inc()
+	}
+	return reply, err
+}
+
+// ping opens a connection to Redis, if the pool has none idle, and checks
+// it.
+func (s *redisCartStore) ping(ctx context.Context) error {
+	_, err := s.do(ctx, "PING")
+	return err
+}
+
+func cartKey(session string) string {
+	return "cart:" + session
+}
+
+func (s *redisCartStore) Get(ctx context.Context, session string) ([]orderItem, error) {
+	b, err := redis.Bytes(s.do(ctx, "GET", cartKey(session)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []orderItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("bad cart %s: %v", session, err)
+	}
+	return items, nil
+}
+
+func (s *redisCartStore) Put(ctx context.Context, session string, items []orderItem) error {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, "SET", cartKey(session), b, "PX", int64(s.ttl/time.Millisecond))
+	return err
+}
+
+func (s *redisCartStore) Delete(ctx context.Context, session string) error {
+	_, err := s.do(ctx, "DEL", cartKey(session))
+	return err
+}
+
+// cartHandler serves the cart of the session: GET returns its items, PUT
+// replaces them and DELETE empties it. A session is started, with a cookie,
+// on the first request without one.
+type cartHandler struct {
+	store cartStore
+}
+
+func (h *cartHandler) session(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	session := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: session, Path: "/", HttpOnly: true})
+	return session, nil
+}
+
+func (h *cartHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.session(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var items []orderItem
+	switch r.Method {
+	case http.MethodGet:
+		items, err = h.store.Get(r.Context(), session)
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			http.Error(w, fmt.Sprintf("bad cart: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(items) > 0 {
+			if err := validateItems(items); err != nil {
+				http.Error(w, fmt.Sprintf("bad cart: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		err = h.store.Put(r.Context(), session, items)
+	case http.MethodDelete:
+		err = h.store.Delete(r.Context(), session)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error().Err(err).Str("session", session).Msg("cart unavailable")
+		http.Error(w, "the cart is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if items == nil {
+		items = []orderItem{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// product is an item of the catalog. The front end has the same products.
+type product struct {
+	SKU        string `json:"sku"`
+	Name       string `json:"name"`
+	PriceCents int64  `json:"priceCents"`
+	ImageURL   string `json:"imageUrl"`
+}
+
+var catalog = []product{
+	{SKU: "surface-book", Name: "Surface Book", PriceCents: 149900, ImageURL: "assets/surface_book_200.jpg"},
+	{SKU: "surface-go", Name: "Surface Go", PriceCents: 39900, ImageURL: "assets/surface_go.jpg"},
+	{SKU: "xbox-elite-controller", Name: "XBox Elite Wireless Controller", PriceCents: 11999, ImageURL: "assets/xbox_controller.jpg"},
+	{SKU: "xbox-one-x", Name: "XBox One X", PriceCents: 39999, ImageURL: "assets/xbox_one_x.jpg"},
+}
+
+// catalogJSON is the catalog encoded once, when the pod warms up.
+var catalogJSON atomic.Value
+
+// loadCatalog encodes the catalog for productsHandler to serve.
+func loadCatalog() error {
+	b, err := json.Marshal(catalog)
+	if err != nil {
+		return err
+	}
+	catalogJSON.Store(append(b, '\n'))
+	return nil
+}
+
+func productsHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if b, ok := catalogJSON.Load().([]byte); ok {
+				w.Write(b)
+				return
+			}
+			json.NewEncoder(w).Encode(catalog)
+		},
+	)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bounds of the faults the chaos endpoints inject.
+const (
+	maxChaosLatency  = 30 * time.Second
+	maxChaosDuration = time.Hour
+	// defaultChaosDuration is how long a fault lasts when the request
+	// doesn't say, so that a forgotten one doesn't outlive the demo.
+	defaultChaosDuration = 5 * time.Minute
+)
+
+var chaosFaultsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chaos_faults_injected_total",
+	Help: "Faults injected through the chaos endpoints, by kind",
+}, []string{"kind"})
+
+func init() {
+	prometheus.MustRegister(chaosFaultsCounter)
+}
+
+// chaosLatency is the latency added to the requests, up to jitter more, until
+// the end.
+type chaosLatency struct {
+	Latency  string    `json:"latency"`
+	Jitter   string    `json:"jitter,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Until    time.Time `json:"until"`
+
+	latency, jitter time.Duration
+}
+
+// chaosErrors is the percentage of the requests answered with code, until
+// the end.
+type chaosErrors struct {
+	Percent  int       `json:"percent"`
+	Code     int       `json:"code,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Until    time.Time `json:"until"`
+}
+
+// chaosCrash stops the app after a delay: exit ends the process, for the
+// container to restart, and unready fails the readiness probe for the
+// duration, for the pod to be taken out of its services.
+type chaosCrash struct {
+	Mode     string `json:"mode"`
+	After    string `json:"after,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+}
+
+// chaosState holds the faults injected in the requests served.
+type chaosState struct {
+	mu           sync.Mutex
+	latency      *chaosLatency
+	errors       *chaosErrors
+	unreadyUntil time.Time
+}
+
+// chaos is the app's chaos state, injected in the instrumented handlers.
+var chaos = &chaosState{}
+
+// inject delays or fails the requests to handler as the faults set say.
+func (c *chaosState) inject(handler http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			c.mu.Lock()
+			var delay time.Duration
+			if l := c.latency; l != nil && now.Before(l.Until) {
+				delay = l.latency
+				if l.jitter > 0 {
+					delay += time.Duration(rand.Int63n(int64(l.jitter)))
+				}
+			}
+			code := 0
+			if e := c.errors; e != nil && now.Before(e.Until) && rand.Intn(100) < e.Percent {
+				code = e.Code
+			}
+			c.mu.Unlock()
+
+			if delay > 0 {
+				chaosFaultsCounter.WithLabelValues("latency").Inc()
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if code != 0 {
+				chaosFaultsCounter.WithLabelValues("error").Inc()
+				http.Error(w, "injected fault", code)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		},
+	)
+}
+
+// readiness fails the readiness probe while a crash in unready mode lasts,
+// and is ready otherwise.
+func (c *chaosState) readiness(ready http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			c.mu.Lock()
+			unready := time.Now().Before(c.unreadyUntil)
+			c.mu.Unlock()
+			if unready {
+				http.Error(w, "injected fault", http.StatusServiceUnavailable)
+				return
+			}
+			ready.ServeHTTP(w, r)
+		},
+	)
+}
+
+// chaosDuration parses the duration s of a fault, defaultChaosDuration if
+// it is empty.
+func chaosDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultChaosDuration, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 || d > maxChaosDuration {
+		return 0, fmt.Errorf("duration must be a duration up to %s", maxChaosDuration)
+	}
+	return d, nil
+}
+
+// handleChaos serves the chaos endpoints on mux, behind $CHAOS_TOKEN, which
+// requests send as a bearer token. Without a token they aren't served, so
+// the faults can't be injected by whoever reaches the app.
+func handleChaos(mux *http.ServeMux) {
+	token := os.Getenv("CHAOS_TOKEN")
+	if token == "" {
+		return
+	}
+	mux.Handle("/chaos/latency", withChaosToken(token, chaos.latencyHandler()))
+	mux.Handle("/chaos/error-rate", withChaosToken(token, chaos.errorRateHandler()))
+	mux.Handle("/chaos/crash", withChaosToken(token, chaos.crashHandler()))
+	logger.Info().Msg("serving the chaos endpoints")
+}
+
+// withChaosToken only passes on the requests with the bearer token.
+func withChaosToken(token string, handler http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		},
+	)
+}
+
+// latencyHandler serves /chaos/latency: GET returns the latency injected,
+// PUT sets it, as {"latency": "500ms", "jitter": "100ms", "duration": "2m"},
+// and DELETE stops it.
+func (c *chaosState) latencyHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPut:
+				var body chaosLatency
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, fmt.Sprintf("bad latency: %v", err), http.StatusBadRequest)
+					return
+				}
+				latency, err := time.ParseDuration(body.Latency)
+				if err != nil || latency <= 0 || latency > maxChaosLatency {
+					http.Error(w, fmt.Sprintf("latency must be a duration up to %s", maxChaosLatency), http.StatusBadRequest)
+					return
+				}
+				var jitter time.Duration
+				if body.Jitter != "" {
+					jitter, err = time.ParseDuration(body.Jitter)
+					if err != nil || jitter < 0 || jitter > maxChaosLatency {
+						http.Error(w, fmt.Sprintf("jitter must be a duration up to %s", maxChaosLatency), http.StatusBadRequest)
+						return
+					}
+				}
+				d, err := chaosDuration(body.Duration)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body.latency, body.jitter, body.Until = latency, jitter, time.Now().Add(d)
+				c.mu.Lock()
+				c.latency = &body
+				c.mu.Unlock()
+				logger.Warn().Str("latency", latency.String()).Str("jitter", jitter.String()).Time("until", body.Until).Msg("injecting latency")
+			case http.MethodDelete:
+				c.mu.Lock()
+				c.latency = nil
+				c.mu.Unlock()
+				logger.Info().Msg("stopped injecting latency")
+			default:
+				w.Header().Set("Allow", "GET, PUT, DELETE")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			c.mu.Lock()
+			latency := c.latency
+			if latency != nil && time.Now().After(latency.Until) {
+				latency = nil
+			}
+			c.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(latency)
+		},
+	)
+}
+
+// errorRateHandler serves /chaos/error-rate: GET returns the errors
+// injected, PUT sets them, as {"percent": 20, "code": 503, "duration": "2m"},
+// 500 by default, and DELETE stops them.
+func (c *chaosState) errorRateHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPut:
+				var body chaosErrors
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, fmt.Sprintf("bad error rate: %v", err), http.StatusBadRequest)
+					return
+				}
+				if body.Percent < 1 || body.Percent > 100 {
+					http.Error(w, "percent must be an integer between 1 and 100", http.StatusBadRequest)
+					return
+				}
+				if body.Code == 0 {
+					body.Code = http.StatusInternalServerError
+				}
+				if body.Code < 500 || body.Code > 599 {
+					http.Error(w, "code must be a 5xx status code", http.StatusBadRequest)
+					return
+				}
+				d, err := chaosDuration(body.Duration)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body.Until = time.Now().Add(d)
+				c.mu.Lock()
+				c.errors = &body
+				c.mu.Unlock()
+				logger.Warn().Int("percent", body.Percent).Int("code", body.Code).Time("until", body.Until).Msg("injecting errors")
+			case http.MethodDelete:
+				c.mu.Lock()
+				c.errors = nil
+				c.mu.Unlock()
+				logger.Info().Msg("stopped injecting errors")
+			default:
+				w.Header().Set("Allow", "GET, PUT, DELETE")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			c.mu.Lock()
+			errors := c.errors
+			if errors != nil && time.Now().After(errors.Until) {
+				errors = nil
+			}
+			c.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(errors)
+		},
+	)
+}
+
+// crashHandler serves /chaos/crash: POST, as {"mode": "exit", "after": "5s",
+// "exitCode": 1}, ends the process after the delay, and as {"mode":
+// "unready", "duration": "1m"} fails the readiness probe for the duration.
+// The crash is answered before it happens.
+func (c *chaosState) crashHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", "POST")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var body chaosCrash
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, fmt.Sprintf("bad crash: %v", err), http.StatusBadRequest)
+				return
+			}
+			after := time.Duration(0)
+			if body.After != "" {
+				var err error
+				after, err = time.ParseDuration(body.After)
+				if err != nil || after < 0 || after > maxChaosDuration {
+					http.Error(w, fmt.Sprintf("after must be a duration up to %s", maxChaosDuration), http.StatusBadRequest)
+					return
+				}
+			}
+
+			switch body.Mode {
+			case "", "exit":
+				body.Mode = "exit"
+				if body.ExitCode == 0 {
+					body.ExitCode = 1
+				}
+				logger.Warn().Str("after", after.String()).Int("exitCode", body.ExitCode).Msg("crashing")
+				chaosFaultsCounter.WithLabelValues("crash").Inc()
+				// Leave the time to answer, and to scrape the counter.
+				time.AfterFunc(after+100*time.Millisecond, func() {
+					logger.Warn().Int("exitCode", body.ExitCode).Msg("crashed on request")
+					os.Exit(body.ExitCode)
+				})
+			case "unready":
+				d, err := chaosDuration(body.Duration)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body.Duration = d.String()
+				logger.Warn().Str("after", after.String()).Str("duration", d.String()).Msg("failing the readiness probe")
+				chaosFaultsCounter.WithLabelValues("unready").Inc()
+				time.AfterFunc(after, func() {
+					c.mu.Lock()
+					c.unreadyUntil = time.Now().Add(d)
+					c.mu.Unlock()
+				})
+			default:
+				http.Error(w, fmt.Sprintf("bad mode %q, want exit or unready", body.Mode), http.StatusBadRequest)
+				return
+			}
+			body.After = after.String()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(body)
+		},
+	)
+}
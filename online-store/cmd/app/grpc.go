@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"online-store/storepb"
+	"online-store/tracing"
+)
+
+// defaultGRPCAddress is where the gRPC API is served, unless $GRPC_ADDRESS
+// says otherwise.
+const defaultGRPCAddress = ":9090"
+
+// storeServer serves the catalog, cart and order operations over gRPC, on
+// the same carts and orders as the HTTP API.
+type storeServer struct {
+	carts  cartStore
+	orders *orderHandler
+}
+
+var _ storepb.StoreServer = (*storeServer)(nil)
+
+func toItems(items []*storepb.Item) []orderItem {
+	converted := make([]orderItem, 0, len(items))
+	for _, item := range items {
+		converted = append(converted, orderItem{SKU: item.Sku, Quantity: int(item.Quantity)})
+	}
+	return converted
+}
+
+func fromItems(items []orderItem) []*storepb.Item {
+	converted := make([]*storepb.Item, 0, len(items))
+	for _, item := range items {
+		converted = append(converted, &storepb.Item{Sku: item.SKU, Quantity: int32(item.Quantity)})
+	}
+	return converted
+}
+
+func (s *storeServer) ListProducts(ctx context.Context, req *storepb.ListProductsRequest) (*storepb.ListProductsResponse, error) {
+	resp := &storepb.ListProductsResponse{}
+	for _, p := range catalog {
+		resp.Products = append(resp.Products, &storepb.Product{
+			Sku:        p.SKU,
+			Name:       p.Name,
+			PriceCents: p.PriceCents,
+			ImageUrl:   p.ImageURL,
+		})
+	}
+	return resp, nil
+}
+
+func (s *storeServer) GetCart(ctx context.Context, req *storepb.GetCartRequest) (*storepb.Cart, error) {
+	if req.Session == "" {
+		return nil, status.Error(codes.InvalidArgument, "no session")
+	}
+	items, err := s.carts.Get(ctx, req.Session)
+	if err != nil {
+		requestLogger(ctx).Error().Err(err).Str("session", req.Session).Msg("cart unavailable")
+		return nil, status.Error(codes.Unavailable, "the cart is unavailable")
+	}
+	return &storepb.Cart{Session: req.Session, Items: fromItems(items)}, nil
+}
+
+func (s *storeServer) UpdateCart(ctx context.Context, req *storepb.UpdateCartRequest) (*storepb.Cart, error) {
+	if req.Session == "" {
+		return nil, status.Error(codes.InvalidArgument, "no session")
+	}
+	items := toItems(req.Items)
+	if len(items) > 0 {
+		if err := validateItems(items); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad cart: %v", err)
+		}
+	}
+	if err := s.carts.Put(ctx, req.Session, items); err != nil {
+		requestLogger(ctx).Error().Err(err).Str("session", req.Session).Msg("cart unavailable")
+		return nil, status.Error(codes.Unavailable, "the cart is unavailable")
+	}
+	return &storepb.Cart{Session: req.Session, Items: req.Items}, nil
+}
+
+func (s *storeServer) ClearCart(ctx context.Context, req *storepb.ClearCartRequest) (*storepb.Cart, error) {
+	if req.Session == "" {
+		return nil, status.Error(codes.InvalidArgument, "no session")
+	}
+	if err := s.carts.Delete(ctx, req.Session); err != nil {
+		requestLogger(ctx).Error().Err(err).Str("session", req.Session).Msg("cart unavailable")
+		return nil, status.Error(codes.Unavailable, "the cart is unavailable")
+	}
+	return &storepb.Cart{Session: req.Session}, nil
+}
+
+func (s *storeServer) PlaceOrder(ctx context.Context, req *storepb.PlaceOrderRequest) (*storepb.Order, error) {
+	items := toItems(req.Items)
+	fromCart := len(items) == 0 && req.Session != ""
+	if fromCart {
+		var err error
+		if items, err = s.carts.Get(ctx, req.Session); err != nil {
+			requestLogger(ctx).Error().Err(err).Str("session", req.Session).Msg("cart unavailable")
+			return nil, status.Error(codes.Unavailable, "the cart is unavailable")
+		}
+	}
+	if err := validateItems(items); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad order: %v", err)
+	}
+
+	o, err := s.orders.place(ctx, items)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if fromCart {
+		if err := s.carts.Delete(ctx, req.Session); err != nil {
+			requestLogger(ctx).Error().Err(err).Str("session", req.Session).Msg("emptying the cart")
+		}
+	}
+	return &storepb.Order{
+		Id:           o.ID,
+		Items:        fromItems(o.Items),
+		PlacedAtUnix: o.PlacedAt.Unix(),
+		ServedBy: &storepb.ServedBy{
+			Pod:         o.ServedBy.Pod,
+			Node:        o.ServedBy.Node,
+			VirtualNode: o.ServedBy.VirtualNode,
+		},
+	}, nil
+}
+
+// instrumentUnary records the gRPC requests served, as instrumentHandler
+// does for HTTP.
+func instrumentUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcHandledCounter.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	grpcHandlingHistogram.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// chainUnary returns an interceptor calling outer, then inner, then the
+// handler.
+func chainUnary(outer, inner grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return outer(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return inner(ctx, req, info, handler)
+		})
+	}
+}
+
+// newGRPCServer returns a server of the store API, gRPC health checking and
+// reflection. The health is NOT_SERVING while the pod warms up, and turns
+// to it again as soon as the pod stops being ready.
+func newGRPCServer(store *storeServer, ready *readiness) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.StatsHandler(tracing.ServerHandler()),
+		grpc.UnaryInterceptor(chainUnary(logUnary, instrumentUnary)),
+	)
+	storepb.RegisterStoreServer(srv, store)
+
+	healthServer := health.NewServer()
+	setStatus := func(status healthpb.HealthCheckResponse_ServingStatus) {
+		healthServer.SetServingStatus("", status)
+		healthServer.SetServingStatus("store.Store", status)
+	}
+	if ready.warmingUp() {
+		setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	} else {
+		setStatus(healthpb.HealthCheckResponse_SERVING)
+	}
+	ready.onWarmedUp(func() {
+		setStatus(healthpb.HealthCheckResponse_SERVING)
+	})
+	ready.onStop(func() {
+		setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	})
+	healthpb.RegisterHealthServer(srv, healthServer)
+
+	reflection.Register(srv)
+	return srv
+}
+
+// serveGRPC serves srv on $GRPC_ADDRESS.
+func serveGRPC(srv *grpc.Server) {
+	addr := os.Getenv("GRPC_ADDRESS")
+	if addr == "" {
+		addr = defaultGRPCAddress
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Fatal().Err(err).Str("addr", addr).Msg("Failed to listen")
+	}
+	logger.Info().Str("addr", addr).Msg("serving the gRPC API")
+	if err := srv.Serve(lis); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to serve the gRPC API")
+	}
+}
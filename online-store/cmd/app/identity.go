@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the token and CA of the pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// identity says which pod serves the requests, and where it runs. It is
+// taken from the environment, which the Downward API fills in, and from the
+// labels of the node.
+type identity struct {
+	Pod         string `json:"pod"`
+	Node        string `json:"node"`
+	VirtualNode bool   `json:"virtualNode"`
+}
+
+// loadIdentity reads $POD_NAME and $NODE_NAME. The node is virtual if it
+// has the label $VIRTUAL_NODE_LABEL, type=virtual-kubelet by default, as
+// virtual-kubelet labels its node; the node is read from the API server
+// with the service account of the pod. The identity is returned with the
+// error if the node can't be read, and the node taken as a regular one.
+func loadIdentity() (identity, error) {
+	id := identity{
+		Pod:  os.Getenv("POD_NAME"),
+		Node: os.Getenv("NODE_NAME"),
+	}
+	if id.Pod == "" {
+		id.Pod, _ = os.Hostname()
+	}
+	if id.Node == "" {
+		return id, nil
+	}
+	label := os.Getenv("VIRTUAL_NODE_LABEL")
+	if label == "" {
+		label = "type=virtual-kubelet"
+	}
+	key, value := label, ""
+	if i := strings.Index(label, "="); i >= 0 {
+		key, value = label[:i], label[i+1:]
+	}
+	labels, err := nodeLabels(id.Node)
+	if err != nil {
+		return id, err
+	}
+	have, ok := labels[key]
+	id.VirtualNode = ok && have == value
+	return id, nil
+}
+
+// nodeLabels reads the labels of node from the API server.
+func nodeLabels(node string) (map[string]string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("reading node %s: not running in a cluster", node)
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("reading node %s: no certificate in the service account CA", node)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := "https://" + net.JoinHostPort(host, port) + "/api/v1/nodes/" + node
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading node %s: %s", node, resp.Status)
+	}
+	var object struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return nil, fmt.Errorf("reading node %s: %s", node, err)
+	}
+	return object.Metadata.Labels, nil
+}
+
+// withIdentity adds the identity to the headers of every response.
+func withIdentity(id identity, handler http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Served-By-Pod", id.Pod)
+			h.Set("X-Served-By-Node", id.Node)
+			h.Set("X-Virtual-Node", strconv.FormatBool(id.VirtualNode))
+			handler.ServeHTTP(w, r)
+		},
+	)
+}
+
+func whoamiHandler(id identity) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(id)
+		},
+	)
+}
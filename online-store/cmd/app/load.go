@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bounds of the artificial load one request can ask for.
+const (
+	maxWorkDuration = 10 * time.Second
+	// workSlice is the period over which the CPU share is kept.
+	workSlice = 10 * time.Millisecond
+
+	maxHogMB   = 4096
+	maxHogHold = 10 * time.Minute
+	// maxHoggedMB bounds the memory held by all the /memhog requests
+	// together, so that a burst of them can't take the node down.
+	maxHoggedMB = 4096
+)
+
+// queryInt returns the integer query parameter name of r, def if it is
+// absent, or an error if it isn't within [min, max].
+func queryInt(r *http.Request, name string, def, min, max int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be an integer between %d and %d", name, min, max)
+	}
+	return n, nil
+}
+
+// burnCPU keeps a core busy for pct percent of every slice, for d.
+func burnCPU(d time.Duration, pct int) {
+	busy := workSlice * time.Duration(pct) / 100
+	end := time.Now().Add(d)
+	for now := time.Now(); now.Before(end); now = time.Now() {
+		sliceEnd := now.Add(workSlice)
+		for time.Now().Before(now.Add(busy)) {
+		}
+		time.Sleep(time.Until(sliceEnd))
+	}
+}
+
+// workHandler serves /work?ms=<n>&cpu=<pct>: it keeps a core pct percent
+// busy for n milliseconds before it answers, so CPU-based autoscaling can be
+// driven deterministically.
+func workHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ms, err := queryInt(r, "ms", 100, 0, int(maxWorkDuration/time.Millisecond))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pct, err := queryInt(r, "cpu", 100, 0, 100)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			start := time.Now()
+			burnCPU(time.Duration(ms)*time.Millisecond, pct)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Milliseconds int     `json:"ms"`
+				CPU          int     `json:"cpu"`
+				Took         float64 `json:"took"`
+			}{ms, pct, time.Since(start).Seconds()})
+		},
+	)
+}
+
+var hoggedBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "memhog_bytes",
+	Help: "Memory held by /memhog, in Bytes",
+})
+
+func init() {
+	prometheus.MustRegister(hoggedBytesGauge)
+}
+
+// hogs keeps the memory held by /memhog reachable until it is released,
+// and counts it, reserved before it is allocated, in mb.
+var hogs = struct {
+	sync.Mutex
+	held map[*[]byte]bool
+	mb   int
+}{held: make(map[*[]byte]bool)}
+
+// memhogHandler serves /memhog?mb=<n>&hold=<duration>: it allocates n MB,
+// touching every page so they count against the pod, and holds them for
+// the duration after it answers, so memory-based autoscaling and the
+// memory limits of the virtual node can be shown. Requests that would take
+// the memory held over maxHoggedMB are rejected.
+func memhogHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mb, err := queryInt(r, "mb", 100, 1, maxHogMB)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			hold := 30 * time.Second
+			if s := r.URL.Query().Get("hold"); s != "" {
+				hold, err = time.ParseDuration(s)
+				if err != nil || hold < 0 || hold > maxHogHold {
+					http.Error(w, fmt.Sprintf("hold must be a duration up to %s", maxHogHold), http.StatusBadRequest)
+					return
+				}
+			}
+
+			hogs.Lock()
+			if hogs.mb+mb > maxHoggedMB {
+				held := hogs.mb
+				hogs.Unlock()
+				http.Error(w, fmt.Sprintf("%d MB held already, at most %d MB can be", held, maxHoggedMB), http.StatusServiceUnavailable)
+				return
+			}
+			hogs.mb += mb
+			hogs.Unlock()
+
+			b := make([]byte, mb<<20)
+			for i := 0; i < len(b); i += os.Getpagesize() {
+				b[i] = 1
+			}
+			hogs.Lock()
+			hogs.held[&b] = true
+			hogs.Unlock()
+			hoggedBytesGauge.Add(float64(len(b)))
+			time.AfterFunc(hold, func() {
+				hogs.Lock()
+				delete(hogs.held, &b)
+				hogs.mb -= mb
+				hogs.Unlock()
+				hoggedBytesGauge.Sub(float64(len(b)))
+			})
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				MB   int    `json:"mb"`
+				Hold string `json:"hold"`
+			}{mb, hold.String()})
+		},
+	)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDHeader carries the ID of a request, from the ingress if it sets
+// one, and back in the response.
+const requestIDHeader = "X-Request-ID"
+
+// logger writes the app's logs as JSON lines, each with the pod, the node
+// and whether it is virtual, so that the logs of the pods that burst to ACI
+// can be told apart and correlated with the others in Log Analytics.
+var logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+// setupLogging adds the identity to every line, and sets the level from
+// $LOG_LEVEL, info by default. What is written to the standard logger, as
+// by the vendored packages, goes through logger too.
+func setupLogging(id identity) {
+	logger = logger.With().
+		Str("pod", id.Pod).
+		Str("node", id.Node).
+		Bool("virtualNode", id.VirtualNode).
+		Logger()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		level, err := zerolog.ParseLevel(s)
+		if err != nil {
+			logger.Fatal().Msgf("bad value for LOG_LEVEL: %s", s)
+		}
+		zerolog.SetGlobalLevel(level)
+	}
+	log.SetFlags(0)
+	log.SetOutput(logger)
+}
+
+// requestLogger returns the logger of the request served with ctx, with its
+// IDs, or logger outside of a request.
+func requestLogger(ctx context.Context) *zerolog.Logger {
+	// Ctx returns a disabled logger for a context without one.
+	if l := zerolog.Ctx(ctx); l != zerolog.Ctx(context.Background()) {
+		return l
+	}
+	return &logger
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withTraceIDs adds the IDs of the span in ctx, if any, to c.
+func withTraceIDs(ctx context.Context, c zerolog.Context) zerolog.Context {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		c = c.Str("traceId", sc.TraceID().String()).Str("spanId", sc.SpanID().String())
+	}
+	return c
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// withRequestLogging gives every request a logger with its request ID,
+// taken from the X-Request-ID header or made up, and its trace ID, and logs
+// the requests served at the debug level. The request ID is sent back in the
+// response.
+func withRequestLogging(handler http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if id == "" {
+				id = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, id)
+			l := withTraceIDs(r.Context(), logger.With().Str("requestId", id)).Logger()
+
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			handler.ServeHTTP(rec, r.WithContext(l.WithContext(r.Context())))
+			l.Debug().
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Int("status", rec.code).
+				Dur("durationMs", time.Since(start)).
+				Msg("served")
+		},
+	)
+}
+
+// logUnary does for the gRPC requests what withRequestLogging does for
+// HTTP, with the request ID in the x-request-id metadata.
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md["x-request-id"]) > 0 {
+		id = md["x-request-id"][0]
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	l := withTraceIDs(ctx, logger.With().Str("requestId", id)).Logger()
+
+	start := time.Now()
+	resp, err := handler(l.WithContext(ctx), req)
+	l.Debug().
+		Str("method", info.FullMethod).
+		Str("code", status.Code(err).String()).
+		Dur("durationMs", time.Since(start)).
+		Msg("served")
+	return resp, err
+}
+
+// logLevel is the body of /loglevel.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler serves the log level: GET returns it, and PUT sets it,
+// such as to debug while looking into a burst, without restarting the pods.
+func logLevelHandler() http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPut:
+				var body logLevel
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, fmt.Sprintf("bad level: %v", err), http.StatusBadRequest)
+					return
+				}
+				level, err := zerolog.ParseLevel(body.Level)
+				if err != nil || body.Level == "" {
+					http.Error(w, fmt.Sprintf("bad level: %q", body.Level), http.StatusBadRequest)
+					return
+				}
+				zerolog.SetGlobalLevel(level)
+				logger.Info().Str("newLevel", level.String()).Msg("log level changed")
+			default:
+				w.Header().Set("Allow", "GET, PUT")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(logLevel{Level: zerolog.GlobalLevel().String()})
+		},
+	)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// requestDurationsHistogram is what the HPA scales on, through the
+	// Prometheus adapter; keep its name and labels as they are.
+	requestDurationsHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "request_durations_histogram_secs",
+		Buckets: prometheus.DefBuckets,
+		Help:    "Requests Durations, in Seconds",
+	})
+
+	requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Requests served, by handler, method and status code",
+	}, []string{"handler", "method", "code"})
+	requestLatencyHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Buckets: prometheus.DefBuckets,
+		Help:    "Request latencies, in Seconds, by handler and method",
+	}, []string{"handler", "method"})
+	inFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests being served",
+	})
+
+	ordersCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "orders_placed_total",
+		Help: "Orders placed",
+	})
+	orderItemsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "order_items_total",
+		Help: "Items in the orders placed",
+	})
+	orderQueueErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "order_queue_send_errors_total",
+		Help: "Orders that couldn't be sent to the order queue",
+	})
+
+	grpcHandledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "gRPC requests served, by method and status code",
+	}, []string{"grpc_method", "grpc_code"})
+	grpcHandlingHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Buckets: prometheus.DefBuckets,
+		Help:    "gRPC request latencies, in Seconds, by method",
+	}, []string{"grpc_method"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDurationsHistogram)
+	prometheus.MustRegister(requestsCounter)
+	prometheus.MustRegister(requestLatencyHistogram)
+	prometheus.MustRegister(inFlightGauge)
+	prometheus.MustRegister(ordersCounter)
+	prometheus.MustRegister(orderItemsCounter)
+	prometheus.MustRegister(orderQueueErrorsCounter)
+	prometheus.MustRegister(grpcHandledCounter)
+	prometheus.MustRegister(grpcHandlingHistogram)
+}
+
+// instrumentHandler records the requests served by handler, labelled with
+// name. The faults injected by the chaos endpoints are recorded as real
+// ones would be, for the autoscaler to react to.
+func instrumentHandler(
+	name string,
+	handler http.Handler,
+) http.Handler {
+	handler = chaos.inject(handler)
+	labels := prometheus.Labels{"handler": name}
+	instrumented := promhttp.InstrumentHandlerInFlight(inFlightGauge,
+		promhttp.InstrumentHandlerCounter(requestsCounter.MustCurryWith(labels),
+			promhttp.InstrumentHandlerDuration(requestLatencyHistogram.MustCurryWith(labels), handler),
+		),
+	)
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t := prometheus.NewTimer(requestDurationsHistogram)
+			defer t.ObserveDuration()
+			instrumented.ServeHTTP(w, r)
+		},
+	)
+}
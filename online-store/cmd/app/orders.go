@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"online-store/orderqueue"
+)
+
+// orderItem is a product and how many of it are ordered.
+type orderItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+type order struct {
+	ID       string      `json:"id"`
+	Items    []orderItem `json:"items"`
+	PlacedAt time.Time   `json:"placedAt"`
+	// ServedBy is the pod that took the order.
+	ServedBy *identity `json:"servedBy,omitempty"`
+}
+
+// errQueueUnavailable is returned when an order can't be sent to the order
+// queue.
+var errQueueUnavailable = errors.New("the order queue is unavailable")
+
+// orderHandler takes orders, POSTed as JSON. Orders are counted and, if
+// there is an order queue, sent to it for the order workers to fulfil.
+type orderHandler struct {
+	id    identity
+	queue orderqueue.Queue
+}
+
+// newOrderHandler returns a handler sending the orders to queue, unless it
+// is nil.
+func newOrderHandler(id identity, queue orderqueue.Queue) *orderHandler {
+	return &orderHandler{id: id, queue: queue}
+}
+
+func (h *orderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var o order
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, fmt.Sprintf("bad order: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateItems(o.Items); err != nil {
+		http.Error(w, fmt.Sprintf("bad order: %v", err), http.StatusBadRequest)
+		return
+	}
+	o, err := h.place(r.Context(), o.Items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+// validateItems checks the items of an order.
+func validateItems(items []orderItem) error {
+	if len(items) == 0 {
+		return errors.New("no items")
+	}
+	for _, item := range items {
+		if item.SKU == "" || item.Quantity <= 0 {
+			return errors.New("items need a sku and a positive quantity")
+		}
+	}
+	return nil
+}
+
+// place places an order for items, which must be valid.
+func (h *orderHandler) place(ctx context.Context, items []orderItem) (order, error) {
+	// Every replica takes orders, so the IDs are random rather than
+	// counted, not to clash.
+	o := order{ID: uuid.New().String(), Items: items}
+	o.PlacedAt = time.Now().UTC()
+	o.ServedBy = &h.id
+	if h.queue != nil {
+		body, _ := json.Marshal(o)
+		if err := h.queue.Send(ctx, body); err != nil {
+			requestLogger(ctx).Error().Err(err).Str("order", o.ID).Msg("sending the order to the queue")
+			orderQueueErrorsCounter.Inc()
+			return order{}, errQueueUnavailable
+		}
+	}
+
+	quantity := 0
+	for _, item := range items {
+		quantity += item.Quantity
+	}
+	ordersCounter.Inc()
+	orderItemsCounter.Add(float64(quantity))
+	return o, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+// otlpConfig is how the OTLP exporters reach the collector.
+type otlpConfig struct {
+	endpoint    string
+	creds       credentials.TransportCredentials
+	compression string
+	headers     map[string]string
+	retry       otlptracegrpc.RetryConfig
+}
+
+// loadOTLPConfig reads $COLLECTOR_ENDPOINT and the TLS variables of
+// collectorCredentials. $EXPORTER_COMPRESSION, gzip, compresses the spans
+// and metrics sent, and $EXPORTER_HEADERS, key=value pairs separated by
+// commas, adds headers to the calls to the collector, such as the API key
+// of a hosted one. $EXPORTER_INITIAL_BACKOFF and $EXPORTER_MAX_BACKOFF pace
+// the retries of a batch the collector didn't take, and
+// $EXPORTER_MAX_RETRY_DURATION bounds how long it is retried before being
+// dropped.
+func loadOTLPConfig() (otlpConfig, error) {
+	cfg := otlpConfig{
+		endpoint:    os.Getenv("COLLECTOR_ENDPOINT"),
+		compression: os.Getenv("EXPORTER_COMPRESSION"),
+		retry: otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: durationEnv("EXPORTER_INITIAL_BACKOFF", 5*time.Second),
+			MaxInterval:     durationEnv("EXPORTER_MAX_BACKOFF", 30*time.Second),
+			MaxElapsedTime:  durationEnv("EXPORTER_MAX_RETRY_DURATION", time.Minute),
+		},
+	}
+	if cfg.compression != "" && cfg.compression != "gzip" {
+		return cfg, fmt.Errorf("unknown EXPORTER_COMPRESSION %q, want gzip", cfg.compression)
+	}
+	var err error
+	if cfg.creds, err = collectorCredentials(); err != nil {
+		return cfg, err
+	}
+	if s := os.Getenv("EXPORTER_HEADERS"); s != "" {
+		if cfg.headers, err = parseHeaders(s); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg otlpConfig) traceOptions() []otlptracegrpc.Option {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithRetry(cfg.retry)}
+	if cfg.endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.endpoint))
+	}
+	if cfg.creds != nil {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(cfg.creds))
+	} else {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if cfg.compression != "" {
+		opts = append(opts, otlptracegrpc.WithCompressor(cfg.compression))
+	}
+	if cfg.headers != nil {
+		opts = append(opts, otlptracegrpc.WithHeaders(cfg.headers))
+	}
+	return opts
+}
+
+func (cfg otlpConfig) metricOptions() []otlpmetricgrpc.Option {
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig(cfg.retry))}
+	if cfg.endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(cfg.endpoint))
+	}
+	if cfg.creds != nil {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(cfg.creds))
+	} else {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	if cfg.compression != "" {
+		opts = append(opts, otlpmetricgrpc.WithCompressor(cfg.compression))
+	}
+	if cfg.headers != nil {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.headers))
+	}
+	return opts
+}
+
+// newOTLPExporters returns the exporters sending the spans and the metrics
+// to the collector at $COLLECTOR_ENDPOINT, host:port, over OTLP, or to the
+// one $OTEL_EXPORTER_OTLP_ENDPOINT names, localhost:4317 by default. They
+// don't wait for the collector on startup, so pods bursted to a cold
+// virtual node serve right away.
+func newOTLPExporters(serviceName string) (sdktrace.SpanExporter, sdkmetric.Exporter, error) {
+	cfg, err := loadOTLPConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := context.Background()
+	spans, err := otlptracegrpc.New(ctx, cfg.traceOptions()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics, err := otlpmetricgrpc.New(ctx, cfg.metricOptions()...)
+	if err != nil {
+		spans.Shutdown(ctx)
+		return nil, nil, err
+	}
+
+	endpoint := cfg.endpoint
+	if endpoint == "" {
+		endpoint = "the default otlp endpoint"
+	}
+	logger.Info().Str("service", serviceName).Str("endpoint", endpoint).Str("compression", cfg.compression).Msg("exporting the traces and metrics over otlp")
+	return spans, metrics, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Defaults of $DRAIN_PERIOD and $SHUTDOWN_TIMEOUT.
+const (
+	defaultDrainPeriod     = 5 * time.Second
+	defaultShutdownTimeout = 20 * time.Second
+)
+
+// readiness is whether the pod takes new requests. It starts once the pod
+// has warmed up, and stops as soon as the pod is told to terminate.
+type readiness struct {
+	notReady int32
+	warming  int32
+	stopped  []func()
+	warmed   []func()
+}
+
+// onStop registers f to be called when the pod stops being ready.
+func (r *readiness) onStop(f func()) {
+	r.stopped = append(r.stopped, f)
+}
+
+// onWarmedUp registers f to be called when the pod has warmed up, unless it
+// was told to terminate first.
+func (r *readiness) onWarmedUp(f func()) {
+	r.warmed = append(r.warmed, f)
+}
+
+func (r *readiness) stop() {
+	atomic.StoreInt32(&r.notReady, 1)
+	for _, f := range r.stopped {
+		f()
+	}
+}
+
+// startWarmUp keeps the pod from being ready until warmedUp.
+func (r *readiness) startWarmUp() {
+	atomic.StoreInt32(&r.warming, 1)
+}
+
+func (r *readiness) warmedUp() {
+	atomic.StoreInt32(&r.warming, 0)
+	if atomic.LoadInt32(&r.notReady) != 0 {
+		return
+	}
+	for _, f := range r.warmed {
+		f()
+	}
+}
+
+func (r *readiness) warmingUp() bool {
+	return atomic.LoadInt32(&r.warming) != 0
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&r.notReady) != 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.warmingUp() {
+		http.Error(w, "warming up", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// durationEnv returns the duration in $name, or def if it is unset.
+func durationEnv(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		logger.Fatal().Msgf("bad value for %s: %s", name, s)
+	}
+	return d
+}
+
+// serveUntilTerminated serves srv until SIGTERM or SIGINT. Then it reports
+// not ready, keeps serving for the drain period, while the pod is taken out
+// of the endpoints of its services, and shuts down, waiting up to the
+// shutdown timeout for the requests in flight. Scaling in is then invisible
+// to the clients.
+func serveUntilTerminated(srv *http.Server, ready *readiness) error {
+	drainPeriod := durationEnv("DRAIN_PERIOD", defaultDrainPeriod)
+	shutdownTimeout := durationEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		logger.Info().Str("signal", sig.String()).Str("drainPeriod", drainPeriod.String()).Msg("draining")
+	}
+
+	ready.stop()
+	time.Sleep(drainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	logger.Info().Msg("shut down")
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"google.golang.org/grpc/credentials"
+
+	"online-store/appinsights"
+	"online-store/tracing"
+)
+
+const (
+	// metricsInterval is how often the metrics are sent.
+	metricsInterval = 10 * time.Second
+	// stopTimeout bounds how long the app waits, when it stops, for the
+	// last spans and metrics to be sent.
+	stopTimeout = 5 * time.Second
+)
+
+// startExporter has the OpenTelemetry SDK send the spans and the metrics of
+// the app to the exporter $TELEMETRY_EXPORTER names, and returns a func
+// sending what is left when the app stops: otlp, the default, to send them
+// to a collector over OTLP, or appinsights to send them straight to
+// Application Insights, without a collector.
+func startExporter(serviceName string, id identity) (func(), error) {
+	switch kind := os.Getenv("TELEMETRY_EXPORTER"); kind {
+	case "", "otlp":
+		spans, metrics, err := newOTLPExporters(serviceName)
+		if err != nil {
+			return nil, err
+		}
+		return startSDK(serviceName, id, spans, metrics)
+	case "appinsights":
+		exporter, err := newAppInsightsExporter(serviceName, id)
+		if err != nil {
+			return nil, err
+		}
+		stop, err := startSDK(serviceName, id, exporter, exporter)
+		if err != nil {
+			exporter.Stop()
+			return nil, err
+		}
+		return func() {
+			stop()
+			exporter.Stop()
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown TELEMETRY_EXPORTER %q, want otlp or appinsights", kind)
+	}
+}
+
+// startSDK sets up the tracer and meter providers of the OpenTelemetry SDK
+// sending to spans and metrics, with the service, the pod and the node as
+// the resource. Every request is traced.
+func startSDK(serviceName string, id identity, spans sdktrace.SpanExporter, metrics sdkmetric.Exporter) (func(), error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.K8SPodName(id.Pod),
+		semconv.K8SNodeName(id.Node),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn().Err(err).Msg("exporting the telemetry")
+	}))
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spans),
+		sdktrace.WithResource(res),
+		// Always trace for this demo. In a production application, you
+		// should sample a share of the requests instead.
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+	)
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics,
+			sdkmetric.WithInterval(metricsInterval),
+		)),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+	otel.SetTextMapPropagator(tracing.Propagator)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("sending the last spans")
+		}
+		if err := meterProvider.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("sending the last metrics")
+		}
+	}, nil
+}
+
+// newAppInsightsExporter returns an exporter sending to the Application
+// Insights resource of $APPLICATIONINSIGHTS_CONNECTION_STRING, or of the
+// instrumentation key $APPINSIGHTS_INSTRUMENTATIONKEY, with the pod as the
+// role instance.
+func newAppInsightsExporter(serviceName string, id identity) (*appinsights.Exporter, error) {
+	opts := appinsights.Options{
+		InstrumentationKey: os.Getenv("APPINSIGHTS_INSTRUMENTATIONKEY"),
+		ServiceName:        serviceName,
+		Instance:           id.Pod,
+		OnError: func(err error) {
+			logger.Warn().Err(err).Msg("exporting to application insights")
+		},
+	}
+	if s := os.Getenv("APPLICATIONINSIGHTS_CONNECTION_STRING"); s != "" {
+		var err error
+		opts.InstrumentationKey, opts.Endpoint, err = appinsights.ParseConnectionString(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Info().Str("service", serviceName).Msg("exporting the traces and metrics to application insights")
+	return appinsights.NewExporter(opts)
+}
+
+// parseHeaders parses headers as key=value pairs separated by commas.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for i, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			// The pair isn't quoted, as it may hold a secret.
+			return nil, fmt.Errorf("EXPORTER_HEADERS: pair %d is not key=value", i+1)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers, nil
+}
+
+// collectorCredentials returns the TLS credentials to reach the collector
+// with, or nil to reach it in plain text. TLS is on as soon as
+// $COLLECTOR_TLS_CA, the PEM file of the CA to trust instead of the system
+// ones, or $COLLECTOR_TLS_CERT and $COLLECTOR_TLS_KEY, the certificate the
+// app presents for mutual TLS, are set. $COLLECTOR_TLS_SERVER_NAME
+// overrides the name the collector's certificate is checked against.
+func collectorCredentials() (credentials.TransportCredentials, error) {
+	caFile := os.Getenv("COLLECTOR_TLS_CA")
+	certFile := os.Getenv("COLLECTOR_TLS_CERT")
+	keyFile := os.Getenv("COLLECTOR_TLS_KEY")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: os.Getenv("COLLECTOR_TLS_SERVER_NAME")}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading the collector CA: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in the collector CA %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading the client certificate for the collector: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	logger.Info().Bool("mutual", len(config.Certificates) > 0).Msg("exporting to the collector over TLS")
+	return credentials.NewTLS(config), nil
+}
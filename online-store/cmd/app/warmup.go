@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"online-store/orderqueue"
+)
+
+// defaultWarmUpTimeout is how long, unless $WARMUP_TIMEOUT says otherwise,
+// the warm-up retries the connections before the pod gets ready without
+// them.
+const defaultWarmUpTimeout = 30 * time.Second
+
+// contentDir holds the pages of the store, as the image lays them out.
+const contentDir = "/app/content"
+
+// startTime is when the process started, near enough.
+var startTime = time.Now()
+
+var warmUpGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "warmup_seconds",
+	Help: "Time from the start of the process to the pod being ready, in Seconds",
+})
+
+func init() {
+	prometheus.MustRegister(warmUpGauge)
+}
+
+// pinger is a cart store that can open its connections ahead of the
+// requests.
+type pinger interface {
+	ping(ctx context.Context) error
+}
+
+// warmUp gets the pod ready to serve: it loads the catalog and the pages of
+// the store, and connects to the cart store and the order queue, retrying
+// for up to $WARMUP_TIMEOUT. The pod stays not ready until then, and for at
+// least $WARMUP_SECONDS since the process started, so the time it takes
+// pods to get ready on the virtual node and on the VM nodes can be told
+// apart and exaggerated for a demo.
+func warmUp(ready *readiness, carts cartStore, queue orderqueue.Queue) {
+	minimum := time.Duration(0)
+	if s := os.Getenv("WARMUP_SECONDS"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds < 0 {
+			logger.Fatal().Msgf("bad value for WARMUP_SECONDS: %s", s)
+		}
+		minimum = time.Duration(seconds * float64(time.Second))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), durationEnv("WARMUP_TIMEOUT", defaultWarmUpTimeout))
+	defer cancel()
+
+	if err := loadCatalog(); err != nil {
+		logger.Warn().Err(err).Msg("Failed to load the catalog")
+	}
+	files, size := loadContent(contentDir)
+	logger.Debug().Int("files", files).Int64("bytes", size).Msg("loaded the content")
+	if p, ok := carts.(pinger); ok {
+		retryUntil(ctx, "connecting to the cart store", p.ping)
+	}
+	if queue != nil {
+		retryUntil(ctx, "connecting to the order queue", func(ctx context.Context) error {
+			_, err := queue.Depth(ctx)
+			return err
+		})
+	}
+
+	if wait := minimum - time.Since(startTime); wait > 0 {
+		time.Sleep(wait)
+	}
+	took := time.Since(startTime)
+	warmUpGauge.Set(took.Seconds())
+	ready.warmedUp()
+	logger.Info().Str("took", took.String()).Msg("warmed up")
+}
+
+// loadContent reads the files under dir, for the first requests not to wait
+// on the disk, or on the image layers of the virtual node. It returns how
+// many files and bytes it read.
+func loadContent(dir string) (files int, size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		files++
+		size += int64(len(b))
+		return nil
+	})
+	return files, size
+}
+
+// retryUntil calls f until it succeeds, waiting longer between attempts,
+// or until ctx is done, when it gives up with a warning: the requests then
+// retry the connection, failing while it is down.
+func retryUntil(ctx context.Context, what string, f func(ctx context.Context) error) {
+	wait := 100 * time.Millisecond
+	for {
+		err := f(ctx)
+		if err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			logger.Warn().Err(err).Msg("gave up " + what + ", getting ready without it")
+			return
+		case <-time.After(wait):
+		}
+		if wait < 2*time.Second {
+			wait *= 2
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"online-store/kedascaler"
+	"online-store/kedascaler/externalscaler"
+)
+
+func main() {
+	var (
+		opts      kedascaler.Options
+		queueOpts kedascaler.QueueOptions
+		addr      string
+		mode      string
+	)
+	flag.StringVar(&addr, "listen-address", ":6000", "address to serve the external scaler on")
+	flag.StringVar(&mode, "scaler", "orders", "what to scale on: orders, the rate of orders placed, or queue, the depth of a Redis stream")
+	flag.StringVar(&opts.PodsHost, "pods-host", "online-store-pods.default.svc.cluster.local", "host name resolving to every online-store pod, such as a headless service")
+	flag.IntVar(&opts.MetricsPort, "metrics-port", 8080, "port of the pods' Prometheus endpoint")
+	flag.StringVar(&opts.MetricsPath, "metrics-path", "/metrics", "path of the pods' Prometheus endpoint")
+	flag.StringVar(&opts.Series, "series", "orders_placed_total", "counter of the orders placed")
+	flag.Float64Var(&opts.Target, "target", 5, "orders per second per replica, unless the ScaledObject sets "+kedascaler.TargetKey)
+	flag.DurationVar(&opts.ScrapeInterval, "scrape-interval", 5*time.Second, "how often the pods are scraped")
+	flag.StringVar(&queueOpts.RedisAddr, "redis-addr", "redis:6379", "host:port of the Redis holding the queue")
+	flag.StringVar(&queueOpts.Stream, "queue-stream", "orders", "Redis stream of the queue")
+	flag.StringVar(&queueOpts.Group, "queue-group", "order-workers", "consumer group the workers read the queue in")
+	flag.Float64Var(&queueOpts.Target, "queue-target", 10, "messages waiting per replica, unless the ScaledObject sets "+kedascaler.QueueTargetKey)
+	flag.DurationVar(&queueOpts.PollInterval, "queue-poll-interval", 5*time.Second, "how often the depth of the queue is read")
+	flag.Parse()
+	queueOpts.RedisPassword = os.Getenv("REDIS_PASSWORD")
+
+	var scaler externalscaler.ExternalScalerServer
+	switch mode {
+	case "orders":
+		s := kedascaler.New(opts)
+		go s.Run(context.Background())
+		scaler = s
+	case "queue":
+		s := kedascaler.NewQueueScaler(queueOpts)
+		go s.Run(context.Background())
+		scaler = s
+	default:
+		log.Fatalf("unknown scaler %q, want orders or queue", mode)
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	srv := grpc.NewServer()
+	externalscaler.RegisterExternalScalerServer(srv, scaler)
+	log.Printf("serving the KEDA external scaler on %s", addr)
+	log.Fatal(srv.Serve(lis))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+
+	"online-store/orderqueue"
+)
+
+var (
+	queueDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "order_queue_depth",
+		Help: "Orders waiting in the queue, or being processed",
+	})
+	processedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "orders_processed_total",
+		Help: "Orders taken from the queue, by result",
+	}, []string{"result"})
+	processingHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "order_processing_seconds",
+		Buckets: prometheus.DefBuckets,
+		Help:    "Time spent processing an order, in Seconds",
+	})
+	latencyHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "order_latency_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		Help:    "Time from an order being queued to it being processed, in Seconds",
+	})
+)
+
+// logger writes the worker's logs as JSON lines, each with the pod and the
+// node, like those of the app.
+var logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+func init() {
+	prometheus.MustRegister(queueDepthGauge)
+	prometheus.MustRegister(processedCounter)
+	prometheus.MustRegister(processingHistogram)
+	prometheus.MustRegister(latencyHistogram)
+}
+
+// order is the part of the orders sent by the online-store the worker
+// reads.
+type order struct {
+	ID    string `json:"id"`
+	Items []struct {
+		SKU      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+	} `json:"items"`
+}
+
+func main() {
+	consumer := os.Getenv("POD_NAME")
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	setupLogging(consumer)
+	queue, err := orderqueue.FromEnv(consumer)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to set up the order queue")
+	}
+	if queue == nil {
+		logger.Fatal().Msg("ORDER_QUEUE isn't set")
+	}
+	defer queue.Close()
+	processingTime := durationEnv("PROCESSING_TIME", 200*time.Millisecond)
+	concurrency := 1
+	if s := os.Getenv("WORKER_CONCURRENCY"); s != "" {
+		if concurrency, err = strconv.Atoi(s); err != nil || concurrency < 1 {
+			logger.Fatal().Msgf("bad value for WORKER_CONCURRENCY: %s", s)
+		}
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	go func() {
+		err := http.ListenAndServe(":8080", nil)
+		logger.Fatal().Err(err).Msg("Failed to serve the metrics")
+	}()
+
+	// Stop taking orders on SIGTERM; the ones being processed are
+	// finished, and those not acked go back to the queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logger.Info().Msg("draining")
+		cancel()
+	}()
+	go watchDepth(ctx, queue)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(ctx, queue, processingTime)
+		}()
+	}
+	logger.Info().Int("concurrency", concurrency).Msg("processing orders")
+	wg.Wait()
+}
+
+// work processes the orders of queue until ctx is done.
+func work(ctx context.Context, queue orderqueue.Queue, processingTime time.Duration) {
+	for ctx.Err() == nil {
+		m, err := queue.Receive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error().Err(err).Msg("receiving an order")
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if m == nil {
+			continue
+		}
+
+		start := time.Now()
+		var o order
+		result := "processed"
+		if err := json.Unmarshal(m.Body, &o); err != nil {
+			// It would fail again; drop it rather than retry it forever.
+			logger.Warn().Err(err).Str("message", m.ID).Msg("dropping a malformed order")
+			result = "malformed"
+		} else {
+			// Fulfilling an order is simulated.
+			time.Sleep(processingTime)
+		}
+		// The order is finished even if the worker is draining.
+		if err := m.Ack(context.Background()); err != nil {
+			logger.Error().Err(err).Str("order", o.ID).Msg("acking the order")
+			processedCounter.WithLabelValues("unacked").Inc()
+			continue
+		}
+		processedCounter.WithLabelValues(result).Inc()
+		processingHistogram.Observe(time.Since(start).Seconds())
+		if !m.EnqueuedAt.IsZero() {
+			latencyHistogram.Observe(time.Since(m.EnqueuedAt).Seconds())
+		}
+	}
+}
+
+// watchDepth keeps queueDepthGauge up to date until ctx is done.
+func watchDepth(ctx context.Context, queue orderqueue.Queue) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		if depth, err := queue.Depth(ctx); err != nil {
+			logger.Warn().Err(err).Msg("reading the queue depth")
+		} else {
+			queueDepthGauge.Set(float64(depth))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// durationEnv returns the duration in $name, or def if it is unset.
+func durationEnv(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		logger.Fatal().Msgf("bad value for %s: %s", name, s)
+	}
+	return d
+}
+
+// setupLogging adds the pod and the node to every line, and sets the level
+// from $LOG_LEVEL, info by default.
+func setupLogging(pod string) {
+	logger = logger.With().
+		Str("pod", pod).
+		Str("node", os.Getenv("NODE_NAME")).
+		Logger()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		level, err := zerolog.ParseLevel(s)
+		if err != nil {
+			logger.Fatal().Msgf("bad value for LOG_LEVEL: %s", s)
+		}
+		zerolog.SetGlobalLevel(level)
+	}
+}
@@ -0,0 +1,257 @@
+package kedascaler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"online-store/kedascaler/externalscaler"
+)
+
+// QueueMetricName is the name of the metric given to KEDA by the
+// QueueScaler.
+const QueueMetricName = "queue_depth"
+
+// Metadata keys of a ScaledObject's trigger on the queue.
+const (
+	// QueueTargetKey is the messages waiting per replica.
+	QueueTargetKey = "targetQueueDepth"
+	// QueueActivationKey is the depth above which the worker is active, and
+	// scaled up from zero.
+	QueueActivationKey = "activationQueueDepth"
+)
+
+// activatorBlock is how long the activator waits for a message in one read.
+const activatorBlock = 5 * time.Second
+
+// QueueOptions configures the queue scaler.
+type QueueOptions struct {
+	// RedisAddr and RedisPassword locate the Redis holding the queue.
+	RedisAddr     string
+	RedisPassword string
+	// Stream is the Redis stream of the queue, and Group the consumer group
+	// the workers read it in. The workers delete the messages they are done
+	// with, so the length of the stream is the work left.
+	Stream string
+	Group  string
+	// Target is the messages waiting per replica when the ScaledObject
+	// doesn't set it.
+	Target       float64
+	PollInterval time.Duration
+}
+
+// QueueScaler serves the KEDA external scaler contract for a worker
+// consuming a Redis stream, which it scales on the depth of the stream, down
+// to zero replicas when the stream is empty.
+//
+// It also activates the worker: it makes sure the consumer group exists
+// from the start of the stream, so the messages sent while no worker runs
+// are delivered once one starts rather than skipped, and it blocks reading
+// the stream to report the worker active as soon as the first message
+// arrives, without waiting for the next poll.
+type QueueScaler struct {
+	opts QueueOptions
+	pool *redis.Pool
+
+	mu    sync.Mutex
+	depth int64
+	// changed is closed, and replaced, whenever depth changes.
+	changed chan struct{}
+}
+
+var _ externalscaler.ExternalScalerServer = (*QueueScaler)(nil)
+
+// NewQueueScaler returns a queue scaler; call Run to start watching the
+// queue.
+func NewQueueScaler(opts QueueOptions) *QueueScaler {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 5 * time.Second
+	}
+	return &QueueScaler{
+		opts: opts,
+		pool: &redis.Pool{
+			MaxIdle:     2,
+			IdleTimeout: 5 * time.Minute,
+			Dial:        opts.dial,
+		},
+		changed: make(chan struct{}),
+	}
+}
+
+func (o QueueOptions) dial() (redis.Conn, error) {
+	return redis.Dial("tcp", o.RedisAddr,
+		redis.DialPassword(o.RedisPassword),
+		redis.DialConnectTimeout(5*time.Second),
+		redis.DialReadTimeout(2*activatorBlock),
+		redis.DialWriteTimeout(5*time.Second),
+	)
+}
+
+// Run polls the depth of the queue every PollInterval, and activates the
+// worker on the first message, until ctx is done.
+func (s *QueueScaler) Run(ctx context.Context) {
+	go s.activate(ctx)
+
+	ticker := time.NewTicker(s.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.ensureGroup(); err != nil {
+			log.Printf("creating the consumer group %s of %s: %v", s.opts.Group, s.opts.Stream, err)
+		}
+		if depth, err := s.poll(); err != nil {
+			log.Printf("reading the depth of %s: %v", s.opts.Stream, err)
+		} else {
+			s.setDepth(depth)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensureGroup creates the consumer group, reading from the start of the
+// stream, unless it exists. A worker creating it on its first start would
+// read from the end, skipping what was sent while it was scaled to zero.
+func (s *QueueScaler) ensureGroup() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XGROUP", "CREATE", s.opts.Stream, s.opts.Group, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+func (s *QueueScaler) poll() (int64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Int64(conn.Do("XLEN", s.opts.Stream))
+}
+
+// activate blocks reading the stream for new messages, and counts the
+// queue as not empty as soon as one arrives.
+func (s *QueueScaler) activate(ctx context.Context) {
+	for ctx.Err() == nil {
+		conn, err := s.opts.dial()
+		if err != nil {
+			log.Printf("connecting the activator to %s: %v", s.opts.RedisAddr, err)
+			time.Sleep(s.opts.PollInterval)
+			continue
+		}
+		for ctx.Err() == nil {
+			reply, err := conn.Do("XREAD", "COUNT", 1, "BLOCK", int64(activatorBlock/time.Millisecond), "STREAMS", s.opts.Stream, "$")
+			if err != nil {
+				log.Printf("waiting for messages on %s: %v", s.opts.Stream, err)
+				break
+			}
+			if reply == nil {
+				continue
+			}
+			s.mu.Lock()
+			empty := s.depth == 0
+			s.mu.Unlock()
+			if empty {
+				log.Printf("activating the worker on a message on %s", s.opts.Stream)
+				s.setDepth(1)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func (s *QueueScaler) setDepth(depth int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if depth == s.depth {
+		return
+	}
+	s.depth = depth
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Depth returns the messages waiting in the queue.
+func (s *QueueScaler) Depth() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+func (s *QueueScaler) active(ref *externalscaler.ScaledObjectRef) (bool, <-chan struct{}, error) {
+	activation, err := metadataFloat(ref, QueueActivationKey, 0)
+	if err != nil {
+		return false, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return float64(s.depth) > activation, s.changed, nil
+}
+
+// IsActive reports whether messages are waiting. KEDA scales the worker to
+// zero while it is inactive, if the ScaledObject allows it.
+func (s *QueueScaler) IsActive(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.IsActiveResponse, error) {
+	active, _, err := s.active(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &externalscaler.IsActiveResponse{Result: active}, nil
+}
+
+// StreamIsActive sends whether messages are waiting whenever that changes,
+// right as the activator sees the first message.
+func (s *QueueScaler) StreamIsActive(ref *externalscaler.ScaledObjectRef, stream externalscaler.ExternalScaler_StreamIsActiveServer) error {
+	first := true
+	var last bool
+	for {
+		active, changed, err := s.active(ref)
+		if err != nil {
+			return err
+		}
+		if first || active != last {
+			if err := stream.Send(&externalscaler.IsActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			first, last = false, active
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// GetMetricSpec returns the target messages waiting per replica.
+func (s *QueueScaler) GetMetricSpec(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	target, err := metadataFloat(ref, QueueTargetKey, s.opts.Target)
+	if err != nil {
+		return nil, err
+	}
+	if target <= 0 {
+		return nil, fmt.Errorf("%s must be positive, got %v", QueueTargetKey, target)
+	}
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{{
+			MetricName: QueueMetricName,
+			TargetSize: int64(math.Ceil(target)),
+		}},
+	}, nil
+}
+
+// GetMetrics returns the messages waiting in the queue.
+func (s *QueueScaler) GetMetrics(ctx context.Context, req *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{{
+			MetricName:  QueueMetricName,
+			MetricValue: s.Depth(),
+		}},
+	}, nil
+}
@@ -0,0 +1,249 @@
+// Package kedascaler is a KEDA external scaler scaling the online-store on
+// the rate of orders placed, read from the online-store's own metrics.
+package kedascaler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+
+	"online-store/kedascaler/externalscaler"
+)
+
+// MetricName is the name of the metric given to KEDA.
+const MetricName = "orders_per_second"
+
+// Metadata keys of a ScaledObject's trigger.
+const (
+	// TargetKey is the orders per second each replica should take.
+	TargetKey = "targetOrdersPerSecond"
+	// ActivationKey is the rate above which the workload is active, and
+	// scaled up from zero.
+	ActivationKey = "activationOrdersPerSecond"
+)
+
+// Options configures the scaler.
+type Options struct {
+	// PodsHost resolves to the addresses of every online-store pod, as the
+	// name of a headless service does.
+	PodsHost string
+	// MetricsPort and MetricsPath locate the Prometheus endpoint of a pod.
+	MetricsPort int
+	MetricsPath string
+	// Series is the counter of orders placed.
+	Series string
+	// Target is the orders per second per replica when the ScaledObject
+	// doesn't set it.
+	Target         float64
+	ScrapeInterval time.Duration
+}
+
+// Scaler serves the KEDA external scaler contract.
+type Scaler struct {
+	opts Options
+	http *http.Client
+
+	mu sync.Mutex
+	// counters are the last orders counters, by pod address.
+	counters map[string]float64
+	scraped  time.Time
+	rate     float64
+}
+
+var _ externalscaler.ExternalScalerServer = (*Scaler)(nil)
+
+// New returns a scaler; call Run to start scraping.
+func New(opts Options) *Scaler {
+	if opts.ScrapeInterval <= 0 {
+		opts.ScrapeInterval = 5 * time.Second
+	}
+	return &Scaler{
+		opts:     opts,
+		http:     &http.Client{Timeout: opts.ScrapeInterval},
+		counters: make(map[string]float64),
+	}
+}
+
+// Run scrapes the pods every ScrapeInterval, until ctx is done.
+func (s *Scaler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.ScrapeInterval)
+	defer ticker.Stop()
+	for {
+		s.scrape()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scaler) scrape() {
+	// No pods resolve once scaled to zero; that is a rate of zero.
+	addrs, err := net.LookupHost(s.opts.PodsHost)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			log.Printf("looking up the pods at %s: %v", s.opts.PodsHost, err)
+			return
+		}
+	}
+
+	counters := make(map[string]float64, len(addrs))
+	for _, addr := range addrs {
+		value, err := s.scrapePod(addr)
+		if err != nil {
+			log.Printf("scraping pod %s: %v", addr, err)
+			continue
+		}
+		counters[addr] = value
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Only pods seen in both scrapes count; a counter going down means the
+	// pod restarted, and counts from zero.
+	if elapsed := now.Sub(s.scraped).Seconds(); !s.scraped.IsZero() && elapsed > 0 {
+		var orders float64
+		for addr, value := range counters {
+			prev, ok := s.counters[addr]
+			if !ok {
+				continue
+			}
+			if value < prev {
+				prev = 0
+			}
+			orders += value - prev
+		}
+		s.rate = orders / elapsed
+	}
+	s.counters, s.scraped = counters, now
+}
+
+func (s *Scaler) scrapePod(addr string) (float64, error) {
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(addr, strconv.Itoa(s.opts.MetricsPort)), s.opts.MetricsPath)
+	resp, err := s.http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	family, ok := families[s.opts.Series]
+	if !ok {
+		// No order was placed since the pod started.
+		return 0, nil
+	}
+	var total float64
+	for _, m := range family.GetMetric() {
+		total += m.GetCounter().GetValue() + m.GetUntyped().GetValue()
+	}
+	return total, nil
+}
+
+// Rate returns the orders per second over the last scrape interval.
+func (s *Scaler) Rate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
+
+func (s *Scaler) active(ref *externalscaler.ScaledObjectRef) (bool, error) {
+	activation, err := metadataFloat(ref, ActivationKey, 0)
+	if err != nil {
+		return false, err
+	}
+	return s.Rate() > activation, nil
+}
+
+// IsActive reports whether orders are coming in. KEDA scales the workload
+// to zero while it is inactive, if the ScaledObject allows it.
+func (s *Scaler) IsActive(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.IsActiveResponse, error) {
+	active, err := s.active(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &externalscaler.IsActiveResponse{Result: active}, nil
+}
+
+// StreamIsActive sends whether orders are coming in whenever that changes,
+// so KEDA wakes the workload without waiting for its next poll.
+func (s *Scaler) StreamIsActive(ref *externalscaler.ScaledObjectRef, stream externalscaler.ExternalScaler_StreamIsActiveServer) error {
+	ticker := time.NewTicker(s.opts.ScrapeInterval)
+	defer ticker.Stop()
+
+	first := true
+	var last bool
+	for {
+		active, err := s.active(ref)
+		if err != nil {
+			return err
+		}
+		if first || active != last {
+			if err := stream.Send(&externalscaler.IsActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			first, last = false, active
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetMetricSpec returns the target orders per second per replica.
+func (s *Scaler) GetMetricSpec(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	target, err := metadataFloat(ref, TargetKey, s.opts.Target)
+	if err != nil {
+		return nil, err
+	}
+	if target <= 0 {
+		return nil, fmt.Errorf("%s must be positive, got %v", TargetKey, target)
+	}
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{{
+			MetricName: MetricName,
+			TargetSize: int64(math.Ceil(target)),
+		}},
+	}, nil
+}
+
+// GetMetrics returns the orders per second, rounded up so that any order
+// keeps a replica.
+func (s *Scaler) GetMetrics(ctx context.Context, req *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{{
+			MetricName:  MetricName,
+			MetricValue: int64(math.Ceil(s.Rate())),
+		}},
+	}, nil
+}
+
+func metadataFloat(ref *externalscaler.ScaledObjectRef, key string, def float64) (float64, error) {
+	value, ok := ref.GetScalerMetadata()[key]
+	if !ok || value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %v", key, value, err)
+	}
+	return f, nil
+}
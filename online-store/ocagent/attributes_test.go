@@ -0,0 +1,53 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var smallAttributeSets = []map[string]interface{}{
+	{"http.method": "GET"},
+	{"http.status_code": 200, "cache.hit": true},
+	{"retries": int64(3), "ignored": 1.5},
+}
+
+func TestOCSmallAttributesToProtoAttributes_matchesGeneralPath(t *testing.T) {
+	for _, attrs := range smallAttributeSets {
+		fast := ocSmallAttributesToProtoAttributes(attrs)
+		general := ocAnyAttributesToProtoAttributes(attrs)
+		if !proto.Equal(fast, general) {
+			t.Errorf("%v:\nfast path    %v\ngeneral path %v", attrs, fast, general)
+		}
+	}
+}
+
+func BenchmarkOCAttributesToProtoAttributes_small(b *testing.B) {
+	attrs := smallAttributeSets[1]
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ocSmallAttributesToProtoAttributes(attrs)
+		}
+	})
+	b.Run("general", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ocAnyAttributesToProtoAttributes(attrs)
+		}
+	})
+}
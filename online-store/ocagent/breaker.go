@@ -0,0 +1,120 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops export attempts after threshold failures have
+// happened within window. Once open, it rejects every attempt until cooldown
+// has elapsed and then lets a single probe through: a successful probe closes
+// the circuit again while a failed one re-opens it for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures []time.Time
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether an export attempt may be made right now.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// The probe is still in flight.
+		return false
+	default:
+		return true
+	}
+}
+
+// cancel gives up an attempt that allow let through without making it, such
+// as when none of the spans of a batch could be sent. A probe goes back to
+// the open circuit, whose cooldown is over, so the next attempt probes again.
+func (cb *circuitBreaker) cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		cb.state = breakerOpen
+	}
+}
+
+func (cb *circuitBreaker) recordResult(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		cb.state = breakerClosed
+		cb.failures = cb.failures[:0]
+		return
+	}
+
+	now := cb.now()
+	if cb.state == breakerHalfOpen {
+		cb.trip(now)
+		return
+	}
+
+	// Only keep the failures that are still within the window.
+	recent := cb.failures[:0]
+	for _, t := range cb.failures {
+		if now.Sub(t) < cb.window {
+			recent = append(recent, t)
+		}
+	}
+	cb.failures = append(recent, now)
+	if len(cb.failures) >= cb.threshold {
+		cb.trip(now)
+	}
+}
+
+func (cb *circuitBreaker) trip(now time.Time) {
+	cb.state = breakerOpen
+	cb.openedAt = now
+	cb.failures = cb.failures[:0]
+}
@@ -0,0 +1,83 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_recoversAfterSuccessfulProbe(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cb := newCircuitBreaker(2, time.Second, 5*time.Second)
+	cb.now = func() time.Time { return now }
+
+	errSend := errors.New("send failed")
+	cb.recordResult(errSend)
+	if !cb.allow() {
+		t.Fatal("Breaker opened before reaching the threshold")
+	}
+	cb.recordResult(errSend)
+	if cb.allow() {
+		t.Fatal("Breaker should be open after reaching the threshold")
+	}
+
+	now = now.Add(5 * time.Second)
+	if !cb.allow() {
+		t.Fatal("Breaker should let a probe through after the cooldown")
+	}
+	if cb.allow() {
+		t.Fatal("Breaker should only let a single probe through")
+	}
+	cb.recordResult(nil)
+	for i := 0; i < 3; i++ {
+		if !cb.allow() {
+			t.Fatalf("#%d: breaker should be closed after a successful probe", i)
+		}
+	}
+}
+
+func TestCircuitBreaker_failuresOutsideWindowDoNotTrip(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cb := newCircuitBreaker(2, time.Second, time.Second)
+	cb.now = func() time.Time { return now }
+
+	cb.recordResult(errors.New("first"))
+	now = now.Add(2 * time.Second)
+	cb.recordResult(errors.New("second"))
+	if !cb.allow() {
+		t.Fatal("Failures spread beyond the window should not trip the breaker")
+	}
+}
+
+func TestCircuitBreaker_cancelledProbeLetsTheNextOneThrough(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cb := newCircuitBreaker(1, time.Second, 5*time.Second)
+	cb.now = func() time.Time { return now }
+
+	cb.recordResult(errors.New("send failed"))
+	now = now.Add(5 * time.Second)
+	if !cb.allow() {
+		t.Fatal("Breaker should let a probe through after the cooldown")
+	}
+	cb.cancel()
+	if !cb.allow() {
+		t.Fatal("Breaker should let another probe through after one was cancelled")
+	}
+	if cb.allow() {
+		t.Fatal("Breaker should only let a single probe through")
+	}
+}
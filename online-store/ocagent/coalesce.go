@@ -0,0 +1,54 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"sync"
+	"time"
+)
+
+// flushCoalescer merges the flushes requested within a window into one.
+type flushCoalescer struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// pending is closed once the flush that callers are waiting for is
+	// done. It is nil when no flush has been requested.
+	pending chan struct{}
+}
+
+// flush runs do, along with all the other calls made during the window
+// that started with the first of them, and returns once do has returned.
+func (fc *flushCoalescer) flush(do func()) {
+	fc.mu.Lock()
+	if done := fc.pending; done != nil {
+		fc.mu.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	fc.pending = done
+	fc.mu.Unlock()
+
+	// The first caller waits out the window for the others to join, then
+	// flushes for all of them. Callers arriving during the flush request
+	// another one, since what they exported may have missed this one.
+	time.Sleep(fc.window)
+	fc.mu.Lock()
+	fc.pending = nil
+	fc.mu.Unlock()
+	do()
+	close(done)
+}
@@ -0,0 +1,153 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ConnectionState is the state of the exporter's connection to the agent.
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+)
+
+func (cs ConnectionState) String() string {
+	switch cs {
+	case Disconnected:
+		return "Disconnected"
+	case Connecting:
+		return "Connecting"
+	case Connected:
+		return "Connected"
+	}
+	return "ConnectionState(" + strconv.Itoa(int(cs)) + ")"
+}
+
+func connectionStateFromGRPC(s connectivity.State) ConnectionState {
+	switch s {
+	case connectivity.Ready:
+		return Connected
+	case connectivity.Connecting:
+		return Connecting
+	}
+	return Disconnected
+}
+
+// connectionStateTracker keeps the latest ConnectionState and publishes
+// every transition to an optional channel.
+type connectionStateTracker struct {
+	mu    sync.Mutex
+	state ConnectionState
+	ch    chan ConnectionState
+	// conn is the connection whose watcher may update the state.
+	conn *grpc.ClientConn
+}
+
+// track makes cc the connection whose state setFrom records, ignoring the
+// watchers of the connections it replaced.
+func (cst *connectionStateTracker) track(cc *grpc.ClientConn) {
+	cst.mu.Lock()
+	defer cst.mu.Unlock()
+	cst.conn = cc
+}
+
+// setFrom records the state of cc, unless cc is no longer the tracked
+// connection, in which case it reports false.
+func (cst *connectionStateTracker) setFrom(cc *grpc.ClientConn, state ConnectionState) bool {
+	cst.mu.Lock()
+	defer cst.mu.Unlock()
+
+	if cc != cst.conn {
+		return false
+	}
+	cst.setLocked(state)
+	return true
+}
+
+func (cst *connectionStateTracker) get() ConnectionState {
+	cst.mu.Lock()
+	defer cst.mu.Unlock()
+	return cst.state
+}
+
+// set records a new state and publishes it if it is a transition. It never
+// blocks: when the channel is full, the oldest undelivered state is dropped
+// to make room, so that the latest state is always delivered.
+func (cst *connectionStateTracker) set(state ConnectionState) {
+	cst.mu.Lock()
+	defer cst.mu.Unlock()
+	cst.setLocked(state)
+}
+
+func (cst *connectionStateTracker) setLocked(state ConnectionState) {
+	if state == cst.state {
+		return
+	}
+	cst.state = state
+	if cst.ch == nil {
+		return
+	}
+	for {
+		select {
+		case cst.ch <- state:
+			return
+		default:
+		}
+		if cap(cst.ch) == 0 {
+			// Nobody is receiving, and there is no room to leave it in.
+			return
+		}
+		select {
+		case <-cst.ch:
+		default:
+		}
+	}
+}
+
+// ConnectionState returns the current state of the connection to the agent.
+func (ae *Exporter) ConnectionState() ConnectionState {
+	return ae.connState.get()
+}
+
+// watchConnectivity tracks the state of cc for as long as it is the
+// exporter's connection to the agent.
+func (ae *Exporter) watchConnectivity(cc *grpc.ClientConn) {
+	for {
+		s := cc.GetState()
+		if s == connectivity.Shutdown {
+			return
+		}
+		if !ae.connState.setFrom(cc, connectionStateFromGRPC(s)) {
+			return
+		}
+		if s == connectivity.Idle {
+			// gRPC leaves a connection that broke idle until the next call;
+			// reconnect right away instead, as it did before.
+			cc.Connect()
+		}
+		if !cc.WaitForStateChange(context.Background(), s) {
+			return
+		}
+	}
+}
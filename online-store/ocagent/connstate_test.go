@@ -0,0 +1,44 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestConnectionStateTracker_ignoresReplacedConnections(t *testing.T) {
+	old, current := new(grpc.ClientConn), new(grpc.ClientConn)
+	var cst connectionStateTracker
+
+	cst.track(old)
+	if !cst.setFrom(old, Connected) {
+		t.Fatal("The state of the tracked connection was not recorded")
+	}
+	cst.track(current)
+	if cst.setFrom(old, Disconnected) {
+		t.Error("The state of a replaced connection was recorded")
+	}
+	if g, w := cst.get(), Connected; g != w {
+		t.Errorf("State: got %v want %v", g, w)
+	}
+	if !cst.setFrom(current, Connecting) {
+		t.Fatal("The state of the tracked connection was not recorded")
+	}
+	if g, w := cst.get(), Connecting; g != w {
+		t.Errorf("State: got %v want %v", g, w)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import "testing"
+
+func TestDialOptions_bufferSizes(t *testing.T) {
+	plain, err := NewUnstartedExporter(WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to create the exporter: %v", err)
+	}
+	buffered, err := NewUnstartedExporter(WithInsecure(), WithWriteBufferSize(100), WithReadBufferSize(1<<20))
+	if err != nil {
+		t.Fatalf("Failed to create the exporter: %v", err)
+	}
+
+	if g, w := buffered.writeBufferSize, minBufferSize; g != w {
+		t.Errorf("Write buffer below the minimum: got %d want %d", g, w)
+	}
+	if g, w := buffered.readBufferSize, 1<<20; g != w {
+		t.Errorf("Read buffer: got %d want %d", g, w)
+	}
+	if g, w := len(buffered.dialOptions())-len(plain.dialOptions()), 2; g != w {
+		t.Errorf("Extra dial options for the buffer sizes: got %d want %d", g, w)
+	}
+}
+
+func TestDialOptions_compressionAndHeaders(t *testing.T) {
+	plain, err := NewUnstartedExporter(WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to create the exporter: %v", err)
+	}
+	exp, err := NewUnstartedExporter(WithInsecure(), WithCompressor("gzip"),
+		WithHeaders(map[string]string{"X-API-Key": "secret"}), WithHeaders(map[string]string{"authorization": "Bearer token"}))
+	if err != nil {
+		t.Fatalf("Failed to create the exporter: %v", err)
+	}
+
+	want := map[string]string{"x-api-key": "secret", "authorization": "Bearer token"}
+	if g, w := len(exp.headers), len(want); g != w {
+		t.Errorf("Headers: got %v want %v", exp.headers, want)
+	}
+	for k, v := range want {
+		if g := exp.headers[k]; g != v {
+			t.Errorf("Header %q: got %q want %q", k, g, v)
+		}
+	}
+	if g, w := len(exp.dialOptions())-len(plain.dialOptions()), 2; g != w {
+		t.Errorf("Extra dial options for the compressor and the headers: got %d want %d", g, w)
+	}
+
+	if _, err := NewUnstartedExporter(WithInsecure(), WithCompressor("snappy")); err == nil {
+		t.Error("An unknown compressor was accepted")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"math/rand"
+
+	"go.opencensus.io/trace"
+)
+
+// maxDropSampleHandlers bounds the calls to a drop sample handler that may
+// run at once; samples taken while that many are running are skipped.
+const maxDropSampleHandlers = 4
+
+// dropSampler passes a random sample of the dropped spans to a handler,
+// in goroutines of their own so that the caller dropping the span is never
+// held up by it.
+type dropSampler struct {
+	fraction float64
+	handle   func(sd *trace.SpanData, reason string)
+	inFlight chan struct{}
+}
+
+func newDropSampler(fraction float64, handle func(*trace.SpanData, string)) *dropSampler {
+	return &dropSampler{
+		fraction: fraction,
+		handle:   handle,
+		inFlight: make(chan struct{}, maxDropSampleHandlers),
+	}
+}
+
+func (ds *dropSampler) sample(sd *trace.SpanData, reason string) {
+	if sd == nil || rand.Float64() >= ds.fraction {
+		return
+	}
+	select {
+	case ds.inFlight <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-ds.inFlight }()
+		ds.handle(sd, reason)
+	}()
+}
+
+// dropSpan counts sd as dropped for reason and offers it to the drop
+// sampler, if there is one.
+func (ae *Exporter) dropSpan(sd *trace.SpanData, reason string) {
+	ae.stats.recordDropped(reason, 1)
+	if ae.dropSampler != nil {
+		ae.dropSampler.sample(sd, reason)
+	}
+}
+
+// dropQueuedSpans is dropSpan for a batch of queued spans.
+func (ae *Exporter) dropQueuedSpans(qsl []*queuedSpan, reason string) {
+	ae.stats.recordDropped(reason, len(qsl))
+	if ae.dropSampler != nil {
+		for _, qs := range qsl {
+			ae.dropSampler.sample(qs.sd, reason)
+		}
+	}
+}
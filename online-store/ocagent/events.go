@@ -0,0 +1,151 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventSpansDropped is published when spans are discarded instead of
+	// being sent to the agent.
+	EventSpansDropped EventType = iota
+	// EventReconnected is published when the exporter has reconnected to
+	// the agent.
+	EventReconnected
+	// EventConfigApplied is published when a trace config from the agent
+	// has been applied.
+	EventConfigApplied
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventSpansDropped:
+		return "SpansDropped"
+	case EventReconnected:
+		return "Reconnected"
+	case EventConfigApplied:
+		return "ConfigApplied"
+	}
+	return "EventType(" + strconv.Itoa(int(et)) + ")"
+}
+
+// Event is something that happened in the exporter, as delivered to the
+// channels returned by Subscribe.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// DropReason and Dropped are the reason, one of the DropReason
+	// constants, and the number of spans of an EventSpansDropped.
+	DropReason string
+	Dropped    int
+
+	// Config is the trace config of an EventConfigApplied.
+	Config *tracepb.TraceConfig
+}
+
+// subscriberBufferSize is how many events each subscriber may fall behind
+// by before further events are dropped for it.
+const subscriberBufferSize = 64
+
+// eventHub fans events out to every subscriber.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func (eh *eventHub) subscribe() (<-chan Event, func()) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	ch := make(chan Event, subscriberBufferSize)
+	if eh.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if eh.subs == nil {
+		eh.subs = make(map[chan Event]struct{})
+	}
+	eh.subs[ch] = struct{}{}
+	cancel := func() {
+		eh.mu.Lock()
+		defer eh.mu.Unlock()
+		if _, ok := eh.subs[ch]; ok {
+			delete(eh.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish delivers ev to every subscriber that has room for it, without
+// blocking, so that a slow subscriber only misses events itself.
+func (eh *eventHub) publish(ev Event) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	if len(eh.subs) == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for ch := range eh.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close ends every subscription, and the ones made afterwards right away.
+func (eh *eventHub) close() {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	eh.closed = true
+	for ch := range eh.subs {
+		close(ch)
+	}
+	eh.subs = nil
+}
+
+// reopen lets subscriptions be made again after close, for an exporter
+// that is started again after being stopped.
+func (eh *eventHub) reopen() {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	eh.closed = false
+}
+
+// Subscribe returns a channel delivering the exporter's events: span drops,
+// reconnects to the agent and trace configs applied. Each subscriber has
+// its own buffer, and events that don't fit in it are dropped for that
+// subscriber alone, so a slow subscriber never holds up the exporter or the
+// other subscribers. The channel is closed when cancel is called or the
+// exporter is stopped; subscribe again once it is started again.
+func (ae *Exporter) Subscribe() (events <-chan Event, cancel func()) {
+	return ae.events.subscribe()
+}
@@ -20,8 +20,9 @@ import (
 	"log"
 	"time"
 
-	"contrib.go.opencensus.io/exporter/ocagent"
 	"go.opencensus.io/trace"
+
+	"online-store/ocagent"
 )
 
 func Example() {
@@ -0,0 +1,62 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"go.opencensus.io/trace"
+)
+
+// exportSampler decides which traces are exported, by hashing their
+// TraceIDs so that every exporter keeps or drops all the spans of a trace
+// alike.
+type exportSampler struct {
+	fraction float64
+	seed     uint64
+	seeded   bool
+	// hash is the seam that tests replace to make exact decisions; nil
+	// means hashTraceID.
+	hash func(es *exportSampler, id trace.TraceID) uint64
+}
+
+// sample reports whether the trace with the given ID is to be exported.
+func (es *exportSampler) sample(id trace.TraceID) bool {
+	if es.fraction >= 1 {
+		return true
+	}
+	if es.fraction <= 0 {
+		return false
+	}
+	hash := es.hash
+	if hash == nil {
+		hash = hashTraceID
+	}
+	return hash(es, id) < uint64(es.fraction*math.MaxUint64)
+}
+
+// hashTraceID is the FNV-1a hash of id, preceded by the seed, if one is set.
+func hashTraceID(es *exportSampler, id trace.TraceID) uint64 {
+	h := fnv.New64a()
+	if es.seeded {
+		var seed [8]byte
+		binary.LittleEndian.PutUint64(seed[:], es.seed)
+		h.Write(seed[:])
+	}
+	h.Write(id[:])
+	return h.Sum64()
+}
@@ -0,0 +1,72 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestExportSampler_exactDecisions(t *testing.T) {
+	es := &exportSampler{
+		fraction: 0.25,
+		// The leading bytes of the TraceID as they are, so that decisions
+		// follow from the IDs alone.
+		hash: func(_ *exportSampler, id trace.TraceID) uint64 {
+			return binary.BigEndian.Uint64(id[:8])
+		},
+	}
+	tests := []struct {
+		id   trace.TraceID
+		want bool
+	}{
+		{trace.TraceID{0x00}, true},
+		{trace.TraceID{0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, true},
+		{trace.TraceID{0x40}, false},
+		{trace.TraceID{0x80, 0x01}, false},
+		{trace.TraceID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+	}
+	for i, tt := range tests {
+		if g, w := es.sample(tt.id), tt.want; g != w {
+			t.Errorf("#%d: %x: got %v want %v", i, tt.id, g, w)
+		}
+	}
+}
+
+func TestExportSampler_seededDecisions(t *testing.T) {
+	e, err := NewUnstartedExporter(WithExportSampling(0.5), WithExportSamplerSeed(42))
+	if err != nil {
+		t.Fatalf("Failed to create the exporter: %v", err)
+	}
+
+	want := []bool{false, true, true, false, true, false, false, false}
+	dropped := 0
+	for i, w := range want {
+		b := byte(i + 1)
+		id := trace.TraceID{b, 2 * b, 3 * b}
+		if g := e.exportSampler.sample(id); g != w {
+			t.Errorf("%x: got %v want %v", id, g, w)
+		}
+		if !w {
+			dropped++
+		}
+		e.ExportSpan(&trace.SpanData{Name: "span", SpanContext: trace.SpanContext{TraceID: id}})
+	}
+	if g, w := e.Stats().SpansDropped[DropReasonNotSampled], int64(dropped); g != w {
+		t.Errorf("Spans not sampled: got %d want %d", g, w)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent_test
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exporterGoroutines returns the stacks of the goroutines that run the
+// exporter's code or its batching, leaving out the calling goroutine.
+func exporterGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var stacks []string
+	// The first stack is the calling goroutine's.
+	for _, stack := range strings.Split(string(buf), "\n\n")[1:] {
+		if strings.Contains(stack, "exporter/ocagent.") || strings.Contains(stack, "support/bundler.") {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
+// checkNoGoroutineLeaks fails the test if, within a couple of seconds,
+// there are still more goroutines running exporter code than baseline,
+// which should come from exporterGoroutines before the exporter started.
+func checkNoGoroutineLeaks(t *testing.T, baseline []string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stacks := exporterGoroutines()
+		if len(stacks) <= len(baseline) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines leaked:\n\n%s", len(stacks)-len(baseline), strings.Join(stacks, "\n\n"))
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"time"
+
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+)
+
+// keepStreamActive sends an empty export request on the trace stream
+// whenever nothing has been sent on it for interval, until the exporter is
+// stopped, so that proxies that reap idle streams leave it open.
+func (ae *Exporter) keepStreamActive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ae.sendIdlePing(interval); err != nil {
+				ae.logf("ocagent: failed to send an idle activity ping: %v", err)
+			}
+		}
+	}
+}
+
+func (ae *Exporter) sendIdlePing(interval time.Duration) error {
+	ae.streamMu.Lock()
+	defer ae.streamMu.Unlock()
+
+	if ae.traceExporter == nil || time.Since(ae.lastTraceSend) < interval {
+		return nil
+	}
+	if err := ae.traceExporter.Send(&agenttracepb.ExportTraceServiceRequest{}); err != nil {
+		return err
+	}
+	ae.lastTraceSend = time.Now()
+	return nil
+}
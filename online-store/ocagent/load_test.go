@@ -30,10 +30,11 @@ import (
 
 	"google.golang.org/grpc"
 
-	"contrib.go.opencensus.io/exporter/ocagent"
 	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
+
+	"online-store/ocagent"
 )
 
 // Issue #13. The agent exporter was crashing due to -1 that was being
@@ -0,0 +1,150 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+// localConfigPollInterval is how often the local config file is checked
+// for changes.
+var localConfigPollInterval = time.Second
+
+// localTraceConfig is the JSON form of a TraceConfig, using the field
+// names of the protobuf JSON mapping. At most one sampler may be set.
+type localTraceConfig struct {
+	ProbabilitySampler  *tracepb.ProbabilitySampler  `json:"probabilitySampler"`
+	ConstantSampler     *tracepb.ConstantSampler     `json:"constantSampler"`
+	RateLimitingSampler *tracepb.RateLimitingSampler `json:"rateLimitingSampler"`
+}
+
+// parseLocalConfig parses a TraceConfig from its JSON form.
+func parseLocalConfig(data []byte) (*tracepb.TraceConfig, error) {
+	var lc localTraceConfig
+	if err := json.Unmarshal(data, &lc); err != nil {
+		return nil, err
+	}
+
+	cfg := new(tracepb.TraceConfig)
+	n := 0
+	if lc.ProbabilitySampler != nil {
+		cfg.Sampler = &tracepb.TraceConfig_ProbabilitySampler{ProbabilitySampler: lc.ProbabilitySampler}
+		n++
+	}
+	if lc.ConstantSampler != nil {
+		cfg.Sampler = &tracepb.TraceConfig_ConstantSampler{ConstantSampler: lc.ConstantSampler}
+		n++
+	}
+	if lc.RateLimitingSampler != nil {
+		cfg.Sampler = &tracepb.TraceConfig_RateLimitingSampler{RateLimitingSampler: lc.RateLimitingSampler}
+		n++
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("%d samplers set, want at most one", n)
+	}
+	return cfg, nil
+}
+
+// loadLocalConfig reads the trace config in path and applies it.
+func (ae *Exporter) loadLocalConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseLocalConfig(data)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := applyTraceConfig(cfg); err != nil {
+		return err
+	}
+
+	ae.configMu.Lock()
+	ae.lastConfig = cfg
+	ae.configMu.Unlock()
+	ae.firstConfigOnce.Do(func() { close(ae.firstConfigApplied) })
+	ae.events.publish(Event{Type: EventConfigApplied, Config: cfg})
+	return nil
+}
+
+// localConfigWatcher loads the trace config in a file again whenever the
+// file's size or modification time changes. A config that can't be loaded
+// is logged and skipped, leaving the one in effect.
+type localConfigWatcher struct {
+	ae   *Exporter
+	path string
+	last os.FileInfo
+}
+
+// check loads the config if the file changed since the last check.
+func (w *localConfigWatcher) check() {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		if w.last != nil || !os.IsNotExist(err) {
+			w.ae.logf("ocagent: checking local trace config: %v", err)
+		}
+		w.last = nil
+		return
+	}
+	if w.last != nil && fi.Size() == w.last.Size() && fi.ModTime().Equal(w.last.ModTime()) {
+		return
+	}
+	w.last = fi
+	if err := w.ae.loadLocalConfig(w.path); err != nil {
+		w.ae.stats.recordConfigError()
+		w.ae.logf("ocagent: skipping local trace config: %v", err)
+	}
+}
+
+// startLocalConfigWatcherLocked loads the local config file, if one was
+// given, and starts watching it, unless that is done already. It doesn't
+// depend on the connection to the agent, so the file applies even while
+// the agent can't be reached.
+func (ae *Exporter) startLocalConfigWatcherLocked() {
+	if ae.localConfigPath == "" || ae.localConfigStop != nil {
+		return
+	}
+	w := &localConfigWatcher{ae: ae, path: ae.localConfigPath}
+	w.check()
+	ae.localConfigStop = make(chan struct{})
+	go w.run(localConfigPollInterval, ae.localConfigStop)
+}
+
+func (ae *Exporter) stopLocalConfigWatcherLocked() {
+	if ae.localConfigStop != nil {
+		close(ae.localConfigStop)
+		ae.localConfigStop = nil
+	}
+}
+
+// run checks the file every interval until stop is closed.
+func (w *localConfigWatcher) run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			w.check()
+		}
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	exporterpb "github.com/census-instrumentation/opencensus-proto/gen-go/exporter/v1"
+	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+func makeMockAgent(t *testing.T) *mockAgent {
+	return &mockAgent{configsToSend: make(chan *agenttracepb.UpdatedLibraryConfig), t: t, wg: new(sync.WaitGroup)}
+}
+
+type mockAgent struct {
+	t *testing.T
+
+	spans   []*tracepb.Span
+	metrics []*metricspb.Metric
+	mu      sync.Mutex
+	wg      *sync.WaitGroup
+
+	traceNodes      []*commonpb.Node
+	traceStreams    int
+	streamPeers     []string
+	userAgents      []string
+	apiKeys         []string
+	receivedConfigs []*agenttracepb.CurrentLibraryConfig
+
+	// idleTimeout, if set, is how long trace streams may go without
+	// requests before the agent closes them, counting in idleCloses.
+	idleTimeout time.Duration
+	idleCloses  int
+
+	configsToSend          chan *agenttracepb.UpdatedLibraryConfig
+	closeConfigsToSendOnce sync.Once
+
+	port     uint16
+	stopFunc func() error
+	stopOnce sync.Once
+}
+
+var _ agenttracepb.TraceServiceServer = (*mockAgent)(nil)
+var _ exporterpb.ExportServer = (*mockAgent)(nil)
+
+func (ma *mockAgent) Config(tscs agenttracepb.TraceService_ConfigServer) error {
+	ma.mu.Lock()
+	ma.wg.Add(1)
+	ma.mu.Unlock()
+	defer func() {
+		ma.mu.Lock()
+		ma.wg.Done()
+		ma.mu.Unlock()
+	}()
+
+	in, err := tscs.Recv()
+	if err != nil {
+		return err
+	}
+	if in == nil || in.Node == nil {
+		return fmt.Errorf("the first message must contain the node identifier")
+	}
+	ma.mu.Lock()
+	ma.receivedConfigs = append(ma.receivedConfigs, in)
+	ma.mu.Unlock()
+
+	// Push down all the configs
+	for cfg := range ma.configsToSend {
+		// Push down configs
+		if err := tscs.Send(cfg); err != nil {
+			return err
+		}
+
+		// And then get back the config sent back by the client library
+		back, err := tscs.Recv()
+		if err != nil {
+			return err
+		}
+		ma.mu.Lock()
+		ma.receivedConfigs = append(ma.receivedConfigs, back)
+		ma.mu.Unlock()
+	}
+
+	// Just for the sake of draining any configs
+	// that the client-side exporter is still sending.
+	for {
+		back, err := tscs.Recv()
+		if err != nil {
+			return err
+		}
+		ma.mu.Lock()
+		ma.receivedConfigs = append(ma.receivedConfigs, back)
+		ma.mu.Unlock()
+	}
+}
+
+func (ma *mockAgent) Export(tses agenttracepb.TraceService_ExportServer) error {
+	in, err := tses.Recv()
+	if err != nil {
+		return err
+	}
+
+	ma.mu.Lock()
+	ma.wg.Add(1)
+	ma.mu.Unlock()
+	defer func() {
+		ma.mu.Lock()
+		ma.wg.Done()
+		ma.mu.Unlock()
+	}()
+
+	// The first trace message should contain the node identifier.
+	if in == nil || in.Node == nil {
+		return fmt.Errorf("the first message must contain the node identifier")
+	}
+	ma.mu.Lock()
+	ma.traceStreams++
+	ma.recordStreamPeerLocked(tses.Context())
+	ma.traceNodes = append(ma.traceNodes, in.Node)
+	if md, ok := metadata.FromIncomingContext(tses.Context()); ok {
+		ma.userAgents = append(ma.userAgents, md.Get("user-agent")...)
+		ma.apiKeys = append(ma.apiKeys, md.Get("x-api-key")...)
+	}
+	ma.mu.Unlock()
+
+	ma.mu.Lock()
+	idleTimeout := ma.idleTimeout
+	ma.mu.Unlock()
+	if idleTimeout > 0 {
+		return ma.receiveSpansUntilIdle(tses, idleTimeout)
+	}
+
+	// Now that we have the node identifier, let's start receiving spans.
+	for {
+		req, err := tses.Recv()
+		if err != nil {
+			return err
+		}
+		ma.recordTraceRequest(req)
+	}
+}
+
+func (ma *mockAgent) recordTraceRequest(req *agenttracepb.ExportTraceServiceRequest) {
+	ma.mu.Lock()
+	ma.spans = append(ma.spans, req.Spans...)
+	ma.traceNodes = append(ma.traceNodes, req.Node)
+	ma.mu.Unlock()
+}
+
+// receiveSpansUntilIdle receives spans like Export does, but ends the
+// stream once nothing has been received on it for idleTimeout, like a proxy
+// reaping idle streams would.
+func (ma *mockAgent) receiveSpansUntilIdle(tses agenttracepb.TraceService_ExportServer, idleTimeout time.Duration) error {
+	ctx := tses.Context()
+	reqs := make(chan *agenttracepb.ExportTraceServiceRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := tses.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case req := <-reqs:
+			ma.recordTraceRequest(req)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(idleTimeout)
+		case err := <-errs:
+			return err
+		case <-idle.C:
+			ma.mu.Lock()
+			ma.idleCloses++
+			ma.mu.Unlock()
+			return fmt.Errorf("the stream was idle for %v", idleTimeout)
+		}
+	}
+}
+
+func (ma *mockAgent) ExportSpan(eses exporterpb.Export_ExportSpanServer) error {
+	for {
+		if _, err := eses.Recv(); err != nil {
+			return err
+		}
+	}
+}
+
+func (ma *mockAgent) ExportMetrics(emes exporterpb.Export_ExportMetricsServer) error {
+	ma.mu.Lock()
+	ma.recordStreamPeerLocked(emes.Context())
+	ma.mu.Unlock()
+	for {
+		req, err := emes.Recv()
+		if err != nil {
+			return err
+		}
+		ma.mu.Lock()
+		ma.metrics = append(ma.metrics, req.Metrics...)
+		ma.mu.Unlock()
+	}
+}
+
+func (ma *mockAgent) recordStreamPeerLocked(ctx context.Context) {
+	if p, ok := peer.FromContext(ctx); ok {
+		ma.streamPeers = append(ma.streamPeers, p.Addr.String())
+	}
+}
+
+func (ma *mockAgent) transitionToReceivingClientConfigs() {
+	// Since we are done sending all the configs, close the configsChannel
+	// so that the state can transition to receiving all the client configs.
+	ma.closeConfigsToSendOnce.Do(func() {
+		close(ma.configsToSend)
+	})
+}
+
+var errAlreadyStopped = fmt.Errorf("already stopped")
+
+func (ma *mockAgent) stop() error {
+	var err = errAlreadyStopped
+	ma.stopOnce.Do(func() {
+		ma.transitionToReceivingClientConfigs()
+
+		if ma.stopFunc != nil {
+			err = ma.stopFunc()
+		}
+	})
+	// Give it sometime to shutdown.
+	<-time.After(160 * time.Millisecond)
+	ma.mu.Lock()
+	ma.wg.Wait()
+	ma.mu.Unlock()
+	return err
+}
+
+// runMockAgent is a helper function to create a mockAgent
+func runMockAgent(t *testing.T) *mockAgent {
+	return runMockAgentAtAddr(t, ":0")
+}
+
+func runMockAgentAtAddr(t *testing.T, addr string, opts ...grpc.ServerOption) *mockAgent {
+	var deferFuncs []func() error
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to get an address: %v", err)
+	}
+	deferFuncs = append(deferFuncs, ln.Close)
+
+	srv := grpc.NewServer(opts...)
+	ma := makeMockAgent(t)
+	agenttracepb.RegisterTraceServiceServer(srv, ma)
+	exporterpb.RegisterExportServer(srv, ma)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	deferFunc := func() error {
+		srv.Stop()
+		return ln.Close()
+	}
+
+	_, agentPortStr, _ := net.SplitHostPort(ln.Addr().String())
+	agentPort, _ := strconv.Atoi(agentPortStr)
+
+	ma.port = uint16(agentPort)
+	ma.stopFunc = deferFunc
+
+	return ma
+}
+
+func (ma *mockAgent) getSpans() []*tracepb.Span {
+	ma.mu.Lock()
+	spans := append([]*tracepb.Span{}, ma.spans...)
+	ma.mu.Unlock()
+
+	return spans
+}
+
+func (ma *mockAgent) getMetrics() []*metricspb.Metric {
+	ma.mu.Lock()
+	metrics := append([]*metricspb.Metric{}, ma.metrics...)
+	ma.mu.Unlock()
+
+	return metrics
+}
+
+func (ma *mockAgent) getReceivedConfigs() []*agenttracepb.CurrentLibraryConfig {
+	ma.mu.Lock()
+	receivedConfigs := append([]*agenttracepb.CurrentLibraryConfig{}, ma.receivedConfigs...)
+	ma.mu.Unlock()
+
+	return receivedConfigs
+}
+
+func (ma *mockAgent) getTraceNodes() []*commonpb.Node {
+	ma.mu.Lock()
+	traceNodes := append([]*commonpb.Node{}, ma.traceNodes...)
+	ma.mu.Unlock()
+
+	return traceNodes
+}
+
+func (ma *mockAgent) getUserAgents() []string {
+	ma.mu.Lock()
+	userAgents := append([]string{}, ma.userAgents...)
+	ma.mu.Unlock()
+
+	return userAgents
+}
+
+func (ma *mockAgent) getAPIKeys() []string {
+	ma.mu.Lock()
+	apiKeys := append([]string{}, ma.apiKeys...)
+	ma.mu.Unlock()
+
+	return apiKeys
+}
+
+func (ma *mockAgent) getTraceStreams() int {
+	ma.mu.Lock()
+	traceStreams := ma.traceStreams
+	ma.mu.Unlock()
+
+	return traceStreams
+}
+
+func (ma *mockAgent) getStreamPeers() []string {
+	ma.mu.Lock()
+	streamPeers := append([]string{}, ma.streamPeers...)
+	ma.mu.Unlock()
+
+	return streamPeers
+}
+
+func (ma *mockAgent) setIdleTimeout(d time.Duration) {
+	ma.mu.Lock()
+	ma.idleTimeout = d
+	ma.mu.Unlock()
+}
+
+func (ma *mockAgent) getIdleCloses() int {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	return ma.idleCloses
+}
@@ -0,0 +1,176 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	"go.opencensus.io"
+)
+
+func createNodeInfo(nodeName string) *commonpb.Node {
+	return &commonpb.Node{
+		Identifier: &commonpb.ProcessIdentifier{
+			HostName:       os.Getenv("HOSTNAME"),
+			Pid:            uint32(os.Getpid()),
+			StartTimestamp: timeToTimestamp(startTime),
+		},
+		LibraryInfo: &commonpb.LibraryInfo{
+			Language:           commonpb.LibraryInfo_GO_LANG,
+			ExporterVersion:    Version,
+			CoreLibraryVersion: opencensus.Version(),
+		},
+		ServiceInfo: &commonpb.ServiceInfo{
+			Name: nodeName,
+		},
+		Attributes: make(map[string]string),
+	}
+}
+
+// Detector discovers attributes describing the environment that the exporter
+// runs in, such as the cloud, the container or the Kubernetes pod, to add to
+// the Node sent to the agent.
+type Detector func(ctx context.Context) (map[string]string, error)
+
+// detectorTimeout bounds how long each Detector may take.
+const detectorTimeout = 2 * time.Second
+
+// detectAttributes runs the detectors in order and merges the attributes they
+// find, letting later detectors override earlier ones. A detector that fails
+// or times out is skipped, and is passed to onError.
+func detectAttributes(detectors []Detector, onError func(i int, err error)) map[string]string {
+	attrs := make(map[string]string)
+	for i, detect := range detectors {
+		found, err := runDetector(detect)
+		if err != nil {
+			onError(i, err)
+			continue
+		}
+		for k, v := range found {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func runDetector(detect Detector) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), detectorTimeout)
+	defer cancel()
+
+	type result struct {
+		attrs map[string]string
+		err   error
+	}
+	// Buffered, so that a detector ignoring ctx does not leak a blocked goroutine.
+	done := make(chan result, 1)
+	go func() {
+		attrs, err := detect(ctx)
+		done <- result{attrs, err}
+	}()
+	select {
+	case r := <-done:
+		return r.attrs, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ErrStableNode is returned by SetNodeAttributes when the exporter was
+// created with WithStableNodeOnly and has already been started.
+var ErrStableNode = errors.New("ocagent: the node cannot change once the exporter has started")
+
+// SetNodeAttributes adds attrs to the attributes of the Node that identifies
+// the exporter, overriding those of the same key. Once the exporter has
+// started, the new Node is sent to the agent along with the next batch of
+// spans.
+//
+// Agents may batch by Node, so the Node should change rarely and its
+// attributes should not hold per-request values such as IDs or timestamps;
+// attributes that look like such values are reported to the logger.
+func (ae *Exporter) SetNodeAttributes(attrs map[string]string) error {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	if ae.stableNodeOnly && ae.started {
+		return ErrStableNode
+	}
+	ae.warnVolatileAttributes(attrs)
+	node := proto.Clone(ae.nodeInfo).(*commonpb.Node)
+	if node.Attributes == nil {
+		node.Attributes = make(map[string]string, len(attrs))
+	}
+	for k, v := range attrs {
+		node.Attributes[k] = v
+	}
+	ae.nodeInfo = node
+	ae.streamMu.Lock()
+	ae.streamNode = node
+	if ae.started {
+		ae.pendingNode = node
+		// The uncompressed trace stream is reopened with the new Node.
+		if ae.uncompressedTraceExporter != nil {
+			ae.uncompressedTraceExporter.CloseSend()
+			ae.uncompressedTraceExporter = nil
+		}
+	}
+	ae.streamMu.Unlock()
+	return nil
+}
+
+func (ae *Exporter) warnVolatileAttributes(attrs map[string]string) {
+	for k, v := range attrs {
+		if looksVolatile(v) {
+			ae.logf("ocagent: node attribute %q=%q looks like it varies per request, which fragments batching by node on the agent", k, v)
+		}
+	}
+}
+
+// looksVolatile reports whether v looks like a value that is unique to a
+// request or an instant rather than to the process: a UUID, a long
+// hexadecimal or decimal ID, or a timestamp.
+func looksVolatile(v string) bool {
+	if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return true
+	}
+	var digits, hex, dashes int
+	for _, r := range v {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'a' && r <= 'f', r >= 'A' && r <= 'F':
+			hex++
+		case r == '-':
+			dashes++
+		default:
+			return false
+		}
+	}
+	switch {
+	case len(v) == 36 && dashes == 4:
+		// A UUID.
+		return true
+	case dashes == 0 && hex == 0:
+		return digits >= 10
+	case dashes == 0:
+		return digits > 0 && digits+hex >= 16
+	}
+	return false
+}
@@ -0,0 +1,1444 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/api/support/bundler"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+
+	agentcommonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	exporterpb "github.com/census-instrumentation/opencensus-proto/gen-go/exporter/v1"
+	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+var startupMu sync.Mutex
+var startTime time.Time
+
+func init() {
+	startupMu.Lock()
+	startTime = time.Now()
+	startupMu.Unlock()
+}
+
+var _ trace.Exporter = (*Exporter)(nil)
+var _ view.Exporter = (*Exporter)(nil)
+
+type Exporter struct {
+	// mu protects the non-atomic and non-channel variables
+	mu              sync.RWMutex
+	started         bool
+	stopped         bool
+	agentPort       uint16
+	agentAddress    string
+	serviceName     string
+	connectionName  string
+	canDialInsecure bool
+	writeBufferSize int
+	readBufferSize  int
+	compressor      string
+	noCompress      func(*trace.SpanData) bool
+	headers         map[string]string
+	nodeInfo        *agentcommonpb.Node
+	exportedViews   map[string]*view.View
+
+	// clientCredentials secure the connection to the agent, set with
+	// WithTLSCredentials.
+	clientCredentials credentials.TransportCredentials
+
+	spanConversion       spanConversion
+	metricConversion     metricConversion
+	logger               *log.Logger
+	trackQueueLatency    bool
+	trackRequestSize     bool
+	honorExportDeadlines bool
+	checkCompatibility   bool
+	exportNameMatcher    func(name string) bool
+	detectors            []Detector
+	sinks                []Sink
+	sinkDestinations     []*traceDestination
+	fallbackSink         *Sink
+	fallbackDestination  *traceDestination
+	shards               []string
+	shardDestinations    []*traceDestination
+
+	batchTimeout time.Duration
+	maxBatchSize int
+	traceBundler *bundler.Bundler
+
+	errorThreshold int
+	errorWindow    time.Duration
+	errorCooldown  time.Duration
+	breaker        *circuitBreaker
+
+	exportRetry retryPolicy
+	// retryingBatches counts the failed batches that retryInBackground is
+	// retrying, which Stop waits for with retries.
+	retryingBatches int32
+	retries         sync.WaitGroup
+
+	dropSampler   *dropSampler
+	exportSampler *exportSampler
+
+	indexedAttributes []string
+
+	selfTracer trace.Exporter
+
+	flushCoalescer *flushCoalescer
+
+	// dumpMu serializes calls to DumpQueue, which set queueDump, guarded by
+	// queueDumpMu, while they take the queued spans.
+	dumpMu      sync.Mutex
+	queueDumpMu sync.Mutex
+	queueDump   *queueDump
+
+	networkChanges   <-chan struct{}
+	idlePingInterval time.Duration
+
+	stableNodeOnly bool
+
+	localConfigPath    string
+	ignoreRemoteConfig bool
+	// localConfigStop, guarded by mu, stops the watcher of the local config
+	// file, which runs from NewUnstartedExporter until Stop.
+	localConfigStop chan struct{}
+
+	initialConfigTimeout time.Duration
+	// firstConfigApplied is closed once a trace config from the agent
+	// has been applied.
+	firstConfigApplied chan struct{}
+	firstConfigOnce    sync.Once
+
+	// configMu protects lastConfig, the trace config from the agent or the
+	// local config file that was last applied.
+	configMu   sync.Mutex
+	lastConfig *tracepb.TraceConfig
+
+	// connectMu serializes Start and the reconnects, which dial the agent
+	// without holding mu so that spans keep being queued meanwhile.
+	connectMu sync.Mutex
+
+	// streamMu protects the connection to the agent and its streams, which
+	// are replaced on reconnects while uploads may be in flight. It is
+	// separate from mu because Stop holds mu while it waits for the last
+	// upload to finish.
+	streamMu sync.Mutex
+	// stopCh is closed when the exporter is stopped.
+	stopCh          chan struct{}
+	streamConn      *grpc.ClientConn
+	connectedAt     time.Time
+	traceSvcClient  agenttracepb.TraceServiceClient
+	traceExporter   agenttracepb.TraceService_ExportClient
+	metricsExporter exporterpb.Export_ExportMetricsClient
+	// uncompressedTraceExporter is the trace stream, opened on the first
+	// batch that WithNoCompressPredicate keeps from being compressed, on
+	// which such batches are sent.
+	uncompressedTraceExporter agenttracepb.TraceService_ExportClient
+	// streamNode is nodeInfo, for the streams to be opened with.
+	streamNode *agentcommonpb.Node
+	// lastTraceSend is when a request was last sent on the trace stream.
+	lastTraceSend time.Time
+	// pendingNode is set by SetNodeAttributes to the Node to send along
+	// with the next request on the trace stream.
+	pendingNode *agentcommonpb.Node
+
+	unifiedStream bool
+	// reconnecting is set while reconnectWithBackoff runs.
+	reconnecting int32
+	// connectBackoff paces the dials to the agent and the reconnects.
+	connectBackoff connectBackoff
+
+	connState connectionStateTracker
+
+	stats  statsRecorder
+	events eventHub
+}
+
+// NewExporter creates an exporter and connects it to the agent. It behaves
+// exactly like NewExporterBlocking: it returns once the connection is up,
+// or with an error if the agent can't be reached.
+//
+// Deprecated: whether NewExporter waits for the agent may change. Use
+// NewExporterBlocking to keep failing fast when the agent is down, or
+// NewUnstartedExporter and Start to construct the exporter without waiting
+// for the agent.
+func NewExporter(opts ...ExporterOption) (*Exporter, error) {
+	return NewExporterBlocking(opts...)
+}
+
+// NewExporterBlocking creates an exporter and synchronously connects it to
+// the agent, returning an error, and no exporter, if the agent can't be
+// reached after Start's retries.
+func NewExporterBlocking(opts ...ExporterOption) (*Exporter, error) {
+	exp, err := NewUnstartedExporter(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := exp.Start(); err != nil {
+		exp.mu.Lock()
+		exp.stopLocalConfigWatcherLocked()
+		exp.mu.Unlock()
+		return nil, err
+	}
+	return exp, nil
+}
+
+const (
+	spanDataBufferSize  = 300
+	defaultBatchTimeout = 2 * time.Second
+)
+
+// NewUnstartedExporter creates an exporter without connecting it to the
+// agent, so it returns right away even if the agent is unreachable. Spans
+// can be exported once it is created but are only sent after Start has
+// connected, which callers that must not wait for the agent can run in a
+// goroutine.
+func NewUnstartedExporter(opts ...ExporterOption) (*Exporter, error) {
+	e := new(Exporter)
+	for _, opt := range opts {
+		opt.withExporter(e)
+	}
+	if e.agentPort <= 0 {
+		e.agentPort = DefaultAgentPort
+	}
+	if e.compressor != "" && e.compressor != "gzip" {
+		return nil, fmt.Errorf("ocagent: unknown compressor %q, only gzip is supported", e.compressor)
+	}
+	e.batchTimeout = defaultBatchTimeout
+	e.maxBatchSize = spanDataBufferSize
+	e.traceBundler = e.newTraceBundler()
+	if e.errorThreshold > 0 {
+		cooldown := e.errorCooldown
+		if cooldown <= 0 {
+			cooldown = e.errorWindow
+		}
+		e.breaker = newCircuitBreaker(e.errorThreshold, e.errorWindow, cooldown)
+	}
+	e.firstConfigApplied = make(chan struct{})
+	e.spanConversion.stats = &e.stats
+	e.metricConversion.stats = &e.stats
+	e.stats.events = &e.events
+	e.nodeInfo = createNodeInfo(e.serviceName)
+	if len(e.detectors) > 0 {
+		attrs := detectAttributes(e.detectors, func(i int, err error) {
+			e.logf("ocagent: skipping resource detector %d: %v", i, err)
+		})
+		for k, v := range attrs {
+			e.nodeInfo.Attributes[k] = v
+		}
+		e.warnVolatileAttributes(attrs)
+	}
+	e.streamNode = e.nodeInfo
+	e.startLocalConfigWatcherLocked()
+	if len(e.indexedAttributes) > 0 {
+		e.logf("ocagent: ignoring the indexed attributes %q: the span proto has no field for indexed attributes, they are exported as regular attributes only", e.indexedAttributes)
+	}
+	return e, nil
+}
+
+func (ae *Exporter) newTraceBundler() *bundler.Bundler {
+	traceBundler := bundler.NewBundler((*queuedSpan)(nil), func(bundle interface{}) {
+		ae.uploadTraces(bundle.([]*queuedSpan))
+	})
+	traceBundler.DelayThreshold = ae.batchTimeout
+	traceBundler.BundleCountThreshold = ae.maxBatchSize
+	return traceBundler
+}
+
+// SetBatchTimeout changes how long spans are buffered before they are
+// uploaded to the agent. The new timeout applies from the next batch on;
+// spans that are already buffered are uploaded right away rather than lost.
+// Non-positive durations are ignored.
+func (ae *Exporter) SetBatchTimeout(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	ae.mu.Lock()
+	ae.batchTimeout = d
+	ae.mu.Unlock()
+	ae.swapTraceBundler()
+}
+
+// SetMaxBatchSize changes the maximum number of spans uploaded in a single
+// batch. Like SetBatchTimeout, it takes effect from the next batch on.
+// Non-positive sizes are ignored.
+func (ae *Exporter) SetMaxBatchSize(n int) {
+	if n <= 0 {
+		return
+	}
+	ae.mu.Lock()
+	ae.maxBatchSize = n
+	ae.mu.Unlock()
+	ae.swapTraceBundler()
+}
+
+// swapTraceBundler replaces the running bundler with one built from the
+// current batching settings, then flushes the old one so that no queued
+// spans are dropped during the switch.
+func (ae *Exporter) swapTraceBundler() {
+	ae.mu.Lock()
+	old := ae.traceBundler
+	ae.traceBundler = ae.newTraceBundler()
+	ae.mu.Unlock()
+
+	old.Flush()
+}
+
+const (
+	maxInitialConfigRetries = 10
+	maxInitialTracesRetries = 10
+)
+
+// Start dials to the agent, establishing a connection to it. It also
+// initiates the Config and Trace services by sending over the initial
+// messages that consist of the node identifier. Start performs a best case
+// attempt to try to send the initial messages, by applying exponential
+// backoff at most 10 times. With WithWaitForInitialConfig, Start then also
+// waits for the first trace config from the agent to be applied.
+func (ae *Exporter) Start() error {
+	ae.connectMu.Lock()
+	defer ae.connectMu.Unlock()
+
+	ae.mu.RLock()
+	started := ae.started
+	ae.mu.RUnlock()
+	if started {
+		return nil
+	}
+	conn, err := ae.connect()
+
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	if err == nil {
+		ae.installConnection(conn, nil)
+		err = ae.connectSinksLocked()
+	}
+	if err == nil {
+		err = ae.connectShardsLocked()
+	}
+	if err == nil {
+		err = ae.connectFallbackLocked()
+	}
+	if err == nil {
+		ae.started = true
+		// Stop closed the events and stopped the exports, if this is a restart.
+		ae.stopped = false
+		ae.events.reopen()
+		stop := make(chan struct{})
+		ae.streamMu.Lock()
+		ae.stopCh = stop
+		ae.streamMu.Unlock()
+		if ae.networkChanges != nil {
+			go ae.watchNetworkChanges(ae.networkChanges, stop)
+		}
+		if ae.idlePingInterval > 0 {
+			go ae.keepStreamActive(ae.idlePingInterval, stop)
+		}
+		// Watching again after a restart.
+		ae.startLocalConfigWatcherLocked()
+		if ae.initialConfigTimeout > 0 {
+			ae.waitForFirstConfig(ae.initialConfigTimeout)
+		}
+		return nil
+	}
+
+	// Otherwise we have an error and should clean up to avoid leaking resources.
+	ae.started = false
+	ae.streamMu.Lock()
+	if ae.streamConn != nil {
+		ae.streamConn.Close()
+		ae.streamConn = nil
+		ae.connState.track(nil)
+		ae.connState.set(Disconnected)
+	}
+	ae.streamMu.Unlock()
+	ae.closeSinksLocked()
+	ae.closeShardsLocked()
+	ae.closeFallbackLocked()
+
+	return err
+}
+
+func (ae *Exporter) prepareAgentAddress() string {
+	if ae.agentAddress != "" {
+		return ae.agentAddress
+	}
+	port := DefaultAgentPort
+	if ae.agentPort > 0 {
+		port = ae.agentPort
+	}
+	return fmt.Sprintf("%s:%d", DefaultAgentHost, port)
+}
+
+// agentConnection is a connection to the agent on which the Trace and
+// Config services have been initiated.
+type agentConnection struct {
+	cc             *grpc.ClientConn
+	node           *agentcommonpb.Node
+	traceSvcClient agenttracepb.TraceServiceClient
+	traceExporter  agenttracepb.TraceService_ExportClient
+	configStream   agenttracepb.TraceService_ConfigClient
+}
+
+// connect dials the agent and initiates the Trace and Config services on
+// the new connection, which installConnection then makes the current one.
+// It takes neither mu nor streamMu while it dials, which may take seconds.
+func (ae *Exporter) connect() (*agentConnection, error) {
+	ae.streamMu.Lock()
+	node := ae.streamNode
+	ae.streamMu.Unlock()
+
+	ae.connState.set(Connecting)
+	cc, err := ae.dialToAgent(ae.prepareAgentAddress())
+	if err != nil {
+		ae.connState.set(Disconnected)
+		return nil, err
+	}
+	if ae.checkCompatibility {
+		if err := checkAgentCompatibility(cc); err != nil {
+			cc.Close()
+			ae.connState.set(Disconnected)
+			return nil, err
+		}
+	}
+
+	// Initiate the trace service by sending over node identifier info.
+	traceSvcClient := agenttracepb.NewTraceServiceClient(cc)
+	traceExporter, err := traceSvcClient.Export(context.Background())
+	if err != nil {
+		cc.Close()
+		return nil, fmt.Errorf("Exporter.Start:: TraceServiceClient: %v", err)
+	}
+
+	firstTraceMessage := &agenttracepb.ExportTraceServiceRequest{Node: node}
+	err = nTriesWithExponentialBackoff(maxInitialTracesRetries, 200*time.Microsecond, func() error {
+		return traceExporter.Send(firstTraceMessage)
+	})
+	if err != nil {
+		cc.Close()
+		return nil, fmt.Errorf("Exporter.Start:: Failed to initiate the Config service: %v", err)
+	}
+
+	// Initiate the config service by sending over node identifier info.
+	configStream, err := traceSvcClient.Config(context.Background())
+	if err != nil {
+		cc.Close()
+		return nil, fmt.Errorf("Exporter.Start:: ConfigStream: %v", err)
+	}
+	firstCfgMessage := &agenttracepb.CurrentLibraryConfig{Node: node}
+	err = nTriesWithExponentialBackoff(maxInitialConfigRetries, 200*time.Microsecond, func() error {
+		return configStream.Send(firstCfgMessage)
+	})
+	if err != nil {
+		cc.Close()
+		return nil, fmt.Errorf("Exporter.Start:: Failed to initiate the Config service: %v", err)
+	}
+
+	return &agentConnection{
+		cc:             cc,
+		node:           node,
+		traceSvcClient: traceSvcClient,
+		traceExporter:  traceExporter,
+		configStream:   configStream,
+	}, nil
+}
+
+// installConnection makes conn the connection to the agent, in place of the
+// one it returns, unless the exporter was started or stopped since stop was
+// its stopCh, in which case conn is closed instead and ok is false.
+func (ae *Exporter) installConnection(conn *agentConnection, stop chan struct{}) (old *grpc.ClientConn, ok bool) {
+	ae.streamMu.Lock()
+	if ae.stopCh != stop {
+		ae.streamMu.Unlock()
+		conn.cc.Close()
+		return nil, false
+	}
+	old = ae.streamConn
+	ae.streamConn = conn.cc
+	ae.connectedAt = time.Now()
+	ae.traceSvcClient = conn.traceSvcClient
+	ae.traceExporter = conn.traceExporter
+	ae.lastTraceSend = time.Now()
+	if ae.streamNode != conn.node {
+		// SetNodeAttributes was called while dialing.
+		ae.pendingNode = ae.streamNode
+	}
+	// The metrics and uncompressed trace streams are lazily reopened on the
+	// new connection.
+	ae.metricsExporter = nil
+	ae.uncompressedTraceExporter = nil
+	// Tracked before the old connection's watcher can see it closed.
+	ae.connState.track(conn.cc)
+	ae.streamMu.Unlock()
+
+	go ae.watchConnectivity(conn.cc)
+	// In the background, handle trace configurations that are beamed down
+	// by the agent, but also reply to it with the applied configuration.
+	go ae.handleConfigStreaming(conn.configStream)
+	return old, true
+}
+
+// compatibilityProbeTimeout is how long checkAgentCompatibility waits for
+// the server to reject the trace service.
+const compatibilityProbeTimeout = 200 * time.Millisecond
+
+// checkAgentCompatibility verifies that the server at the other end of cc
+// serves the agent's trace service, by opening a trace stream on which
+// nothing is sent. A server without the service rejects it right away as
+// unimplemented. An agent waits for the first message instead, until the
+// probe gives up; so does a server that can't tell, which is let through.
+func checkAgentCompatibility(cc *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), compatibilityProbeTimeout)
+	defer cancel()
+
+	stream, err := agenttracepb.NewTraceServiceClient(cc).Export(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("Exporter.Start:: %s does not serve the OpenCensus agent trace service, is it the agent's address? %v", cc.Target(), err)
+	}
+	return nil
+}
+
+// reconnect replaces the connection to the agent with a freshly dialed one,
+// then closes the old connection. If the agent can't be reached, the old
+// connection is kept.
+func (ae *Exporter) reconnect() error {
+	ae.connectMu.Lock()
+	defer ae.connectMu.Unlock()
+
+	return ae.reconnectSerialized()
+}
+
+// reconnectSerialized is reconnect for callers holding connectMu. Uploads
+// and ExportSpan carry on over the old connection while it dials.
+func (ae *Exporter) reconnectSerialized() error {
+	ae.streamMu.Lock()
+	stop := ae.stopCh
+	ae.streamMu.Unlock()
+	if stop == nil {
+		return errNotStarted
+	}
+	conn, err := ae.connect()
+	if err != nil {
+		return err
+	}
+	oldConn, ok := ae.installConnection(conn, stop)
+	if !ok {
+		return errNotStarted
+	}
+	if oldConn != nil {
+		oldConn.Close()
+	}
+	ae.events.publish(Event{Type: EventReconnected})
+	return nil
+}
+
+// ForceReconnectIfStale reconnects to the agent, as if by a network change
+// signal, if the current connection was made more than maxAge ago, and
+// reports whether it did. Calling it periodically spreads exporters across
+// the agent's replicas after they are redeployed, without cycling
+// connections that were just made.
+func (ae *Exporter) ForceReconnectIfStale(maxAge time.Duration) (bool, error) {
+	ae.connectMu.Lock()
+	defer ae.connectMu.Unlock()
+
+	ae.streamMu.Lock()
+	fresh := ae.stopCh != nil && time.Since(ae.connectedAt) <= maxAge
+	ae.streamMu.Unlock()
+	if fresh {
+		return false, nil
+	}
+	if err := ae.reconnectSerialized(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// splitMetrics separates the metrics queued with WithUnifiedStream from
+// the spans.
+func splitMetrics(qsl []*queuedSpan) ([]*queuedSpan, []*metricspb.Metric) {
+	var metrics []*metricspb.Metric
+	spans := qsl[:0]
+	for _, qs := range qsl {
+		if qs.metric != nil {
+			metrics = append(metrics, qs.metric)
+		} else {
+			spans = append(spans, qs)
+		}
+	}
+	return spans, metrics
+}
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+)
+
+// reconnectInBackground starts reconnectWithBackoff, unless it is running
+// already. It must neither reconnect synchronously nor take mu, since it is
+// called from uploads that Stop may be waiting for while holding mu.
+func (ae *Exporter) reconnectInBackground() {
+	ae.streamMu.Lock()
+	stop := ae.stopCh
+	ae.streamMu.Unlock()
+	if stop == nil || !atomic.CompareAndSwapInt32(&ae.reconnecting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&ae.reconnecting, 0)
+		ae.reconnectWithBackoff(stop)
+	}()
+}
+
+// reconnectWithBackoff reconnects to the agent, retrying with exponential
+// backoff until it succeeds or the exporter is stopped.
+//
+// With WithMaxRetryDuration, it gives up once that long has passed; the
+// next upload that fails starts it over.
+func (ae *Exporter) reconnectWithBackoff(stop <-chan struct{}) {
+	backoff := ae.connectBackoff.initialOr(minReconnectBackoff)
+	maxBackoff := ae.connectBackoff.maxOr(maxReconnectBackoff)
+	var deadline time.Time
+	if ae.connectBackoff.maxElapsed > 0 {
+		deadline = time.Now().Add(ae.connectBackoff.maxElapsed)
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		err := ae.reconnect()
+		if err == nil || err == errNotStarted {
+			return
+		}
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			ae.logf("ocagent: failed to reconnect to the agent, giving up after %v: %v", ae.connectBackoff.maxElapsed, err)
+			return
+		}
+		ae.logf("ocagent: failed to reconnect to the agent, retrying in %v: %v", backoff, err)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// watchNetworkChanges reconnects to the agent every time the caller signals
+// a network change, until the exporter is stopped or changes is closed.
+func (ae *Exporter) watchNetworkChanges(changes <-chan struct{}, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+			if err := ae.reconnect(); err != nil && err != errNotStarted {
+				ae.logf("ocagent: failed to reconnect after a network change: %v", err)
+			}
+		}
+	}
+}
+
+// dialToAgent performs a best case attempt to dial to the agent at addr.
+// It retries failed dials with:
+//  * gRPC dialTimeout of 1s
+//  * exponential backoff, 5 times with a period of 50ms
+// hence in the worst case of (no agent actually available), it
+// will take at least:
+//      (5 * 1s) + ((1<<5)-1) * 0.05 s = 5s + 1.55s = 6.55s
+// unless WithReconnectBackoff or WithMaxRetryDuration change that.
+func (ae *Exporter) dialToAgent(addr string) (*grpc.ClientConn, error) {
+	dialOpts := ae.dialOptions()
+	if ae.connectBackoff != (connectBackoff{}) {
+		return ae.connectBackoff.dial(addr, dialOpts)
+	}
+
+	var cc *grpc.ClientConn
+	dialBackoffWaitPeriod := 50 * time.Millisecond
+	err := nTriesWithExponentialBackoff(5, dialBackoffWaitPeriod, func() error {
+		var err error
+		cc, err = grpc.Dial(addr, dialOpts...)
+		return err
+	})
+	return cc, err
+}
+
+func (ae *Exporter) dialOptions() []grpc.DialOption {
+	dialOpts := []grpc.DialOption{grpc.WithBlock()}
+	if ae.clientCredentials != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(ae.clientCredentials))
+	} else if ae.canDialInsecure {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	if name := ae.connectionDisplayName(); name != "" {
+		dialOpts = append(dialOpts, grpc.WithUserAgent(name))
+	}
+	if ae.writeBufferSize > 0 {
+		dialOpts = append(dialOpts, grpc.WithWriteBufferSize(ae.writeBufferSize))
+	}
+	if ae.readBufferSize > 0 {
+		dialOpts = append(dialOpts, grpc.WithReadBufferSize(ae.readBufferSize))
+	}
+	if ae.compressor == "gzip" {
+		dialOpts = append(dialOpts, grpc.WithCompressor(grpc.NewGZIPCompressor()))
+	}
+	if len(ae.headers) > 0 {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(headerCredentials(ae.headers)))
+	}
+	return append(dialOpts, grpc.WithTimeout(1*time.Second))
+}
+
+// connectionDisplayName is the name that the exporter's gRPC connection is
+// identified by: the one set with WithConnectionName, or else the service name.
+func (ae *Exporter) connectionDisplayName() string {
+	if ae.connectionName != "" {
+		return ae.connectionName
+	}
+	return ae.serviceName
+}
+
+func (ae *Exporter) handleConfigStreaming(configStream agenttracepb.TraceService_ConfigClient) error {
+	var appliedConfig *tracepb.TraceConfig
+	for {
+		recv, err := configStream.Recv()
+		if err != nil {
+			// TODO: Check if this is a transient error or exponential backoff-able.
+			return err
+		}
+		cfg := recv.Config
+		if cfg == nil {
+			continue
+		}
+
+		// Otherwise now apply the trace configuration sent down from the agent.
+		// A config that can't be applied is skipped, rather than ending the
+		// stream, so that later configs from the agent still get through.
+		if ae.ignoreRemoteConfig {
+			// Still answer, so that the agent doesn't wait on us.
+		} else if err := applyTraceConfig(cfg); err != nil {
+			ae.stats.recordConfigError()
+			ae.logf("ocagent: skipping trace config from the agent: %v", err)
+		} else {
+			appliedConfig = &tracepb.TraceConfig{Sampler: cfg.Sampler}
+			ae.configMu.Lock()
+			ae.lastConfig = cfg
+			ae.configMu.Unlock()
+			ae.firstConfigOnce.Do(func() { close(ae.firstConfigApplied) })
+			ae.events.publish(Event{Type: EventConfigApplied, Config: appliedConfig})
+		}
+
+		// Then finally send back to upstream the configuration now in effect
+		err = configStream.Send(&agenttracepb.CurrentLibraryConfig{Config: appliedConfig})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReapplyCurrentConfig applies the trace config most recently received from
+// the agent, or loaded from the file given to WithLocalConfigFile, again,
+// restoring its sampling decisions after something else in the process
+// changed the global trace config. It returns an error if no config has
+// been received yet.
+func (ae *Exporter) ReapplyCurrentConfig() error {
+	ae.configMu.Lock()
+	cfg := ae.lastConfig
+	ae.configMu.Unlock()
+
+	if cfg == nil {
+		return errNoConfig
+	}
+	return applyTraceConfig(cfg)
+}
+
+// waitForFirstConfig blocks until the first trace config from the agent has
+// been applied, or until timeout, whichever comes first.
+func (ae *Exporter) waitForFirstConfig(timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-ae.firstConfigApplied:
+	case <-t.C:
+		ae.logf("ocagent: no trace config from the agent within %v, starting without one", timeout)
+	}
+}
+
+func applyTraceConfig(cfg *tracepb.TraceConfig) error {
+	if psamp := cfg.GetProbabilitySampler(); psamp != nil {
+		p := psamp.SamplingProbability
+		if p < 0 || p > 1 {
+			return fmt.Errorf("sampling probability %v is outside of [0, 1]", p)
+		}
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(p)})
+	} else if csamp := cfg.GetConstantSampler(); csamp != nil {
+		alwaysSample := csamp.Decision == true
+		if alwaysSample {
+			trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+		} else {
+			trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+		}
+	} else { // TODO: Add the rate limiting sampler here
+	}
+	return nil
+}
+
+func (ae *Exporter) logf(format string, args ...interface{}) {
+	if ae.logger != nil {
+		ae.logger.Printf(format, args...)
+	}
+}
+
+var (
+	errNotStarted = errors.New("not started")
+	errNoConfig   = errors.New("no trace config received")
+)
+
+// Stop shuts down all the connections and resources
+// related to the exporter.
+func (ae *Exporter) Stop() error {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	// The local config file is watched even if the exporter never started.
+	ae.stopLocalConfigWatcherLocked()
+	if !ae.started {
+		return errNotStarted
+	}
+	if ae.stopped {
+		// TODO: tell the user that we've already stopped, so perhaps a sentinel error?
+		return nil
+	}
+
+	ae.streamMu.Lock()
+	if ae.stopCh != nil {
+		close(ae.stopCh)
+		ae.stopCh = nil
+	}
+	ae.streamMu.Unlock()
+	ae.traceBundler.Flush()
+	// Then wait for the failed batches being retried, which stopping hurries.
+	ae.retries.Wait()
+
+	// Leave a record of everything that was discarded over the exporter's
+	// lifetime, now that the final batch has been uploaded.
+	if summary := ae.stats.snapshot().dropSummary(); summary != "" {
+		ae.logf("ocagent: %s", summary)
+	}
+
+	// Now close the underlying gRPC connection.
+	var err error
+	ae.streamMu.Lock()
+	if ae.streamConn != nil {
+		err = ae.streamConn.Close()
+	}
+	ae.streamConn = nil
+	ae.metricsExporter = nil
+	ae.uncompressedTraceExporter = nil
+	ae.streamMu.Unlock()
+	ae.closeSinksLocked()
+	ae.closeShardsLocked()
+	ae.closeFallbackLocked()
+	ae.connState.track(nil)
+	ae.connState.set(Disconnected)
+	ae.events.close()
+
+	// At this point we can change the state variables: started and stopped
+	ae.started = false
+	ae.stopped = true
+
+	return err
+}
+
+// queuedSpan is a span waiting in the bundler to be uploaded. It holds
+// either SpanData still to be converted or an already built proto Span.
+// With WithUnifiedStream, it can also hold a metric instead.
+type queuedSpan struct {
+	sd     *trace.SpanData
+	proto  *tracepb.Span
+	metric *metricspb.Metric
+	// forcedClose marks the spans of ExportOpenSpans, which get
+	// ForcedCloseAttributeKey once converted.
+	forcedClose bool
+	// enqueuedAt is only set when queue latency tracking is enabled.
+	enqueuedAt time.Time
+}
+
+func (ae *Exporter) ExportSpan(sd *trace.SpanData) {
+	ae.exportQueuedSpan(&queuedSpan{sd: sd})
+}
+
+// exportQueuedSpan queues qs, which holds SpanData, unless it is dropped.
+func (ae *Exporter) exportQueuedSpan(qs *queuedSpan) {
+	sd := qs.sd
+	if isMalformedSpanData(sd) {
+		ae.dropSpan(sd, DropReasonMalformed)
+		return
+	}
+	if ae.exportNameMatcher != nil && !ae.exportNameMatcher(sd.Name) {
+		ae.dropSpan(sd, DropReasonNameNotAllowed)
+		return
+	}
+	if ae.exportSampler != nil && !ae.exportSampler.sample(sd.TraceID) {
+		ae.dropSpan(sd, DropReasonNotSampled)
+		return
+	}
+	if ae.trackQueueLatency {
+		qs.enqueuedAt = time.Now()
+	}
+	// Stop holds mu until it is done, so a span is either queued before
+	// Stop flushes the queue, or seen here as exported after Stop.
+	ae.mu.RLock()
+	defer ae.mu.RUnlock()
+	if ae.stopped {
+		ae.dropSpan(sd, DropReasonStopped)
+		return
+	}
+	_ = ae.traceBundler.Add(qs, 1)
+}
+
+// ExportNow queues sd like ExportSpan does, then has the current batch,
+// including sd, sent to the agent right away instead of when the batch
+// timeout expires. It does not wait for the batch to be sent.
+func (ae *Exporter) ExportNow(sd *trace.SpanData) {
+	ae.ExportSpan(sd)
+	go ae.Flush()
+}
+
+// ForcedCloseAttributeKey is the boolean span attribute that marks the spans
+// passed to ExportOpenSpans, whose end time was set by the exporter rather
+// than by the span ending.
+const ForcedCloseAttributeKey = ReservedAttributePrefix + "forced_close"
+
+// ExportOpenSpans exports spans that have not ended yet, such as the ones
+// still in flight when the application shuts down, so that they are not
+// lost. Each span is exported with ForcedCloseAttributeKey set and, unless
+// it has a valid one already, an end time of now. The SpanData passed in
+// are not modified. Call it before Stop, which uploads the queued spans.
+func (ae *Exporter) ExportOpenSpans(spans []*trace.SpanData) {
+	now := time.Now()
+	for _, sd := range spans {
+		if isMalformedSpanData(sd) {
+			ae.dropSpan(sd, DropReasonMalformed)
+			continue
+		}
+		closed := *sd
+		if closed.EndTime.IsZero() || closed.EndTime.Before(closed.StartTime) {
+			closed.EndTime = now
+		}
+		ae.exportQueuedSpan(&queuedSpan{sd: &closed, forcedClose: true})
+	}
+}
+
+// isMalformedSpanData reports whether sd is nil or empty, i.e. it has
+// neither a name, a span context nor timestamps, so there is nothing in it
+// worth sending to the agent.
+func isMalformedSpanData(sd *trace.SpanData) bool {
+	if sd == nil {
+		return true
+	}
+	return sd.Name == "" && sd.SpanContext == (trace.SpanContext{}) &&
+		sd.StartTime.IsZero() && sd.EndTime.IsZero()
+}
+
+// ExportProtoSpans queues already built proto Spans for upload, bypassing the
+// conversion from SpanData. The spans are batched and sent to the agent just
+// like the ones passed to ExportSpan; nil spans are skipped and counted as
+// malformed.
+func (ae *Exporter) ExportProtoSpans(ctx context.Context, spans []*tracepb.Span) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ae.mu.RLock()
+	defer ae.mu.RUnlock()
+
+	if !ae.started {
+		return errNotStarted
+	}
+	for _, span := range spans {
+		if span == nil {
+			ae.stats.recordDropped(DropReasonMalformed, 1)
+			continue
+		}
+		qs := &queuedSpan{proto: span}
+		if ae.trackQueueLatency {
+			qs.enqueuedAt = time.Now()
+		}
+		if err := ae.traceBundler.Add(qs, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ae *Exporter) uploadTraces(qsl []*queuedSpan) {
+	if ae.unifiedStream {
+		var metrics []*metricspb.Metric
+		qsl, metrics = splitMetrics(qsl)
+		if len(metrics) > 0 {
+			if err := ae.uploadMetrics(metrics); err != nil {
+				ae.reconnectInBackground()
+			}
+		}
+	}
+	if qd := ae.currentQueueDump(); qd != nil && qd.dump(func() []*tracepb.Span {
+		return ae.dropInvalidIDs(ae.toProtoSpans(qsl))
+	}) {
+		return
+	}
+	if ae.honorExportDeadlines {
+		qsl = ae.dropStale(qsl, time.Now())
+	}
+	if len(qsl) == 0 {
+		return
+	}
+	if ae.breaker != nil && !ae.breaker.allow() {
+		if !ae.sendToFallback(qsl) {
+			ae.dropQueuedSpans(qsl, DropReasonCircuitOpen)
+		}
+		return
+	}
+	uncompressed := ae.skipsCompression(qsl)
+	protoSpans := ae.dropInvalidIDs(ae.toProtoSpans(qsl))
+	if len(protoSpans) == 0 {
+		// Nothing is sent, so the breaker's probe, if this was one, isn't made.
+		if ae.breaker != nil {
+			ae.breaker.cancel()
+		}
+		return
+	}
+	req := &agenttracepb.ExportTraceServiceRequest{Spans: protoSpans}
+	if ae.trackRequestSize {
+		ae.stats.recordRequestBytes(StreamTypeTrace, proto.Size(req))
+	}
+	sendStart := time.Now()
+	err := ae.sendTraces(req, uncompressed)
+	ae.mirrorToSinks(req)
+	if err != nil && ae.exportRetry.retries > 0 && ae.retryInBackground(qsl, req, uncompressed, sendStart, err) {
+		return
+	}
+	ae.recordUpload(qsl, req, sendStart, err)
+}
+
+// retryInBackground retries sending req, which failed with err, away from
+// the bundler's goroutine so that the waits between the attempts don't hold
+// up the batches behind it, then records the upload. It reports false,
+// leaving the batch to fail, if too many batches are being retried already.
+func (ae *Exporter) retryInBackground(qsl []*queuedSpan, req *agenttracepb.ExportTraceServiceRequest, uncompressed bool, sendStart time.Time, err error) bool {
+	if atomic.AddInt32(&ae.retryingBatches, 1) > maxRetryingBatches {
+		atomic.AddInt32(&ae.retryingBatches, -1)
+		return false
+	}
+	ae.streamMu.Lock()
+	stop := ae.stopCh
+	ae.streamMu.Unlock()
+	if stop == nil {
+		// The exporter is stopping, or not started: try once more right away.
+		stop = closedChan
+	}
+	ae.retries.Add(1)
+	go func() {
+		defer ae.retries.Done()
+		defer atomic.AddInt32(&ae.retryingBatches, -1)
+		err := ae.exportRetry.retry(err, func() error {
+			// A stream on which a send failed is broken for good.
+			if err := ae.reopenTraceStream(uncompressed); err != nil {
+				ae.reconnectInBackground()
+				return err
+			}
+			return ae.sendTraces(req, uncompressed)
+		}, stop)
+		ae.recordUpload(qsl, req, sendStart, err)
+	}()
+	return true
+}
+
+// closedChan is a closed channel, for stop channels that are done already.
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// reopenTraceStream replaces the trace stream that uploads go over, the
+// uncompressed one if uncompressed is set, with a new one on the current
+// connection to the agent.
+func (ae *Exporter) reopenTraceStream(uncompressed bool) error {
+	if len(ae.shardDestinations) > 0 {
+		return nil
+	}
+	ae.streamMu.Lock()
+	defer ae.streamMu.Unlock()
+
+	if ae.streamConn == nil {
+		return errNotStarted
+	}
+	if uncompressed {
+		// Reopened by the next send.
+		ae.uncompressedTraceExporter = nil
+		return nil
+	}
+	stream, err := agenttracepb.NewTraceServiceClient(ae.streamConn).Export(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&agenttracepb.ExportTraceServiceRequest{Node: ae.streamNode}); err != nil {
+		return err
+	}
+	ae.traceExporter = stream
+	ae.pendingNode = nil
+	return nil
+}
+
+// recordUpload records the outcome of sending the batch qsl as req.
+func (ae *Exporter) recordUpload(qsl []*queuedSpan, req *agenttracepb.ExportTraceServiceRequest, sendStart time.Time, err error) {
+	if ae.selfTracer != nil && !isSelfTraceBatch(qsl) {
+		ae.selfTrace(sendStart, len(req.Spans), err)
+	}
+	if err != nil && ae.unifiedStream {
+		ae.reconnectInBackground()
+	}
+	ae.stats.recordExport(err)
+	if ae.breaker != nil {
+		ae.breaker.recordResult(err)
+	}
+	if err == nil && ae.trackQueueLatency {
+		sentAt := time.Now()
+		for _, qs := range qsl {
+			ae.stats.recordQueueLatency(sentAt.Sub(qs.enqueuedAt))
+		}
+	}
+}
+
+// dropInvalidIDs filters out, and counts, the spans whose IDs don't have
+// the lengths that the agent expects, which remapped IDs or spans built by
+// callers of ExportProtoSpans could lack. A root span may have no parent ID.
+func (ae *Exporter) dropInvalidIDs(spans []*tracepb.Span) []*tracepb.Span {
+	valid := spans[:0]
+	var invalid *tracepb.Span
+	for _, span := range spans {
+		if len(span.TraceId) != len(trace.TraceID{}) || len(span.SpanId) != len(trace.SpanID{}) ||
+			(len(span.ParentSpanId) != 0 && len(span.ParentSpanId) != len(trace.SpanID{})) {
+			invalid = span
+			ae.stats.recordDropped(DropReasonInvalidID, 1)
+			continue
+		}
+		valid = append(valid, span)
+	}
+	if invalid != nil {
+		ae.logf("ocagent: dropped %d spans with invalid IDs, such as span %q with trace ID %x, span ID %x and parent span ID %x",
+			len(spans)-len(valid), invalid.GetName().GetValue(), invalid.TraceId, invalid.SpanId, invalid.ParentSpanId)
+	}
+	return valid
+}
+
+// ExportDeadlineAttributeKey is the span attribute that, with
+// WithExportDeadlinePropagationFromSpan, holds the time after which the span
+// is no longer worth sending: either an int64 of Unix nanoseconds or an
+// RFC 3339 string.
+const ExportDeadlineAttributeKey = "export.deadline"
+
+// exportDeadline returns the deadline set on sd, if any.
+func exportDeadline(sd *trace.SpanData) (time.Time, bool) {
+	switch v := sd.Attributes[ExportDeadlineAttributeKey].(type) {
+	case int64:
+		return time.Unix(0, v), true
+	case string:
+		deadline, err := time.Parse(time.RFC3339Nano, v)
+		return deadline, err == nil
+	}
+	return time.Time{}, false
+}
+
+// dropStale filters out the spans whose export deadline is before now,
+// counting them as stale.
+func (ae *Exporter) dropStale(qsl []*queuedSpan, now time.Time) []*queuedSpan {
+	fresh := qsl[:0]
+	for _, qs := range qsl {
+		if qs.sd != nil {
+			if deadline, ok := exportDeadline(qs.sd); ok && deadline.Before(now) {
+				ae.dropSpan(qs.sd, DropReasonStale)
+				continue
+			}
+		}
+		fresh = append(fresh, qs)
+	}
+	return fresh
+}
+
+func (ae *Exporter) toProtoSpans(qsl []*queuedSpan) []*tracepb.Span {
+	batch := ae.spanConversion.newBatch()
+	protoSpans := make([]*tracepb.Span, 0, len(qsl))
+	for _, qs := range qsl {
+		if qs.proto != nil {
+			protoSpans = append(protoSpans, qs.proto)
+		} else if span := batch.toProtoSpan(qs.sd); span != nil {
+			if qs.forcedClose {
+				// Set on the converted span, like the exporter's other
+				// reserved attributes, for it not to count as a user's.
+				setProtoAttribute(span, ForcedCloseAttributeKey, &tracepb.AttributeValue{
+					Value: &tracepb.AttributeValue_BoolValue{BoolValue: true},
+				})
+			}
+			protoSpans = append(protoSpans, span)
+		}
+	}
+	return protoSpans
+}
+
+// skipsCompression reports whether the batch qsl is to be sent
+// uncompressed, i.e. WithNoCompressPredicate matches every span in it.
+func (ae *Exporter) skipsCompression(qsl []*queuedSpan) bool {
+	if ae.noCompress == nil || ae.compressor == "" || len(qsl) == 0 {
+		return false
+	}
+	for _, qs := range qsl {
+		if qs.sd == nil || !ae.noCompress(qs.sd) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendTraces sends req to the agent, on the uncompressed trace stream if
+// uncompressed is set, or, when sharding by trace ID, splits it up across
+// the shards.
+func (ae *Exporter) sendTraces(req *agenttracepb.ExportTraceServiceRequest, uncompressed bool) error {
+	if len(ae.shardDestinations) > 0 {
+		return ae.sendToShards(req.Spans)
+	}
+	ae.streamMu.Lock()
+	defer ae.streamMu.Unlock()
+	if ae.traceExporter == nil {
+		return errNotStarted
+	}
+	if uncompressed {
+		return ae.sendUncompressedTracesLocked(req)
+	}
+	if ae.pendingNode != nil {
+		// Copied so that the sinks, which have Nodes of their own, don't get it.
+		withNode := *req
+		withNode.Node = ae.pendingNode
+		req = &withNode
+	}
+	if err := ae.traceExporter.Send(req); err != nil {
+		return err
+	}
+	ae.pendingNode = nil
+	ae.lastTraceSend = time.Now()
+	return nil
+}
+
+// sendUncompressedTracesLocked sends req on the uncompressed trace stream,
+// opening it first if need be. The stream is reopened after a failed send.
+func (ae *Exporter) sendUncompressedTracesLocked(req *agenttracepb.ExportTraceServiceRequest) error {
+	if ae.uncompressedTraceExporter == nil {
+		// The identity compressor overrides the one the connection was
+		// dialed with, for this stream alone.
+		stream, err := agenttracepb.NewTraceServiceClient(ae.streamConn).Export(context.Background(), grpc.UseCompressor(encoding.Identity))
+		if err != nil {
+			return err
+		}
+		// Like the other trace stream, it starts with the Node.
+		if err := stream.Send(&agenttracepb.ExportTraceServiceRequest{Node: ae.streamNode}); err != nil {
+			return err
+		}
+		ae.uncompressedTraceExporter = stream
+	}
+	if err := ae.uncompressedTraceExporter.Send(req); err != nil {
+		ae.uncompressedTraceExporter = nil
+		return err
+	}
+	ae.lastTraceSend = time.Now()
+	return nil
+}
+
+// ExportView converts the view data into metrics and sends them to the agent.
+func (ae *Exporter) ExportView(vd *view.Data) {
+	if vd == nil || vd.View == nil {
+		return
+	}
+	ae.mu.Lock()
+	if ae.exportedViews == nil {
+		ae.exportedViews = make(map[string]*view.View)
+	}
+	ae.exportedViews[vd.View.Name] = vd.View
+	ae.mu.Unlock()
+
+	if len(vd.Rows) == 0 {
+		return
+	}
+	metric := ae.metricConversion.viewDataToMetric(vd)
+	if metric == nil {
+		return
+	}
+	if ae.unifiedStream {
+		ae.mu.RLock()
+		if !ae.stopped {
+			_ = ae.traceBundler.Add(&queuedSpan{metric: metric}, 1)
+		}
+		ae.mu.RUnlock()
+		return
+	}
+	_ = ae.uploadMetrics([]*metricspb.Metric{metric})
+}
+
+// FlushMetrics immediately collects the current data of the given views,
+// as well as of every view previously passed to ExportView, and sends it to
+// the agent without waiting for the next reporting period. It returns once
+// the metrics have been sent.
+func (ae *Exporter) FlushMetrics(views ...*view.View) error {
+	ae.mu.RLock()
+	byName := make(map[string]*view.View, len(ae.exportedViews)+len(views))
+	for name, v := range ae.exportedViews {
+		byName[name] = v
+	}
+	ae.mu.RUnlock()
+	for _, v := range views {
+		if v != nil {
+			byName[v.Name] = v
+		}
+	}
+
+	now := time.Now()
+	metrics := make([]*metricspb.Metric, 0, len(byName))
+	for name, v := range byName {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		vd := &view.Data{View: v, Start: startTime, End: now, Rows: rows}
+		if metric := ae.metricConversion.viewDataToMetric(vd); metric != nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	return ae.uploadMetrics(metrics)
+}
+
+// RegisterViews registers the views with OpenCensus so that their data gets
+// collected, and adds them to the views that FlushMetrics sends. It is safe
+// to call repeatedly, e.g. when an exporter is re-installed after a reload:
+// a view that is already registered is not registered again, nil views are
+// skipped, and a different view under an already registered name yields an
+// error rather than a panic.
+func (ae *Exporter) RegisterViews(views ...*view.View) error {
+	for _, v := range views {
+		if v == nil {
+			continue
+		}
+		if err := registerViewOnce(v); err != nil {
+			return err
+		}
+		ae.mu.Lock()
+		if ae.exportedViews == nil {
+			ae.exportedViews = make(map[string]*view.View)
+		}
+		ae.exportedViews[v.Name] = v
+		ae.mu.Unlock()
+	}
+	return nil
+}
+
+// registeredViews holds the views registered through RegisterViews by any
+// exporter, keyed by name.
+var registeredViews = struct {
+	sync.Mutex
+	byName map[string]*view.View
+}{byName: make(map[string]*view.View)}
+
+func registerViewOnce(v *view.View) error {
+	registeredViews.Lock()
+	defer registeredViews.Unlock()
+
+	if registeredViews.byName[v.Name] == v {
+		return nil
+	}
+	if err := view.Register(v); err != nil {
+		return fmt.Errorf("ocagent: failed to register view %q: %v", v.Name, err)
+	}
+	if _, ok := registeredViews.byName[v.Name]; !ok {
+		registeredViews.byName[v.Name] = v
+	}
+	return nil
+}
+
+func (ae *Exporter) uploadMetrics(metrics []*metricspb.Metric) error {
+	ae.streamMu.Lock()
+	defer ae.streamMu.Unlock()
+
+	if ae.streamConn == nil {
+		return errNotStarted
+	}
+	// The metrics stream is only opened once there are metrics to send,
+	// so that agents which only accept traces keep working as before.
+	if ae.metricsExporter == nil {
+		metricsExporter, err := exporterpb.NewExportClient(ae.streamConn).ExportMetrics(context.Background())
+		if err != nil {
+			return err
+		}
+		ae.metricsExporter = metricsExporter
+	}
+	req := &exporterpb.ExportMetricsRequest{Metrics: metrics}
+	if ae.trackRequestSize {
+		ae.stats.recordRequestBytes(StreamTypeMetrics, proto.Size(req))
+	}
+	if err := ae.metricsExporter.Send(req); err != nil {
+		// Reopen the stream on the next export.
+		ae.metricsExporter = nil
+		return err
+	}
+	return nil
+}
+
+func (ae *Exporter) Flush() {
+	ae.mu.RLock()
+	traceBundler := ae.traceBundler
+	ae.mu.RUnlock()
+
+	if ae.flushCoalescer != nil {
+		ae.flushCoalescer.flush(traceBundler.Flush)
+		return
+	}
+	traceBundler.Flush()
+}
@@ -0,0 +1,2173 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"go.opencensus.io"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+
+	"online-store/ocagent"
+)
+
+func TestNewExporter_endToEnd(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	serviceName := "endToEnd_test"
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port), ocagent.WithServiceName(serviceName))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// Once we've register the exporter, we can then send over a bunch of spans.
+	trace.RegisterExporter(exp)
+	defer trace.UnregisterExporter(exp)
+
+	// Let the agent push down a couple of configurations.
+	// 1. Always sample
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ConstantSampler{
+				ConstantSampler: &tracepb.ConstantSampler{Decision: true}, // Always sample
+			},
+		},
+	}
+	<-time.After(5 * time.Millisecond)
+
+	// Now create a couple of spans
+	for i := 0; i < 4; i++ {
+		_, span := trace.StartSpan(context.Background(), "AlwaysSample")
+		span.Annotatef([]trace.Attribute{trace.Int64Attribute("i", int64(i))}, "Annotation")
+		span.End()
+	}
+	<-time.After(10 * time.Millisecond)
+	exp.Flush()
+
+	// 2. Never sample
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ConstantSampler{
+				ConstantSampler: &tracepb.ConstantSampler{Decision: false}, // Never sample
+			},
+		},
+	}
+	<-time.After(5 * time.Millisecond)
+	exp.Flush()
+
+	// Now create a couple of spans
+	for i, n := 0, 2; i < n; i++ {
+		_, span := trace.StartSpan(context.Background(), "NeverSample")
+		span.Annotatef([]trace.Attribute{trace.Int64Attribute("i", int64(n-i))}, "Annotation")
+		span.End()
+	}
+	<-time.After(10 * time.Millisecond)
+	exp.Flush()
+
+	// 3. Probability sampler (100%)
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ProbabilitySampler{
+				ProbabilitySampler: &tracepb.ProbabilitySampler{SamplingProbability: 1.0}, // 100% probability
+			},
+		},
+	}
+	<-time.After(5 * time.Millisecond)
+	exp.Flush()
+
+	// Now create a couple of spans
+	for i := 0; i < 3; i++ {
+		_, span := trace.StartSpan(context.Background(), "ProbabilitySampler-100%")
+		span.Annotatef([]trace.Attribute{trace.BoolAttribute("odd", i&1 == 1)}, "Annotation")
+		span.End()
+	}
+	<-time.After(10 * time.Millisecond)
+	exp.Flush()
+
+	// 4. Probability sampler (0%)
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ProbabilitySampler{
+				ProbabilitySampler: &tracepb.ProbabilitySampler{SamplingProbability: 0.0}, // 0% probability
+			},
+		},
+	}
+	<-time.After(5 * time.Millisecond)
+	exp.Flush()
+
+	for i := 0; i < 3; i++ {
+		_, span := trace.StartSpan(context.Background(), "ProbabilitySampler-0%")
+		span.Annotatef([]trace.Attribute{trace.BoolAttribute("even", i&1 == 0)}, "Annotation")
+		span.End()
+	}
+	// Give the traces some time to be exported or dropped by the core library
+	<-time.After(5 * time.Millisecond)
+
+	ma.transitionToReceivingClientConfigs()
+	<-time.After(5 * time.Millisecond)
+
+	// Now invoke Flush on the exporter.
+	exp.Flush()
+	<-time.After(5 * time.Millisecond)
+
+	// Now shutdown the exporter
+	if err := exp.Stop(); err != nil {
+		t.Errorf("Failed to stop the exporter: %v", err)
+	}
+
+	// Shutdown the agent too so that we can begin
+	// verification checks of expected data back.
+	ma.stop()
+
+	// Expecting 5 receivedConfigs: the first one with the nodeInfo
+	// and the rest with {AlwaysSample, NeverSample, 100%, 0%}
+	spans := ma.getSpans()
+	traceNodes := ma.getTraceNodes()
+	receivedConfigs := ma.getReceivedConfigs()
+
+	if g, w := len(receivedConfigs), 5; g != w {
+		t.Errorf("ReceivedConfigs: got %d want %d", g, w)
+	}
+
+	// Expecting 7 spanData that were sampled, given that
+	// two of the trace configs pushed down to the client
+	// were {NeverSample, ProbabilitySampler(0.0)}
+	if g, w := len(spans), 7; g != w {
+		t.Errorf("Spans: got %d want %d", g, w)
+	}
+
+	// Now check that the responses received by the agent properly
+	// contain the node identifier that we expect the exporter to have.
+	wantIdentifier := &commonpb.ProcessIdentifier{
+		HostName: os.Getenv("HOSTNAME"),
+		Pid:      uint32(os.Getpid()),
+	}
+	wantLibraryInfo := &commonpb.LibraryInfo{
+		Language:           commonpb.LibraryInfo_GO_LANG,
+		ExporterVersion:    ocagent.Version,
+		CoreLibraryVersion: opencensus.Version(),
+	}
+	wantServiceInfo := &commonpb.ServiceInfo{
+		Name: serviceName,
+	}
+
+	var firstNodeInConfig, firstNodeInTraceExport *commonpb.Node
+	if len(receivedConfigs) > 0 {
+		firstNodeInConfig = receivedConfigs[0].Node
+	}
+	if len(traceNodes) > 0 {
+		firstNodeInTraceExport = traceNodes[0]
+	}
+	nodeComparisons := []struct {
+		name string
+		node *commonpb.Node
+	}{
+		// Expecting the first config message that the agent got to contain the nodeInfo
+		{name: "Config", node: firstNodeInConfig},
+		// Expecting the first span message that the agent got to contain the nodeInfo
+		{name: "Trace", node: firstNodeInTraceExport},
+	}
+
+	for _, tt := range nodeComparisons {
+		node := tt.node
+		if node == nil {
+			t.Errorf("%q: first message should contain a non-nil Node", tt.name)
+		} else if g, w := node.Identifier, wantIdentifier; !sameProcessIdentifier(g, w) {
+			t.Errorf("%q: ProcessIdentifier mismatch\nGot  %#v\nWant %#v", tt.name, g, w)
+		} else if g, w := node.LibraryInfo, wantLibraryInfo; !sameLibraryInfo(g, w) {
+			t.Errorf("%q: LibraryInfo mismatch\nGot  %#v\nWant %#v", tt.name, g, w)
+		} else if g, w := node.ServiceInfo, wantServiceInfo; !sameServiceInfo(g, w) {
+			t.Errorf("%q: ServiceInfo mismatch\nGot  %#v\nWant %#v", tt.name, g, w)
+		}
+	}
+}
+
+func TestNewExporter_invokeStartThenStopManyTimes(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatal("Surprisingly connected with a bad port")
+	}
+	defer exp.Stop()
+
+	// Invoke Start numerous times
+	for i := 0; i < 10; i++ {
+		if err := exp.Start(); err != nil {
+			t.Errorf("#%d unexpected Start error: %v", i, err)
+		}
+	}
+
+	exp.Stop()
+	// Invoke Stop numerous times
+	for i := 0; i < 10; i++ {
+		if err := exp.Stop(); err == nil || !strings.Contains(err.Error(), "not started") {
+			t.Errorf(`#%d got error (%v) expected a "not started error"`, i, err)
+		}
+	}
+}
+
+func TestNewExporter_agentConnectionDiesInMidst(t *testing.T) {
+	ma := runMockAgent(t)
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatal("Surprisingly connected with a bad port")
+	}
+	defer exp.Stop()
+
+	if err := exp.Start(); err != nil {
+		t.Fatalf("Unexpected Start error: %v", err)
+	}
+
+	// Stop the agent right away to simulate killing
+	// the connection in the midst of communication.
+	ma.stop()
+
+	exp.ExportSpan(&trace.SpanData{Name: "in the midst"})
+}
+
+// This test takes a long time to run: to skip it, run tests using: -short
+func TestNewExporter_agentOnBadConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skipf("Skipping this long running test")
+	}
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to grab an available port: %v", err)
+	}
+	// Firstly close the "agent's" channel: optimistically this address won't get reused ASAP
+	// However, our goal of closing it is to simulate an unavailable connection
+	ln.Close()
+
+	startTime := time.Now()
+	// If this returns in less than 6.5s report an error
+	// since that's a sign that exponential backoff didn't happen.
+	wantMinDuration := (6 * time.Second) + (500 * time.Millisecond)
+	defer func() {
+		timeSpent := time.Now().Sub(startTime)
+		if timeSpent < wantMinDuration {
+			t.Errorf("Took %s, yet with a non-existent connection it should take at least %s",
+				timeSpent, wantMinDuration)
+		}
+	}()
+
+	_, agentPortStr, _ := net.SplitHostPort(ln.Addr().String())
+	agentPort, _ := strconv.Atoi(agentPortStr)
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(uint16(agentPort)))
+	if err == nil {
+		t.Fatal("Surprisingly connected to an unavailable non-gRPC connection")
+	}
+	if exp != nil {
+		t.Fatalf("Surprisingly created an exporter: %#v", exp)
+	}
+}
+
+func TestNewExporter_maxRetryDurationOnBadConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to grab an available port: %v", err)
+	}
+	ln.Close()
+	_, agentPortStr, _ := net.SplitHostPort(ln.Addr().String())
+	agentPort, _ := strconv.Atoi(agentPortStr)
+
+	startTime := time.Now()
+	exp, err := ocagent.NewExporter(
+		ocagent.WithInsecure(),
+		ocagent.WithPort(uint16(agentPort)),
+		ocagent.WithReconnectBackoff(10*time.Millisecond, 100*time.Millisecond),
+		ocagent.WithMaxRetryDuration(500*time.Millisecond),
+	)
+	if err == nil {
+		t.Fatal("Surprisingly connected to an unavailable non-gRPC connection")
+	}
+	if exp != nil {
+		t.Fatalf("Surprisingly created an exporter: %#v", exp)
+	}
+	// The default would take 6.5s; allow for the last dial and the retries
+	// of the initial messages.
+	if timeSpent, wantMaxDuration := time.Since(startTime), 2*time.Second; timeSpent > wantMaxDuration {
+		t.Errorf("Took %s, yet the retries should give up after about 500ms", timeSpent)
+	}
+}
+
+func TestNewExporterBlocking_failsOnDeadAddress(t *testing.T) {
+	if testing.Short() {
+		t.Skipf("Skipping this long running test")
+	}
+
+	exp, err := ocagent.NewExporterBlocking(ocagent.WithInsecure(), ocagent.WithAddress(deadAddress(t)))
+	if err == nil {
+		t.Fatal("Surprisingly connected to a dead address")
+	}
+	if exp != nil {
+		t.Fatalf("Surprisingly created an exporter: %#v", exp)
+	}
+}
+
+func TestNewUnstartedExporter_doesNotWaitForDeadAddress(t *testing.T) {
+	start := time.Now()
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithAddress(deadAddress(t)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer exp.Stop()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("NewUnstartedExporter blocked for %v", d)
+	}
+	if g, w := exp.ConnectionState(), ocagent.Disconnected; g != w {
+		t.Errorf("ConnectionState: got %v want %v", g, w)
+	}
+	exp.ExportSpan(&trace.SpanData{Name: "queued"})
+}
+
+// deadAddress returns the address of a port that nothing listens on.
+func deadAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to grab an available port: %v", err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestNewExporter_withAddress(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	addr := fmt.Sprintf("localhost:%d", ma.port)
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithAddress(addr))
+	if err != nil {
+		t.Fatal("Surprisingly connected with a bad port")
+	}
+	defer exp.Stop()
+
+	if err := exp.Start(); err != nil {
+		t.Fatalf("Unexpected Start error: %v", err)
+	}
+}
+
+// Best case comparison for information that we can externally introspect
+func sameProcessIdentifier(n1, n2 *commonpb.ProcessIdentifier) bool {
+	if n1 == nil || n2 == nil {
+		return n1 == n2
+	}
+	return n1.HostName == n2.HostName && n1.Pid == n2.Pid
+}
+
+func sameLibraryInfo(li1, li2 *commonpb.LibraryInfo) bool {
+	if li1 == nil || li2 == nil {
+		return li1 == li2
+	}
+	return li1.Language == li2.Language &&
+		li1.ExporterVersion == li2.ExporterVersion &&
+		li1.CoreLibraryVersion == li2.CoreLibraryVersion
+}
+
+func sameServiceInfo(si1, si2 *commonpb.ServiceInfo) bool {
+	if si1 == nil || si2 == nil {
+		return si1 == si2
+	}
+	return si1.Name == si2.Name
+}
+
+func TestExporter_SetBatchTimeoutAtRuntime(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// Buffered under the default (2s) timeout, this span must not be lost
+	// when the batching settings change underneath it.
+	exp.ExportSpan(&trace.SpanData{Name: "before"})
+	exp.SetBatchTimeout(50 * time.Millisecond)
+	exp.SetMaxBatchSize(100)
+
+	exp.ExportSpan(&trace.SpanData{Name: "after"})
+	// Without calling Flush, the new cadence alone should ship the span
+	// well before the default timeout would have fired.
+	<-time.After(400 * time.Millisecond)
+
+	spans := ma.getSpans()
+	if g, w := len(spans), 2; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	for i, name := range []string{"before", "after"} {
+		if g := spans[i].Name.GetValue(); g != name {
+			t.Errorf("Span #%d: got name %q want %q", i, g, name)
+		}
+	}
+}
+
+func TestExporter_circuitBreakerStopsSendingUntilCooldown(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	cooldown := 300 * time.Millisecond
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithErrorThreshold(2, time.Minute), ocagent.WithCircuitBreakerCooldown(cooldown))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// Take the agent down so that every export fails.
+	ma.stop()
+
+	exportAndFlush := func() {
+		exp.ExportSpan(&trace.SpanData{Name: "breaker"})
+		exp.Flush()
+	}
+
+	// The first sends on a dead stream may still be buffered successfully,
+	// so keep exporting until the failures have tripped the breaker.
+	deadline := time.Now().Add(5 * time.Second)
+	for exp.Stats().ExportFailures < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Exports never failed: %+v", exp.Stats())
+		}
+		exportAndFlush()
+		<-time.After(10 * time.Millisecond)
+	}
+
+	tripped := exp.Stats()
+	for i := 0; i < 3; i++ {
+		exportAndFlush()
+	}
+	stats := exp.Stats()
+	if g, w := stats.ExportAttempts, tripped.ExportAttempts; g != w {
+		t.Errorf("ExportAttempts while open: got %d want %d", g, w)
+	}
+	if g, w := stats.SpansDropped[ocagent.DropReasonCircuitOpen], int64(3); g != w {
+		t.Errorf("Spans dropped while open: got %d want %d", g, w)
+	}
+
+	// After the cooldown a single probe is let through.
+	<-time.After(cooldown)
+	exportAndFlush()
+	exportAndFlush()
+	stats = exp.Stats()
+	if g, w := stats.ExportAttempts, tripped.ExportAttempts+1; g != w {
+		t.Errorf("ExportAttempts after cooldown: got %d want %d", g, w)
+	}
+	if g, w := stats.SpansDropped[ocagent.DropReasonCircuitOpen], int64(4); g != w {
+		t.Errorf("Spans dropped after failed probe: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_invalidConfigDoesNotStopConfigStream(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// A probability outside of [0, 1] can't be applied...
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ProbabilitySampler{
+				ProbabilitySampler: &tracepb.ProbabilitySampler{SamplingProbability: 1.5},
+			},
+		},
+	}
+	// ...but the config that follows it must still be applied.
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ConstantSampler{
+				ConstantSampler: &tracepb.ConstantSampler{Decision: true},
+			},
+		},
+	}
+	<-time.After(50 * time.Millisecond)
+
+	_, span := trace.StartSpan(context.Background(), "after-bad-config")
+	span.End()
+	if !span.SpanContext().IsSampled() {
+		t.Error("The valid config following the invalid one was not applied")
+	}
+	if g, w := exp.Stats().ConfigErrors, int64(1); g != w {
+		t.Errorf("ConfigErrors: got %d want %d", g, w)
+	}
+
+	exp.Stop()
+	ma.stop()
+
+	// The node message, a reply to the skipped config and one to the applied one.
+	receivedConfigs := ma.getReceivedConfigs()
+	if g, w := len(receivedConfigs), 3; g != w {
+		t.Fatalf("ReceivedConfigs: got %d want %d", g, w)
+	}
+	if g := receivedConfigs[1].Config; g != nil {
+		t.Errorf("Reply to the skipped config: got %+v want no config in effect", g)
+	}
+	if g := receivedConfigs[2].Config.GetConstantSampler(); g == nil || !g.Decision {
+		t.Errorf("Reply to the applied config: got %+v want the always-on sampler", receivedConfigs[2].Config)
+	}
+}
+
+func TestExporter_queueLatencyTracking(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port), ocagent.WithQueueLatencyTracking())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exportAfter := func(delay time.Duration) time.Duration {
+		exp.ExportSpan(&trace.SpanData{Name: "queued"})
+		<-time.After(delay)
+		exp.Flush()
+		return exp.Stats().QueueLatency.Last
+	}
+
+	short := exportAfter(20 * time.Millisecond)
+	long := exportAfter(200 * time.Millisecond)
+	if short < 20*time.Millisecond {
+		t.Errorf("Short queueing delay: got %s want at least 20ms", short)
+	}
+	if long < 200*time.Millisecond || long <= short {
+		t.Errorf("Long queueing delay: got %s want at least 200ms and more than %s", long, short)
+	}
+
+	ql := exp.Stats().QueueLatency
+	if g, w := ql.Count, int64(2); g != w {
+		t.Errorf("QueueLatency.Count: got %d want %d", g, w)
+	}
+	if g, w := ql.Max, long; g != w {
+		t.Errorf("QueueLatency.Max: got %s want %s", g, w)
+	}
+}
+
+func TestNewExporter_withConnectionName(t *testing.T) {
+	tests := []struct {
+		opts []ocagent.ExporterOption
+		want string
+	}{
+		{opts: []ocagent.ExporterOption{ocagent.WithConnectionName("checkout-exporter")}, want: "checkout-exporter"},
+		// Without an explicit name, the service name identifies the connection.
+		{opts: []ocagent.ExporterOption{ocagent.WithServiceName("checkout")}, want: "checkout"},
+	}
+
+	for i, tt := range tests {
+		ma := runMockAgent(t)
+		opts := append([]ocagent.ExporterOption{ocagent.WithInsecure(), ocagent.WithPort(ma.port)}, tt.opts...)
+		exp, err := ocagent.NewExporter(opts...)
+		if err != nil {
+			t.Fatalf("#%d: Failed to create a new agent exporter: %v", i, err)
+		}
+		<-time.After(50 * time.Millisecond)
+		exp.Stop()
+		ma.stop()
+
+		userAgents := ma.getUserAgents()
+		if len(userAgents) == 0 {
+			t.Errorf("#%d: the agent saw no user agent", i)
+			continue
+		}
+		if g, w := userAgents[0], tt.want; !strings.HasPrefix(g, w+" ") {
+			t.Errorf("#%d: user agent %q does not start with the connection name %q", i, g, w)
+		}
+	}
+}
+
+func TestNewExporter_withCompressorAndHeaders(t *testing.T) {
+	// The agent only reads gzip messages with a decompressor.
+	ma := runMockAgentAtAddr(t, ":0", grpc.RPCDecompressor(grpc.NewGZIPDecompressor()))
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithCompressor("gzip"), ocagent.WithHeaders(map[string]string{"X-API-Key": "secret"}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: trace.TraceID{0x01}, SpanID: trace.SpanID{0x02}},
+		Name:        "compressed",
+		StartTime:   time.Now(),
+		EndTime:     time.Now(),
+	})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+
+	if g, w := len(ma.getSpans()), 1; g != w {
+		t.Errorf("Spans received through the compressed stream: got %d want %d", g, w)
+	}
+	apiKeys := ma.getAPIKeys()
+	if len(apiKeys) == 0 || apiKeys[0] != "secret" {
+		t.Errorf("API keys the agent saw: got %q want [\"secret\"]", apiKeys)
+	}
+}
+
+// countingDecompressor is a gzip decompressor counting the messages it
+// decompresses, i.e. the ones that were sent compressed.
+type countingDecompressor struct {
+	grpc.Decompressor
+	mu sync.Mutex
+	n  int
+}
+
+func (cd *countingDecompressor) Do(r io.Reader) ([]byte, error) {
+	cd.mu.Lock()
+	cd.n++
+	cd.mu.Unlock()
+	return cd.Decompressor.Do(r)
+}
+
+func (cd *countingDecompressor) count() int {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	return cd.n
+}
+
+func TestNewExporter_withNoCompressPredicate(t *testing.T) {
+	dc := &countingDecompressor{Decompressor: grpc.NewGZIPDecompressor()}
+	ma := runMockAgentAtAddr(t, ":0", grpc.RPCDecompressor(dc))
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithCompressor("gzip"),
+		ocagent.WithNoCompressPredicate(func(sd *trace.SpanData) bool {
+			_, ok := sd.Attributes["payload"]
+			return ok
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	export := func(name string, attributes map[string]interface{}) {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{TraceID: trace.TraceID{0x01}, SpanID: trace.SpanID{0x02}},
+			Name:        name,
+			StartTime:   time.Now(),
+			EndTime:     time.Now(),
+			Attributes:  attributes,
+		})
+		exp.Flush()
+		<-time.After(100 * time.Millisecond)
+	}
+
+	// Let the Node and config messages, which are compressed, arrive first.
+	<-time.After(100 * time.Millisecond)
+	before := dc.count()
+	export("flagged", map[string]interface{}{"payload": "H4sIAAAAAAAA"})
+	if g, w := len(ma.getSpans()), 1; g != w {
+		t.Fatalf("Spans received after the flagged batch: got %d want %d", g, w)
+	}
+	if g := dc.count(); g != before {
+		t.Errorf("The flagged batch was sent compressed: %d messages decompressed, want %d", g, before)
+	}
+
+	export("normal", nil)
+	if g, w := len(ma.getSpans()), 2; g != w {
+		t.Fatalf("Spans received after the normal batch: got %d want %d", g, w)
+	}
+	if g, w := dc.count(), before+1; g != w {
+		t.Errorf("The normal batch was not sent compressed: %d messages decompressed, want %d", g, w)
+	}
+}
+
+func TestExporter_ExportProtoSpans(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	makeSpans := func() []*tracepb.Span {
+		return []*tracepb.Span{
+			{
+				TraceId: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+				SpanId:  []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+				Name:    &tracepb.TruncatableString{Value: "forwarded-1"},
+				Kind:    tracepb.Span_SERVER,
+			},
+			{
+				TraceId:      []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+				SpanId:       []byte{0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28},
+				ParentSpanId: []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+				Name:         &tracepb.TruncatableString{Value: "forwarded-2"},
+				Status:       &tracepb.Status{Code: 5, Message: "not found"},
+			},
+		}
+	}
+
+	if err := exp.ExportProtoSpans(context.Background(), makeSpans()); err == nil {
+		t.Error("ExportProtoSpans on an unstarted exporter: expected an error")
+	}
+	if err := exp.Start(); err != nil {
+		t.Fatalf("Unexpected Start error: %v", err)
+	}
+	if err := exp.ExportProtoSpans(context.Background(), append(makeSpans(), nil)); err != nil {
+		t.Fatalf("ExportProtoSpans: %v", err)
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	if g, w := ma.getSpans(), makeSpans(); !reflect.DeepEqual(g, w) {
+		t.Errorf("Forwarded spans\nGot  %+v\nWant %+v", g, w)
+	}
+	if nodes := ma.getTraceNodes(); len(nodes) == 0 || nodes[0] == nil {
+		t.Error("Expected the node handshake before the forwarded spans")
+	}
+}
+
+func TestExporter_ExportProtoSpansDropsInvalidIDs(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	var logs bytes.Buffer
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	traceID := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}
+	spanID := []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	spans := []*tracepb.Span{
+		{TraceId: traceID, SpanId: spanID, Name: &tracepb.TruncatableString{Value: "valid"}},
+		{TraceId: traceID[:8], SpanId: spanID, Name: &tracepb.TruncatableString{Value: "short-trace-id"}},
+		{TraceId: traceID, SpanId: traceID, Name: &tracepb.TruncatableString{Value: "long-span-id"}},
+		{TraceId: traceID, SpanId: spanID, ParentSpanId: spanID[:4], Name: &tracepb.TruncatableString{Value: "short-parent-id"}},
+	}
+	if err := exp.ExportProtoSpans(context.Background(), spans); err != nil {
+		t.Fatalf("ExportProtoSpans: %v", err)
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	got := ma.getSpans()
+	if g, w := len(got), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	if g, w := got[0].Name.GetValue(), "valid"; g != w {
+		t.Errorf("Span name: got %q want %q", g, w)
+	}
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonInvalidID], int64(3); g != w {
+		t.Errorf("Spans with invalid IDs: got %d want %d", g, w)
+	}
+	if g := logs.String(); !strings.Contains(g, "invalid IDs") {
+		t.Errorf("Got logs %q, want the invalid IDs reported", g)
+	}
+}
+
+func TestExporter_exportNameAllowlist(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithExportNameAllowlist([]string{"payments.Charge", "inventory.Reserve"}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	for _, name := range []string{"payments.Charge", "render.Template", "inventory.Reserve", "cache.Get", "payments.Charge"} {
+		exp.ExportSpan(&trace.SpanData{Name: name})
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	var gotNames []string
+	for _, span := range ma.getSpans() {
+		gotNames = append(gotNames, span.Name.GetValue())
+	}
+	if g, w := gotNames, []string{"payments.Charge", "inventory.Reserve", "payments.Charge"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("Exported span names: got %v want %v", g, w)
+	}
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonNameNotAllowed], int64(2); g != w {
+		t.Errorf("Spans dropped by name: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_StopLogsDropSummary(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	var logs bytes.Buffer
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithExportNameAllowlist([]string{"kept"}),
+		ocagent.WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.ExportSpan(&trace.SpanData{Name: "kept"})
+	for i := 0; i < 12; i++ {
+		exp.ExportSpan(&trace.SpanData{Name: "discarded"})
+	}
+	if err := exp.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonNameNotAllowed], int64(12); g != w {
+		t.Errorf("SpansDropped: got %d want %d", g, w)
+	}
+	want := "ocagent: dropped 12 spans: 12 " + ocagent.DropReasonNameNotAllowed + "\n"
+	if g := logs.String(); g != want {
+		t.Errorf("Shutdown log: got %q want %q", g, want)
+	}
+}
+
+func TestExporter_reconnectsOnNetworkChangeSignal(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	networkChanges := make(chan struct{})
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithNetworkChangeSignal(networkChanges))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	<-time.After(50 * time.Millisecond)
+	if g, w := ma.getTraceStreams(), 1; g != w {
+		t.Fatalf("Trace streams before the signal: got %d want %d", g, w)
+	}
+
+	networkChanges <- struct{}{}
+	<-time.After(200 * time.Millisecond)
+	if g, w := ma.getTraceStreams(), 2; g != w {
+		t.Fatalf("Trace streams after the signal: got %d want %d", g, w)
+	}
+
+	// Spans exported after the reconnect go over the new connection.
+	exp.ExportSpan(&trace.SpanData{Name: "after-reconnect"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	spans := ma.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	if g, w := spans[0].Name.GetValue(), "after-reconnect"; g != w {
+		t.Errorf("Span name: got %q want %q", g, w)
+	}
+}
+
+func TestExporter_exportSpanDoesNotWaitForReconnects(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	networkChanges := make(chan struct{})
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithMaxRetryDuration(time.Second), ocagent.WithNetworkChangeSignal(networkChanges))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// With the agent gone, the reconnect keeps dialing it for a second.
+	ma.stop()
+	networkChanges <- struct{}{}
+	<-time.After(100 * time.Millisecond)
+
+	start := time.Now()
+	exp.ExportSpan(&trace.SpanData{Name: "during-reconnect"})
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("ExportSpan blocked for %v while reconnecting", d)
+	}
+}
+
+func TestExporter_malformedSpanDataIsSkipped(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.ExportSpan(nil)
+	exp.ExportSpan(&trace.SpanData{})
+	exp.ExportSpan(&trace.SpanData{Name: "valid"})
+	if err := exp.ExportProtoSpans(context.Background(), []*tracepb.Span{nil}); err != nil {
+		t.Fatalf("ExportProtoSpans: %v", err)
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonMalformed], int64(3); g != w {
+		t.Errorf("Malformed spans: got %d want %d", g, w)
+	}
+	spans := ma.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	if g, w := spans[0].Name.GetValue(), "valid"; g != w {
+		t.Errorf("Span name: got %q want %q", g, w)
+	}
+}
+
+func TestNewExporter_withResourceDetectors(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	cloud := func(context.Context) (map[string]string, error) {
+		return map[string]string{"cloud.provider": "azure", "host.id": "vm-1"}, nil
+	}
+	failing := func(context.Context) (map[string]string, error) {
+		return map[string]string{"never": "merged"}, fmt.Errorf("downward API not mounted")
+	}
+	container := func(context.Context) (map[string]string, error) {
+		return map[string]string{"host.id": "container-1", "container.name": "app"}, nil
+	}
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithResourceDetectors(cloud, failing, container))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	<-time.After(50 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	nodes := ma.getTraceNodes()
+	if len(nodes) == 0 {
+		t.Fatal("The agent received no node")
+	}
+	want := map[string]string{
+		"cloud.provider": "azure",
+		"host.id":        "container-1",
+		"container.name": "app",
+	}
+	if g := nodes[0].Attributes; !reflect.DeepEqual(g, want) {
+		t.Errorf("Node attributes:\ngot  %v\nwant %v", g, want)
+	}
+}
+
+func TestExporter_ExportNowSendsWithoutWaitingForBatch(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	exp.SetBatchTimeout(time.Hour)
+
+	start := time.Now()
+	exp.ExportNow(&trace.SpanData{Name: "urgent"})
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("ExportNow blocked for %v", d)
+	}
+
+	<-time.After(200 * time.Millisecond)
+	spans := ma.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans sent before the batch timeout: got %d want %d", g, w)
+	}
+	if g, w := spans[0].Name.GetValue(), "urgent"; g != w {
+		t.Errorf("Span name: got %q want %q", g, w)
+	}
+}
+
+func TestExporter_teeSinksGetTheirOwnNode(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+	legacy := runMockAgent(t)
+	defer legacy.stop()
+	otlp := runMockAgent(t)
+	defer otlp.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithServiceName("checkout"),
+		ocagent.WithTeeSinks(
+			ocagent.Sink{Address: fmt.Sprintf("localhost:%d", legacy.port)},
+			ocagent.Sink{
+				Address:        fmt.Sprintf("localhost:%d", otlp.port),
+				ServiceName:    "checkout-v2",
+				NodeAttributes: map[string]string{"service.name": "checkout-v2"},
+			},
+		))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.ExportSpan(&trace.SpanData{Name: "mirrored"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+
+	tests := []struct {
+		name        string
+		agent       *mockAgent
+		serviceName string
+		attributes  map[string]string
+	}{
+		{name: "main", agent: ma, serviceName: "checkout"},
+		{name: "legacy", agent: legacy, serviceName: "checkout"},
+		{name: "otlp", agent: otlp, serviceName: "checkout-v2", attributes: map[string]string{"service.name": "checkout-v2"}},
+	}
+	for _, tt := range tests {
+		tt.agent.stop()
+		if g, w := len(tt.agent.getSpans()), 1; g != w {
+			t.Errorf("%s: spans got %d want %d", tt.name, g, w)
+		}
+		nodes := tt.agent.getTraceNodes()
+		if len(nodes) == 0 {
+			t.Errorf("%s: received no node", tt.name)
+			continue
+		}
+		if g, w := nodes[0].GetServiceInfo().GetName(), tt.serviceName; g != w {
+			t.Errorf("%s: service name got %q want %q", tt.name, g, w)
+		}
+		attributes := nodes[0].Attributes
+		if len(attributes) == 0 {
+			attributes = nil
+		}
+		if g, w := attributes, tt.attributes; !reflect.DeepEqual(g, w) {
+			t.Errorf("%s: node attributes got %v want %v", tt.name, g, w)
+		}
+	}
+}
+
+func TestExporter_shardByTraceIDKeepsTracesTogether(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+	shards := []*mockAgent{runMockAgent(t), runMockAgent(t)}
+	var addrs []string
+	for _, shard := range shards {
+		defer shard.stop()
+		addrs = append(addrs, fmt.Sprintf("localhost:%d", shard.port))
+	}
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithShardByTraceID(addrs))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	const traces, spansPerTrace = 8, 3
+	for i := 0; i < traces; i++ {
+		for j := 0; j < spansPerTrace; j++ {
+			exp.ExportSpan(&trace.SpanData{
+				SpanContext: trace.SpanContext{TraceID: trace.TraceID{byte(i + 1)}, SpanID: trace.SpanID{byte(j + 1)}},
+				Name:        fmt.Sprintf("trace-%d", i),
+			})
+		}
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	if g := len(ma.getSpans()); g != 0 {
+		t.Errorf("Spans sent to the main agent: got %d want 0", g)
+	}
+	shardOf := make(map[string]int)
+	total := 0
+	for i, shard := range shards {
+		shard.stop()
+		for _, span := range shard.getSpans() {
+			total++
+			name := span.Name.GetValue()
+			if prev, ok := shardOf[name]; ok && prev != i {
+				t.Errorf("%s: spans split across shards %d and %d", name, prev, i)
+			}
+			shardOf[name] = i
+		}
+	}
+	if g, w := total, traces*spansPerTrace; g != w {
+		t.Errorf("Spans across shards: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_StartWaitsForInitialConfig(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	const delay = 150 * time.Millisecond
+	go func() {
+		<-time.After(delay)
+		ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+			Config: &tracepb.TraceConfig{
+				Sampler: &tracepb.TraceConfig_ConstantSampler{
+					ConstantSampler: &tracepb.ConstantSampler{Decision: true},
+				},
+			},
+		}
+	}()
+
+	start := time.Now()
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithWaitForInitialConfig(5*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	if d := time.Since(start); d < delay || d >= 5*time.Second {
+		t.Errorf("Start returned after %v, want after the config (%v) and before the timeout", d, delay)
+	}
+}
+
+func TestExporter_StartStopsWaitingForInitialConfigAtTimeout(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	const timeout = 200 * time.Millisecond
+	start := time.Now()
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithWaitForInitialConfig(timeout))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	if d := time.Since(start); d < timeout || d >= time.Second {
+		t.Errorf("Start returned after %v, want right after the %v timeout", d, timeout)
+	}
+}
+
+func TestExporter_fallbackSinkWhileCircuitOpen(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+	fallback := runMockAgent(t)
+	defer fallback.stop()
+
+	cooldown := 300 * time.Millisecond
+	networkChanges := make(chan struct{})
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithErrorThreshold(2, time.Minute), ocagent.WithCircuitBreakerCooldown(cooldown),
+		ocagent.WithFallbackSink(ocagent.Sink{Address: fmt.Sprintf("localhost:%d", fallback.port)}),
+		ocagent.WithNetworkChangeSignal(networkChanges))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exportAndFlush := func(name string) {
+		exp.ExportSpan(&trace.SpanData{Name: name})
+		exp.Flush()
+	}
+	spanNames := func(agent *mockAgent) map[string]int {
+		names := make(map[string]int)
+		for _, span := range agent.getSpans() {
+			names[span.Name.GetValue()]++
+		}
+		return names
+	}
+
+	// Take the primary agent down until the failures trip the breaker.
+	ma.stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for exp.Stats().ExportFailures < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Exports never failed: %+v", exp.Stats())
+		}
+		exportAndFlush("tripping")
+		<-time.After(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		exportAndFlush("outage")
+	}
+	<-time.After(100 * time.Millisecond)
+	if g, w := spanNames(fallback)["outage"], 3; g != w {
+		t.Errorf("Spans sent to the fallback during the outage: got %d want %d", g, w)
+	}
+	if g := exp.Stats().SpansDropped[ocagent.DropReasonCircuitOpen]; g != 0 {
+		t.Errorf("Spans dropped with a fallback sink: got %d want 0", g)
+	}
+
+	// Bring the primary back and reconnect to it; after the cooldown the
+	// probe succeeds and spans return to the primary.
+	recovered := runMockAgentAtAddr(t, fmt.Sprintf(":%d", ma.port))
+	defer recovered.stop()
+	networkChanges <- struct{}{}
+	<-time.After(cooldown)
+	exportAndFlush("recovered")
+	exportAndFlush("recovered")
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	recovered.stop()
+	fallback.stop()
+
+	if g, w := spanNames(recovered)["recovered"], 2; g != w {
+		t.Errorf("Spans sent to the recovered primary: got %d want %d", g, w)
+	}
+	if g := spanNames(fallback)["recovered"]; g != 0 {
+		t.Errorf("Spans sent to the fallback after recovery: got %d want 0", g)
+	}
+}
+
+func TestExporter_dropsSpansPastTheirExportDeadline(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithExportDeadlinePropagationFromSpan())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	now := time.Now()
+	exp.ExportSpan(&trace.SpanData{
+		Name:       "expired",
+		Attributes: map[string]interface{}{ocagent.ExportDeadlineAttributeKey: now.Add(-time.Second).UnixNano()},
+	})
+	exp.ExportSpan(&trace.SpanData{
+		Name:       "expired-rfc3339",
+		Attributes: map[string]interface{}{ocagent.ExportDeadlineAttributeKey: now.Add(-time.Second).Format(time.RFC3339Nano)},
+	})
+	exp.ExportSpan(&trace.SpanData{
+		Name:       "fresh",
+		Attributes: map[string]interface{}{ocagent.ExportDeadlineAttributeKey: now.Add(time.Hour).UnixNano()},
+	})
+	exp.ExportSpan(&trace.SpanData{Name: "no-deadline"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonStale], int64(2); g != w {
+		t.Errorf("Stale spans: got %d want %d", g, w)
+	}
+	var names []string
+	for _, span := range ma.getSpans() {
+		names = append(names, span.Name.GetValue())
+	}
+	if g, w := strings.Join(names, ","), "fresh,no-deadline"; g != w {
+		t.Errorf("Spans sent: got %q want %q", g, w)
+	}
+}
+
+func TestExporter_stateChannelReportsTransitions(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	states := make(chan ocagent.ConnectionState, 16)
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithStateChannel(states))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// waitFor consumes states until want arrives, failing after a timeout.
+	waitFor := func(want ocagent.ConnectionState) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case got := <-states:
+				if got == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %v, currently %v", want, exp.ConnectionState())
+			}
+		}
+	}
+
+	if g, w := <-states, ocagent.Connecting; g != w {
+		t.Errorf("First state: got %v want %v", g, w)
+	}
+	waitFor(ocagent.Connected)
+
+	ma.stop()
+	waitFor(ocagent.Disconnected)
+
+	restored := runMockAgentAtAddr(t, fmt.Sprintf(":%d", ma.port))
+	defer restored.stop()
+	waitFor(ocagent.Connected)
+	if g, w := exp.ConnectionState(), ocagent.Connected; g != w {
+		t.Errorf("ConnectionState: got %v want %v", g, w)
+	}
+
+	exp.Stop()
+	waitFor(ocagent.Disconnected)
+}
+
+func TestNewExporter_agentCompatibilityCheck(t *testing.T) {
+	// A gRPC server that serves something other than the trace service.
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to get an address: %v", err)
+	}
+	srv := grpc.NewServer()
+	go srv.Serve(ln)
+	defer srv.Stop()
+	_, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(uint16(port)),
+		ocagent.WithAgentCompatibilityCheck())
+	if err == nil {
+		exp.Stop()
+		t.Fatal("NewExporter against a server without the trace service: got nil error")
+	}
+	if !strings.Contains(err.Error(), "does not serve the OpenCensus agent trace service") {
+		t.Errorf("Error is not a clear compatibility error: %v", err)
+	}
+
+	// A real agent passes the check.
+	ma := runMockAgent(t)
+	defer ma.stop()
+	exp, err = ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithAgentCompatibilityCheck())
+	if err != nil {
+		t.Fatalf("NewExporter against an agent: %v", err)
+	}
+	exp.Stop()
+}
+
+func TestExporter_ExportSpanConcurrentWithStop(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	const goroutines = 32
+	stopped := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Keep exporting until well after Stop has returned.
+			for j := 0; ; j++ {
+				select {
+				case <-stopped:
+					if j%2 == 0 {
+						exp.ExportNow(&trace.SpanData{Name: "after-stop"})
+					} else {
+						exp.ExportSpan(&trace.SpanData{Name: "after-stop"})
+					}
+					return
+				default:
+				}
+				exp.ExportSpan(&trace.SpanData{Name: fmt.Sprintf("span-%d-%d", i, j)})
+			}
+		}(i)
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if err := exp.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	close(stopped)
+	wg.Wait()
+
+	// Besides the last span of every goroutine, any exported between Stop
+	// returning and stopped being closed is dropped too.
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonStopped], int64(goroutines); g < w {
+		t.Errorf("Spans dropped after Stop: got %d want at least %d", g, w)
+	}
+}
+
+func TestExporter_StopLeavesNoGoroutines(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+	sink := runMockAgent(t)
+	defer sink.stop()
+
+	baseline := exporterGoroutines()
+	for i := 0; i < 3; i++ {
+		exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+			ocagent.WithNetworkChangeSignal(make(chan struct{})),
+			ocagent.WithStateChannel(make(chan ocagent.ConnectionState, 1)),
+			ocagent.WithUnifiedStream(),
+			ocagent.WithErrorThreshold(3, time.Minute),
+			ocagent.WithTeeSinks(ocagent.Sink{Address: fmt.Sprintf("localhost:%d", sink.port)}),
+			ocagent.WithResourceDetectors(func(context.Context) (map[string]string, error) {
+				return map[string]string{"host.id": "leak-test"}, nil
+			}))
+		if err != nil {
+			t.Fatalf("Failed to create a new agent exporter: %v", err)
+		}
+		exp.ExportSpan(&trace.SpanData{Name: "span"})
+		exp.ExportNow(&trace.SpanData{Name: "now"})
+		exp.SetBatchTimeout(time.Second)
+		exp.Flush()
+		if err := exp.Stop(); err != nil {
+			t.Fatalf("Stop: %v", err)
+		}
+	}
+	checkNoGoroutineLeaks(t, baseline)
+}
+
+func TestExporter_SetNodeAttributesWarnsOnVolatileValues(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	var logs bytes.Buffer
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	err = exp.SetNodeAttributes(map[string]string{
+		"region":     "westeurope",
+		"request.id": "6f1c0e0a-8c4e-4d7b-9a55-0d3f5e2b7c11",
+	})
+	if err != nil {
+		t.Fatalf("SetNodeAttributes: %v", err)
+	}
+	exp.ExportSpan(&trace.SpanData{Name: "after-node-change"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	if g := logs.String(); !strings.Contains(g, `"request.id"`) || strings.Contains(g, `"region"`) {
+		t.Errorf("Got logs %q, want a warning about request.id only", g)
+	}
+	nodes := ma.getTraceNodes()
+	last := nodes[len(nodes)-1]
+	if last == nil || last.Attributes["region"] != "westeurope" {
+		t.Errorf("The new node was not sent with the next batch, got %v", last)
+	}
+}
+
+func TestExporter_WithStableNodeOnlyRejectsNodeChanges(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithStableNodeOnly())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	if err := exp.SetNodeAttributes(map[string]string{"region": "westeurope"}); err != nil {
+		t.Fatalf("SetNodeAttributes before Start: %v", err)
+	}
+	if err := exp.Start(); err != nil {
+		t.Fatalf("Failed to start the exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	err = exp.SetNodeAttributes(map[string]string{"request.id": "42"})
+	if err != ocagent.ErrStableNode {
+		t.Fatalf("SetNodeAttributes after Start: got error %v want %v", err, ocagent.ErrStableNode)
+	}
+
+	exp.ExportSpan(&trace.SpanData{Name: "span"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	for i, node := range ma.getTraceNodes() {
+		if node == nil {
+			continue
+		}
+		if _, ok := node.Attributes["request.id"]; ok {
+			t.Errorf("Node #%d changed mid-run: %v", i, node.Attributes)
+		}
+		if g, w := node.Attributes["region"], "westeurope"; g != w {
+			t.Errorf("Node #%d region: got %q want %q", i, g, w)
+		}
+	}
+}
+
+func TestExporter_SubscribeFansOutEvents(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	networkChanges := make(chan struct{})
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithNetworkChangeSignal(networkChanges))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	fast, cancelFast := exp.Subscribe()
+	defer cancelFast()
+	// slow is never read from until the end, and overflows.
+	slow, cancelSlow := exp.Subscribe()
+	defer cancelSlow()
+
+	next := func() ocagent.Event {
+		select {
+		case ev := <-fast:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("The fast subscriber got no event")
+		}
+		return ocagent.Event{}
+	}
+
+	const drops = 100
+	var got []ocagent.Event
+	for i := 0; i < drops; i++ {
+		exp.ExportSpan(nil)
+		ev := next()
+		if ev.Type != ocagent.EventSpansDropped || ev.DropReason != ocagent.DropReasonMalformed || ev.Dropped != 1 {
+			t.Fatalf("Event #%d: got %+v want one malformed span dropped", i, ev)
+		}
+		got = append(got, ev)
+	}
+	networkChanges <- struct{}{}
+	if ev := next(); ev.Type != ocagent.EventReconnected {
+		t.Errorf("Event after the network change: got %v want %v", ev.Type, ocagent.EventReconnected)
+	}
+
+	exp.Stop()
+	var slowGot []ocagent.Event
+	for ev := range slow {
+		slowGot = append(slowGot, ev)
+	}
+	if len(slowGot) == 0 || len(slowGot) >= drops {
+		t.Fatalf("The slow subscriber got %d events, want some but not all of them", len(slowGot))
+	}
+	if !reflect.DeepEqual(slowGot, got[:len(slowGot)]) {
+		t.Errorf("The subscribers got different events:\nslow %v\nfast %v", slowGot, got[:len(slowGot)])
+	}
+	if _, ok := <-fast; ok {
+		t.Error("The subscription is still open after Stop")
+	}
+}
+
+func TestExporter_SubscribeAfterRestart(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.Stop()
+	if err := exp.Start(); err != nil {
+		t.Fatalf("Failed to restart the exporter: %v", err)
+	}
+	events, cancel := exp.Subscribe()
+	defer cancel()
+
+	exp.ExportSpan(nil)
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("The subscription made after the restart is closed")
+		}
+		if ev.Type != ocagent.EventSpansDropped {
+			t.Errorf("Event: got %v want %v", ev.Type, ocagent.EventSpansDropped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The subscriber got no event")
+	}
+
+	exp.ExportSpan(&trace.SpanData{Name: "after-restart"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	if g, w := len(ma.getSpans()), 1; g != w {
+		t.Errorf("Spans exported after the restart: got %d want %d", g, w)
+	}
+}
+
+func TestSpanRouter_routesSpansToTheirTenantsExporter(t *testing.T) {
+	agentA := runMockAgent(t)
+	defer agentA.stop()
+	agentB := runMockAgent(t)
+	defer agentB.stop()
+
+	expA, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agentA.port))
+	if err != nil {
+		t.Fatalf("Failed to create the exporter of tenant a: %v", err)
+	}
+	defer expA.Stop()
+	expB, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agentB.port))
+	if err != nil {
+		t.Fatalf("Failed to create the exporter of tenant b: %v", err)
+	}
+	defer expB.Stop()
+
+	router := ocagent.NewSpanRouter("tenant")
+	router.Route("a", expA)
+	router.Route("b", expB)
+	trace.RegisterExporter(router)
+	defer trace.UnregisterExporter(router)
+
+	startSpan := func(tenant, name string) {
+		_, span := trace.StartSpan(context.Background(), name, trace.WithSampler(trace.AlwaysSample()))
+		if tenant != "" {
+			span.AddAttributes(trace.StringAttribute("tenant", tenant))
+		}
+		span.End()
+	}
+	startSpan("a", "a-1")
+	startSpan("b", "b-1")
+	startSpan("a", "a-2")
+	startSpan("", "no-tenant")
+	startSpan("c", "unknown-tenant")
+
+	for _, exp := range []*ocagent.Exporter{expA, expB} {
+		exp.Flush()
+	}
+	<-time.After(100 * time.Millisecond)
+	expA.Stop()
+	expB.Stop()
+	agentA.stop()
+	agentB.stop()
+
+	names := func(ma *mockAgent) []string {
+		var names []string
+		for _, span := range ma.getSpans() {
+			names = append(names, span.Name.GetValue())
+		}
+		return names
+	}
+	if g, w := names(agentA), []string{"a-1", "a-2"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("Spans of tenant a: got %v want %v", g, w)
+	}
+	if g, w := names(agentB), []string{"b-1"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("Spans of tenant b: got %v want %v", g, w)
+	}
+	if g, w := router.Unrouted(), int64(2); g != w {
+		t.Errorf("Unrouted spans: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_dropSampleHandlerSeesDropReasons(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	type drop struct {
+		name, reason string
+	}
+	drops := make(chan drop, 10)
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithExportNameAllowlist([]string{"allowed"}),
+		ocagent.WithDropSampleHandler(1, func(sd *trace.SpanData, reason string) {
+			drops <- drop{sd.Name, reason}
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	next := func() drop {
+		select {
+		case d := <-drops:
+			return d
+		case <-time.After(time.Second):
+			t.Fatal("The drop sample handler was not called")
+		}
+		return drop{}
+	}
+
+	exp.ExportSpan(&trace.SpanData{Name: "denied"})
+	if g, w := next(), (drop{"denied", ocagent.DropReasonNameNotAllowed}); g != w {
+		t.Errorf("Drop: got %+v want %+v", g, w)
+	}
+	exp.ExportSpan(&trace.SpanData{Name: "allowed"})
+	exp.Stop()
+	exp.ExportSpan(&trace.SpanData{Name: "allowed"})
+	if g, w := next(), (drop{"allowed", ocagent.DropReasonStopped}); g != w {
+		t.Errorf("Drop: got %+v want %+v", g, w)
+	}
+	select {
+	case d := <-drops:
+		t.Errorf("Unexpected drop of a span that was sent: %+v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestExporter_dropSampleHandlerSamplesFraction(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	var mu sync.Mutex
+	sampled := 0
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithDropSampleHandler(0.25, func(sd *trace.SpanData, reason string) {
+			mu.Lock()
+			sampled++
+			mu.Unlock()
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	exp.Stop()
+
+	const drops = 400
+	for i := 0; i < drops; i++ {
+		exp.ExportSpan(&trace.SpanData{Name: "late"})
+		// Let the handler calls finish so that none are skipped as busy.
+		<-time.After(100 * time.Microsecond)
+	}
+	<-time.After(50 * time.Millisecond)
+
+	if g, w := exp.Stats().SpansDropped[ocagent.DropReasonStopped], int64(drops); g != w {
+		t.Fatalf("Dropped spans: got %d want %d", g, w)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sampled < drops/8 || sampled > drops/2 {
+		t.Errorf("Sampled drops: got %d want about %d", sampled, drops/4)
+	}
+}
+
+func TestExporter_idleActivityPingKeepsStreamOpen(t *testing.T) {
+	closes, spans := exportAfterIdle(t, ocagent.WithIdleActivityPing(50*time.Millisecond))
+	if closes != 0 || spans != 1 {
+		t.Errorf("With pings: got %d idle closes and %d spans want 0 and 1", closes, spans)
+	}
+
+	// Without pings, the agent closes the stream and the span is lost.
+	closes, spans = exportAfterIdle(t)
+	if closes != 1 || spans != 0 {
+		t.Errorf("Without pings: got %d idle closes and %d spans want 1 and 0", closes, spans)
+	}
+}
+
+func TestExporter_exportRetriesReopenTheStream(t *testing.T) {
+	// The agent closes the stream before the span is sent, failing the send.
+	closes, spans := exportAfterIdle(t, ocagent.WithExportRetries(2, 10*time.Millisecond))
+	if closes != 1 || spans != 1 {
+		t.Errorf("With retries: got %d idle closes and %d spans want 1 and 1", closes, spans)
+	}
+}
+
+// exportAfterIdle exports a span after the exporter has been idle for longer
+// than the agent lets streams idle, and returns the number of streams that
+// the agent closed and of spans that it received.
+func exportAfterIdle(t *testing.T, opts ...ocagent.ExporterOption) (closes, spans int) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+	ma.setIdleTimeout(150 * time.Millisecond)
+
+	opts = append(opts, ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	exp, err := ocagent.NewExporter(opts...)
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	<-time.After(400 * time.Millisecond)
+	exp.ExportSpan(&trace.SpanData{Name: "after-idle"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	return ma.getIdleCloses(), len(ma.getSpans())
+}
+
+func TestExporter_ForceReconnectIfStale(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	reconnect := func(maxAge time.Duration, want bool) {
+		t.Helper()
+		reconnected, err := exp.ForceReconnectIfStale(maxAge)
+		if err != nil {
+			t.Fatalf("ForceReconnectIfStale(%v): %v", maxAge, err)
+		}
+		if reconnected != want {
+			t.Errorf("ForceReconnectIfStale(%v): got %v want %v", maxAge, reconnected, want)
+		}
+	}
+
+	// A fresh connection is left alone.
+	reconnect(time.Hour, false)
+	<-time.After(100 * time.Millisecond)
+	// An old one is cycled, and the new one is then fresh.
+	reconnect(50*time.Millisecond, true)
+	reconnect(50*time.Millisecond, false)
+
+	<-time.After(100 * time.Millisecond)
+	if g, w := ma.getTraceStreams(), 2; g != w {
+		t.Errorf("Trace streams: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_DumpQueueCanBeReplayed(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	exp.SetBatchTimeout(time.Hour)
+
+	names := []string{"queued-1", "queued-2", "queued-3"}
+	for _, name := range names {
+		exp.ExportSpan(&trace.SpanData{Name: name, SpanContext: trace.SpanContext{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}}})
+	}
+	var dump bytes.Buffer
+	if err := exp.DumpQueue(&dump); err != nil {
+		t.Fatalf("DumpQueue: %v", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	if g := len(ma.getSpans()); g != 0 {
+		t.Fatalf("Dumped spans were also sent: got %d spans want 0", g)
+	}
+
+	spans, err := ocagent.ReadQueueDump(&dump)
+	if err != nil {
+		t.Fatalf("ReadQueueDump: %v", err)
+	}
+	if err := exp.ExportProtoSpans(context.Background(), spans); err != nil {
+		t.Fatalf("ExportProtoSpans: %v", err)
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	var got []string
+	for _, span := range ma.getSpans() {
+		got = append(got, span.Name.GetValue())
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("Replayed spans: got %v want %v", got, names)
+	}
+}
+
+func TestExporter_ReapplyCurrentConfig(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	if err := exp.ReapplyCurrentConfig(); err == nil {
+		t.Error("ReapplyCurrentConfig before any config: expected an error")
+	}
+
+	sampled := func() bool {
+		_, span := trace.StartSpan(context.Background(), "sampler-probe")
+		defer span.End()
+		return span.SpanContext().IsSampled()
+	}
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ConstantSampler{
+				ConstantSampler: &tracepb.ConstantSampler{Decision: true},
+			},
+		},
+	}
+	<-time.After(50 * time.Millisecond)
+	if !sampled() {
+		t.Fatal("The agent's always-sample config was not applied")
+	}
+
+	// Some other component changes the global sampler behind our back.
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+	if sampled() {
+		t.Fatal("The external sampler change did not take effect")
+	}
+
+	if err := exp.ReapplyCurrentConfig(); err != nil {
+		t.Fatalf("ReapplyCurrentConfig: %v", err)
+	}
+	if !sampled() {
+		t.Error("The agent's sampler was not restored")
+	}
+}
+
+func TestExporter_LocalConfigFile(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	dir, err := ioutil.TempDir("", "ocagent")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace_config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"constantSampler": {"decision": true}}`), 0644); err != nil {
+		t.Fatalf("Failed to write the config file: %v", err)
+	}
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithLocalConfigFile(path), ocagent.WithIgnoreRemoteConfig())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	sampled := func() bool {
+		_, span := trace.StartSpan(context.Background(), "sampler-probe")
+		defer span.End()
+		return span.SpanContext().IsSampled()
+	}
+	if !sampled() {
+		t.Fatal("The always-sample config in the file was not applied")
+	}
+
+	// The agent's config must not override the file's.
+	ma.configsToSend <- &agenttracepb.UpdatedLibraryConfig{
+		Config: &tracepb.TraceConfig{
+			Sampler: &tracepb.TraceConfig_ConstantSampler{
+				ConstantSampler: &tracepb.ConstantSampler{Decision: false},
+			},
+		},
+	}
+	<-time.After(50 * time.Millisecond)
+	if !sampled() {
+		t.Fatal("The agent's never-sample config was applied")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"constantSampler": {}}`), 0644); err != nil {
+		t.Fatalf("Failed to rewrite the config file: %v", err)
+	}
+	<-time.After(1500 * time.Millisecond)
+	if sampled() {
+		t.Error("The never-sample config written to the file was not applied")
+	}
+}
+
+func TestExporter_localConfigFileWithoutAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocagent")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace_config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"constantSampler": {"decision": true}}`), 0644); err != nil {
+		t.Fatalf("Failed to write the config file: %v", err)
+	}
+
+	// No agent listens there, and the exporter is never started.
+	exp, err := ocagent.NewUnstartedExporter(ocagent.WithInsecure(), ocagent.WithPort(1),
+		ocagent.WithLocalConfigFile(path))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	sampled := func() bool {
+		_, span := trace.StartSpan(context.Background(), "sampler-probe")
+		defer span.End()
+		return span.SpanContext().IsSampled()
+	}
+	if !sampled() {
+		t.Fatal("The always-sample config in the file was not applied")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"constantSampler": {}}`), 0644); err != nil {
+		t.Fatalf("Failed to rewrite the config file: %v", err)
+	}
+	<-time.After(1500 * time.Millisecond)
+	if sampled() {
+		t.Error("The never-sample config written to the file was not applied")
+	}
+}
+
+// spanRecorder is a trace.Exporter keeping the spans it is given.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (sr *spanRecorder) ExportSpan(sd *trace.SpanData) {
+	sr.mu.Lock()
+	sr.spans = append(sr.spans, sd)
+	sr.mu.Unlock()
+}
+
+func (sr *spanRecorder) getSpans() []*trace.SpanData {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return append([]*trace.SpanData(nil), sr.spans...)
+}
+
+func TestExporter_selfTracingReportsExports(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	sink := new(spanRecorder)
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithSelfTracing(sink))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	for i := 0; i < 3; i++ {
+		exp.ExportSpan(&trace.SpanData{Name: fmt.Sprintf("span-%d", i)})
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	ma.stop()
+
+	selfSpans := sink.getSpans()
+	if g, w := len(selfSpans), 1; g != w {
+		t.Fatalf("Self-tracing spans: got %d want %d", g, w)
+	}
+	sd := selfSpans[0]
+	if g, w := sd.Name, "ocagent.Export"; g != w {
+		t.Errorf("Name: got %q want %q", g, w)
+	}
+	if g, w := sd.Attributes[ocagent.SelfTraceBatchSizeAttributeKey], int64(3); g != w {
+		t.Errorf("Batch size: got %v want %v", g, w)
+	}
+	if sd.Status.Code != 0 || sd.EndTime.Before(sd.StartTime) {
+		t.Errorf("Got status %+v from %v to %v, want a successful export", sd.Status, sd.StartTime, sd.EndTime)
+	}
+	if g, w := len(ma.getSpans()), 3; g != w {
+		t.Errorf("Spans sent to the agent: got %d want %d", g, w)
+	}
+}
+
+// exporterFunc adapts a function to a trace.Exporter.
+type exporterFunc func(*trace.SpanData)
+
+func (ef exporterFunc) ExportSpan(sd *trace.SpanData) { ef(sd) }
+
+func TestExporter_selfTracingToItselfDoesNotLoop(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	var exp *ocagent.Exporter
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithSelfTracing(exporterFunc(func(sd *trace.SpanData) { exp.ExportSpan(sd) })))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.ExportSpan(&trace.SpanData{Name: "user"})
+	for i := 0; i < 3; i++ {
+		exp.Flush()
+		<-time.After(50 * time.Millisecond)
+	}
+	// The batch that Stop sends is self-traced while Stop is under way,
+	// which must not deadlock.
+	exp.ExportSpan(&trace.SpanData{Name: "last"})
+	exp.Stop()
+	ma.stop()
+
+	var names []string
+	for _, span := range ma.getSpans() {
+		names = append(names, span.Name.GetValue())
+	}
+	if len(names) > 2 {
+		// Only the last batch may follow, and its self-tracing span comes
+		// after Stop.
+		names = names[:2]
+	}
+	if g, w := names, []string{"user", "ocagent.Export"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("Spans sent to the agent: got %v want %v", g, w)
+	}
+}
+
+func TestExporter_batchCoalescingAcrossFlushes(t *testing.T) {
+	ma := runMockAgent(t)
+	defer ma.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(ma.port),
+		ocagent.WithBatchCoalescingAcrossFlushes(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+	exp.SetBatchTimeout(time.Hour)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			exp.ExportSpan(&trace.SpanData{Name: fmt.Sprintf("span-%d", i)})
+			exp.Flush()
+		}(i)
+	}
+	wg.Wait()
+	<-time.After(100 * time.Millisecond)
+
+	if g, w := exp.Stats().ExportAttempts, int64(1); g != w {
+		t.Errorf("Exports: got %d want %d", g, w)
+	}
+	if g, w := len(ma.getSpans()), callers; g != w {
+		t.Errorf("Spans: got %d want %d", g, w)
+	}
+}
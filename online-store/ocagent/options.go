@@ -0,0 +1,954 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	DefaultAgentPort uint16 = 55678
+	DefaultAgentHost string = "localhost"
+)
+
+type ExporterOption interface {
+	withExporter(e *Exporter)
+}
+
+type portSetter uint16
+
+func (ps portSetter) withExporter(e *Exporter) {
+	e.agentPort = uint16(ps)
+}
+
+var _ ExporterOption = (*portSetter)(nil)
+
+type insecureGrpcConnection int
+
+var _ ExporterOption = (*insecureGrpcConnection)(nil)
+
+func (igc *insecureGrpcConnection) withExporter(e *Exporter) {
+	e.canDialInsecure = true
+}
+
+// WithInsecure disables client transport security for the exporter's gRPC connection
+// just like grpc.WithInsecure() https://godoc.org/google.golang.org/grpc#WithInsecure
+// does. Note, by default, client security is required unless WithInsecure is used.
+func WithInsecure() ExporterOption { return new(insecureGrpcConnection) }
+
+type clientCredentials struct {
+	credentials.TransportCredentials
+}
+
+var _ ExporterOption = (*clientCredentials)(nil)
+
+func (cc clientCredentials) withExporter(e *Exporter) {
+	e.clientCredentials = cc.TransportCredentials
+}
+
+// WithTLSCredentials secures the exporter's gRPC connection to the agent
+// with creds, such as credentials.NewTLS with a tls.Config holding the
+// agent's CA and, for mutual TLS, the client's own certificate. It takes
+// precedence over WithInsecure.
+func WithTLSCredentials(creds credentials.TransportCredentials) ExporterOption {
+	return clientCredentials{creds}
+}
+
+// WithPort allows one to override the port that the exporter will
+// connect to the agent on, instead of using DefaultAgentPort.
+func WithPort(port uint16) ExporterOption {
+	return portSetter(port)
+}
+
+type addressSetter string
+
+func (as addressSetter) withExporter(e *Exporter) {
+	e.agentAddress = string(as)
+}
+
+var _ ExporterOption = (*addressSetter)(nil)
+
+// WithAddress allows one to set the address that the exporter will
+// connect to the agent on. If unset, it will instead try to use
+// connect to DefaultAgentHost:DefaultAgentPort
+func WithAddress(addr string) ExporterOption {
+	return addressSetter(addr)
+}
+
+type serviceNameSetter string
+
+func (sns serviceNameSetter) withExporter(e *Exporter) {
+	e.serviceName = string(sns)
+}
+
+var _ ExporterOption = (*serviceNameSetter)(nil)
+
+// WithServiceName allows one to set/override the service name
+// that the exporter will report to the agent.
+func WithServiceName(serviceName string) ExporterOption {
+	return serviceNameSetter(serviceName)
+}
+
+type errorThreshold struct {
+	count  int
+	window time.Duration
+}
+
+var _ ExporterOption = (*errorThreshold)(nil)
+
+func (et errorThreshold) withExporter(e *Exporter) {
+	e.errorThreshold = et.count
+	e.errorWindow = et.window
+}
+
+// WithErrorThreshold enables a circuit breaker on span exports: once count
+// exports have failed within window, the circuit opens and spans are dropped
+// without attempting an RPC until the cooldown (by default, the same as
+// window) has elapsed. A single export is then let through to probe whether
+// the agent has recovered.
+func WithErrorThreshold(count int, window time.Duration) ExporterOption {
+	return errorThreshold{count: count, window: window}
+}
+
+type circuitBreakerCooldown time.Duration
+
+var _ ExporterOption = (*circuitBreakerCooldown)(nil)
+
+func (cbc circuitBreakerCooldown) withExporter(e *Exporter) {
+	e.errorCooldown = time.Duration(cbc)
+}
+
+// WithCircuitBreakerCooldown sets how long the circuit breaker enabled by
+// WithErrorThreshold stays open before probing the agent again.
+func WithCircuitBreakerCooldown(d time.Duration) ExporterOption {
+	return circuitBreakerCooldown(d)
+}
+
+type histogramBucketMapper HistogramBucketMapper
+
+var _ ExporterOption = (*histogramBucketMapper)(nil)
+
+func (hbm histogramBucketMapper) withExporter(e *Exporter) {
+	e.metricConversion.mapBuckets = HistogramBucketMapper(hbm)
+}
+
+// WithHistogramBucketMapper allows one to re-bucket distribution views
+// before they are exported, for backends that expect fixed histogram
+// bucket boundaries. See HistogramBucketMapper.
+func WithHistogramBucketMapper(fn HistogramBucketMapper) ExporterOption {
+	return histogramBucketMapper(fn)
+}
+
+type traceOptionsAttribute bool
+
+var _ ExporterOption = (*traceOptionsAttribute)(nil)
+
+func (toa traceOptionsAttribute) withExporter(e *Exporter) {
+	e.spanConversion.includeTraceOptions = bool(toa)
+}
+
+// WithTraceOptions makes the exporter carry each span's trace options
+// (the sampled and debug flags) to the agent, under the
+// TraceOptionsAttributeKey attribute, so that backends can route on them.
+func WithTraceOptions() ExporterOption {
+	return traceOptionsAttribute(true)
+}
+
+type loggerSetter struct {
+	logger *log.Logger
+}
+
+var _ ExporterOption = (*loggerSetter)(nil)
+
+func (ls loggerSetter) withExporter(e *Exporter) {
+	e.logger = ls.logger
+}
+
+// WithLogger sets the logger that the exporter reports problems to,
+// such as trace configs from the agent that could not be applied, and
+// that Stop writes a summary of the spans dropped by reason to.
+// By default nothing is logged.
+func WithLogger(logger *log.Logger) ExporterOption {
+	return loggerSetter{logger: logger}
+}
+
+type queueLatencyTracking bool
+
+var _ ExporterOption = (*queueLatencyTracking)(nil)
+
+func (qlt queueLatencyTracking) withExporter(e *Exporter) {
+	e.trackQueueLatency = bool(qlt)
+}
+
+// WithQueueLatencyTracking makes the exporter measure how long each span
+// waits between ExportSpan and its batch being sent to the agent. The
+// measurements are reported in Stats().QueueLatency.
+func WithQueueLatencyTracking() ExporterOption {
+	return queueLatencyTracking(true)
+}
+
+type requestSizeTracking bool
+
+var _ ExporterOption = (*requestSizeTracking)(nil)
+
+func (rst requestSizeTracking) withExporter(e *Exporter) {
+	e.trackRequestSize = bool(rst)
+}
+
+// WithExportRequestSizeHistogram makes the exporter record the marshaled
+// size of every export request it sends to the agent, to help size the
+// agent and its message limits. The distribution, per stream type, is
+// reported in Stats().ExportRequestBytes.
+func WithExportRequestSizeHistogram() ExporterOption {
+	return requestSizeTracking(true)
+}
+
+type connectionNameSetter string
+
+var _ ExporterOption = (*connectionNameSetter)(nil)
+
+func (cns connectionNameSetter) withExporter(e *Exporter) {
+	e.connectionName = string(cns)
+}
+
+// WithConnectionName sets the name that the exporter's gRPC connection
+// identifies itself with, to tell it apart from the other gRPC clients of
+// the process when debugging. Since gRPC channelz lists channels by their
+// target, the name is sent as the connection's user agent, which the agent
+// and any proxy in between see on every stream. It defaults to the service
+// name.
+func WithConnectionName(name string) ExporterOption {
+	return connectionNameSetter(name)
+}
+
+type exportNameMatcher func(name string) bool
+
+var _ ExporterOption = (*exportNameMatcher)(nil)
+
+func (enm exportNameMatcher) withExporter(e *Exporter) {
+	e.exportNameMatcher = enm
+}
+
+// WithExportNameAllowlist restricts the spans sent to the agent to those
+// named exactly as one of names. Other spans are dropped before conversion
+// and counted under DropReasonNameNotAllowed.
+func WithExportNameAllowlist(names []string) ExporterOption {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return exportNameMatcher(func(name string) bool { return allowed[name] })
+}
+
+// WithExportNameMatcher is like WithExportNameAllowlist, but lets match
+// decide which span names are exported.
+func WithExportNameMatcher(match func(name string) bool) ExporterOption {
+	return exportNameMatcher(match)
+}
+
+type spanIDRemapper func(trace.SpanID) trace.SpanID
+
+var _ ExporterOption = (*spanIDRemapper)(nil)
+
+func (sir spanIDRemapper) withExporter(e *Exporter) {
+	e.spanConversion.remapSpanID = sir
+}
+
+// WithSpanIDRemapper rewrites span IDs as spans are exported, for instance
+// to re-issue or anonymize the IDs of spans passing through a gateway. The
+// span's own ID, its parent's ID and the IDs of the spans it links to are
+// all rewritten, and within a batch each ID is remapped only once, so
+// parent/child relationships between the spans of a batch are preserved.
+func WithSpanIDRemapper(remap func(trace.SpanID) trace.SpanID) ExporterOption {
+	return spanIDRemapper(remap)
+}
+
+type networkChangeSignal <-chan struct{}
+
+var _ ExporterOption = (*networkChangeSignal)(nil)
+
+func (ncs networkChangeSignal) withExporter(e *Exporter) {
+	e.networkChanges = ncs
+}
+
+// WithNetworkChangeSignal makes the exporter reconnect to the agent right
+// away whenever a value is received on changes, instead of waiting for gRPC
+// to notice that the old connection is gone. This is meant for nodes that
+// roam between networks, e.g. from wifi to cellular. The exporter stops
+// watching changes when it is stopped or when changes is closed.
+func WithNetworkChangeSignal(changes <-chan struct{}) ExporterOption {
+	return networkChangeSignal(changes)
+}
+
+type resourceDetectors []Detector
+
+var _ ExporterOption = (*resourceDetectors)(nil)
+
+func (rd resourceDetectors) withExporter(e *Exporter) {
+	e.detectors = append(e.detectors, rd...)
+}
+
+// WithResourceDetectors adds the attributes found by the detectors to the
+// Node that identifies the exporter to the agent. The detectors run in order
+// when the exporter is created, and an attribute found by a later detector
+// overrides one of the same key found by an earlier one. Each detector gets
+// a couple of seconds; one that fails or takes longer is skipped.
+func WithResourceDetectors(detectors ...Detector) ExporterOption {
+	return resourceDetectors(detectors)
+}
+
+type teeSinks []Sink
+
+var _ ExporterOption = (*teeSinks)(nil)
+
+func (ts teeSinks) withExporter(e *Exporter) {
+	e.sinks = append(e.sinks, ts...)
+}
+
+// WithTeeSinks makes the exporter mirror all the spans it exports to the
+// given sinks, in addition to its agent. Each sink can override the service
+// name and attributes that the exporter identifies itself to it with, so
+// that every destination gets the identity it expects.
+func WithTeeSinks(sinks ...Sink) ExporterOption {
+	return teeSinks(sinks)
+}
+
+type traceIDShards []string
+
+var _ ExporterOption = (*traceIDShards)(nil)
+
+func (tis traceIDShards) withExporter(e *Exporter) {
+	e.shards = append([]string(nil), tis...)
+}
+
+// WithShardByTraceID sends spans to agents that are sharded by trace ID
+// instead of to the exporter's agent: the trace ID of every span is hashed
+// to pick one of the shards' host:port addresses, so all the spans of a
+// trace land on the same shard. The exporter keeps a connection to every
+// shard. Trace configs and metrics still go through the exporter's agent.
+func WithShardByTraceID(shards []string) ExporterOption {
+	return traceIDShards(shards)
+}
+
+type initialConfigTimeout time.Duration
+
+var _ ExporterOption = (*initialConfigTimeout)(nil)
+
+func (ict initialConfigTimeout) withExporter(e *Exporter) {
+	e.initialConfigTimeout = time.Duration(ict)
+}
+
+// WithWaitForInitialConfig makes Start wait, for at most timeout, until the
+// first trace config sent down by the agent has been applied, so that the
+// agent controls sampling from the very first span. If no config is applied
+// by then, Start returns without one rather than failing.
+func WithWaitForInitialConfig(timeout time.Duration) ExporterOption {
+	return initialConfigTimeout(timeout)
+}
+
+type fallbackSink Sink
+
+var _ ExporterOption = (*fallbackSink)(nil)
+
+func (fs fallbackSink) withExporter(e *Exporter) {
+	sink := Sink(fs)
+	e.fallbackSink = &sink
+}
+
+// WithFallbackSink sends spans to sink instead of dropping them while the
+// circuit breaker set up with WithErrorThreshold is open. Once the breaker
+// lets a probe through to the agent and it succeeds, spans go back to the
+// agent. Without WithErrorThreshold the fallback sink is never used.
+//
+// The probe is sent over the exporter's current connection, so after an
+// outage that broke it, the agent is only retried once a reconnect, e.g. by
+// WithNetworkChangeSignal, has opened a new one.
+func WithFallbackSink(sink Sink) ExporterOption {
+	return fallbackSink(sink)
+}
+
+type reservedKeyPrefix string
+
+var _ ExporterOption = (*reservedKeyPrefix)(nil)
+
+func (rkp reservedKeyPrefix) withExporter(e *Exporter) {
+	e.spanConversion.reservedKeyPrefix = string(rkp)
+}
+
+// WithReservedKeyPrefix prepends prefix to the keys of span attributes that
+// start with ReservedAttributePrefix, so that user data isn't mistaken for
+// metadata of the exporter or the agent. For instance, with the prefix
+// "user.", a "opencensus.trace_options" attribute set by the application is
+// exported as "user.opencensus.trace_options".
+func WithReservedKeyPrefix(prefix string) ExporterOption {
+	return reservedKeyPrefix(prefix)
+}
+
+type exportDeadlines bool
+
+var _ ExporterOption = (*exportDeadlines)(nil)
+
+func (ed exportDeadlines) withExporter(e *Exporter) {
+	e.honorExportDeadlines = bool(ed)
+}
+
+// WithExportDeadlinePropagationFromSpan makes the exporter honor the
+// ExportDeadlineAttributeKey attribute of spans: a span whose deadline has
+// passed by the time its batch is sent is dropped, and counted as stale in
+// Stats().SpansDropped, since delivering it late is worthless.
+func WithExportDeadlinePropagationFromSpan() ExporterOption {
+	return exportDeadlines(true)
+}
+
+type stateChannel chan ConnectionState
+
+var _ ExporterOption = (*stateChannel)(nil)
+
+func (sc stateChannel) withExporter(e *Exporter) {
+	e.connState.ch = sc
+}
+
+// WithStateChannel makes the exporter send every transition of its
+// connection to the agent, as returned by ConnectionState, to ch. The
+// exporter never blocks on ch: if ch is full, the oldest state in it is
+// dropped to make room for the latest one, so ch should be buffered.
+func WithStateChannel(ch chan ConnectionState) ExporterOption {
+	return stateChannel(ch)
+}
+
+type agentCompatibilityCheck bool
+
+var _ ExporterOption = (*agentCompatibilityCheck)(nil)
+
+func (acc agentCompatibilityCheck) withExporter(e *Exporter) {
+	e.checkCompatibility = bool(acc)
+}
+
+// WithAgentCompatibilityCheck makes Start verify that the address it dialed
+// serves the agent's trace service, and fail with a clear error if it does
+// not, e.g. because it points at the wrong port. If the server's response
+// is inconclusive the check passes. It adds up to 200ms to Start.
+func WithAgentCompatibilityCheck() ExporterOption {
+	return agentCompatibilityCheck(true)
+}
+
+type exportFieldMask spanFieldMask
+
+var _ ExporterOption = (*exportFieldMask)(nil)
+
+func (efm exportFieldMask) withExporter(e *Exporter) {
+	mask := spanFieldMask(efm)
+	e.spanConversion.fieldMask = &mask
+}
+
+// WithExportFieldMask limits the optional fields of SpanData that are
+// exported to the given ones, leaving out the others before the span is
+// even converted, to save egress on constrained links. The IDs, name, kind
+// and times of spans are always exported. For instance, to leave out
+// annotations, message events and links:
+//
+//	ocagent.WithExportFieldMask(ocagent.SpanFieldAttributes, ocagent.SpanFieldStatus, ocagent.SpanFieldTracestate)
+func WithExportFieldMask(fields ...SpanField) ExporterOption {
+	var mask exportFieldMask
+	for _, f := range fields {
+		mask |= exportFieldMask(f)
+	}
+	return mask
+}
+
+type unifiedStream bool
+
+var _ ExporterOption = (*unifiedStream)(nil)
+
+func (us unifiedStream) withExporter(e *Exporter) {
+	e.unifiedStream = bool(us)
+}
+
+// WithUnifiedStream manages trace and metric exports together, over the
+// exporter's single connection to the agent: metrics from ExportView are
+// batched along with the spans instead of being sent right away, and a
+// failure to send either makes the exporter reconnect, with a shared
+// exponential backoff, reopening both streams at once.
+//
+// The tradeoff is that the two no longer fail independently: a broken
+// metrics stream also cycles the trace stream and vice versa, and metrics
+// wait for the next batch. Without this option, metrics are sent as soon as
+// they are exported, and only their own stream is reopened on failures.
+func WithUnifiedStream() ExporterOption {
+	return unifiedStream(true)
+}
+
+type monotonicTimestamps bool
+
+var _ ExporterOption = (*monotonicTimestamps)(nil)
+
+func (mt monotonicTimestamps) withExporter(e *Exporter) {
+	e.spanConversion.monotonicTimes = bool(mt)
+}
+
+// WithSpanExportTimestampSource exports the end time of spans as their start
+// time plus their duration by the monotonic clock, which the times of spans
+// recorded in this process carry, so that exported durations are right even
+// if the wall clock was stepped, e.g. by NTP, while the span was open. For
+// spans whose times have no monotonic reading, durations that come out
+// negative are exported as zero and counted in Stats().NegativeDurations.
+func WithSpanExportTimestampSource() ExporterOption {
+	return monotonicTimestamps(true)
+}
+
+type exportRetries struct {
+	retries int
+	delay   time.Duration
+}
+
+var _ ExporterOption = (*exportRetries)(nil)
+
+func (er exportRetries) withExporter(e *Exporter) {
+	e.exportRetry.retries = er.retries
+	e.exportRetry.delay = er.delay
+}
+
+// WithExportRetries resends a batch of spans that failed to export up to
+// retries more times, waiting delay before the first retry and doubling the
+// wait before each following one. Each retry goes over a new trace stream,
+// since the one the send failed on is broken. The batches are retried in the
+// background, without holding up the ones behind them, up to a few at once;
+// further failed batches are not resent. Stop cuts the waits short, giving
+// each batch one last attempt. By default a failed batch is not resent.
+func WithExportRetries(retries int, delay time.Duration) ExporterOption {
+	return exportRetries{retries: retries, delay: delay}
+}
+
+type exportRetryJitter float64
+
+var _ ExporterOption = (*exportRetryJitter)(nil)
+
+func (erj exportRetryJitter) withExporter(e *Exporter) {
+	e.exportRetry.jitter = float64(erj)
+}
+
+// WithExportRetryJitter randomly lengthens or shortens each wait between
+// the retries set up with WithExportRetries by up to fraction of it, which
+// must be between 0 and 1, e.g. 0.2 spreads a one second wait over 0.8s to
+// 1.2s. This keeps a fleet of exporters that failed at the same time from
+// retrying in lockstep against the agent. It does not affect the backoff
+// used when connecting to the agent.
+func WithExportRetryJitter(fraction float64) ExporterOption {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	return exportRetryJitter(fraction)
+}
+
+type stableNodeOnly bool
+
+var _ ExporterOption = (*stableNodeOnly)(nil)
+
+func (sn stableNodeOnly) withExporter(e *Exporter) {
+	e.stableNodeOnly = bool(sn)
+}
+
+// WithStableNodeOnly makes SetNodeAttributes fail with ErrStableNode once
+// the exporter has started, so that the Node identifying the exporter to the
+// agent stays the same for its whole run. Use it to guard against code that
+// would otherwise put per-request values in the Node and fragment the
+// agent's batching by Node.
+func WithStableNodeOnly() ExporterOption {
+	return stableNodeOnly(true)
+}
+
+type maxSpanNameLength int
+
+var _ ExporterOption = (*maxSpanNameLength)(nil)
+
+func (msnl maxSpanNameLength) withExporter(e *Exporter) {
+	e.spanConversion.maxNameLength = int(msnl)
+}
+
+// WithMaxSpanNameLength truncates the names of exported spans to at most n
+// characters, i.e. runes, for backends that reject or silently cut longer
+// names. The limit applies to the name as finally exported, after any other
+// conversion of the span. Truncated names are counted in
+// Stats().SpanNamesTruncated. Spans passed to ExportProtoSpans are sent
+// as they are.
+func WithMaxSpanNameLength(n int) ExporterOption {
+	return maxSpanNameLength(n)
+}
+
+type dropSampleHandler struct {
+	fraction float64
+	handle   func(*trace.SpanData, string)
+}
+
+var _ ExporterOption = (*dropSampleHandler)(nil)
+
+func (dsh dropSampleHandler) withExporter(e *Exporter) {
+	e.dropSampler = newDropSampler(dsh.fraction, dsh.handle)
+}
+
+// WithDropSampleHandler calls handle with about fraction, between 0 and 1,
+// of the spans the exporter drops, along with the reason they were dropped,
+// one of the DropReason constants, to help understand what is being lost
+// without logging every drop. handle runs in a goroutine of its own, and a
+// sample is skipped if too many earlier calls are still running, so a slow
+// handler never holds up exporting. Spans that are nil, or were passed to
+// ExportProtoSpans, are never sampled.
+func WithDropSampleHandler(fraction float64, handle func(sd *trace.SpanData, reason string)) ExporterOption {
+	return dropSampleHandler{fraction: fraction, handle: handle}
+}
+
+type idleActivityPing time.Duration
+
+var _ ExporterOption = (*idleActivityPing)(nil)
+
+func (iap idleActivityPing) withExporter(e *Exporter) {
+	e.idlePingInterval = time.Duration(iap)
+}
+
+// WithIdleActivityPing sends an empty export request to the agent whenever
+// no spans have been sent for interval, for proxies that close HTTP/2
+// streams without traffic even if gRPC keepalive pings get through. Without
+// it, the first spans exported after a long idle period may go to a stream
+// that the proxy has already closed. Pick an interval shorter than the
+// proxy's idle timeout; the ping goes out within 1.5 intervals of the last
+// request.
+func WithIdleActivityPing(interval time.Duration) ExporterOption {
+	return idleActivityPing(interval)
+}
+
+type metricsTagFilter func(tag.Key, string) bool
+
+var _ ExporterOption = (*metricsTagFilter)(nil)
+
+func (mtf metricsTagFilter) withExporter(e *Exporter) {
+	e.metricConversion.tagFilter = mtf
+}
+
+// WithMetricsTagFilter exports the tag values of views only when keep
+// returns true for them, to keep high-cardinality values such as user or
+// request IDs from blowing up the number of time series in the metrics
+// backend. A rejected value is exported as unset, and the rows that then
+// have the same tag values are merged into a single time series: counts,
+// sums and distributions are added up, while gauges keep the value of one
+// of the rows. Rejected values are counted in Stats().MetricTagsFiltered.
+func WithMetricsTagFilter(keep func(key tag.Key, value string) bool) ExporterOption {
+	return metricsTagFilter(keep)
+}
+
+type exportSampling float64
+
+var _ ExporterOption = (*exportSampling)(nil)
+
+func (es exportSampling) withExporter(e *Exporter) {
+	if e.exportSampler == nil {
+		e.exportSampler = new(exportSampler)
+	}
+	e.exportSampler.fraction = float64(es)
+}
+
+// WithExportSampling exports only about fraction, between 0 and 1, of the
+// traces, on top of the sampling decision made when spans start. Which
+// traces are kept depends on a hash of their TraceID alone, so exporters in
+// different processes keep or drop the spans of a trace alike. Spans of
+// the other traces are counted as dropped with DropReasonNotSampled. Spans
+// passed to ExportProtoSpans are all exported.
+func WithExportSampling(fraction float64) ExporterOption {
+	return exportSampling(fraction)
+}
+
+type exportSamplerSeed int64
+
+var _ ExporterOption = (*exportSamplerSeed)(nil)
+
+func (ess exportSamplerSeed) withExporter(e *Exporter) {
+	if e.exportSampler == nil {
+		e.exportSampler = &exportSampler{fraction: 1}
+	}
+	e.exportSampler.seed = uint64(ess)
+	e.exportSampler.seeded = true
+}
+
+// WithExportSamplerSeed mixes seed into the TraceID hash that
+// WithExportSampling decides by, which makes it pick another, but just as
+// deterministic, set of traces. Only exporters with the same seed keep the
+// same traces, so it is mostly useful in tests that need exact decisions.
+func WithExportSamplerSeed(seed int64) ExporterOption {
+	return exportSamplerSeed(seed)
+}
+
+type indexedAttributes []string
+
+var _ ExporterOption = (*indexedAttributes)(nil)
+
+func (ia indexedAttributes) withExporter(e *Exporter) {
+	e.indexedAttributes = append([]string(nil), ia...)
+}
+
+// WithIndexedAttributes asks for the span attributes with the given keys to
+// also be exported in the span's indexed labels, for agents that index them.
+// The version of the span proto that the exporter sends has no such field,
+// so for now this only logs a notice when the exporter is created; the
+// attributes are exported as regular attributes, as they always are.
+func WithIndexedAttributes(keys []string) ExporterOption {
+	return indexedAttributes(keys)
+}
+
+// minBufferSize is the smallest gRPC write or read buffer that
+// WithWriteBufferSize and WithReadBufferSize allow.
+const minBufferSize = 4 << 10
+
+func clampBufferSize(size int) int {
+	if size < minBufferSize {
+		return minBufferSize
+	}
+	return size
+}
+
+type writeBufferSize int
+
+var _ ExporterOption = (*writeBufferSize)(nil)
+
+func (wbs writeBufferSize) withExporter(e *Exporter) {
+	e.writeBufferSize = clampBufferSize(int(wbs))
+}
+
+// WithWriteBufferSize sets the size, in bytes, of the buffer that gRPC
+// batches writes to the agent in before they go to the network; gRPC's
+// default is 32KiB. Sizes under 4KiB are raised to 4KiB. Services
+// exporting thousands of spans per second usually do best with a buffer
+// that holds a whole export request, 256KiB to 1MiB, which
+// WithExportRequestSizeHistogram helps to size.
+func WithWriteBufferSize(size int) ExporterOption {
+	return writeBufferSize(size)
+}
+
+type readBufferSize int
+
+var _ ExporterOption = (*readBufferSize)(nil)
+
+func (rbs readBufferSize) withExporter(e *Exporter) {
+	e.readBufferSize = clampBufferSize(int(rbs))
+}
+
+// WithReadBufferSize sets the size, in bytes, of the buffer that gRPC reads
+// from the agent into; gRPC's default is 32KiB. Sizes under 4KiB are raised
+// to 4KiB. The agent sends little back to the exporter, so the default is
+// fine unless the write buffer was raised a lot, and 64KiB is plenty even
+// for services with high span rates.
+func WithReadBufferSize(size int) ExporterOption {
+	return readBufferSize(size)
+}
+
+type compressor string
+
+var _ ExporterOption = (*compressor)(nil)
+
+func (c compressor) withExporter(e *Exporter) {
+	e.compressor = string(c)
+}
+
+// WithCompressor compresses the requests to the agent with the named
+// compressor; only "gzip" is supported, and NewExporter fails on others.
+// Spans compress well, often to a fifth of their size, which keeps the
+// exporters of many replicas from saturating the egress of a node, at the
+// cost of some CPU. The agent must accept gzip, as the OpenCensus agent and
+// the OpenTelemetry Collector do.
+func WithCompressor(name string) ExporterOption {
+	return compressor(name)
+}
+
+type noCompressPredicate func(*trace.SpanData) bool
+
+var _ ExporterOption = (*noCompressPredicate)(nil)
+
+func (ncp noCompressPredicate) withExporter(e *Exporter) {
+	e.noCompress = ncp
+}
+
+// WithNoCompressPredicate sends the batches whose spans all match pred
+// uncompressed, on a second trace stream to the agent, while the other
+// batches stay compressed with the compressor of WithCompressor. It saves
+// the CPU of compressing spans that wouldn't shrink, such as ones carrying
+// already-compressed payloads in their attributes. gRPC compresses whole
+// streams, so a batch mixing such spans with others is compressed, as are
+// the spans passed to ExportProtoSpans. Without WithCompressor, it has no
+// effect.
+func WithNoCompressPredicate(pred func(*trace.SpanData) bool) ExporterOption {
+	return noCompressPredicate(pred)
+}
+
+type headerSetter map[string]string
+
+var _ ExporterOption = (*headerSetter)(nil)
+
+func (hs headerSetter) withExporter(e *Exporter) {
+	if e.headers == nil {
+		e.headers = make(map[string]string, len(hs))
+	}
+	for k, v := range hs {
+		e.headers[strings.ToLower(k)] = v
+	}
+}
+
+// WithHeaders sends headers as gRPC metadata on every stream to the agent,
+// such as the API key or the authorization header that hosted collectors
+// require. Header names are lowercased, as gRPC sends them. Repeated uses
+// add to the headers. The headers are sent in plain text unless the
+// connection uses WithTLSCredentials.
+func WithHeaders(headers map[string]string) ExporterOption {
+	return headerSetter(headers)
+}
+
+// headerCredentials sends the headers of WithHeaders with every call.
+type headerCredentials map[string]string
+
+var _ credentials.PerRPCCredentials = headerCredentials(nil)
+
+func (hc headerCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return hc, nil
+}
+
+// RequireTransportSecurity is false so that the headers also reach agents
+// in the cluster that are dialed with WithInsecure.
+func (hc headerCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+type selfTracing struct {
+	exporter trace.Exporter
+}
+
+var _ ExporterOption = (*selfTracing)(nil)
+
+func (st selfTracing) withExporter(e *Exporter) {
+	e.selfTracer = st.exporter
+}
+
+// WithSelfTracing reports every export of a batch of spans to the agent as
+// a span of its own, named "ocagent.Export", passed straight to exporter
+// rather than to the exporters registered with OpenCensus. The span lasts
+// for the export, retries included, holds the number of spans in
+// SelfTraceBatchSizeAttributeKey and has the gRPC status of a failed
+// export. Batches made of self-tracing spans only are not reported, so an
+// exporter may self-trace to itself, or to an exporter self-tracing to it,
+// without looping. exporter is called in a goroutine of its own, so a slow
+// one doesn't hold up exports.
+func WithSelfTracing(exporter trace.Exporter) ExporterOption {
+	return selfTracing{exporter: exporter}
+}
+
+type flushCoalescing time.Duration
+
+var _ ExporterOption = (*flushCoalescing)(nil)
+
+func (fc flushCoalescing) withExporter(e *Exporter) {
+	e.flushCoalescer = &flushCoalescer{window: time.Duration(fc)}
+}
+
+// WithBatchCoalescingAcrossFlushes merges the calls to Flush made within
+// window of each other into a single export of everything queued, instead
+// of sending a request per call. Each Flush still returns only once the
+// spans queued before it have been sent, but now waits for up to window
+// longer. This saves round trips to the agent for code that flushes often,
+// such as tests or layered shutdown hooks.
+func WithBatchCoalescingAcrossFlushes(window time.Duration) ExporterOption {
+	return flushCoalescing(window)
+}
+
+type localConfigFile string
+
+var _ ExporterOption = (*localConfigFile)(nil)
+
+func (lcf localConfigFile) withExporter(e *Exporter) {
+	e.localConfigPath = string(lcf)
+}
+
+// WithLocalConfigFile applies the trace config in the file at path, and
+// applies it again whenever the file changes, checked for every second
+// from the creation of the exporter until Stop, whether or not the agent
+// can be reached. The file holds a TraceConfig in its protobuf JSON form,
+// such as
+//
+//	{"probabilitySampler": {"samplingProbability": 0.25}}
+//
+// A file that is missing or can't be applied is logged and otherwise
+// ignored. The config is also applied when it comes from the agent, so
+// combine it with WithIgnoreRemoteConfig to control sampling from the
+// file only.
+func WithLocalConfigFile(path string) ExporterOption {
+	return localConfigFile(path)
+}
+
+type ignoreRemoteConfig bool
+
+var _ ExporterOption = (*ignoreRemoteConfig)(nil)
+
+func (irc ignoreRemoteConfig) withExporter(e *Exporter) {
+	e.ignoreRemoteConfig = bool(irc)
+}
+
+// WithIgnoreRemoteConfig stops the exporter from applying the trace configs
+// sent by the agent, leaving sampling to the application or to
+// WithLocalConfigFile.
+func WithIgnoreRemoteConfig() ExporterOption {
+	return ignoreRemoteConfig(true)
+}
+
+type reconnectBackoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+var _ ExporterOption = (*reconnectBackoff)(nil)
+
+func (rb reconnectBackoff) withExporter(e *Exporter) {
+	e.connectBackoff.initial = rb.initial
+	e.connectBackoff.max = rb.max
+}
+
+// WithReconnectBackoff sets how long the exporter waits after a failed
+// attempt to reach the agent, initial, doubling after each following
+// failure up to max. It applies both to the dials made by Start and to the
+// reconnects after the stream to the agent breaks. By default the dials
+// wait 50ms doubling without bound, and the reconnects 100ms up to 5s.
+func WithReconnectBackoff(initial, max time.Duration) ExporterOption {
+	return reconnectBackoff{initial: initial, max: max}
+}
+
+type maxRetryDuration time.Duration
+
+var _ ExporterOption = (*maxRetryDuration)(nil)
+
+func (mrd maxRetryDuration) withExporter(e *Exporter) {
+	e.connectBackoff.maxElapsed = time.Duration(mrd)
+}
+
+// WithMaxRetryDuration bounds how long the exporter keeps trying to reach
+// the agent, rather than a fixed 5 dials of up to a second each. Start
+// fails once d has passed without reaching it, so an application starting
+// before the agent isn't held up for longer than d, and a background
+// reconnect gives up until the next failed upload starts it again.
+func WithMaxRetryDuration(d time.Duration) ExporterOption {
+	return maxRetryDuration(d)
+}
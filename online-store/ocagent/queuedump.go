@@ -0,0 +1,160 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+// queueDumpTimeout is how long DumpQueue waits for the queue to drain,
+// which a batch stuck being sent to the agent can hold up.
+var queueDumpTimeout = 5 * time.Second
+
+var errQueueDumpTimeout = errors.New("ocagent: timed out waiting for the batch being sent, the spans queued behind it are sent rather than dumped")
+
+// queueDump receives the batches that DumpQueue takes out of the queue.
+type queueDump struct {
+	mu   sync.Mutex
+	w    io.Writer
+	err  error
+	done bool
+}
+
+// dump writes the spans that convert returns to the dump, and reports
+// whether it did: once DumpQueue is done, batches are left to be sent.
+func (qd *queueDump) dump(convert func() []*tracepb.Span) bool {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+
+	if qd.done {
+		return false
+	}
+	qd.write(convert())
+	return true
+}
+
+// finish ends the dump, returning its error.
+func (qd *queueDump) finish() error {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+
+	qd.done = true
+	return qd.err
+}
+
+// write appends a batch to the dump as a varint length-prefixed
+// ExportTraceServiceRequest. After the first error, batches are discarded.
+func (qd *queueDump) write(spans []*tracepb.Span) {
+	if qd.err != nil || len(spans) == 0 {
+		return
+	}
+	b, err := proto.Marshal(&agenttracepb.ExportTraceServiceRequest{Spans: spans})
+	if err != nil {
+		qd.err = err
+		return
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(b)))
+	if _, err := qd.w.Write(size[:n]); err != nil {
+		qd.err = err
+		return
+	}
+	_, qd.err = qd.w.Write(b)
+}
+
+// DumpQueue writes the spans waiting to be sent to the agent to w instead
+// of sending them, as a best effort to save them when the process is about
+// to crash, e.g. from a recovered panic. ReadQueueDump reads them back, to
+// be passed to ExportProtoSpans after a restart. Batches already being sent
+// when DumpQueue is called are sent rather than dumped, and metrics queued
+// with WithUnifiedStream are still sent. DumpQueue waits a few seconds at
+// most for a batch being sent; if it is still stuck by then, DumpQueue
+// returns an error and leaves the spans queued behind it to be sent.
+func (ae *Exporter) DumpQueue(w io.Writer) error {
+	ae.dumpMu.Lock()
+	defer ae.dumpMu.Unlock()
+
+	ae.mu.RLock()
+	traceBundler := ae.traceBundler
+	ae.mu.RUnlock()
+
+	qd := &queueDump{w: w}
+	ae.setQueueDump(qd)
+	defer ae.setQueueDump(nil)
+
+	flushed := make(chan struct{})
+	go func() {
+		traceBundler.Flush()
+		close(flushed)
+	}()
+	t := time.NewTimer(queueDumpTimeout)
+	defer t.Stop()
+	select {
+	case <-flushed:
+		return qd.finish()
+	case <-t.C:
+		if err := qd.finish(); err != nil {
+			return err
+		}
+		return errQueueDumpTimeout
+	}
+}
+
+func (ae *Exporter) setQueueDump(qd *queueDump) {
+	ae.queueDumpMu.Lock()
+	ae.queueDump = qd
+	ae.queueDumpMu.Unlock()
+}
+
+func (ae *Exporter) currentQueueDump() *queueDump {
+	ae.queueDumpMu.Lock()
+	defer ae.queueDumpMu.Unlock()
+	return ae.queueDump
+}
+
+// ReadQueueDump reads the spans written by DumpQueue from r.
+func ReadQueueDump(r io.Reader) ([]*tracepb.Span, error) {
+	br := bufio.NewReader(r)
+	var spans []*tracepb.Span
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return spans, nil
+		}
+		if err != nil {
+			return spans, err
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return spans, fmt.Errorf("ocagent: truncated queue dump: %v", err)
+		}
+		req := new(agenttracepb.ExportTraceServiceRequest)
+		if err := proto.Unmarshal(b, req); err != nil {
+			return spans, err
+		}
+		spans = append(spans, req.Spans...)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/support/bundler"
+)
+
+func TestDumpQueue_doesNotWaitForStuckUploads(t *testing.T) {
+	defer func(d time.Duration) { queueDumpTimeout = d }(queueDumpTimeout)
+	queueDumpTimeout = 100 * time.Millisecond
+
+	ae, err := NewUnstartedExporter()
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	// The first batch hangs in its upload until released.
+	uploading := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	first := true
+	ae.traceBundler = bundler.NewBundler((*queuedSpan)(nil), func(bundle interface{}) {
+		if first {
+			first = false
+			close(uploading)
+			<-release
+		}
+		ae.uploadTraces(bundle.([]*queuedSpan))
+	})
+
+	ae.ExportSpan(&trace.SpanData{Name: "stuck"})
+	go ae.traceBundler.Flush()
+	<-uploading
+	ae.ExportSpan(&trace.SpanData{Name: "queued"})
+
+	start := time.Now()
+	err = ae.DumpQueue(new(bytes.Buffer))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("DumpQueue waited %v for the stuck upload", d)
+	}
+	if err != errQueueDumpTimeout {
+		t.Errorf("DumpQueue: got error %v want %v", err, errQueueDumpTimeout)
+	}
+}
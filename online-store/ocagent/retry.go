@@ -0,0 +1,139 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// retryPolicy resends a failed export batch up to retries times, waiting
+// delay before the first retry and twice as long before each following one.
+// Each wait is spread by up to ±jitter of its length so that exporters which
+// failed together don't all retry at the same moment.
+type retryPolicy struct {
+	retries int
+	delay   time.Duration
+	jitter  float64
+	sleep   func(time.Duration)
+}
+
+// backoff returns how long to wait before the given retry, counting from 0.
+func (rp *retryPolicy) backoff(attempt int) time.Duration {
+	d := rp.delay << uint(attempt)
+	if rp.jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * rp.jitter * float64(d))
+	}
+	return d
+}
+
+// retry calls send again, as send first failed with err, while it fails
+// and retries remain. Once stop is closed, it no longer waits: it makes one
+// last attempt right away.
+func (rp *retryPolicy) retry(err error, send func() error, stop <-chan struct{}) error {
+	for attempt := 0; err != nil && attempt < rp.retries; attempt++ {
+		if !rp.wait(rp.backoff(attempt), stop) {
+			return send()
+		}
+		err = send()
+	}
+	return err
+}
+
+// wait waits for d, and reports false if stop was closed first.
+func (rp *retryPolicy) wait(d time.Duration, stop <-chan struct{}) bool {
+	if rp.sleep != nil {
+		rp.sleep(d)
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// maxRetryingBatches is how many failed batches may be waiting to be retried
+// at once. Further failed batches are not retried.
+const maxRetryingBatches = 8
+
+const (
+	dialTimeout        = 1 * time.Second
+	dialTries          = 5
+	defaultDialBackoff = 50 * time.Millisecond
+)
+
+// connectBackoff is how the exporter paces its attempts to reach the agent,
+// set with WithReconnectBackoff and WithMaxRetryDuration. Zero fields keep
+// the defaults of the dial or the reconnect loop using it.
+type connectBackoff struct {
+	initial    time.Duration
+	max        time.Duration
+	maxElapsed time.Duration
+}
+
+func (cb connectBackoff) initialOr(d time.Duration) time.Duration {
+	if cb.initial > 0 {
+		return cb.initial
+	}
+	return d
+}
+
+func (cb connectBackoff) maxOr(d time.Duration) time.Duration {
+	if cb.max > 0 {
+		return cb.max
+	}
+	return d
+}
+
+// dial dials addr, waiting initial after the first failure and doubling the
+// wait after each following one, up to max. Without maxElapsed it makes
+// dialTries attempts; with it, it keeps trying until maxElapsed has passed,
+// cutting the dial timeout short so as not to overrun it.
+func (cb connectBackoff) dial(addr string, dialOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	var deadline time.Time
+	if cb.maxElapsed > 0 {
+		deadline = time.Now().Add(cb.maxElapsed)
+	}
+	wait := cb.initialOr(defaultDialBackoff)
+	for attempt := 1; ; attempt++ {
+		timeout := dialTimeout
+		if !deadline.IsZero() {
+			if left := time.Until(deadline); left < timeout {
+				timeout = left
+			}
+		}
+		cc, err := grpc.Dial(addr, append(dialOpts, grpc.WithTimeout(timeout))...)
+		if err == nil {
+			return cc, nil
+		}
+
+		if deadline.IsZero() && attempt >= dialTries {
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		time.Sleep(wait)
+		if wait *= 2; cb.max > 0 && wait > cb.max {
+			wait = cb.max
+		}
+	}
+}
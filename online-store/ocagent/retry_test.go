@@ -0,0 +1,110 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_jittersDelays(t *testing.T) {
+	var delays []time.Duration
+	rp := &retryPolicy{
+		retries: 8,
+		delay:   10 * time.Millisecond,
+		jitter:  0.5,
+		sleep:   func(d time.Duration) { delays = append(delays, d) },
+	}
+
+	sends := 0
+	errSend := errors.New("send failed")
+	send := func() error {
+		sends++
+		return errSend
+	}
+	err := rp.retry(send(), send, nil)
+	if err != errSend {
+		t.Fatalf("got error %v want %v", err, errSend)
+	}
+	if g, w := sends, 9; g != w {
+		t.Fatalf("got %d sends want %d", g, w)
+	}
+	if g, w := len(delays), 8; g != w {
+		t.Fatalf("got %d delays want %d", g, w)
+	}
+
+	distinct := make(map[float64]bool)
+	for i, d := range delays {
+		base := rp.delay << uint(i)
+		lo, hi := base/2, base+base/2
+		if d < lo || d > hi {
+			t.Errorf("delay #%d: got %v want between %v and %v", i, d, lo, hi)
+		}
+		distinct[float64(d)/float64(base)] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("delays are not jittered: %v", delays)
+	}
+}
+
+func TestRetryPolicy_stopsOnSuccess(t *testing.T) {
+	var delays []time.Duration
+	rp := &retryPolicy{
+		retries: 5,
+		delay:   time.Millisecond,
+		sleep:   func(d time.Duration) { delays = append(delays, d) },
+	}
+
+	sends := 0
+	send := func() error {
+		sends++
+		if sends < 3 {
+			return errors.New("send failed")
+		}
+		return nil
+	}
+	err := rp.retry(send(), send, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if g, w := sends, 3; g != w {
+		t.Errorf("got %d sends want %d", g, w)
+	}
+	want := []time.Duration{time.Millisecond, 2 * time.Millisecond}
+	if len(delays) != len(want) || delays[0] != want[0] || delays[1] != want[1] {
+		t.Errorf("got delays %v want %v", delays, want)
+	}
+}
+
+func TestRetryPolicy_stopEndsTheWait(t *testing.T) {
+	rp := &retryPolicy{retries: 5, delay: time.Hour}
+	stop := make(chan struct{})
+	close(stop)
+
+	sends := 0
+	send := func() error {
+		sends++
+		return errors.New("send failed")
+	}
+	start := time.Now()
+	rp.retry(send(), send, stop)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("retry waited %v after stop", d)
+	}
+	if g, w := sends, 2; g != w {
+		t.Errorf("got %d sends want %d", g, w)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"go.opencensus.io/trace"
+)
+
+// SpanRouter is a trace.Exporter that sends each span to the Exporter of the
+// tenant it belongs to, as told by one of the span's string attributes. In
+// a process serving several tenants, registering a single SpanRouter with
+// trace.RegisterExporter, instead of every tenant's Exporter, keeps the
+// spans of one tenant from reaching the agents of the others.
+type SpanRouter struct {
+	key string
+
+	mu        sync.RWMutex
+	exporters map[string]*Exporter
+
+	unrouted int64 // accessed atomically
+}
+
+var _ trace.Exporter = (*SpanRouter)(nil)
+
+// NewSpanRouter creates a SpanRouter that routes spans by the value of
+// their attribute key.
+func NewSpanRouter(key string) *SpanRouter {
+	return &SpanRouter{key: key, exporters: make(map[string]*Exporter)}
+}
+
+// Route sends the spans whose routing attribute is value to exp from now
+// on. A nil exp removes the route.
+func (sr *SpanRouter) Route(value string, exp *Exporter) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if exp == nil {
+		delete(sr.exporters, value)
+	} else {
+		sr.exporters[value] = exp
+	}
+}
+
+// ExportSpan passes sd on to the Exporter routed to by its attribute. Spans
+// without the attribute or without a route for its value are dropped and
+// counted by Unrouted, rather than sent to any other tenant's agent.
+func (sr *SpanRouter) ExportSpan(sd *trace.SpanData) {
+	var exp *Exporter
+	if sd != nil {
+		if value, ok := sd.Attributes[sr.key].(string); ok {
+			sr.mu.RLock()
+			exp = sr.exporters[value]
+			sr.mu.RUnlock()
+		}
+	}
+	if exp == nil {
+		atomic.AddInt64(&sr.unrouted, 1)
+		return
+	}
+	exp.ExportSpan(sd)
+}
+
+// Unrouted returns the number of spans that were dropped for lack of a
+// route.
+func (sr *SpanRouter) Unrouted() int64 {
+	return atomic.LoadInt64(&sr.unrouted)
+}
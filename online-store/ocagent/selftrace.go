@@ -0,0 +1,81 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/status"
+)
+
+// Attributes of the spans that WithSelfTracing reports exports with.
+const (
+	// SelfTraceAttributeKey is true on every self-tracing span, so that
+	// batches made of them only are not traced in turn.
+	SelfTraceAttributeKey = "ocagent.self_trace"
+	// SelfTraceBatchSizeAttributeKey is the number of spans exported.
+	SelfTraceBatchSizeAttributeKey = "ocagent.batch_size"
+)
+
+// selfTraceSpanName is the name of the spans that WithSelfTracing reports.
+const selfTraceSpanName = "ocagent.Export"
+
+// isSelfTraceBatch reports whether all the spans of qsl are self-tracing
+// spans, which happens when they are exported by an exporter that
+// self-traces itself, or one that self-traces the exporter self-tracing it.
+func isSelfTraceBatch(qsl []*queuedSpan) bool {
+	for _, qs := range qsl {
+		if qs.sd != nil {
+			if selfTrace, _ := qs.sd.Attributes[SelfTraceAttributeKey].(bool); selfTrace {
+				continue
+			}
+		} else if qs.proto != nil {
+			if qs.proto.GetAttributes().GetAttributeMap()[SelfTraceAttributeKey].GetBoolValue() {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// selfTrace reports an export of n spans that started at start and ended
+// with err to the self-tracing exporter.
+func (ae *Exporter) selfTrace(start time.Time, n int, err error) {
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{TraceOptions: 1},
+		Name:        selfTraceSpanName,
+		SpanKind:    trace.SpanKindClient,
+		StartTime:   start,
+		EndTime:     time.Now(),
+		Attributes: map[string]interface{}{
+			SelfTraceAttributeKey:          true,
+			SelfTraceBatchSizeAttributeKey: int64(n),
+		},
+	}
+	binary.LittleEndian.PutUint64(sd.TraceID[:8], rand.Uint64())
+	binary.LittleEndian.PutUint64(sd.TraceID[8:], rand.Uint64())
+	binary.LittleEndian.PutUint64(sd.SpanID[:], rand.Uint64())
+	if err != nil {
+		st := status.Convert(err)
+		sd.Status = trace.Status{Code: int32(st.Code()), Message: st.Message()}
+	}
+	// Not called in place, since the exporter may be self-tracing to itself
+	// and ExportSpan would then wait for Stop, which waits for this upload.
+	go ae.selfTracer.ExportSpan(sd)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+func (ae *Exporter) connectShardsLocked() error {
+	for _, addr := range ae.shards {
+		td, err := ae.connectTraceDestination(addr, ae.nodeInfo)
+		if err != nil {
+			return fmt.Errorf("Exporter.Start:: shard %s: %v", addr, err)
+		}
+		ae.shardDestinations = append(ae.shardDestinations, td)
+	}
+	return nil
+}
+
+func (ae *Exporter) closeShardsLocked() {
+	for _, td := range ae.shardDestinations {
+		td.close()
+	}
+	ae.shardDestinations = nil
+}
+
+// shardIndex picks which of n shards the spans of a trace are sent to.
+func shardIndex(traceID []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(traceID)
+	return int(h.Sum32() % uint32(n))
+}
+
+// sendToShards sends every span to the shard of its trace, in one request
+// per shard. It returns the first error, after trying all the shards.
+func (ae *Exporter) sendToShards(spans []*tracepb.Span) error {
+	byShard := make([][]*tracepb.Span, len(ae.shardDestinations))
+	for _, span := range spans {
+		i := shardIndex(span.TraceId, len(byShard))
+		byShard[i] = append(byShard[i], span)
+	}
+	var firstErr error
+	for i, shardSpans := range byShard {
+		if len(shardSpans) == 0 {
+			continue
+		}
+		err := ae.shardDestinations[i].send(&agenttracepb.ExportTraceServiceRequest{Spans: shardSpans})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
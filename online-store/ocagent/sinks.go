@@ -0,0 +1,161 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+
+	agentcommonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+)
+
+// Sink is an additional agent that the exporter mirrors every batch of
+// spans to, on top of the agent it is configured with. This allows tee-ing
+// spans to a new backend while migrating off the old one.
+type Sink struct {
+	// Address is the host:port of the agent.
+	Address string
+	// ServiceName, when set, replaces the exporter's service name in the
+	// Node that identifies the exporter to this sink.
+	ServiceName string
+	// NodeAttributes are added to the attributes of the Node sent to this
+	// sink, overriding the exporter's own attributes of the same key.
+	NodeAttributes map[string]string
+}
+
+// node returns the Node to identify the exporter to the sink with: a copy
+// of base with the sink's overrides applied.
+func (s Sink) node(base *agentcommonpb.Node) *agentcommonpb.Node {
+	node := proto.Clone(base).(*agentcommonpb.Node)
+	if s.ServiceName != "" {
+		node.ServiceInfo = &agentcommonpb.ServiceInfo{Name: s.ServiceName}
+	}
+	if len(s.NodeAttributes) > 0 && node.Attributes == nil {
+		node.Attributes = make(map[string]string, len(s.NodeAttributes))
+	}
+	for k, v := range s.NodeAttributes {
+		node.Attributes[k] = v
+	}
+	return node
+}
+
+// traceDestination is a connection to an agent, other than the exporter's
+// main one, with the trace stream opened on it.
+type traceDestination struct {
+	address string
+	cc      *grpc.ClientConn
+
+	mu     sync.Mutex
+	stream agenttracepb.TraceService_ExportClient
+}
+
+// connectTraceDestination dials the agent at addr and initiates the trace
+// service with node as the identifier.
+func (ae *Exporter) connectTraceDestination(addr string, node *agentcommonpb.Node) (*traceDestination, error) {
+	cc, err := ae.dialToAgent(addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := agenttracepb.NewTraceServiceClient(cc).Export(context.Background())
+	if err != nil {
+		cc.Close()
+		return nil, err
+	}
+	if err := stream.Send(&agenttracepb.ExportTraceServiceRequest{Node: node}); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	return &traceDestination{address: addr, cc: cc, stream: stream}, nil
+}
+
+func (td *traceDestination) send(req *agenttracepb.ExportTraceServiceRequest) error {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return td.stream.Send(req)
+}
+
+func (td *traceDestination) close() error {
+	return td.cc.Close()
+}
+
+func (ae *Exporter) connectSinksLocked() error {
+	for _, sink := range ae.sinks {
+		td, err := ae.connectTraceDestination(sink.Address, sink.node(ae.nodeInfo))
+		if err != nil {
+			return fmt.Errorf("Exporter.Start:: sink %s: %v", sink.Address, err)
+		}
+		ae.sinkDestinations = append(ae.sinkDestinations, td)
+	}
+	return nil
+}
+
+func (ae *Exporter) closeSinksLocked() {
+	for _, td := range ae.sinkDestinations {
+		td.close()
+	}
+	ae.sinkDestinations = nil
+}
+
+// mirrorToSinks sends req to every sink. Failing to reach a sink doesn't
+// affect the export to the main agent; it is only logged.
+func (ae *Exporter) mirrorToSinks(req *agenttracepb.ExportTraceServiceRequest) {
+	for _, td := range ae.sinkDestinations {
+		if err := td.send(req); err != nil {
+			ae.logf("ocagent: failed to mirror spans to sink %s: %v", td.address, err)
+		}
+	}
+}
+
+func (ae *Exporter) connectFallbackLocked() error {
+	if ae.fallbackSink == nil {
+		return nil
+	}
+	td, err := ae.connectTraceDestination(ae.fallbackSink.Address, ae.fallbackSink.node(ae.nodeInfo))
+	if err != nil {
+		return fmt.Errorf("Exporter.Start:: fallback sink %s: %v", ae.fallbackSink.Address, err)
+	}
+	ae.fallbackDestination = td
+	return nil
+}
+
+func (ae *Exporter) closeFallbackLocked() {
+	if ae.fallbackDestination != nil {
+		ae.fallbackDestination.close()
+		ae.fallbackDestination = nil
+	}
+}
+
+// sendToFallback sends the spans to the fallback sink, if there is one,
+// and reports whether they were sent.
+func (ae *Exporter) sendToFallback(qsl []*queuedSpan) bool {
+	if ae.fallbackDestination == nil {
+		return false
+	}
+	protoSpans := ae.toProtoSpans(qsl)
+	if len(protoSpans) == 0 {
+		return true
+	}
+	err := ae.fallbackDestination.send(&agenttracepb.ExportTraceServiceRequest{Spans: protoSpans})
+	if err != nil {
+		ae.logf("ocagent: failed to send spans to fallback sink %s: %v", ae.fallbackDestination.address, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,272 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons reported in Stats.SpansDropped for spans that were
+// discarded instead of being sent to the agent.
+const (
+	DropReasonCircuitOpen    = "circuit_open"
+	DropReasonNameNotAllowed = "name_not_allowed"
+	DropReasonMalformed      = "malformed"
+	DropReasonStale          = "stale"
+	DropReasonStopped        = "stopped"
+	DropReasonNotSampled     = "not_sampled"
+	DropReasonInvalidID      = "invalid_id"
+)
+
+// Stream types that Stats.ExportRequestBytes is keyed by.
+const (
+	StreamTypeTrace   = "trace"
+	StreamTypeMetrics = "metrics"
+)
+
+// ExportRequestSizeBounds are the upper bounds, in bytes, of the buckets
+// of a SizeDistribution: 1KiB, 4KiB, 16KiB, 64KiB, 256KiB, 1MiB and 4MiB.
+var ExportRequestSizeBounds = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// Stats is a point-in-time snapshot of the exporter's own counters.
+type Stats struct {
+	// ExportAttempts is the number of span batches the exporter tried to send.
+	ExportAttempts int64
+	// ExportFailures is the number of those attempts that returned an error.
+	ExportFailures int64
+	// SpansDropped counts the spans that were discarded, keyed by reason.
+	SpansDropped map[string]int64
+	// ConfigErrors is the number of trace configs received from the agent
+	// that could not be applied and were skipped.
+	ConfigErrors int64
+	// QueueLatency describes how long spans waited between ExportSpan and
+	// being sent to the agent. It is only tracked with WithQueueLatencyTracking.
+	QueueLatency LatencySummary
+	// ExportRequestBytes is the distribution of the marshaled size of the
+	// export requests sent to the agent, keyed by stream type. It is only
+	// tracked with WithExportRequestSizeHistogram.
+	ExportRequestBytes map[string]SizeDistribution
+	// ReservedKeyCollisions is the number of span attributes whose keys
+	// started with ReservedAttributePrefix.
+	ReservedKeyCollisions int64
+	// NegativeDurations is the number of spans that ended before they
+	// started, by their wall clock times, and were exported with a zero
+	// duration. It is only tracked with WithSpanExportTimestampSource.
+	NegativeDurations int64
+	// SpanNamesTruncated is the number of spans whose names were cut short
+	// to fit WithMaxSpanNameLength.
+	SpanNamesTruncated int64
+	// MetricTagsFiltered is the number of tag values that the filter set
+	// with WithMetricsTagFilter kept from being exported.
+	MetricTagsFiltered int64
+}
+
+// LatencySummary summarizes a series of observed durations.
+type LatencySummary struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+	// Last is the most recently observed duration.
+	Last time.Duration
+}
+
+func (ls *LatencySummary) observe(d time.Duration) {
+	ls.Count++
+	ls.Total += d
+	if d > ls.Max {
+		ls.Max = d
+	}
+	ls.Last = d
+}
+
+// SizeDistribution is a histogram of sizes in bytes.
+type SizeDistribution struct {
+	Count int64
+	Sum   int64
+	Min   int64
+	Max   int64
+	// BucketCounts[i] counts the sizes no larger than
+	// ExportRequestSizeBounds[i]; its last element counts the sizes
+	// larger than all the bounds.
+	BucketCounts []int64
+}
+
+func (sd *SizeDistribution) observe(size int64) {
+	if sd.BucketCounts == nil {
+		sd.BucketCounts = make([]int64, len(ExportRequestSizeBounds)+1)
+	}
+	if sd.Count == 0 || size < sd.Min {
+		sd.Min = size
+	}
+	if size > sd.Max {
+		sd.Max = size
+	}
+	sd.Count++
+	sd.Sum += size
+	i := sort.Search(len(ExportRequestSizeBounds), func(i int) bool {
+		return size <= ExportRequestSizeBounds[i]
+	})
+	sd.BucketCounts[i]++
+}
+
+type statsRecorder struct {
+	mu             sync.Mutex
+	exportAttempts int64
+	exportFailures int64
+	spansDropped   map[string]int64
+	configErrors   int64
+	queueLatency   LatencySummary
+	requestBytes   map[string]*SizeDistribution
+	reservedKeys   int64
+	negativeDurs   int64
+	truncatedNames int64
+	filteredTags   int64
+
+	// events, if set, is published an EventSpansDropped for every drop.
+	events *eventHub
+}
+
+func (sr *statsRecorder) recordExport(err error) {
+	sr.mu.Lock()
+	sr.exportAttempts++
+	if err != nil {
+		sr.exportFailures++
+	}
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordDropped(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	sr.mu.Lock()
+	if sr.spansDropped == nil {
+		sr.spansDropped = make(map[string]int64)
+	}
+	sr.spansDropped[reason] += int64(n)
+	sr.mu.Unlock()
+
+	if sr.events != nil {
+		sr.events.publish(Event{Type: EventSpansDropped, DropReason: reason, Dropped: n})
+	}
+}
+
+func (sr *statsRecorder) recordConfigError() {
+	sr.mu.Lock()
+	sr.configErrors++
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordQueueLatency(d time.Duration) {
+	sr.mu.Lock()
+	sr.queueLatency.observe(d)
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordRequestBytes(streamType string, size int) {
+	sr.mu.Lock()
+	if sr.requestBytes == nil {
+		sr.requestBytes = make(map[string]*SizeDistribution)
+	}
+	sd := sr.requestBytes[streamType]
+	if sd == nil {
+		sd = new(SizeDistribution)
+		sr.requestBytes[streamType] = sd
+	}
+	sd.observe(int64(size))
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordReservedKeyCollisions(n int) {
+	sr.mu.Lock()
+	sr.reservedKeys += int64(n)
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordNegativeDuration() {
+	sr.mu.Lock()
+	sr.negativeDurs++
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordTruncatedName() {
+	sr.mu.Lock()
+	sr.truncatedNames++
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) recordFilteredTags(n int) {
+	sr.mu.Lock()
+	sr.filteredTags += int64(n)
+	sr.mu.Unlock()
+}
+
+func (sr *statsRecorder) snapshot() Stats {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	dropped := make(map[string]int64, len(sr.spansDropped))
+	for reason, n := range sr.spansDropped {
+		dropped[reason] = n
+	}
+	requestBytes := make(map[string]SizeDistribution, len(sr.requestBytes))
+	for streamType, sd := range sr.requestBytes {
+		dist := *sd
+		dist.BucketCounts = append([]int64(nil), sd.BucketCounts...)
+		requestBytes[streamType] = dist
+	}
+	return Stats{
+		ExportAttempts:        sr.exportAttempts,
+		ExportFailures:        sr.exportFailures,
+		SpansDropped:          dropped,
+		ConfigErrors:          sr.configErrors,
+		QueueLatency:          sr.queueLatency,
+		ExportRequestBytes:    requestBytes,
+		ReservedKeyCollisions: sr.reservedKeys,
+		NegativeDurations:     sr.negativeDurs,
+		SpanNamesTruncated:    sr.truncatedNames,
+		MetricTagsFiltered:    sr.filteredTags,
+	}
+}
+
+// Stats returns a snapshot of the exporter's export and drop counters.
+func (ae *Exporter) Stats() Stats {
+	return ae.stats.snapshot()
+}
+
+// dropSummary describes SpansDropped on a single line, with the reasons in
+// a stable order, e.g. "dropped 3 spans: 2 circuit_open, 1 name_not_allowed".
+// It returns "" if no spans were dropped.
+func (s Stats) dropSummary() string {
+	var total int64
+	reasons := make([]string, 0, len(s.SpansDropped))
+	for reason, n := range s.SpansDropped {
+		total += n
+		reasons = append(reasons, reason)
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(reasons)
+	counts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		counts = append(counts, fmt.Sprintf("%d %s", s.SpansDropped[reason], reason))
+	}
+	return fmt.Sprintf("dropped %d spans: %s", total, strings.Join(counts, ", "))
+}
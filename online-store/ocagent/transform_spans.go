@@ -0,0 +1,504 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/tracestate"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// SpanDataToProto converts an OpenCensus SpanData into the proto Span that
+// the exporter sends to the agent. It returns nil for a nil SpanData.
+func SpanDataToProto(sd *trace.SpanData) *tracepb.Span {
+	return ocSpanToProtoSpan(sd)
+}
+
+// SpanDataToProtoSpans converts a batch of SpanData, skipping nil entries.
+func SpanDataToProtoSpans(sdl []*trace.SpanData) []*tracepb.Span {
+	return new(spanConversion).toProtoSpans(sdl)
+}
+
+// TraceOptionsAttributeKey is the span attribute that carries the raw
+// trace options of the span's SpanContext when WithTraceOptions is used,
+// since the Span proto has no field of its own for them. Bit 0 is the
+// sampled flag and bit 1 is the debug flag, when a propagator sets it.
+const TraceOptionsAttributeKey = "opencensus.trace_options"
+
+// ReservedAttributePrefix prefixes the attribute keys that are reserved for
+// the exporter and the agent, like TraceOptionsAttributeKey. User attributes
+// with such a key are counted in Stats().ReservedKeyCollisions, and can be
+// moved out of the way with WithReservedKeyPrefix.
+const ReservedAttributePrefix = "opencensus."
+
+// SpanField is an optional field of SpanData, for WithExportFieldMask.
+type SpanField uint
+
+const (
+	SpanFieldAttributes SpanField = 1 << iota
+	SpanFieldAnnotations
+	SpanFieldMessageEvents
+	SpanFieldLinks
+	SpanFieldStatus
+	SpanFieldTracestate
+)
+
+// spanFieldMask is a set of SpanFields.
+type spanFieldMask SpanField
+
+// apply returns a shallow copy of sd without the optional fields that are
+// not in the mask.
+func (m spanFieldMask) apply(sd *trace.SpanData) *trace.SpanData {
+	masked := *sd
+	if m&spanFieldMask(SpanFieldAttributes) == 0 {
+		masked.Attributes = nil
+	}
+	if m&spanFieldMask(SpanFieldAnnotations) == 0 {
+		masked.Annotations = nil
+	}
+	if m&spanFieldMask(SpanFieldMessageEvents) == 0 {
+		masked.MessageEvents = nil
+	}
+	if m&spanFieldMask(SpanFieldLinks) == 0 {
+		masked.Links = nil
+	}
+	if m&spanFieldMask(SpanFieldStatus) == 0 {
+		masked.Status = trace.Status{}
+	}
+	if m&spanFieldMask(SpanFieldTracestate) == 0 {
+		masked.Tracestate = nil
+	}
+	return &masked
+}
+
+// spanConversion holds the exporter settings that alter how
+// SpanData is converted into the proto Spans sent to the agent.
+type spanConversion struct {
+	includeTraceOptions bool
+	remapSpanID         func(trace.SpanID) trace.SpanID
+	// reservedKeyPrefix, if set, is prepended to user attribute keys that
+	// start with ReservedAttributePrefix.
+	reservedKeyPrefix string
+	// stats is where collisions with reserved keys are counted; it is nil
+	// for conversions made outside of an Exporter.
+	stats *statsRecorder
+	// fieldMask, if set, limits the optional fields that are exported.
+	fieldMask *spanFieldMask
+	// monotonicTimes derives the exported end time from the span's
+	// monotonic duration.
+	monotonicTimes bool
+	// maxNameLength, if positive, is the number of runes that span names
+	// are truncated to.
+	maxNameLength int
+}
+
+func (sc *spanConversion) toProtoSpans(sdl []*trace.SpanData) []*tracepb.Span {
+	batch := sc.newBatch()
+	protoSpans := make([]*tracepb.Span, 0, len(sdl))
+	for _, sd := range sdl {
+		if span := batch.toProtoSpan(sd); span != nil {
+			protoSpans = append(protoSpans, span)
+		}
+	}
+	return protoSpans
+}
+
+// spanBatchConversion converts the spans of a single batch, keeping what
+// has to stay consistent across them, such as remapped span IDs.
+type spanBatchConversion struct {
+	*spanConversion
+	remappedSpanIDs map[trace.SpanID]trace.SpanID
+}
+
+func (sc *spanConversion) newBatch() *spanBatchConversion {
+	return &spanBatchConversion{spanConversion: sc}
+}
+
+func (bc *spanBatchConversion) toProtoSpan(sd *trace.SpanData) *tracepb.Span {
+	if sd == nil {
+		return nil
+	}
+	if bc.fieldMask != nil {
+		sd = bc.fieldMask.apply(sd)
+	}
+	span := ocSpanToProtoSpan(sd)
+	if bc.monotonicTimes {
+		bc.correctEndTime(sd, span)
+	}
+	bc.protectReservedKeys(span)
+	if bc.includeTraceOptions {
+		setProtoAttribute(span, TraceOptionsAttributeKey, &tracepb.AttributeValue{
+			Value: &tracepb.AttributeValue_IntValue{IntValue: int64(sd.TraceOptions)},
+		})
+	}
+	if bc.remapSpanID != nil {
+		span.SpanId = bc.remappedSpanID(sd.SpanID)
+		if sd.ParentSpanID != (trace.SpanID{}) {
+			span.ParentSpanId = bc.remappedSpanID(sd.ParentSpanID)
+		}
+		for i, link := range span.GetLinks().GetLink() {
+			link.SpanId = bc.remappedSpanID(sd.Links[i].SpanID)
+		}
+	}
+	// Last, so that the name is limited once it is otherwise final.
+	if bc.maxNameLength > 0 {
+		bc.truncateName(span)
+	}
+	return span
+}
+
+// truncateName cuts the name of span down to maxNameLength runes, recording
+// the number of bytes cut in the name's TruncatedByteCount.
+func (bc *spanBatchConversion) truncateName(span *tracepb.Span) {
+	if span.Name == nil || len(span.Name.Value) <= bc.maxNameLength {
+		return
+	}
+	name := span.Name.Value
+	runes := 0
+	for i := range name {
+		if runes == bc.maxNameLength {
+			span.Name = &tracepb.TruncatableString{
+				Value:              name[:i],
+				TruncatedByteCount: span.Name.TruncatedByteCount + int32(len(name)-i),
+			}
+			if bc.stats != nil {
+				bc.stats.recordTruncatedName()
+			}
+			return
+		}
+		runes++
+	}
+}
+
+// correctEndTime sets the end time of span to its start time plus its
+// duration as measured by the monotonic clock, when sd's times carry
+// monotonic readings, so that a wall clock step during the span doesn't
+// skew it. Times with wall readings only can still yield a negative
+// duration, which is clamped to zero and counted.
+func (bc *spanBatchConversion) correctEndTime(sd *trace.SpanData, span *tracepb.Span) {
+	if sd.StartTime.IsZero() || sd.EndTime.IsZero() {
+		return
+	}
+	// Sub uses the monotonic readings when both times have one.
+	d := sd.EndTime.Sub(sd.StartTime)
+	if d < 0 {
+		d = 0
+		if bc.stats != nil {
+			bc.stats.recordNegativeDuration()
+		}
+	}
+	span.EndTime = timeToTimestamp(sd.StartTime.Add(d))
+}
+
+// protectReservedKeys counts the user attributes of span whose keys are
+// reserved and, with a reservedKeyPrefix, renames them so that the agent
+// doesn't take them for its own. It must run before the exporter adds its
+// own reserved attributes to the span.
+func (bc *spanBatchConversion) protectReservedKeys(span *tracepb.Span) {
+	attrs := span.GetAttributes().GetAttributeMap()
+	var collisions []string
+	for key := range attrs {
+		if strings.HasPrefix(key, ReservedAttributePrefix) {
+			collisions = append(collisions, key)
+		}
+	}
+	if len(collisions) == 0 {
+		return
+	}
+	if bc.stats != nil {
+		bc.stats.recordReservedKeyCollisions(len(collisions))
+	}
+	if bc.reservedKeyPrefix == "" {
+		return
+	}
+	for _, key := range collisions {
+		attrs[bc.reservedKeyPrefix+key] = attrs[key]
+		delete(attrs, key)
+	}
+}
+
+// remappedSpanID returns the span ID that id is rewritten to, calling the
+// remapper only once per ID so that a span and the references to it from
+// other spans of the batch (as a parent or a link) always agree.
+func (bc *spanBatchConversion) remappedSpanID(id trace.SpanID) []byte {
+	if bc.remappedSpanIDs == nil {
+		bc.remappedSpanIDs = make(map[trace.SpanID]trace.SpanID)
+	}
+	newID, ok := bc.remappedSpanIDs[id]
+	if !ok {
+		newID = bc.remapSpanID(id)
+		bc.remappedSpanIDs[id] = newID
+	}
+	return newID[:]
+}
+
+func setProtoAttribute(span *tracepb.Span, key string, value *tracepb.AttributeValue) {
+	if span.Attributes == nil {
+		span.Attributes = &tracepb.Span_Attributes{}
+	}
+	if span.Attributes.AttributeMap == nil {
+		span.Attributes.AttributeMap = make(map[string]*tracepb.AttributeValue)
+	}
+	span.Attributes.AttributeMap[key] = value
+}
+
+func ocSpanToProtoSpan(sd *trace.SpanData) *tracepb.Span {
+	if sd == nil {
+		return nil
+	}
+	var namePtr *tracepb.TruncatableString
+	if sd.Name != "" {
+		namePtr = &tracepb.TruncatableString{Value: sd.Name}
+	}
+	return &tracepb.Span{
+		TraceId:      sd.TraceID[:],
+		SpanId:       sd.SpanID[:],
+		ParentSpanId: sd.ParentSpanID[:],
+		Status:       ocStatusToProtoStatus(sd.Status),
+		StartTime:    timeToTimestamp(sd.StartTime),
+		EndTime:      timeToTimestamp(sd.EndTime),
+		TimeEvents:   ocEventsToProtoTimeEvents(sd.Annotations, sd.MessageEvents),
+		Links:        ocLinksToProtoLinks(sd.Links),
+		Kind:         ocSpanKindToProtoSpanKind(sd.SpanKind),
+		Name:         namePtr,
+		Attributes:   ocAttributesToProtoAttributes(sd.Attributes),
+		Tracestate:   ocTracestateToProtoTracestate(sd.Tracestate),
+	}
+}
+
+var blankStatus trace.Status
+
+func ocStatusToProtoStatus(status trace.Status) *tracepb.Status {
+	if status == blankStatus {
+		return nil
+	}
+	return &tracepb.Status{
+		Code:    status.Code,
+		Message: status.Message,
+	}
+}
+
+func ocLinksToProtoLinks(links []trace.Link) *tracepb.Span_Links {
+	if len(links) == 0 {
+		return nil
+	}
+
+	sl := make([]*tracepb.Span_Link, 0, len(links))
+	for _, ocLink := range links {
+		// This redefinition is necessary to prevent ocLink.*ID[:] copies
+		// being reused -- in short we need a new ocLink per iteration.
+		ocLink := ocLink
+
+		sl = append(sl, &tracepb.Span_Link{
+			TraceId:    ocLink.TraceID[:],
+			SpanId:     ocLink.SpanID[:],
+			Type:       ocLinkTypeToProtoLinkType(ocLink.Type),
+			Attributes: ocAttributesToProtoAttributes(ocLink.Attributes),
+		})
+	}
+
+	return &tracepb.Span_Links{
+		Link: sl,
+	}
+}
+
+func ocLinkTypeToProtoLinkType(oct trace.LinkType) tracepb.Span_Link_Type {
+	switch oct {
+	case trace.LinkTypeChild:
+		return tracepb.Span_Link_CHILD_LINKED_SPAN
+	case trace.LinkTypeParent:
+		return tracepb.Span_Link_PARENT_LINKED_SPAN
+	default:
+		return tracepb.Span_Link_TYPE_UNSPECIFIED
+	}
+}
+
+func ocEventsToProtoTimeEvents(as []trace.Annotation, es []trace.MessageEvent) *tracepb.Span_TimeEvents {
+	if len(as) == 0 && len(es) == 0 {
+		return nil
+	}
+
+	timeEvents := make([]*tracepb.Span_TimeEvent, 0, len(as)+len(es))
+	for _, a := range as {
+		timeEvents = append(timeEvents, &tracepb.Span_TimeEvent{
+			Time: timeToTimestamp(a.Time),
+			Value: &tracepb.Span_TimeEvent_Annotation_{
+				Annotation: &tracepb.Span_TimeEvent_Annotation{
+					Description: &tracepb.TruncatableString{Value: a.Message},
+					Attributes:  ocAttributesToProtoAttributes(a.Attributes),
+				},
+			},
+		})
+	}
+	for _, e := range es {
+		timeEvents = append(timeEvents, &tracepb.Span_TimeEvent{
+			Time: timeToTimestamp(e.Time),
+			Value: &tracepb.Span_TimeEvent_MessageEvent_{
+				MessageEvent: &tracepb.Span_TimeEvent_MessageEvent{
+					Type:             ocMessageEventTypeToProtoMessageEventType(e.EventType),
+					Id:               uint64(e.MessageID),
+					UncompressedSize: uint64(e.UncompressedByteSize),
+					CompressedSize:   uint64(e.CompressedByteSize),
+				},
+			},
+		})
+	}
+	return &tracepb.Span_TimeEvents{
+		TimeEvent: timeEvents,
+	}
+}
+
+func ocMessageEventTypeToProtoMessageEventType(oct trace.MessageEventType) tracepb.Span_TimeEvent_MessageEvent_Type {
+	switch oct {
+	case trace.MessageEventTypeSent:
+		return tracepb.Span_TimeEvent_MessageEvent_SENT
+	case trace.MessageEventTypeRecv:
+		return tracepb.Span_TimeEvent_MessageEvent_RECEIVED
+	default:
+		return tracepb.Span_TimeEvent_MessageEvent_TYPE_UNSPECIFIED
+	}
+}
+
+// smallAttributeCount is the largest number of attributes that are
+// converted by ocSmallAttributesToProtoAttributes. Most spans have no more.
+const smallAttributeCount = 2
+
+func ocAttributesToProtoAttributes(attrs map[string]interface{}) *tracepb.Span_Attributes {
+	if len(attrs) == 0 {
+		return nil
+	}
+	if len(attrs) <= smallAttributeCount {
+		return ocSmallAttributesToProtoAttributes(attrs)
+	}
+	return ocAnyAttributesToProtoAttributes(attrs)
+}
+
+// smallAttributes holds everything that the attributes of a span with few
+// of them are built from, so that it takes a single allocation.
+type smallAttributes struct {
+	attrs   tracepb.Span_Attributes
+	values  [smallAttributeCount]tracepb.AttributeValue
+	bools   [smallAttributeCount]tracepb.AttributeValue_BoolValue
+	ints    [smallAttributeCount]tracepb.AttributeValue_IntValue
+	strings [smallAttributeCount]tracepb.AttributeValue_StringValue
+	strs    [smallAttributeCount]tracepb.TruncatableString
+}
+
+// ocSmallAttributesToProtoAttributes is the fast path for spans with up to
+// smallAttributeCount attributes: apart from the map, the whole result is
+// carved out of one smallAttributes instead of being allocated value by
+// value. It converts exactly like ocAnyAttributesToProtoAttributes.
+func ocSmallAttributesToProtoAttributes(attrs map[string]interface{}) *tracepb.Span_Attributes {
+	sa := new(smallAttributes)
+	outMap := make(map[string]*tracepb.AttributeValue, len(attrs))
+	i := 0
+	for k, v := range attrs {
+		switch v := v.(type) {
+		case bool:
+			sa.bools[i].BoolValue = v
+			sa.values[i].Value = &sa.bools[i]
+
+		case int:
+			sa.ints[i].IntValue = int64(v)
+			sa.values[i].Value = &sa.ints[i]
+
+		case int64:
+			sa.ints[i].IntValue = v
+			sa.values[i].Value = &sa.ints[i]
+
+		case string:
+			sa.strs[i].Value = v
+			sa.strings[i].StringValue = &sa.strs[i]
+			sa.values[i].Value = &sa.strings[i]
+
+		default:
+			continue
+		}
+		outMap[k] = &sa.values[i]
+		i++
+	}
+	sa.attrs.AttributeMap = outMap
+	return &sa.attrs
+}
+
+func ocAnyAttributesToProtoAttributes(attrs map[string]interface{}) *tracepb.Span_Attributes {
+	outMap := make(map[string]*tracepb.AttributeValue)
+	for k, v := range attrs {
+		switch v := v.(type) {
+		case bool:
+			outMap[k] = &tracepb.AttributeValue{Value: &tracepb.AttributeValue_BoolValue{BoolValue: v}}
+
+		case int:
+			outMap[k] = &tracepb.AttributeValue{Value: &tracepb.AttributeValue_IntValue{IntValue: int64(v)}}
+
+		case int64:
+			outMap[k] = &tracepb.AttributeValue{Value: &tracepb.AttributeValue_IntValue{IntValue: v}}
+
+		case string:
+			outMap[k] = &tracepb.AttributeValue{
+				Value: &tracepb.AttributeValue_StringValue{
+					StringValue: &tracepb.TruncatableString{Value: v},
+				},
+			}
+		}
+	}
+	return &tracepb.Span_Attributes{
+		AttributeMap: outMap,
+	}
+}
+
+func timeToTimestamp(t time.Time) *timestamp.Timestamp {
+	nanoTime := t.UnixNano()
+	return &timestamp.Timestamp{
+		Seconds: nanoTime / 1e9,
+		Nanos:   int32(nanoTime % 1e9),
+	}
+}
+
+func ocSpanKindToProtoSpanKind(kind int) tracepb.Span_SpanKind {
+	switch kind {
+	case trace.SpanKindClient:
+		return tracepb.Span_CLIENT
+	case trace.SpanKindServer:
+		return tracepb.Span_SERVER
+	default:
+		return tracepb.Span_SPAN_KIND_UNSPECIFIED
+	}
+}
+
+func ocTracestateToProtoTracestate(ts *tracestate.Tracestate) *tracepb.Span_Tracestate {
+	if ts == nil {
+		return nil
+	}
+	return &tracepb.Span_Tracestate{
+		Entries: ocTracestateEntriesToProtoTracestateEntries(ts.Entries()),
+	}
+}
+
+func ocTracestateEntriesToProtoTracestateEntries(entries []tracestate.Entry) []*tracepb.Span_Tracestate_Entry {
+	protoEntries := make([]*tracepb.Span_Tracestate_Entry, 0, len(entries))
+	for _, entry := range entries {
+		protoEntries = append(protoEntries, &tracepb.Span_Tracestate_Entry{
+			Key:   entry.Key,
+			Value: entry.Value,
+		})
+	}
+	return protoEntries
+}
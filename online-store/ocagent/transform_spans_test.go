@@ -0,0 +1,667 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent_test
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/tracestate"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"online-store/ocagent"
+)
+
+func TestOCSpanToProtoSpan_endToEnd(t *testing.T) {
+	// The goal of this test is to ensure that each
+	// spanData is transformed and exported correctly!
+
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	serviceName := "spanTranslation"
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port), ocagent.WithServiceName(serviceName))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	startTime := time.Now()
+	endTime := startTime.Add(10 * time.Second)
+	ocTracestate, err := tracestate.New(new(tracestate.Tracestate), tracestate.Entry{Key: "foo", Value: "bar"},
+		tracestate.Entry{Key: "a", Value: "b"})
+	if err != nil || ocTracestate == nil {
+		t.Fatalf("Failed to create ocTracestate: %v", err)
+	}
+
+	ocSpanData := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID:    trace.TraceID{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F},
+			SpanID:     trace.SpanID{0xFF, 0xFE, 0xFD, 0xFC, 0xFB, 0xFA, 0xF9, 0xF8},
+			Tracestate: ocTracestate,
+		},
+		SpanKind:     trace.SpanKindServer,
+		ParentSpanID: trace.SpanID{0xEF, 0xEE, 0xED, 0xEC, 0xEB, 0xEA, 0xE9, 0xE8},
+		Name:         "End-To-End Here",
+		StartTime:    startTime,
+		EndTime:      endTime,
+		MessageEvents: []trace.MessageEvent{
+			{Time: startTime, EventType: trace.MessageEventTypeSent, UncompressedByteSize: 1024, CompressedByteSize: 512},
+			{Time: endTime, EventType: trace.MessageEventTypeRecv, UncompressedByteSize: 1024, CompressedByteSize: 1000},
+		},
+		Links: []trace.Link{
+			{
+				TraceID: trace.TraceID{0xC0, 0xC1, 0xC2, 0xC3, 0xC4, 0xC5, 0xC6, 0xC7, 0xC8, 0xC9, 0xCA, 0xCB, 0xCC, 0xCD, 0xCE, 0xCF},
+				SpanID:  trace.SpanID{0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7},
+				Type:    trace.LinkTypeParent,
+			},
+			{
+				TraceID: trace.TraceID{0xE0, 0xE1, 0xE2, 0xE3, 0xE4, 0xE5, 0xE6, 0xE7, 0xE8, 0xE9, 0xEA, 0xEB, 0xEC, 0xED, 0xEE, 0xEF},
+				SpanID:  trace.SpanID{0xD0, 0xD1, 0xD2, 0xD3, 0xD4, 0xD5, 0xD6, 0xD7},
+				Type:    trace.LinkTypeChild,
+			},
+		},
+		Status: trace.Status{
+			Code:    trace.StatusCodeInternal,
+			Message: "This is not a drill!",
+		},
+		HasRemoteParent: true,
+		Attributes: map[string]interface{}{
+			"timeout_ns": int64(12e9),
+			"agent":      "ocagent",
+			"cache_hit":  true,
+			"ping_count": int(25), // Should be transformed into int64
+		},
+	}
+
+	// TODO: file a bug with opencensus-go because trace.Annotation.Attributes' type is map[string]interface{}
+	// yet Attribute value and key cannot be easily introspected, so we can't easily test the values.
+
+	exp.ExportSpan(ocSpanData)
+	// Also try to export a nil span and it should never make it
+	exp.ExportSpan(nil)
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	spans := agent.getSpans()
+	if len(spans) == 0 || spans[0] == nil {
+		t.Fatal("Expected the exported span")
+	}
+
+	wantProtoSpan := &tracepb.Span{
+		TraceId:      []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F},
+		SpanId:       []byte{0xFF, 0xFE, 0xFD, 0xFC, 0xFB, 0xFA, 0xF9, 0xF8},
+		ParentSpanId: []byte{0xEF, 0xEE, 0xED, 0xEC, 0xEB, 0xEA, 0xE9, 0xE8},
+		Name:         &tracepb.TruncatableString{Value: "End-To-End Here"},
+		Kind:         tracepb.Span_SERVER,
+		StartTime:    timeToTimestamp(startTime),
+		EndTime:      timeToTimestamp(endTime),
+		Status: &tracepb.Status{
+			Code:    13,
+			Message: "This is not a drill!",
+		},
+		TimeEvents: &tracepb.Span_TimeEvents{
+			TimeEvent: []*tracepb.Span_TimeEvent{
+				{
+					Time: timeToTimestamp(startTime),
+					Value: &tracepb.Span_TimeEvent_MessageEvent_{
+						MessageEvent: &tracepb.Span_TimeEvent_MessageEvent{
+							Type:             tracepb.Span_TimeEvent_MessageEvent_SENT,
+							UncompressedSize: 1024,
+							CompressedSize:   512,
+						},
+					},
+				},
+				{
+					Time: timeToTimestamp(endTime),
+					Value: &tracepb.Span_TimeEvent_MessageEvent_{
+						MessageEvent: &tracepb.Span_TimeEvent_MessageEvent{
+							Type:             tracepb.Span_TimeEvent_MessageEvent_RECEIVED,
+							UncompressedSize: 1024,
+							CompressedSize:   1000,
+						},
+					},
+				},
+			},
+		},
+		Links: &tracepb.Span_Links{
+			Link: []*tracepb.Span_Link{
+				{
+					TraceId: []byte{0xC0, 0xC1, 0xC2, 0xC3, 0xC4, 0xC5, 0xC6, 0xC7, 0xC8, 0xC9, 0xCA, 0xCB, 0xCC, 0xCD, 0xCE, 0xCF},
+					SpanId:  []byte{0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7},
+					Type:    tracepb.Span_Link_PARENT_LINKED_SPAN,
+				},
+				{
+					TraceId: []byte{0xE0, 0xE1, 0xE2, 0xE3, 0xE4, 0xE5, 0xE6, 0xE7, 0xE8, 0xE9, 0xEA, 0xEB, 0xEC, 0xED, 0xEE, 0xEF},
+					SpanId:  []byte{0xD0, 0xD1, 0xD2, 0xD3, 0xD4, 0xD5, 0xD6, 0xD7},
+					Type:    tracepb.Span_Link_CHILD_LINKED_SPAN,
+				},
+			},
+		},
+		Tracestate: &tracepb.Span_Tracestate{
+			Entries: []*tracepb.Span_Tracestate_Entry{
+				{Key: "foo", Value: "bar"},
+				{Key: "a", Value: "b"},
+			},
+		},
+		Attributes: &tracepb.Span_Attributes{
+			AttributeMap: map[string]*tracepb.AttributeValue{
+				"cache_hit":  {Value: &tracepb.AttributeValue_BoolValue{BoolValue: true}},
+				"timeout_ns": {Value: &tracepb.AttributeValue_IntValue{IntValue: 12e9}},
+				"ping_count": {Value: &tracepb.AttributeValue_IntValue{IntValue: 25}},
+				"agent": {Value: &tracepb.AttributeValue_StringValue{
+					StringValue: &tracepb.TruncatableString{Value: "ocagent"},
+				}},
+			},
+		},
+	}
+
+	if g, w := spans[0], wantProtoSpan; !reflect.DeepEqual(g, w) {
+		for i := 0; i < len(w.Links.Link); i++ {
+			t.Logf("#%d:: \nGot:  %#v\nWant: %#v\n\n", i, g.Links.Link[i], w.Links.Link[i])
+		}
+		t.Fatalf("End-to-end transformed span\n\tGot  %+v\n\tWant %+v", g, w)
+	}
+}
+
+func TestSpanDataToProto(t *testing.T) {
+	startTime := time.Now()
+	endTime := startTime.Add(time.Second)
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+			SpanID:  trace.SpanID{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+		},
+		Name:      "standalone",
+		SpanKind:  trace.SpanKindClient,
+		StartTime: startTime,
+		EndTime:   endTime,
+		Attributes: map[string]interface{}{
+			"retries": int64(3),
+		},
+		Annotations: []trace.Annotation{
+			{Time: startTime, Message: "cache miss", Attributes: map[string]interface{}{"key": "sku-42"}},
+		},
+		MessageEvents: []trace.MessageEvent{
+			{Time: endTime, EventType: trace.MessageEventTypeRecv, MessageID: 7, UncompressedByteSize: 64},
+		},
+		Links: []trace.Link{
+			{
+				TraceID:    trace.TraceID{0xA0, 0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6, 0xA7, 0xA8, 0xA9, 0xAA, 0xAB, 0xAC, 0xAD, 0xAE, 0xAF},
+				SpanID:     trace.SpanID{0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7},
+				Type:       trace.LinkTypeChild,
+				Attributes: map[string]interface{}{"batch": true},
+			},
+		},
+		Status: trace.Status{Code: trace.StatusCodeNotFound, Message: "no such sku"},
+	}
+
+	want := &tracepb.Span{
+		TraceId:      []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+		SpanId:       []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+		ParentSpanId: make([]byte, 8),
+		Name:         &tracepb.TruncatableString{Value: "standalone"},
+		Kind:         tracepb.Span_CLIENT,
+		StartTime:    timeToTimestamp(startTime),
+		EndTime:      timeToTimestamp(endTime),
+		Attributes: &tracepb.Span_Attributes{
+			AttributeMap: map[string]*tracepb.AttributeValue{
+				"retries": {Value: &tracepb.AttributeValue_IntValue{IntValue: 3}},
+			},
+		},
+		TimeEvents: &tracepb.Span_TimeEvents{
+			TimeEvent: []*tracepb.Span_TimeEvent{
+				{
+					Time: timeToTimestamp(startTime),
+					Value: &tracepb.Span_TimeEvent_Annotation_{
+						Annotation: &tracepb.Span_TimeEvent_Annotation{
+							Description: &tracepb.TruncatableString{Value: "cache miss"},
+							Attributes: &tracepb.Span_Attributes{
+								AttributeMap: map[string]*tracepb.AttributeValue{
+									"key": {Value: &tracepb.AttributeValue_StringValue{
+										StringValue: &tracepb.TruncatableString{Value: "sku-42"},
+									}},
+								},
+							},
+						},
+					},
+				},
+				{
+					Time: timeToTimestamp(endTime),
+					Value: &tracepb.Span_TimeEvent_MessageEvent_{
+						MessageEvent: &tracepb.Span_TimeEvent_MessageEvent{
+							Type:             tracepb.Span_TimeEvent_MessageEvent_RECEIVED,
+							Id:               7,
+							UncompressedSize: 64,
+						},
+					},
+				},
+			},
+		},
+		Links: &tracepb.Span_Links{
+			Link: []*tracepb.Span_Link{
+				{
+					TraceId: []byte{0xA0, 0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6, 0xA7, 0xA8, 0xA9, 0xAA, 0xAB, 0xAC, 0xAD, 0xAE, 0xAF},
+					SpanId:  []byte{0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7},
+					Type:    tracepb.Span_Link_CHILD_LINKED_SPAN,
+					Attributes: &tracepb.Span_Attributes{
+						AttributeMap: map[string]*tracepb.AttributeValue{
+							"batch": {Value: &tracepb.AttributeValue_BoolValue{BoolValue: true}},
+						},
+					},
+				},
+			},
+		},
+		Status: &tracepb.Status{Code: trace.StatusCodeNotFound, Message: "no such sku"},
+	}
+
+	if g, w := ocagent.SpanDataToProto(sd), want; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Converted span\n\tGot  %+v\n\tWant %+v", g, w)
+	}
+	if g := ocagent.SpanDataToProto(nil); g != nil {
+		t.Errorf("Converting a nil SpanData: got %+v want nil", g)
+	}
+
+	batch := ocagent.SpanDataToProtoSpans([]*trace.SpanData{sd, nil, sd})
+	if g, w := len(batch), 2; g != w {
+		t.Fatalf("Batch conversion: got %d spans want %d", g, w)
+	}
+	for i, span := range batch {
+		if !reflect.DeepEqual(span, want) {
+			t.Errorf("Batch span #%d\n\tGot  %+v\n\tWant %+v", i, span, want)
+		}
+	}
+}
+
+func TestOCSpanToProtoSpan_traceOptions(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port), ocagent.WithTraceOptions())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	const debug = trace.TraceOptions(1 << 1)
+	wantOptions := map[string]int64{
+		"sampled":       1,
+		"sampled-debug": int64(1 | debug),
+		"unsampled":     0,
+	}
+	for name, options := range wantOptions {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{TraceOptions: trace.TraceOptions(options)},
+			Name:        name,
+		})
+	}
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	spans := agent.getSpans()
+	if g, w := len(spans), len(wantOptions); g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	for _, span := range spans {
+		name := span.Name.GetValue()
+		got := span.GetAttributes().GetAttributeMap()[ocagent.TraceOptionsAttributeKey]
+		if got == nil {
+			t.Errorf("%q: missing the trace options attribute", name)
+			continue
+		}
+		if g, w := got.GetIntValue(), wantOptions[name]; g != w {
+			t.Errorf("%q: trace options got %b want %b", name, g, w)
+		}
+	}
+}
+
+func timeToTimestamp(t time.Time) *timestamp.Timestamp {
+	nanoTime := t.UnixNano()
+	return &timestamp.Timestamp{
+		Seconds: nanoTime / 1e9,
+		Nanos:   int32(nanoTime % 1e9),
+	}
+}
+
+func TestOCSpanToProtoSpan_spanIDRemapper(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	// A counter-based remapper returns a different ID on every call, so
+	// parent/child consistency relies on the exporter remapping each ID once.
+	var next byte
+	remap := func(trace.SpanID) trace.SpanID {
+		next++
+		return trace.SpanID{0xAA, next}
+	}
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port), ocagent.WithSpanIDRemapper(remap))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	parentID := trace.SpanID{0x01}
+	childID := trace.SpanID{0x02}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{SpanID: parentID},
+		Name:        "parent",
+	})
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext:  trace.SpanContext{SpanID: childID},
+		ParentSpanID: parentID,
+		Name:         "child",
+	})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	spans := agent.getSpans()
+	if g, w := len(spans), 2; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	byName := make(map[string]*tracepb.Span)
+	for _, span := range spans {
+		byName[span.Name.GetValue()] = span
+	}
+	parent, child := byName["parent"], byName["child"]
+	if parent == nil || child == nil {
+		t.Fatalf("Missing spans, got %v", byName)
+	}
+	if reflect.DeepEqual(parent.SpanId, parentID[:]) {
+		t.Errorf("Parent span ID was not remapped: %x", parent.SpanId)
+	}
+	if g, w := parent.ParentSpanId, make([]byte, 8); !reflect.DeepEqual(g, w) {
+		t.Errorf("Root span's parent span ID was remapped: got %x want %x", g, w)
+	}
+	if g, w := child.ParentSpanId, parent.SpanId; !reflect.DeepEqual(g, w) {
+		t.Errorf("Child's parent span ID: got %x want %x", g, w)
+	}
+}
+
+func TestOCSpanToProtoSpan_reservedKeyPrefix(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithTraceOptions(), ocagent.WithReservedKeyPrefix("user."))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{TraceOptions: 1},
+		Name:        "colliding",
+		Attributes: map[string]interface{}{
+			ocagent.TraceOptionsAttributeKey: "from the app",
+			"http.path":                      "/cart",
+		},
+	})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	spans := agent.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	attrs := spans[0].GetAttributes().GetAttributeMap()
+	if g, w := attrs["user."+ocagent.TraceOptionsAttributeKey].GetStringValue().GetValue(), "from the app"; g != w {
+		t.Errorf("Namespaced user attribute: got %q want %q", g, w)
+	}
+	if g, w := attrs[ocagent.TraceOptionsAttributeKey].GetIntValue(), int64(1); g != w {
+		t.Errorf("Exporter's trace options attribute: got %d want %d", g, w)
+	}
+	if g, w := attrs["http.path"].GetStringValue().GetValue(), "/cart"; g != w {
+		t.Errorf("Unreserved attribute: got %q want %q", g, w)
+	}
+	if g, w := exp.Stats().ReservedKeyCollisions, int64(1); g != w {
+		t.Errorf("ReservedKeyCollisions: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_ExportOpenSpans(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithReservedKeyPrefix("user."))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	start := time.Now().Add(-time.Second)
+	open := &trace.SpanData{
+		Name:       "in-flight",
+		StartTime:  start,
+		Attributes: map[string]interface{}{"http.path": "/checkout"},
+	}
+	before := time.Now()
+	exp.ExportOpenSpans([]*trace.SpanData{open})
+	after := time.Now()
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	if !open.EndTime.IsZero() || len(open.Attributes) != 1 {
+		t.Errorf("ExportOpenSpans modified the SpanData passed in: %+v", open)
+	}
+	spans := agent.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	attrs := spans[0].GetAttributes().GetAttributeMap()
+	if !attrs[ocagent.ForcedCloseAttributeKey].GetBoolValue() {
+		t.Errorf("Missing the forced-close marker: %v", attrs)
+	}
+	if g := exp.Stats().ReservedKeyCollisions; g != 0 {
+		t.Errorf("The forced-close marker counted as a reserved key collision: got %d want 0", g)
+	}
+	if g, w := attrs["http.path"].GetStringValue().GetValue(), "/checkout"; g != w {
+		t.Errorf("Span attribute: got %q want %q", g, w)
+	}
+	end := time.Unix(spans[0].EndTime.Seconds, int64(spans[0].EndTime.Nanos))
+	if end.Before(before) || end.After(after) {
+		t.Errorf("End time %v is not between %v and %v", end, before, after)
+	}
+}
+
+func TestOCSpanToProtoSpan_exportFieldMask(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithExportFieldMask(ocagent.SpanFieldAttributes, ocagent.SpanFieldStatus))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	now := time.Now()
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: trace.TraceID{0x01}, SpanID: trace.SpanID{0x02}},
+		Name:        "masked",
+		StartTime:   now.Add(-time.Second),
+		EndTime:     now,
+		Attributes:  map[string]interface{}{"http.path": "/cart"},
+		Annotations: []trace.Annotation{{Time: now, Message: "cache miss"}},
+		MessageEvents: []trace.MessageEvent{
+			{Time: now, EventType: trace.MessageEventTypeSent, MessageID: 1},
+		},
+		Links:  []trace.Link{{TraceID: trace.TraceID{0x03}, SpanID: trace.SpanID{0x04}}},
+		Status: trace.Status{Code: 2, Message: "unknown"},
+	})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	spans := agent.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	span := spans[0]
+	if span.TimeEvents != nil {
+		t.Errorf("Annotations and message events were exported: %v", span.TimeEvents)
+	}
+	if span.Links != nil {
+		t.Errorf("Links were exported: %v", span.Links)
+	}
+	if g, w := span.GetAttributes().GetAttributeMap()["http.path"].GetStringValue().GetValue(), "/cart"; g != w {
+		t.Errorf("Attribute: got %q want %q", g, w)
+	}
+	if g, w := span.GetStatus().GetCode(), int32(2); g != w {
+		t.Errorf("Status code: got %d want %d", g, w)
+	}
+	if g, w := span.Name.GetValue(), "masked"; g != w {
+		t.Errorf("Name: got %q want %q", g, w)
+	}
+}
+
+func TestOCSpanToProtoSpan_monotonicTimestampSource(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithSpanExportTimestampSource())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// The wall clock was stepped back by a second while the span was open;
+	// Round(0) strips the monotonic readings, as for times that went
+	// through serialization.
+	start := time.Now().Round(0)
+	end := start.Add(-time.Second)
+	exp.ExportSpan(&trace.SpanData{Name: "stepped", StartTime: start, EndTime: end})
+	// A span timed with the monotonic clock keeps its duration.
+	monoStart := time.Now()
+	exp.ExportSpan(&trace.SpanData{Name: "monotonic", StartTime: monoStart, EndTime: monoStart.Add(25 * time.Millisecond)})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	durations := make(map[string]time.Duration)
+	for _, span := range agent.getSpans() {
+		s := time.Unix(span.StartTime.Seconds, int64(span.StartTime.Nanos))
+		e := time.Unix(span.EndTime.Seconds, int64(span.EndTime.Nanos))
+		durations[span.Name.GetValue()] = e.Sub(s)
+	}
+	if g, w := durations["stepped"], time.Duration(0); g != w {
+		t.Errorf("Duration across a backward clock step: got %v want %v", g, w)
+	}
+	if g, w := durations["monotonic"], 25*time.Millisecond; g != w {
+		t.Errorf("Monotonic duration: got %v want %v", g, w)
+	}
+	if g, w := exp.Stats().NegativeDurations, int64(1); g != w {
+		t.Errorf("NegativeDurations: got %d want %d", g, w)
+	}
+}
+
+func TestOCSpanToProtoSpan_maxSpanNameLength(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithMaxSpanNameLength(8))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	exp.ExportSpan(&trace.SpanData{Name: "GET /héllo/wörld"})
+	exp.ExportSpan(&trace.SpanData{Name: "日本語のスパン名です"})
+	exp.ExportSpan(&trace.SpanData{Name: "short"})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	want := map[string]int32{
+		"GET /hél": int32(len("lo/wörld")),
+		"日本語のスパン名": int32(len("です")),
+		"short":    0,
+	}
+	spans := agent.getSpans()
+	if g, w := len(spans), len(want); g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	for _, span := range spans {
+		truncated, ok := want[span.Name.GetValue()]
+		if !ok {
+			t.Errorf("Unexpected span name %q", span.Name.GetValue())
+			continue
+		}
+		if g := span.Name.GetTruncatedByteCount(); g != truncated {
+			t.Errorf("%q: got %d truncated bytes want %d", span.Name.GetValue(), g, truncated)
+		}
+	}
+	if g, w := exp.Stats().SpanNamesTruncated, int64(2); g != w {
+		t.Errorf("SpanNamesTruncated: got %d want %d", g, w)
+	}
+}
+
+func TestOCSpanToProtoSpan_indexedAttributesAreUnsupported(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	var logs bytes.Buffer
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithLogger(log.New(&logs, "", 0)),
+		ocagent.WithIndexedAttributes([]string{"tenant"}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	if g := logs.String(); !strings.Contains(g, `"tenant"`) {
+		t.Errorf("Got logs %q, want a notice about the indexed attribute", g)
+	}
+
+	exp.ExportSpan(&trace.SpanData{
+		Name:       "indexed",
+		Attributes: map[string]interface{}{"tenant": "a"},
+	})
+	exp.Flush()
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	spans := agent.getSpans()
+	if g, w := len(spans), 1; g != w {
+		t.Fatalf("Spans: got %d want %d", g, w)
+	}
+	got := spans[0].GetAttributes().GetAttributeMap()["tenant"].GetStringValue().GetValue()
+	if g, w := got, "a"; g != w {
+		t.Errorf("The indexed attribute in the attribute map: got %q want %q", g, w)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent
+
+import (
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
+)
+
+// HistogramBucketMapper returns the bucket boundaries that the distribution
+// of the named view should be exported with, given the boundaries it was
+// recorded with. Returning the input bounds leaves the distribution as is.
+type HistogramBucketMapper func(view string, bounds []float64) []float64
+
+// metricConversion converts view data into the metrics sent to the agent.
+type metricConversion struct {
+	mapBuckets HistogramBucketMapper
+	// tagFilter, if set, decides which tag values are exported as they are;
+	// the others are collapsed into an unset value.
+	tagFilter func(key tag.Key, value string) bool
+	// stats is where collapsed tag values are counted; it is nil for
+	// conversions made outside of an Exporter.
+	stats *statsRecorder
+}
+
+func (mc *metricConversion) viewDataToMetric(vd *view.Data) *metricspb.Metric {
+	if vd == nil || vd.View == nil {
+		return nil
+	}
+	v := vd.View
+
+	labelKeys := make([]*metricspb.LabelKey, 0, len(v.TagKeys))
+	for _, k := range v.TagKeys {
+		labelKeys = append(labelKeys, &metricspb.LabelKey{Key: k.Name()})
+	}
+
+	var unit string
+	if v.Measure != nil {
+		unit = v.Measure.Unit()
+	}
+	metricType := viewToMetricDescriptorType(v)
+
+	timeseries := make([]*metricspb.TimeSeries, 0, len(vd.Rows))
+	// bySeries finds the time series that rows whose tag values were
+	// collapsed by the filter are merged into.
+	var bySeries map[string]*metricspb.TimeSeries
+	for _, row := range vd.Rows {
+		point := rowDataToPoint(v, row.Data, mc.mapBuckets)
+		if point == nil {
+			continue
+		}
+		point.Timestamp = timeToTimestamp(vd.End)
+		labelValues := rowLabelValues(v, row)
+		if mc.tagFilter != nil {
+			if mc.filterLabelValues(v.TagKeys, labelValues) {
+				if bySeries == nil {
+					bySeries = make(map[string]*metricspb.TimeSeries)
+				}
+				key := seriesKey(labelValues)
+				if ts, ok := bySeries[key]; ok {
+					mergePoint(ts.Points[0], point, metricType)
+					continue
+				}
+				ts := &metricspb.TimeSeries{
+					StartTimestamp: timeToTimestamp(vd.Start),
+					LabelValues:    labelValues,
+					Points:         []*metricspb.Point{point},
+				}
+				bySeries[key] = ts
+				timeseries = append(timeseries, ts)
+				continue
+			}
+		}
+		timeseries = append(timeseries, &metricspb.TimeSeries{
+			StartTimestamp: timeToTimestamp(vd.Start),
+			LabelValues:    labelValues,
+			Points:         []*metricspb.Point{point},
+		})
+	}
+
+	return &metricspb.Metric{
+		Descriptor_: &metricspb.Metric_MetricDescriptor{
+			MetricDescriptor: &metricspb.MetricDescriptor{
+				Name:        v.Name,
+				Description: v.Description,
+				Unit:        unit,
+				Type:        metricType,
+				LabelKeys:   labelKeys,
+			},
+		},
+		Timeseries: timeseries,
+	}
+}
+
+// filterLabelValues unsets the label values that the tag filter rejects,
+// and reports whether it did for any of them.
+func (mc *metricConversion) filterLabelValues(keys []tag.Key, labelValues []*metricspb.LabelValue) bool {
+	filtered := 0
+	for i, lv := range labelValues {
+		if lv.HasValue && !mc.tagFilter(keys[i], lv.Value) {
+			labelValues[i] = &metricspb.LabelValue{}
+			filtered++
+		}
+	}
+	if filtered > 0 && mc.stats != nil {
+		mc.stats.recordFilteredTags(filtered)
+	}
+	return filtered > 0
+}
+
+// seriesKey identifies a time series by its label values.
+func seriesKey(labelValues []*metricspb.LabelValue) string {
+	var b strings.Builder
+	for _, lv := range labelValues {
+		if lv.HasValue {
+			b.WriteString(strconv.Quote(lv.Value))
+		}
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// mergePoint adds the value of src into dst, for rows that end up in the
+// same time series. Gauges can't be added up, so dst keeps its own value.
+func mergePoint(dst, src *metricspb.Point, metricType metricspb.MetricDescriptor_Type) {
+	switch metricType {
+	case metricspb.MetricDescriptor_GAUGE_INT64, metricspb.MetricDescriptor_GAUGE_DOUBLE:
+		return
+	}
+	switch dv := dst.Value.(type) {
+	case *metricspb.Point_Int64Value:
+		dv.Int64Value += src.GetInt64Value()
+	case *metricspb.Point_DoubleValue:
+		dv.DoubleValue += src.GetDoubleValue()
+	case *metricspb.Point_DistributionValue:
+		mergeDistribution(dv.DistributionValue, src.GetDistributionValue())
+	}
+}
+
+func mergeDistribution(dst, src *metricspb.DistributionValue) {
+	if src == nil || src.Count == 0 {
+		return
+	}
+	n1, n2 := float64(dst.Count), float64(src.Count)
+	n := n1 + n2
+	delta := src.Mean - dst.Mean
+	dst.SumOfSquaredDeviation += src.SumOfSquaredDeviation + delta*delta*n1*n2/n
+	dst.Mean += delta * n2 / n
+	dst.Count += src.Count
+	for i, b := range src.Buckets {
+		if i < len(dst.Buckets) {
+			dst.Buckets[i].Count += b.Count
+		}
+	}
+}
+
+func viewToMetricDescriptorType(v *view.View) metricspb.MetricDescriptor_Type {
+	if v.Aggregation == nil {
+		return metricspb.MetricDescriptor_UNSPECIFIED
+	}
+	_, isInt64 := v.Measure.(*stats.Int64Measure)
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		return metricspb.MetricDescriptor_CUMULATIVE_INT64
+	case view.AggTypeSum:
+		return metricspb.MetricDescriptor_CUMULATIVE_DOUBLE
+	case view.AggTypeDistribution:
+		return metricspb.MetricDescriptor_CUMULATIVE_DISTRIBUTION
+	case view.AggTypeLastValue:
+		if isInt64 {
+			return metricspb.MetricDescriptor_GAUGE_INT64
+		}
+		return metricspb.MetricDescriptor_GAUGE_DOUBLE
+	default:
+		return metricspb.MetricDescriptor_UNSPECIFIED
+	}
+}
+
+// rowLabelValues lines the row's tag values up with the view's tag keys,
+// marking the keys that the row has no value for.
+func rowLabelValues(v *view.View, row *view.Row) []*metricspb.LabelValue {
+	labelValues := make([]*metricspb.LabelValue, 0, len(v.TagKeys))
+	for _, k := range v.TagKeys {
+		lv := &metricspb.LabelValue{}
+		for _, t := range row.Tags {
+			if t.Key == k {
+				lv.Value = t.Value
+				lv.HasValue = true
+				break
+			}
+		}
+		labelValues = append(labelValues, lv)
+	}
+	return labelValues
+}
+
+func rowDataToPoint(v *view.View, data view.AggregationData, mapBuckets HistogramBucketMapper) *metricspb.Point {
+	switch data := data.(type) {
+	case *view.CountData:
+		return &metricspb.Point{Value: &metricspb.Point_Int64Value{Int64Value: data.Value}}
+	case *view.SumData:
+		return &metricspb.Point{Value: &metricspb.Point_DoubleValue{DoubleValue: data.Value}}
+	case *view.LastValueData:
+		if _, isInt64 := v.Measure.(*stats.Int64Measure); isInt64 {
+			return &metricspb.Point{Value: &metricspb.Point_Int64Value{Int64Value: int64(data.Value)}}
+		}
+		return &metricspb.Point{Value: &metricspb.Point_DoubleValue{DoubleValue: data.Value}}
+	case *view.DistributionData:
+		var bounds []float64
+		if v.Aggregation != nil {
+			bounds = v.Aggregation.Buckets
+		}
+		counts := data.CountPerBucket
+		if mapBuckets != nil {
+			newBounds := mapBuckets(v.Name, bounds)
+			counts = rebucket(bounds, counts, newBounds)
+			bounds = newBounds
+		}
+		buckets := make([]*metricspb.DistributionValue_Bucket, 0, len(counts))
+		for _, count := range counts {
+			buckets = append(buckets, &metricspb.DistributionValue_Bucket{Count: count})
+		}
+		return &metricspb.Point{
+			Value: &metricspb.Point_DistributionValue{
+				DistributionValue: &metricspb.DistributionValue{
+					Count:                 data.Count,
+					Mean:                  data.Mean,
+					SumOfSquaredDeviation: data.SumOfSquaredDev,
+					BucketBounds:          bounds,
+					Buckets:               buckets,
+				},
+			},
+		}
+	default:
+		return nil
+	}
+}
+
+// rebucket moves the per-bucket counts of a histogram recorded with bounds
+// onto the buckets described by newBounds. Bucket i covers the values in
+// [bounds[i-1], bounds[i]), with the first and last buckets unbounded below
+// and above respectively.
+//
+// Since the individual values are no longer known, this is an approximation:
+// every bucket's count is moved, as a whole, into the new bucket holding its
+// upper bound. Values are thus only ever reported in a bucket at or above
+// the one they were recorded in, which overestimates rather than
+// underestimates, and the total count is always preserved.
+func rebucket(bounds []float64, counts []int64, newBounds []float64) []int64 {
+	newCounts := make([]int64, len(newBounds)+1)
+	for i, count := range counts {
+		if i >= len(bounds) {
+			// The overflow bucket has no upper bound.
+			newCounts[len(newBounds)] += count
+			continue
+		}
+		j := 0
+		for j < len(newBounds) && newBounds[j] < bounds[i] {
+			j++
+		}
+		newCounts[j] += count
+	}
+	return newCounts
+}
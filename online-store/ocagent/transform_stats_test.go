@@ -0,0 +1,365 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocagent_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+
+	"online-store/ocagent"
+)
+
+func TestExportView_histogramBucketRemapping(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	targetBounds := []float64{25, 100}
+	var mappedView string
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithHistogramBucketMapper(func(name string, bounds []float64) []float64 {
+			mappedView = name
+			return targetBounds
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	latency := stats.Float64("latency_remap", "request latency", stats.UnitMilliseconds)
+	v := &view.View{
+		Name:        "latency_remap",
+		Measure:     latency,
+		Aggregation: view.Distribution(10, 20, 50, 100),
+	}
+	now := time.Now()
+	exp.ExportView(&view.Data{
+		View:  v,
+		Start: now.Add(-time.Minute),
+		End:   now,
+		Rows: []*view.Row{
+			// Recorded values: 5, 15, 30, 40, 70, 200
+			{Data: &view.DistributionData{Count: 6, Mean: 60, CountPerBucket: []int64{1, 1, 2, 1, 1}}},
+		},
+	})
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	if g, w := mappedView, "latency_remap"; g != w {
+		t.Errorf("Mapper invoked for view %q want %q", g, w)
+	}
+	metrics := agent.getMetrics()
+	if g, w := len(metrics), 1; g != w {
+		t.Fatalf("Metrics: got %d want %d", g, w)
+	}
+	dist := metrics[0].Timeseries[0].Points[0].GetDistributionValue()
+	if dist == nil {
+		t.Fatalf("Expected a distribution point, got %+v", metrics[0].Timeseries[0].Points[0])
+	}
+	if g, w := dist.BucketBounds, targetBounds; !reflect.DeepEqual(g, w) {
+		t.Errorf("BucketBounds: got %v want %v", g, w)
+	}
+	var gotCounts []int64
+	var total int64
+	for _, b := range dist.Buckets {
+		gotCounts = append(gotCounts, b.Count)
+		total += b.Count
+	}
+	if g, w := gotCounts, []int64{2, 3, 1}; !reflect.DeepEqual(g, w) {
+		t.Errorf("Bucket counts: got %v want %v", g, w)
+	}
+	if g, w := total, dist.Count; g != w {
+		t.Errorf("Total count after remapping: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_FlushMetricsSendsImmediately(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	orders := stats.Int64("orders_flush", "orders placed", stats.UnitDimensionless)
+	v := &view.View{Name: "orders_flush", Measure: orders, Aggregation: view.Count()}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("Failed to register the view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	for i := 0; i < 5; i++ {
+		stats.Record(context.Background(), orders.M(1))
+	}
+	// Recording is asynchronous, so wait for the samples to be aggregated.
+	deadline := time.Now().Add(time.Second)
+	for {
+		rows, _ := view.RetrieveData(v.Name)
+		if len(rows) > 0 && rows[0].Data.(*view.CountData).Value == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The recorded samples were never aggregated: %v", rows)
+		}
+		<-time.After(5 * time.Millisecond)
+	}
+
+	if err := exp.FlushMetrics(v); err != nil {
+		t.Fatalf("FlushMetrics: %v", err)
+	}
+	// Far shorter than the default reporting period.
+	<-time.After(50 * time.Millisecond)
+
+	metrics := agent.getMetrics()
+	if g, w := len(metrics), 1; g != w {
+		t.Fatalf("Metrics: got %d want %d", g, w)
+	}
+	if g, w := metrics[0].GetMetricDescriptor().GetName(), v.Name; g != w {
+		t.Errorf("Metric name: got %q want %q", g, w)
+	}
+	if g, w := metrics[0].Timeseries[0].Points[0].GetInt64Value(), int64(5); g != w {
+		t.Errorf("Count: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_exportRequestSizeHistogram(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithExportRequestSizeHistogram())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	// A small trace request, then one of a few KiB.
+	exp.ExportSpan(&trace.SpanData{Name: "small"})
+	exp.Flush()
+	for i := 0; i < 100; i++ {
+		exp.ExportSpan(&trace.SpanData{Name: strings.Repeat("x", 100)})
+	}
+	exp.Flush()
+
+	requests := stats.Int64("requests_size", "requests", stats.UnitDimensionless)
+	exp.ExportView(&view.Data{
+		View:  &view.View{Name: "requests_size", Measure: requests, Aggregation: view.Count()},
+		Start: time.Now().Add(-time.Minute),
+		End:   time.Now(),
+		Rows:  []*view.Row{{Data: &view.CountData{Value: 3}}},
+	})
+	<-time.After(100 * time.Millisecond)
+
+	sizes := exp.Stats().ExportRequestBytes
+	traces := sizes[ocagent.StreamTypeTrace]
+	if g, w := traces.Count, int64(2); g != w {
+		t.Fatalf("Trace requests: got %d want %d", g, w)
+	}
+	if traces.Min <= 0 || traces.Min >= 1<<10 {
+		t.Errorf("Smallest trace request: got %d bytes want (0, 1KiB)", traces.Min)
+	}
+	if traces.Max < 100*100 {
+		t.Errorf("Largest trace request: got %d bytes want at least %d", traces.Max, 100*100)
+	}
+	if g, w := traces.Sum, traces.Min+traces.Max; g != w {
+		t.Errorf("Trace request bytes sum: got %d want %d", g, w)
+	}
+	if g, w := traces.BucketCounts[0], int64(1); g != w {
+		t.Errorf("Trace requests of at most 1KiB: got %d want %d", g, w)
+	}
+	if g, w := sizes[ocagent.StreamTypeMetrics].Count, int64(1); g != w {
+		t.Errorf("Metrics requests: got %d want %d", g, w)
+	}
+}
+
+func TestExporter_RegisterViewsTwice(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	carts := stats.Int64("carts_register_twice", "carts", stats.UnitDimensionless)
+	v := &view.View{Name: "carts_register_twice", Measure: carts, Aggregation: view.Count()}
+	defer view.Unregister(v)
+
+	// As if the exporter were installed twice, e.g. after a reload.
+	for i := 0; i < 2; i++ {
+		if err := exp.RegisterViews(v, nil); err != nil {
+			t.Fatalf("RegisterViews #%d: %v", i+1, err)
+		}
+	}
+	if err := exp.RegisterViews(&view.View{Name: "carts_register_twice", Measure: carts, Aggregation: view.Count()}); err != nil {
+		t.Errorf("RegisterViews of an identical view: %v", err)
+	}
+
+	conflicting := &view.View{Name: "carts_register_twice", Measure: carts, Aggregation: view.Sum()}
+	if err := exp.RegisterViews(conflicting); err == nil {
+		t.Error("RegisterViews of a conflicting view: got nil error")
+	}
+
+	stats.Record(context.Background(), carts.M(1))
+	<-time.After(50 * time.Millisecond)
+	if err := exp.FlushMetrics(); err != nil {
+		t.Fatalf("FlushMetrics: %v", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	metrics := agent.getMetrics()
+	if g, w := len(metrics), 1; g != w {
+		t.Fatalf("Metrics: got %d want %d", g, w)
+	}
+	if g, w := metrics[0].GetMetricDescriptor().GetName(), "carts_register_twice"; g != w {
+		t.Errorf("Metric name: got %q want %q", g, w)
+	}
+}
+
+func TestExporter_unifiedStreamRecoversTogether(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithUnifiedStream())
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	requests := stats.Int64("unified_requests", "requests", stats.UnitDimensionless)
+	v := &view.View{Name: "unified_requests", Measure: requests, Aggregation: view.Count()}
+	export := func(name string) {
+		exp.ExportSpan(&trace.SpanData{Name: name})
+		exp.ExportView(&view.Data{
+			View:  v,
+			Start: time.Now().Add(-time.Minute),
+			End:   time.Now(),
+			Rows:  []*view.Row{{Data: &view.CountData{Value: 1}}},
+		})
+		exp.Flush()
+	}
+
+	export("before")
+	<-time.After(100 * time.Millisecond)
+	if g, w := len(agent.getSpans()), 1; g != w {
+		t.Errorf("Spans before the disconnect: got %d want %d", g, w)
+	}
+	if g, w := len(agent.getMetrics()), 1; g != w {
+		t.Errorf("Metrics before the disconnect: got %d want %d", g, w)
+	}
+	if peers := agent.getStreamPeers(); len(peers) != 2 || peers[0] != peers[1] {
+		t.Errorf("Traces and metrics did not share a connection: %v", peers)
+	}
+
+	// Take the agent down, bring it back, and keep exporting: the failed
+	// sends make the exporter reconnect both streams to it.
+	agent.stop()
+	restored := runMockAgentAtAddr(t, fmt.Sprintf(":%d", agent.port))
+	defer restored.stop()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(restored.getSpans()) == 0 || len(restored.getMetrics()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Traces and metrics did not recover: %d spans, %d metrics",
+				len(restored.getSpans()), len(restored.getMetrics()))
+		}
+		export("after")
+		<-time.After(50 * time.Millisecond)
+	}
+	if peers := restored.getStreamPeers(); len(peers) != 2 || peers[0] != peers[1] {
+		t.Errorf("Traces and metrics did not recover over one connection: %v", peers)
+	}
+}
+
+func TestExportView_metricsTagFilter(t *testing.T) {
+	agent := runMockAgent(t)
+	defer agent.stop()
+
+	method, _ := tag.NewKey("method")
+	userID, _ := tag.NewKey("user_id")
+	exp, err := ocagent.NewExporter(ocagent.WithInsecure(), ocagent.WithPort(agent.port),
+		ocagent.WithMetricsTagFilter(func(key tag.Key, value string) bool {
+			return key != userID
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create a new agent exporter: %v", err)
+	}
+	defer exp.Stop()
+
+	requests := stats.Int64("requests_by_user", "requests", stats.UnitDimensionless)
+	var rows []*view.Row
+	for i := 0; i < 100; i++ {
+		m := "GET"
+		if i%4 == 0 {
+			m = "POST"
+		}
+		rows = append(rows, &view.Row{
+			Tags: []tag.Tag{{Key: method, Value: m}, {Key: userID, Value: fmt.Sprintf("user-%d", i)}},
+			Data: &view.CountData{Value: 1},
+		})
+	}
+	exp.ExportView(&view.Data{
+		View: &view.View{
+			Name:        "requests_by_user",
+			Measure:     requests,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{method, userID},
+		},
+		Start: time.Now().Add(-time.Minute),
+		End:   time.Now(),
+		Rows:  rows,
+	})
+	<-time.After(100 * time.Millisecond)
+	exp.Stop()
+	agent.stop()
+
+	metrics := agent.getMetrics()
+	if g, w := len(metrics), 1; g != w {
+		t.Fatalf("Metrics: got %d want %d", g, w)
+	}
+	counts := make(map[string]int64)
+	for _, ts := range metrics[0].Timeseries {
+		if g, w := len(ts.LabelValues), 2; g != w {
+			t.Fatalf("Label values: got %d want %d", g, w)
+		}
+		if ts.LabelValues[1].HasValue {
+			t.Errorf("The user_id tag was exported: %q", ts.LabelValues[1].Value)
+		}
+		counts[ts.LabelValues[0].Value] += ts.Points[0].GetInt64Value()
+	}
+	if g, w := len(metrics[0].Timeseries), 2; g != w {
+		t.Errorf("Time series: got %d want %d", g, w)
+	}
+	if g, w := counts, map[string]int64{"GET": 75, "POST": 25}; !reflect.DeepEqual(g, w) {
+		t.Errorf("Counts by method: got %v want %v", g, w)
+	}
+	if g, w := exp.Stats().MetricTagsFiltered, int64(100); g != w {
+		t.Errorf("MetricTagsFiltered: got %d want %d", g, w)
+	}
+}
@@ -0,0 +1,85 @@
+// Package orderqueue carries the orders placed in the online-store to the
+// order workers, over a Redis stream or an Azure Service Bus queue.
+package orderqueue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// receiveWait is how long Receive waits for a message before it returns
+// none.
+const receiveWait = 5 * time.Second
+
+// Message is a message received from the queue.
+type Message struct {
+	ID   string
+	Body []byte
+	// EnqueuedAt is when the message was sent.
+	EnqueuedAt time.Time
+
+	ack func(ctx context.Context) error
+}
+
+// Ack removes the message from the queue once it is processed. A message
+// that isn't acked is delivered again, to another worker if need be.
+func (m *Message) Ack(ctx context.Context) error {
+	return m.ack(ctx)
+}
+
+// Queue is a queue of orders, shared by the online-store replicas sending
+// to it and the workers receiving from it.
+type Queue interface {
+	// Send sends a message.
+	Send(ctx context.Context, body []byte) error
+	// Receive waits a few seconds for a message, and returns nil if none
+	// came.
+	Receive(ctx context.Context) (*Message, error)
+	// Depth returns the messages waiting, or being processed.
+	Depth(ctx context.Context) (int64, error)
+	Close() error
+}
+
+// FromEnv returns the queue that $ORDER_QUEUE names, receiving as consumer,
+// or nil if it is unset:
+//
+//   - redis: the stream $ORDER_QUEUE_STREAM, "orders" by default, read in
+//     the consumer group $ORDER_QUEUE_GROUP, "order-workers" by default, in
+//     the Redis at $ORDER_QUEUE_REDIS_ADDR, or else $REDIS_ADDR, with
+//     $REDIS_PASSWORD.
+//   - servicebus: the queue $ORDER_QUEUE_NAME, "orders" by default, of the
+//     Service Bus namespace in $SERVICEBUS_CONNECTION_STRING.
+func FromEnv(consumer string) (Queue, error) {
+	switch kind := os.Getenv("ORDER_QUEUE"); kind {
+	case "":
+		return nil, nil
+	case "redis":
+		addr := os.Getenv("ORDER_QUEUE_REDIS_ADDR")
+		if addr == "" {
+			addr = os.Getenv("REDIS_ADDR")
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("the redis order queue needs ORDER_QUEUE_REDIS_ADDR or REDIS_ADDR")
+		}
+		return NewRedisQueue(RedisOptions{
+			Addr:     addr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+			Stream:   envOr("ORDER_QUEUE_STREAM", "orders"),
+			Group:    envOr("ORDER_QUEUE_GROUP", "order-workers"),
+			Consumer: consumer,
+		}), nil
+	case "servicebus":
+		return NewServiceBusQueue(os.Getenv("SERVICEBUS_CONNECTION_STRING"), envOr("ORDER_QUEUE_NAME", "orders"))
+	default:
+		return nil, fmt.Errorf("unknown ORDER_QUEUE %q, want redis or servicebus", kind)
+	}
+}
+
+func envOr(name, def string) string {
+	if s := os.Getenv(name); s != "" {
+		return s
+	}
+	return def
+}
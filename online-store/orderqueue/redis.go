@@ -0,0 +1,187 @@
+package orderqueue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisOptions configures a queue on a Redis stream.
+type RedisOptions struct {
+	Addr     string
+	Password string
+	// Stream is the stream of the queue, read in the consumer group Group.
+	Stream string
+	Group  string
+	// Consumer names the receiver in the group, such as the pod name.
+	Consumer string
+	// ClaimAfter is how long a message may go unacked before another
+	// consumer takes it over, as when the worker that had it was scaled
+	// in. Defaults to a minute.
+	ClaimAfter time.Duration
+}
+
+// redisQueue is a queue on a Redis stream. Consumers read it in a consumer
+// group, and delete the messages they ack, so the length of the stream is
+// the work left, as the KEDA queue scaler expects.
+type redisQueue struct {
+	opts RedisOptions
+	pool *redis.Pool
+
+	mu      sync.Mutex
+	grouped bool
+}
+
+// NewRedisQueue returns a queue on the Redis stream opts.Stream.
+func NewRedisQueue(opts RedisOptions) Queue {
+	if opts.ClaimAfter <= 0 {
+		opts.ClaimAfter = time.Minute
+	}
+	return &redisQueue{
+		opts: opts,
+		pool: &redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", opts.Addr,
+					redis.DialPassword(opts.Password),
+					redis.DialConnectTimeout(time.Second),
+					// Receive blocks up to receiveWait.
+					redis.DialReadTimeout(2*receiveWait),
+					redis.DialWriteTimeout(time.Second),
+				)
+			},
+		},
+	}
+}
+
+func (q *redisQueue) do(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+func (q *redisQueue) Send(ctx context.Context, body []byte) error {
+	_, err := q.do(ctx, "XADD", q.opts.Stream, "*",
+		"body", body,
+		"enqueued", strconv.FormatInt(time.Now().UnixNano(), 10))
+	return err
+}
+
+// ensureGroup creates the consumer group from the start of the stream,
+// unless it exists, so nothing sent before the first consumer is skipped.
+func (q *redisQueue) ensureGroup(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.grouped {
+		return nil
+	}
+	_, err := q.do(ctx, "XGROUP", "CREATE", q.opts.Stream, q.opts.Group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	q.grouped = true
+	return nil
+}
+
+func (q *redisQueue) Receive(ctx context.Context) (*Message, error) {
+	if err := q.ensureGroup(ctx); err != nil {
+		return nil, fmt.Errorf("creating the consumer group: %v", err)
+	}
+	// Take over a message left by a consumer that went away first.
+	if m, err := q.claim(ctx); m != nil || err != nil {
+		return m, err
+	}
+
+	reply, err := redis.Values(q.do(ctx, "XREADGROUP", "GROUP", q.opts.Group, q.opts.Consumer,
+		"COUNT", 1, "BLOCK", int64(receiveWait/time.Millisecond), "STREAMS", q.opts.Stream, ">"))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// [[stream, [[id, [field, value, ...]]]]]
+	for _, s := range reply {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			return nil, fmt.Errorf("unexpected reply to XREADGROUP: %v", reply)
+		}
+		return q.message(stream[1])
+	}
+	return nil, nil
+}
+
+// claim takes over the oldest pending message if it has gone unacked for
+// ClaimAfter.
+func (q *redisQueue) claim(ctx context.Context) (*Message, error) {
+	pending, err := redis.Values(q.do(ctx, "XPENDING", q.opts.Stream, q.opts.Group, "-", "+", 1))
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	// [[id, consumer, idle ms, deliveries]]
+	entry, err := redis.Values(pending[0], nil)
+	if err != nil || len(entry) < 3 {
+		return nil, fmt.Errorf("unexpected reply to XPENDING: %v", pending)
+	}
+	id, _ := redis.String(entry[0], nil)
+	idle, _ := redis.Int64(entry[2], nil)
+	minIdle := int64(q.opts.ClaimAfter / time.Millisecond)
+	if idle < minIdle {
+		return nil, nil
+	}
+	claimed, err := q.do(ctx, "XCLAIM", q.opts.Stream, q.opts.Group, q.opts.Consumer, minIdle, id)
+	if err != nil {
+		return nil, err
+	}
+	return q.message(claimed)
+}
+
+// message returns the first of entries, [[id, [field, value, ...]]].
+func (q *redisQueue) message(entries interface{}) (*Message, error) {
+	list, err := redis.Values(entries, nil)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	entry, err := redis.Values(list[0], nil)
+	if err != nil || len(entry) != 2 {
+		return nil, fmt.Errorf("unexpected stream entry: %v", list[0])
+	}
+	id, err := redis.String(entry[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := redis.StringMap(entry[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{ID: id, Body: []byte(fields["body"])}
+	if ns, err := strconv.ParseInt(fields["enqueued"], 10, 64); err == nil {
+		m.EnqueuedAt = time.Unix(0, ns)
+	}
+	m.ack = func(ctx context.Context) error {
+		if _, err := q.do(ctx, "XACK", q.opts.Stream, q.opts.Group, id); err != nil {
+			return err
+		}
+		_, err := q.do(ctx, "XDEL", q.opts.Stream, id)
+		return err
+	}
+	return m, nil
+}
+
+func (q *redisQueue) Depth(ctx context.Context) (int64, error) {
+	return redis.Int64(q.do(ctx, "XLEN", q.opts.Stream))
+}
+
+func (q *redisQueue) Close() error {
+	return q.pool.Close()
+}
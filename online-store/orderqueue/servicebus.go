@@ -0,0 +1,108 @@
+package orderqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+)
+
+// serviceBusQueue is a queue in Azure Service Bus, used with the Service
+// Bus SDK over AMQP. Messages are received with a peek-lock, so one whose
+// worker dies before completing it is delivered again when the lock
+// expires.
+type serviceBusQueue struct {
+	name     string
+	client   *azservicebus.Client
+	admin    *admin.Client
+	sender   *azservicebus.Sender
+	receiver *azservicebus.Receiver
+
+	// receiving serializes the receives, which a receiver takes one at a
+	// time.
+	receiving sync.Mutex
+}
+
+// NewServiceBusQueue returns the queue named queue in the namespace of
+// connectionString, as copied from a shared access policy in the portal:
+// Endpoint=sb://<namespace>/;SharedAccessKeyName=<name>;SharedAccessKey=<key>.
+func NewServiceBusQueue(connectionString, queue string) (Queue, error) {
+	client, err := azservicebus.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the service bus: %v", err)
+	}
+	adminClient, err := admin.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the service bus: %v", err)
+	}
+	// The links are only opened once a message is sent or received.
+	sender, err := client.NewSender(queue, nil)
+	if err != nil {
+		return nil, err
+	}
+	receiver, err := client.NewReceiverForQueue(queue, &azservicebus.ReceiverOptions{
+		ReceiveMode: azservicebus.ReceiveModePeekLock,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serviceBusQueue{
+		name:     queue,
+		client:   client,
+		admin:    adminClient,
+		sender:   sender,
+		receiver: receiver,
+	}, nil
+}
+
+func (q *serviceBusQueue) Send(ctx context.Context, body []byte) error {
+	return q.sender.SendMessage(ctx, &azservicebus.Message{Body: body}, nil)
+}
+
+func (q *serviceBusQueue) Receive(ctx context.Context) (*Message, error) {
+	q.receiving.Lock()
+	defer q.receiving.Unlock()
+
+	wait, cancel := context.WithTimeout(ctx, receiveWait)
+	defer cancel()
+	received, err := q.receiver.ReceiveMessages(wait, 1, nil)
+	if err != nil {
+		// No message came in time.
+		if wait.Err() != nil && ctx.Err() == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(received) == 0 {
+		return nil, nil
+	}
+
+	r := received[0]
+	m := &Message{ID: r.MessageID, Body: r.Body}
+	if r.EnqueuedTime != nil {
+		m.EnqueuedAt = *r.EnqueuedTime
+	}
+	m.ack = func(ctx context.Context) error {
+		return q.receiver.CompleteMessage(ctx, r, nil)
+	}
+	return m, nil
+}
+
+// Depth returns the active messages of the queue. Unlike in Redis, a
+// message locked by a worker no longer counts.
+func (q *serviceBusQueue) Depth(ctx context.Context) (int64, error) {
+	props, err := q.admin.GetQueueRuntimeProperties(ctx, q.name, nil)
+	if err != nil {
+		return 0, err
+	}
+	if props == nil {
+		return 0, fmt.Errorf("service bus: no queue %s", q.name)
+	}
+	return int64(props.ActiveMessageCount), nil
+}
+
+func (q *serviceBusQueue) Close() error {
+	return q.client.Close(context.Background())
+}
@@ -0,0 +1,799 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: store.proto
+
+package storepb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type Product struct {
+	Sku                  string   `protobuf:"bytes,1,opt,name=sku,proto3" json:"sku,omitempty"`
+	Name                 string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	PriceCents           int64    `protobuf:"varint,3,opt,name=price_cents,json=priceCents,proto3" json:"price_cents,omitempty"`
+	ImageUrl             string   `protobuf:"bytes,4,opt,name=image_url,json=imageUrl,proto3" json:"image_url,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Product) Reset()         { *m = Product{} }
+func (m *Product) String() string { return proto.CompactTextString(m) }
+func (*Product) ProtoMessage()    {}
+func (*Product) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{0}
+}
+func (m *Product) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Product.Unmarshal(m, b)
+}
+func (m *Product) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Product.Marshal(b, m, deterministic)
+}
+func (dst *Product) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Product.Merge(dst, src)
+}
+func (m *Product) XXX_Size() int {
+	return xxx_messageInfo_Product.Size(m)
+}
+func (m *Product) XXX_DiscardUnknown() {
+	xxx_messageInfo_Product.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Product proto.InternalMessageInfo
+
+func (m *Product) GetSku() string {
+	if m != nil {
+		return m.Sku
+	}
+	return ""
+}
+
+func (m *Product) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Product) GetPriceCents() int64 {
+	if m != nil {
+		return m.PriceCents
+	}
+	return 0
+}
+
+func (m *Product) GetImageUrl() string {
+	if m != nil {
+		return m.ImageUrl
+	}
+	return ""
+}
+
+type ListProductsRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListProductsRequest) Reset()         { *m = ListProductsRequest{} }
+func (m *ListProductsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListProductsRequest) ProtoMessage()    {}
+func (*ListProductsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{1}
+}
+func (m *ListProductsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListProductsRequest.Unmarshal(m, b)
+}
+func (m *ListProductsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListProductsRequest.Marshal(b, m, deterministic)
+}
+func (dst *ListProductsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListProductsRequest.Merge(dst, src)
+}
+func (m *ListProductsRequest) XXX_Size() int {
+	return xxx_messageInfo_ListProductsRequest.Size(m)
+}
+func (m *ListProductsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListProductsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListProductsRequest proto.InternalMessageInfo
+
+type ListProductsResponse struct {
+	Products             []*Product `protobuf:"bytes,1,rep,name=products,proto3" json:"products,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *ListProductsResponse) Reset()         { *m = ListProductsResponse{} }
+func (m *ListProductsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListProductsResponse) ProtoMessage()    {}
+func (*ListProductsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{2}
+}
+func (m *ListProductsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListProductsResponse.Unmarshal(m, b)
+}
+func (m *ListProductsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListProductsResponse.Marshal(b, m, deterministic)
+}
+func (dst *ListProductsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListProductsResponse.Merge(dst, src)
+}
+func (m *ListProductsResponse) XXX_Size() int {
+	return xxx_messageInfo_ListProductsResponse.Size(m)
+}
+func (m *ListProductsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListProductsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListProductsResponse proto.InternalMessageInfo
+
+func (m *ListProductsResponse) GetProducts() []*Product {
+	if m != nil {
+		return m.Products
+	}
+	return nil
+}
+
+type Item struct {
+	Sku                  string   `protobuf:"bytes,1,opt,name=sku,proto3" json:"sku,omitempty"`
+	Quantity             int32    `protobuf:"varint,2,opt,name=quantity,proto3" json:"quantity,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Item) Reset()         { *m = Item{} }
+func (m *Item) String() string { return proto.CompactTextString(m) }
+func (*Item) ProtoMessage()    {}
+func (*Item) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{3}
+}
+func (m *Item) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Item.Unmarshal(m, b)
+}
+func (m *Item) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Item.Marshal(b, m, deterministic)
+}
+func (dst *Item) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Item.Merge(dst, src)
+}
+func (m *Item) XXX_Size() int {
+	return xxx_messageInfo_Item.Size(m)
+}
+func (m *Item) XXX_DiscardUnknown() {
+	xxx_messageInfo_Item.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Item proto.InternalMessageInfo
+
+func (m *Item) GetSku() string {
+	if m != nil {
+		return m.Sku
+	}
+	return ""
+}
+
+func (m *Item) GetQuantity() int32 {
+	if m != nil {
+		return m.Quantity
+	}
+	return 0
+}
+
+type GetCartRequest struct {
+	Session              string   `protobuf:"bytes,1,opt,name=session,proto3" json:"session,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetCartRequest) Reset()         { *m = GetCartRequest{} }
+func (m *GetCartRequest) String() string { return proto.CompactTextString(m) }
+func (*GetCartRequest) ProtoMessage()    {}
+func (*GetCartRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{4}
+}
+func (m *GetCartRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetCartRequest.Unmarshal(m, b)
+}
+func (m *GetCartRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetCartRequest.Marshal(b, m, deterministic)
+}
+func (dst *GetCartRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetCartRequest.Merge(dst, src)
+}
+func (m *GetCartRequest) XXX_Size() int {
+	return xxx_messageInfo_GetCartRequest.Size(m)
+}
+func (m *GetCartRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetCartRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetCartRequest proto.InternalMessageInfo
+
+func (m *GetCartRequest) GetSession() string {
+	if m != nil {
+		return m.Session
+	}
+	return ""
+}
+
+type UpdateCartRequest struct {
+	Session              string   `protobuf:"bytes,1,opt,name=session,proto3" json:"session,omitempty"`
+	Items                []*Item  `protobuf:"bytes,2,rep,name=items,proto3" json:"items,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *UpdateCartRequest) Reset()         { *m = UpdateCartRequest{} }
+func (m *UpdateCartRequest) String() string { return proto.CompactTextString(m) }
+func (*UpdateCartRequest) ProtoMessage()    {}
+func (*UpdateCartRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{5}
+}
+func (m *UpdateCartRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UpdateCartRequest.Unmarshal(m, b)
+}
+func (m *UpdateCartRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UpdateCartRequest.Marshal(b, m, deterministic)
+}
+func (dst *UpdateCartRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UpdateCartRequest.Merge(dst, src)
+}
+func (m *UpdateCartRequest) XXX_Size() int {
+	return xxx_messageInfo_UpdateCartRequest.Size(m)
+}
+func (m *UpdateCartRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_UpdateCartRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UpdateCartRequest proto.InternalMessageInfo
+
+func (m *UpdateCartRequest) GetSession() string {
+	if m != nil {
+		return m.Session
+	}
+	return ""
+}
+
+func (m *UpdateCartRequest) GetItems() []*Item {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+type ClearCartRequest struct {
+	Session              string   `protobuf:"bytes,1,opt,name=session,proto3" json:"session,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ClearCartRequest) Reset()         { *m = ClearCartRequest{} }
+func (m *ClearCartRequest) String() string { return proto.CompactTextString(m) }
+func (*ClearCartRequest) ProtoMessage()    {}
+func (*ClearCartRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{6}
+}
+func (m *ClearCartRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ClearCartRequest.Unmarshal(m, b)
+}
+func (m *ClearCartRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ClearCartRequest.Marshal(b, m, deterministic)
+}
+func (dst *ClearCartRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ClearCartRequest.Merge(dst, src)
+}
+func (m *ClearCartRequest) XXX_Size() int {
+	return xxx_messageInfo_ClearCartRequest.Size(m)
+}
+func (m *ClearCartRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ClearCartRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ClearCartRequest proto.InternalMessageInfo
+
+func (m *ClearCartRequest) GetSession() string {
+	if m != nil {
+		return m.Session
+	}
+	return ""
+}
+
+type Cart struct {
+	Session              string   `protobuf:"bytes,1,opt,name=session,proto3" json:"session,omitempty"`
+	Items                []*Item  `protobuf:"bytes,2,rep,name=items,proto3" json:"items,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Cart) Reset()         { *m = Cart{} }
+func (m *Cart) String() string { return proto.CompactTextString(m) }
+func (*Cart) ProtoMessage()    {}
+func (*Cart) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{7}
+}
+func (m *Cart) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Cart.Unmarshal(m, b)
+}
+func (m *Cart) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Cart.Marshal(b, m, deterministic)
+}
+func (dst *Cart) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Cart.Merge(dst, src)
+}
+func (m *Cart) XXX_Size() int {
+	return xxx_messageInfo_Cart.Size(m)
+}
+func (m *Cart) XXX_DiscardUnknown() {
+	xxx_messageInfo_Cart.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Cart proto.InternalMessageInfo
+
+func (m *Cart) GetSession() string {
+	if m != nil {
+		return m.Session
+	}
+	return ""
+}
+
+func (m *Cart) GetItems() []*Item {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+type PlaceOrderRequest struct {
+	Items                []*Item  `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	Session              string   `protobuf:"bytes,2,opt,name=session,proto3" json:"session,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PlaceOrderRequest) Reset()         { *m = PlaceOrderRequest{} }
+func (m *PlaceOrderRequest) String() string { return proto.CompactTextString(m) }
+func (*PlaceOrderRequest) ProtoMessage()    {}
+func (*PlaceOrderRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{8}
+}
+func (m *PlaceOrderRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PlaceOrderRequest.Unmarshal(m, b)
+}
+func (m *PlaceOrderRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PlaceOrderRequest.Marshal(b, m, deterministic)
+}
+func (dst *PlaceOrderRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PlaceOrderRequest.Merge(dst, src)
+}
+func (m *PlaceOrderRequest) XXX_Size() int {
+	return xxx_messageInfo_PlaceOrderRequest.Size(m)
+}
+func (m *PlaceOrderRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_PlaceOrderRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PlaceOrderRequest proto.InternalMessageInfo
+
+func (m *PlaceOrderRequest) GetItems() []*Item {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+func (m *PlaceOrderRequest) GetSession() string {
+	if m != nil {
+		return m.Session
+	}
+	return ""
+}
+
+// ServedBy is the pod that served a request, and where it ran.
+type ServedBy struct {
+	Pod                  string   `protobuf:"bytes,1,opt,name=pod,proto3" json:"pod,omitempty"`
+	Node                 string   `protobuf:"bytes,2,opt,name=node,proto3" json:"node,omitempty"`
+	VirtualNode          bool     `protobuf:"varint,3,opt,name=virtual_node,json=virtualNode,proto3" json:"virtual_node,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ServedBy) Reset()         { *m = ServedBy{} }
+func (m *ServedBy) String() string { return proto.CompactTextString(m) }
+func (*ServedBy) ProtoMessage()    {}
+func (*ServedBy) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{9}
+}
+func (m *ServedBy) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ServedBy.Unmarshal(m, b)
+}
+func (m *ServedBy) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ServedBy.Marshal(b, m, deterministic)
+}
+func (dst *ServedBy) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ServedBy.Merge(dst, src)
+}
+func (m *ServedBy) XXX_Size() int {
+	return xxx_messageInfo_ServedBy.Size(m)
+}
+func (m *ServedBy) XXX_DiscardUnknown() {
+	xxx_messageInfo_ServedBy.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ServedBy proto.InternalMessageInfo
+
+func (m *ServedBy) GetPod() string {
+	if m != nil {
+		return m.Pod
+	}
+	return ""
+}
+
+func (m *ServedBy) GetNode() string {
+	if m != nil {
+		return m.Node
+	}
+	return ""
+}
+
+func (m *ServedBy) GetVirtualNode() bool {
+	if m != nil {
+		return m.VirtualNode
+	}
+	return false
+}
+
+type Order struct {
+	Id                   string    `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Items                []*Item   `protobuf:"bytes,2,rep,name=items,proto3" json:"items,omitempty"`
+	PlacedAtUnix         int64     `protobuf:"varint,3,opt,name=placed_at_unix,json=placedAtUnix,proto3" json:"placed_at_unix,omitempty"`
+	ServedBy             *ServedBy `protobuf:"bytes,4,opt,name=served_by,json=servedBy,proto3" json:"served_by,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *Order) Reset()         { *m = Order{} }
+func (m *Order) String() string { return proto.CompactTextString(m) }
+func (*Order) ProtoMessage()    {}
+func (*Order) Descriptor() ([]byte, []int) {
+	return fileDescriptor_store_bf61f40602a5d6da, []int{10}
+}
+func (m *Order) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Order.Unmarshal(m, b)
+}
+func (m *Order) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Order.Marshal(b, m, deterministic)
+}
+func (dst *Order) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Order.Merge(dst, src)
+}
+func (m *Order) XXX_Size() int {
+	return xxx_messageInfo_Order.Size(m)
+}
+func (m *Order) XXX_DiscardUnknown() {
+	xxx_messageInfo_Order.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Order proto.InternalMessageInfo
+
+func (m *Order) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Order) GetItems() []*Item {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+func (m *Order) GetPlacedAtUnix() int64 {
+	if m != nil {
+		return m.PlacedAtUnix
+	}
+	return 0
+}
+
+func (m *Order) GetServedBy() *ServedBy {
+	if m != nil {
+		return m.ServedBy
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Product)(nil), "store.Product")
+	proto.RegisterType((*ListProductsRequest)(nil), "store.ListProductsRequest")
+	proto.RegisterType((*ListProductsResponse)(nil), "store.ListProductsResponse")
+	proto.RegisterType((*Item)(nil), "store.Item")
+	proto.RegisterType((*GetCartRequest)(nil), "store.GetCartRequest")
+	proto.RegisterType((*UpdateCartRequest)(nil), "store.UpdateCartRequest")
+	proto.RegisterType((*ClearCartRequest)(nil), "store.ClearCartRequest")
+	proto.RegisterType((*Cart)(nil), "store.Cart")
+	proto.RegisterType((*PlaceOrderRequest)(nil), "store.PlaceOrderRequest")
+	proto.RegisterType((*ServedBy)(nil), "store.ServedBy")
+	proto.RegisterType((*Order)(nil), "store.Order")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// StoreClient is the client API for Store service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type StoreClient interface {
+	// ListProducts returns the catalog.
+	ListProducts(ctx context.Context, in *ListProductsRequest, opts ...grpc.CallOption) (*ListProductsResponse, error)
+	// GetCart returns the cart of a session.
+	GetCart(ctx context.Context, in *GetCartRequest, opts ...grpc.CallOption) (*Cart, error)
+	// UpdateCart replaces the items of the cart of a session.
+	UpdateCart(ctx context.Context, in *UpdateCartRequest, opts ...grpc.CallOption) (*Cart, error)
+	// ClearCart empties the cart of a session.
+	ClearCart(ctx context.Context, in *ClearCartRequest, opts ...grpc.CallOption) (*Cart, error)
+	// PlaceOrder places an order for the items given or, if there are none,
+	// for those in the cart of the session, which is then emptied.
+	PlaceOrder(ctx context.Context, in *PlaceOrderRequest, opts ...grpc.CallOption) (*Order, error)
+}
+
+type storeClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewStoreClient(cc *grpc.ClientConn) StoreClient {
+	return &storeClient{cc}
+}
+
+func (c *storeClient) ListProducts(ctx context.Context, in *ListProductsRequest, opts ...grpc.CallOption) (*ListProductsResponse, error) {
+	out := new(ListProductsResponse)
+	err := c.cc.Invoke(ctx, "/store.Store/ListProducts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storeClient) GetCart(ctx context.Context, in *GetCartRequest, opts ...grpc.CallOption) (*Cart, error) {
+	out := new(Cart)
+	err := c.cc.Invoke(ctx, "/store.Store/GetCart", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storeClient) UpdateCart(ctx context.Context, in *UpdateCartRequest, opts ...grpc.CallOption) (*Cart, error) {
+	out := new(Cart)
+	err := c.cc.Invoke(ctx, "/store.Store/UpdateCart", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storeClient) ClearCart(ctx context.Context, in *ClearCartRequest, opts ...grpc.CallOption) (*Cart, error) {
+	out := new(Cart)
+	err := c.cc.Invoke(ctx, "/store.Store/ClearCart", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storeClient) PlaceOrder(ctx context.Context, in *PlaceOrderRequest, opts ...grpc.CallOption) (*Order, error) {
+	out := new(Order)
+	err := c.cc.Invoke(ctx, "/store.Store/PlaceOrder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StoreServer is the server API for Store service.
+type StoreServer interface {
+	// ListProducts returns the catalog.
+	ListProducts(context.Context, *ListProductsRequest) (*ListProductsResponse, error)
+	// GetCart returns the cart of a session.
+	GetCart(context.Context, *GetCartRequest) (*Cart, error)
+	// UpdateCart replaces the items of the cart of a session.
+	UpdateCart(context.Context, *UpdateCartRequest) (*Cart, error)
+	// ClearCart empties the cart of a session.
+	ClearCart(context.Context, *ClearCartRequest) (*Cart, error)
+	// PlaceOrder places an order for the items given or, if there are none,
+	// for those in the cart of the session, which is then emptied.
+	PlaceOrder(context.Context, *PlaceOrderRequest) (*Order, error)
+}
+
+func RegisterStoreServer(s *grpc.Server, srv StoreServer) {
+	s.RegisterService(&_Store_serviceDesc, srv)
+}
+
+func _Store_ListProducts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListProductsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).ListProducts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/store.Store/ListProducts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).ListProducts(ctx, req.(*ListProductsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Store_GetCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).GetCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/store.Store/GetCart",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).GetCart(ctx, req.(*GetCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Store_UpdateCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).UpdateCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/store.Store/UpdateCart",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).UpdateCart(ctx, req.(*UpdateCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Store_ClearCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).ClearCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/store.Store/ClearCart",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).ClearCart(ctx, req.(*ClearCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Store_PlaceOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlaceOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).PlaceOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/store.Store/PlaceOrder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).PlaceOrder(ctx, req.(*PlaceOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Store_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "store.Store",
+	HandlerType: (*StoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListProducts",
+			Handler:    _Store_ListProducts_Handler,
+		},
+		{
+			MethodName: "GetCart",
+			Handler:    _Store_GetCart_Handler,
+		},
+		{
+			MethodName: "UpdateCart",
+			Handler:    _Store_UpdateCart_Handler,
+		},
+		{
+			MethodName: "ClearCart",
+			Handler:    _Store_ClearCart_Handler,
+		},
+		{
+			MethodName: "PlaceOrder",
+			Handler:    _Store_PlaceOrder_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "store.proto",
+}
+
+func init() { proto.RegisterFile("store.proto", fileDescriptor_store_bf61f40602a5d6da) }
+
+var fileDescriptor_store_bf61f40602a5d6da = []byte{
+	// 499 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x94, 0xd1, 0x6a, 0xdb, 0x30,
+	0x14, 0x86, 0xb1, 0x13, 0x2f, 0xf6, 0x71, 0xc8, 0x5a, 0x6d, 0x65, 0xc6, 0xbd, 0x58, 0x6a, 0x76,
+	0x11, 0x4a, 0x57, 0x58, 0xda, 0x17, 0x58, 0x72, 0x51, 0x06, 0x63, 0x0b, 0x0e, 0xb9, 0xd9, 0x8d,
+	0x71, 0xa2, 0xc3, 0x10, 0xb3, 0x2d, 0x57, 0x92, 0x4b, 0xf3, 0x12, 0x7b, 0x83, 0xbd, 0xeb, 0xb0,
+	0x22, 0x3b, 0xf5, 0x9a, 0x41, 0xa0, 0x77, 0xd2, 0xff, 0x9f, 0xa3, 0x73, 0x7e, 0xf3, 0x61, 0xf0,
+	0xa5, 0xe2, 0x02, 0xaf, 0x4b, 0xc1, 0x15, 0x27, 0x8e, 0xbe, 0x44, 0x39, 0x0c, 0x16, 0x82, 0xd3,
+	0x6a, 0xa3, 0xc8, 0x09, 0xf4, 0xe4, 0xaf, 0x2a, 0xb0, 0xc6, 0xd6, 0xc4, 0x8b, 0xeb, 0x23, 0x21,
+	0xd0, 0x2f, 0xd2, 0x1c, 0x03, 0x5b, 0x4b, 0xfa, 0x4c, 0xde, 0x83, 0x5f, 0x0a, 0xb6, 0xc1, 0x64,
+	0x83, 0x85, 0x92, 0x41, 0x6f, 0x6c, 0x4d, 0x7a, 0x31, 0x68, 0x69, 0x5e, 0x2b, 0xe4, 0x1c, 0x3c,
+	0x96, 0xa7, 0x3f, 0x31, 0xa9, 0x44, 0x16, 0xf4, 0x75, 0xa7, 0xab, 0x85, 0x95, 0xc8, 0xa2, 0x33,
+	0x78, 0xf3, 0x95, 0x49, 0x65, 0x46, 0xca, 0x18, 0xef, 0x2b, 0x94, 0x2a, 0x9a, 0xc1, 0xdb, 0xae,
+	0x2c, 0x4b, 0x5e, 0x48, 0x24, 0x97, 0xe0, 0x96, 0x46, 0x0b, 0xac, 0x71, 0x6f, 0xe2, 0x4f, 0x47,
+	0xd7, 0xbb, 0x10, 0xa6, 0x34, 0x6e, 0xfd, 0xe8, 0x16, 0xfa, 0x5f, 0x14, 0xe6, 0x07, 0x62, 0x84,
+	0xe0, 0xde, 0x57, 0x69, 0xa1, 0x98, 0xda, 0xea, 0x28, 0x4e, 0xdc, 0xde, 0xa3, 0x4b, 0x18, 0xdd,
+	0xa1, 0x9a, 0xa7, 0x42, 0x99, 0x5d, 0x48, 0x00, 0x03, 0x89, 0x52, 0x32, 0x5e, 0x98, 0x37, 0x9a,
+	0x6b, 0xb4, 0x80, 0xd3, 0x55, 0x49, 0x53, 0x85, 0x47, 0x95, 0x93, 0x0b, 0x70, 0x98, 0xc2, 0x5c,
+	0x06, 0xb6, 0xde, 0xdc, 0x37, 0x9b, 0xd7, 0x4b, 0xc6, 0x3b, 0x27, 0xba, 0x82, 0x93, 0x79, 0x86,
+	0xa9, 0x38, 0x6e, 0xfe, 0x1c, 0xfa, 0x75, 0xe1, 0xcb, 0x46, 0x2e, 0xe0, 0x74, 0x91, 0xa5, 0x1b,
+	0xfc, 0x2e, 0x28, 0x8a, 0x66, 0x66, 0xdb, 0x67, 0xfd, 0xaf, 0xef, 0xe9, 0x50, 0xbb, 0xbb, 0xd6,
+	0x12, 0xdc, 0x25, 0x8a, 0x07, 0xa4, 0xb3, 0x6d, 0xfd, 0xf1, 0x4b, 0x4e, 0x9b, 0x8f, 0x5f, 0x72,
+	0xaa, 0x19, 0xe2, 0x74, 0xcf, 0x10, 0xa7, 0x48, 0x2e, 0x60, 0xf8, 0xc0, 0x84, 0xaa, 0xd2, 0x2c,
+	0xd1, 0x5e, 0x0d, 0x91, 0x1b, 0xfb, 0x46, 0xfb, 0xc6, 0x29, 0x46, 0xbf, 0x2d, 0x70, 0xf4, 0x8a,
+	0x64, 0x04, 0x36, 0x6b, 0x5e, 0xb4, 0x19, 0x3d, 0x22, 0x23, 0xf9, 0x00, 0xa3, 0xb2, 0xce, 0x48,
+	0x93, 0x54, 0x25, 0x55, 0xc1, 0x1e, 0x0d, 0xa6, 0xc3, 0x9d, 0xfa, 0x59, 0xad, 0x0a, 0xf6, 0x48,
+	0xae, 0xc0, 0x93, 0x7a, 0xef, 0x64, 0xbd, 0xd5, 0xa0, 0xfa, 0xd3, 0xd7, 0xe6, 0xb1, 0x26, 0x4f,
+	0xec, 0x4a, 0x73, 0x9a, 0xfe, 0xb1, 0xc1, 0x59, 0xd6, 0x26, 0xb9, 0x83, 0xe1, 0x53, 0x58, 0x49,
+	0x68, 0x9a, 0x0e, 0x80, 0x1d, 0x9e, 0x1f, 0xf4, 0x0c, 0xdd, 0x1f, 0x61, 0x60, 0xd8, 0x23, 0x67,
+	0xa6, 0xae, 0xcb, 0x62, 0xd8, 0x84, 0xd3, 0x35, 0x37, 0x00, 0x7b, 0xfc, 0x48, 0x60, 0xac, 0x67,
+	0x44, 0x76, 0x9b, 0x3e, 0x81, 0xd7, 0x12, 0x46, 0xde, 0x35, 0xce, 0x3f, 0xcc, 0x75, 0x5b, 0x6e,
+	0x01, 0xf6, 0x84, 0xb4, 0x73, 0x9e, 0x41, 0x13, 0x0e, 0x8d, 0xa3, 0xc5, 0x99, 0xf7, 0x63, 0xa0,
+	0xaf, 0xe5, 0x7a, 0xfd, 0x4a, 0xff, 0x61, 0x6e, 0xfe, 0x0e, 0x00, 0xd4, 0x94, 0x91, 0x2a, 0x70,
+	0x04, 0x00, 0x00,
+}
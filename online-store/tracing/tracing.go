@@ -0,0 +1,61 @@
+// Package tracing traces the requests of the online-store with
+// OpenTelemetry, and propagates their trace context between pods, in both
+// the W3C traceparent and the B3 headers, over HTTP and gRPC.
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc/stats"
+)
+
+// Propagator reads the span context from the traceparent header, or from
+// the B3 headers if there is none, and writes both, so that the traces
+// stitch together whichever of them the other side speaks.
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	// The span context of the last propagator to find one wins.
+	b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)),
+	propagation.TraceContext{},
+)
+
+// Handler traces the requests served by h. They come from the ingress or
+// from other pods of the app, so their span context is trusted as the
+// parent, rather than only linked, for the traces to stitch together
+// across the nodes.
+func Handler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "",
+		otelhttp.WithPropagators(Propagator),
+		otelhttp.WithSpanNameFormatter(spanName),
+	)
+}
+
+// Transport returns a round tripper tracing the requests made with base,
+// and propagating their span context.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithPropagators(Propagator),
+		otelhttp.WithSpanNameFormatter(spanName),
+	)
+}
+
+// ServerHandler traces the gRPC requests served, as children of the span
+// context in their metadata, in the same headers as over HTTP.
+func ServerHandler() stats.Handler {
+	return otelgrpc.NewServerHandler(otelgrpc.WithPropagators(Propagator))
+}
+
+// ClientHandler traces the gRPC calls made, and sends their span context in
+// the metadata.
+func ClientHandler() stats.Handler {
+	return otelgrpc.NewClientHandler(otelgrpc.WithPropagators(Propagator))
+}
+
+// spanName names the spans of the HTTP requests after their path, as the
+// OpenCensus HTTP plugin did.
+func spanName(_ string, r *http.Request) string {
+	return r.URL.Path
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path/filepath"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/annotator"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/logging"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	var opts annotator.AnnotatorOpts
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.Namespace, "namespace", "", "namespace of the pods to annotate; all namespaces if empty")
+	flag.StringVar(&opts.PodLabel, "pod-label-selector", "app=online-store", "label selector of the pods to annotate")
+	flag.StringVar(&opts.NodeLabel, "node-label", "type", "node label key identifying virtual nodes")
+	flag.StringVar(&opts.NodeLabelValue, "node-label-value", "virtual-kubelet", "node label value identifying virtual nodes")
+	flag.IntVar(&opts.VMCost, "vm-cost", 100, "deletion cost of the pods on regular nodes")
+	flag.IntVar(&opts.VirtualCost, "virtual-cost", -100, "deletion cost of the pods on the virtual node")
+	flag.DurationVar(&opts.Interval, "interval", 0, "time between two passes over the pods (default 5s)")
+	logLevel := flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+	flag.Parse()
+
+	opts.Logger, err = logging.New(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a, err := annotator.New(opts)
+	if err != nil {
+		opts.Logger.Fatal().Err(err).Msg("Failed to create the annotator")
+	}
+	opts.Logger.Fatal().Err(a.Run()).Msg("Annotator stopped")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/controller"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/cost"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/debug"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/logging"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	opts := controller.ControllerOpts{Pricing: cost.DefaultPricing()}
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.Namespace, "namespace", "", "namespace of the policies to reconcile; all namespaces if empty")
+	flag.StringVar(&opts.NodeLabel, "node-label", "type", "node label key identifying virtual nodes")
+	flag.StringVar(&opts.NodeLabelValue, "node-label-value", "virtual-kubelet", "node label value identifying virtual nodes")
+	flag.DurationVar(&opts.Interval, "interval", 0, "most time between two reconciles of a policy (default 15s)")
+	flag.StringVar(&opts.ListenAddress, "listen-address", ":8080", "address to serve the cost estimate on; not served if empty")
+	flag.Float64Var(&opts.Pricing.NodeHourly, "node-hourly-price", opts.Pricing.NodeHourly, "price of a regular node per hour")
+	flag.Float64Var(&opts.Pricing.NodeCPU, "node-cpu", opts.Pricing.NodeCPU, "allocatable cores of a regular node")
+	flag.Float64Var(&opts.Pricing.NodeMemoryGB, "node-memory-gb", opts.Pricing.NodeMemoryGB, "allocatable memory of a regular node, in GB")
+	flag.Float64Var(&opts.Pricing.VCPUSecond, "vcpu-second-price", opts.Pricing.VCPUSecond, "price of a vCPU per second on the virtual node")
+	flag.Float64Var(&opts.Pricing.GBSecond, "gb-second-price", opts.Pricing.GBSecond, "price of a GB of memory per second on the virtual node")
+	flag.BoolVar(&opts.LeaderElect, "leader-elect", false, "elect a leader among the replicas, so only one reconciles")
+	flag.StringVar(&opts.Election.Namespace, "leader-elect-namespace", "kube-system", "namespace of the lock Lease")
+	flag.StringVar(&opts.Election.Name, "leader-elect-name", "autoscale-controller", "name of the lock Lease")
+	flag.DurationVar(&opts.Election.LeaseDuration, "leader-elect-lease-duration", 0, "how long the others wait before taking the lock of a leader that stopped renewing it (default 15s)")
+	flag.DurationVar(&opts.Election.RenewDeadline, "leader-elect-renew-deadline", 0, "how long the leader tries to renew the lock before it stops leading (default 10s)")
+	flag.DurationVar(&opts.Election.RetryPeriod, "leader-elect-retry-period", 0, "time between two attempts to take or renew the lock (default 2s)")
+	flag.BoolVar(&opts.Predict, "predict", false, "raise the autoscaler minimum ahead of the traffic seen at the same time in the periods before")
+	flag.DurationVar(&opts.Prediction.Period, "predict-period", 0, "how often the traffic recurs (default 24h)")
+	flag.IntVar(&opts.Prediction.Periods, "predict-periods", 0, "how many periods to keep and predict from (default 7)")
+	flag.DurationVar(&opts.Prediction.Resolution, "predict-resolution", 0, "length of the buckets the request rates are kept in (default 1m)")
+	flag.DurationVar(&opts.Prediction.Lookahead, "predict-lookahead", 10*time.Minute, "how far ahead the prediction looks, and so how early the Deployments scale")
+	flag.StringVar(&opts.Prediction.StorePath, "predict-store", "", "file the request rates are saved to, so they survive restarts; kept in memory only if empty")
+	flag.BoolVar(&opts.ACIQuota, "aci-quota", false, "hold the autoscaler maximum to the replicas the container instance quota of the region has room for, once the regular nodes are full")
+	flag.StringVar(&opts.Quota.SubscriptionID, "aci-subscription-id", os.Getenv("AZURE_SUBSCRIPTION_ID"), "subscription the virtual node creates its container groups in")
+	flag.StringVar(&opts.Quota.Location, "aci-location", "", "region the virtual node creates its container groups in, as westeurope")
+	flag.StringVar(&opts.Quota.TenantID, "aci-tenant-id", os.Getenv("AZURE_TENANT_ID"), "tenant of the service principal reading the quota")
+	flag.StringVar(&opts.Quota.ClientID, "aci-client-id", os.Getenv("AZURE_CLIENT_ID"), "client ID of the service principal, with $AZURE_CLIENT_SECRET, or of the managed identity reading the quota")
+	flag.DurationVar(&opts.Quota.CacheFor, "aci-quota-interval", 0, "how long a quota read is used before it is read again (default 1m)")
+	flag.BoolVar(&opts.Notify, "notify", false, "post to Slack, Teams or a webhook when a policy starts or stops bursting to the virtual node")
+	flag.DurationVar(&opts.Notification.Timeout, "notify-timeout", 0, "most time a notification may take to post (default 10s)")
+	flag.BoolVar(&opts.Annotate, "grafana-annotations", false, "write the scale decisions and the starts and ends of the bursts as annotations to Grafana")
+	flag.StringVar(&opts.Annotations.URL, "grafana-url", os.Getenv("GRAFANA_URL"), "root URL of the Grafana to annotate, with the API key in $GRAFANA_API_KEY")
+	flag.DurationVar(&opts.Annotations.Timeout, "grafana-timeout", 0, "most time writing an annotation may take (default 5s)")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "log the scaling decisions and serve them on /decisions without changing the cluster")
+	debugAddress := flag.String("debug-address", "", "address to serve the pprof profiles on, which also exports the runtime's CPUs against the cgroup's quota on /metrics; not served if empty")
+	logLevel := flag.String("log-level", "info", "least severe level logged: debug, info, warn or error; changed at runtime with a PUT to /loglevel")
+	flag.Parse()
+	opts.Quota.ClientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	// The URLs of the webhooks are their secrets, so they aren't flags.
+	opts.Notification.SlackURL = os.Getenv("NOTIFY_SLACK_URL")
+	opts.Notification.TeamsURL = os.Getenv("NOTIFY_TEAMS_URL")
+	opts.Notification.WebhookURL = os.Getenv("NOTIFY_WEBHOOK_URL")
+	opts.Annotations.APIKey = os.Getenv("GRAFANA_API_KEY")
+
+	opts.Logger, err = logging.New(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *debugAddress != "" {
+		go func() {
+			opts.Logger.Info().Str("addr", *debugAddress).Msg("serving the profiles")
+			err := debug.Serve(*debugAddress)
+			opts.Logger.Fatal().Err(err).Msg("Failed to serve the profiles")
+		}()
+	}
+
+	// The pod name tells the replicas apart.
+	opts.Election.Identity = os.Getenv("POD_NAME")
+	if opts.Election.Identity == "" {
+		opts.Election.Identity, _ = os.Hostname()
+	}
+
+	c, err := controller.New(opts)
+	if err != nil {
+		opts.Logger.Fatal().Err(err).Msg("Failed to create the controller")
+	}
+	opts.Logger.Fatal().Err(c.Run()).Msg("Controller stopped")
+}
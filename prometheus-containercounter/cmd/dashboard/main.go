@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/dashboard"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	var opts dashboard.DashboardOpts
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.Namespace, "namespace", "", "namespace of the pods and autoscalers to show; all namespaces if empty")
+	flag.StringVar(&opts.PodLabel, "pod-label-selector", "app=online-store", "label selector of the pods to count")
+	flag.StringVar(&opts.NodeLabel, "node-label", "type", "node label key identifying virtual nodes")
+	flag.StringVar(&opts.NodeLabelValue, "node-label-value", "virtual-kubelet", "node label value identifying virtual nodes")
+	flag.DurationVar(&opts.Interval, "interval", 2*time.Second, "time between two looks at the cluster")
+	flag.StringVar(&opts.ListenAddress, "listen-address", ":8080", "address to serve the feed on")
+	flag.StringVar(&opts.AllowOrigin, "allow-origin", "*", "Access-Control-Allow-Origin sent to the demo UI; none if empty")
+	flag.Parse()
+
+	d, err := dashboard.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(d.Run())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/e2e"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/loadgen"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	var (
+		opts        e2e.HarnessOpts
+		profileOpts loadgen.ProfileOpts
+		profile     string
+	)
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.Namespace, "namespace", "default", "namespace of the online-store")
+	flag.StringVar(&opts.Chart, "chart", "./charts/online-store", "chart of the online-store, installed or upgraded with helm")
+	flag.StringVar(&opts.Release, "release", "online-store", "helm release of the online-store")
+	flag.StringVar(&opts.Set, "set", "", "values of the release, as helm's --set, such as counter.specialNodeName=virtual-kubelet,appInsight.enabled=false")
+	flag.BoolVar(&opts.SkipDeploy, "skip-deploy", false, "test the online-store already deployed rather than install or upgrade it")
+	flag.BoolVar(&opts.Cleanup, "cleanup", false, "delete the release at the end of the test")
+	flag.StringVar(&opts.Deployment, "deployment", "", "Deployment of the online-store; the release if empty")
+	flag.StringVar(&opts.HPA, "hpa", "", "autoscaler of the online-store; the Deployment if empty")
+	flag.StringVar(&opts.NodeLabel, "node-label", "type", "node label key identifying virtual nodes")
+	flag.StringVar(&opts.NodeLabelValue, "node-label-value", "virtual-kubelet", "node label value identifying virtual nodes")
+	flag.DurationVar(&opts.ReadyTimeout, "ready-timeout", 0, "most time the online-store may take to be ready before the load (default 5m)")
+	flag.DurationVar(&opts.ScaleDownTimeout, "scale-down-timeout", 0, "most time the replicas may take to go back down after the load (default 15m)")
+	flag.DurationVar(&opts.Interval, "interval", 0, "time between two looks at the replicas (default 5s)")
+	flag.StringVar(&opts.Load.URL, "url", "", "URL of the online-store, through its ingress, to send the requests to")
+	flag.IntVar(&opts.Load.Concurrency, "concurrency", 200, "most requests in flight")
+	flag.DurationVar(&opts.Load.Duration, "duration", 10*time.Minute, "how long to generate load for")
+	flag.DurationVar(&opts.Load.Timeout, "timeout", 10*time.Second, "timeout of each request")
+	flag.StringVar(&profile, "profile", "ramp", "shape of the load: constant, ramp, spike or sine")
+	flag.Float64Var(&profileOpts.RPS, "rps", 10, "requests per second: the constant rate, the start of a ramp, the base of a spike or the middle of a sine wave")
+	flag.Float64Var(&profileOpts.PeakRPS, "peak-rps", 500, "requests per second at the end of a ramp, the height of a spike or the top of a sine wave")
+	flag.DurationVar(&profileOpts.Ramp, "ramp", 5*time.Minute, "how long a ramp lasts")
+	flag.DurationVar(&profileOpts.SpikeAt, "spike-at", time.Minute, "when the spike starts")
+	flag.DurationVar(&profileOpts.SpikeLength, "spike-length", 5*time.Minute, "how long the spike lasts")
+	flag.DurationVar(&profileOpts.Period, "period", 10*time.Minute, "period of a sine wave")
+	flag.Parse()
+
+	p, err := loadgen.NewProfile(profile, profileOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Load.Profile = p
+	opts.Output = os.Stdout
+
+	h, err := e2e.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Stop on an interrupt, still deleting the release with --cleanup.
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+	result, err := h.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\nautoscaler from %d to %d replicas, at most %d on the virtual node\n",
+		result.BaselineReplicas, result.PeakReplicas, result.PeakVirtual)
+	failures := result.Failures()
+	for _, failure := range failures {
+		fmt.Printf("FAIL: %s\n", failure)
+	}
+	if len(failures) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
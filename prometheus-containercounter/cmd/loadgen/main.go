@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/loadgen"
+)
+
+func main() {
+	var (
+		opts        loadgen.LoadOpts
+		profileOpts loadgen.ProfileOpts
+		profile     string
+	)
+	flag.StringVar(&opts.URL, "url", "http://localhost:8080/", "URL to send the requests to")
+	flag.StringVar(&opts.Method, "method", "GET", "HTTP method of the requests")
+	flag.IntVar(&opts.Concurrency, "concurrency", 50, "most requests in flight")
+	flag.DurationVar(&opts.Duration, "duration", time.Minute, "how long to generate load for")
+	flag.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "timeout of each request")
+	flag.StringVar(&profile, "profile", "constant", "shape of the load: constant, ramp, spike or sine")
+	flag.Float64Var(&profileOpts.RPS, "rps", 10, "requests per second: the constant rate, the start of a ramp, the base of a spike or the middle of a sine wave")
+	flag.Float64Var(&profileOpts.PeakRPS, "peak-rps", 100, "requests per second at the end of a ramp, the height of a spike or the top of a sine wave")
+	flag.DurationVar(&profileOpts.Ramp, "ramp", 30*time.Second, "how long a ramp lasts")
+	flag.DurationVar(&profileOpts.SpikeAt, "spike-at", 10*time.Second, "when the spike starts")
+	flag.DurationVar(&profileOpts.SpikeLength, "spike-length", 10*time.Second, "how long the spike lasts")
+	flag.DurationVar(&profileOpts.Period, "period", time.Minute, "period of a sine wave")
+	flag.Parse()
+
+	p, err := loadgen.NewProfile(profile, profileOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Profile = p
+
+	fmt.Printf("%8s %10s %8s %7s %8s %10s %10s %10s\n", "elapsed", "target", "rps", "errors", "skipped", "p50", "p90", "p99")
+	summary := loadgen.Run(context.Background(), opts, func(s loadgen.Second) {
+		fmt.Printf("%8s %10.1f %8d %7d %8d %10s %10s %10s\n", s.Elapsed, s.TargetRPS, s.Requests, s.Errors, s.Skipped,
+			s.P50.Round(time.Millisecond), s.P90.Round(time.Millisecond), s.P99.Round(time.Millisecond))
+	})
+	fmt.Printf("\n%d requests, %d errors, %d skipped; p50 %s, p90 %s, p99 %s\n",
+		summary.Requests, summary.Errors, summary.Skipped,
+		summary.P50.Round(time.Millisecond), summary.P90.Round(time.Millisecond), summary.P99.Round(time.Millisecond))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/adapter"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// externalMetrics collects the repeated --appinsights-metric flags.
+type externalMetrics []adapter.ExternalMetric
+
+func (m *externalMetrics) String() string {
+	var names []string
+	for _, metric := range *m {
+		names = append(names, metric.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (m *externalMetrics) Set(s string) error {
+	metric, err := adapter.ParseExternalMetric(s)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, metric)
+	return nil
+}
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	var opts adapter.AdapterOpts
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.Namespace, "namespace", "", "namespace of the pods to scrape; all namespaces if empty")
+	flag.StringVar(&opts.PodLabel, "pod-label-selector", "app=online-store", "label selector of the pods to scrape")
+	flag.IntVar(&opts.MetricsPort, "metrics-port", 8080, "port of the pods' Prometheus endpoint")
+	flag.StringVar(&opts.MetricsPath, "metrics-path", "/metrics", "path of the pods' Prometheus endpoint")
+	flag.StringVar(&opts.Series, "series", "request_durations_histogram_secs", "counter, histogram or summary whose per-second rate is served")
+	flag.StringVar(&opts.MetricName, "metric-name", "http_requests_per_second", "name of the custom metric served")
+	flag.StringVar(&opts.ServiceAggregation, "service-aggregation", adapter.AggregateSum, "how pod rates are combined for a service: sum or avg")
+	flag.DurationVar(&opts.ScrapeInterval, "scrape-interval", 0, "how often the pods are scraped (default 15s)")
+	flag.StringVar(&opts.ListenAddress, "listen-address", ":6443", "address to serve the custom metrics API on")
+	flag.StringVar(&opts.TLSCertFile, "tls-cert-file", "", "certificate to serve with; plain HTTP if empty")
+	flag.StringVar(&opts.TLSKeyFile, "tls-private-key-file", "", "key of the certificate to serve with")
+	flag.Var((*externalMetrics)(&opts.ExternalMetrics), "appinsights-metric", "external metric to serve from application insights, as name=metricID[:aggregation], such as requests_per_second=requests/rate:avg; may be repeated")
+	flag.StringVar(&opts.AppInsightsAppID, "appinsights-app-id", os.Getenv("APPINSIGHTS_APP_ID"), "application insights app ID (default $APPINSIGHTS_APP_ID)")
+	flag.DurationVar(&opts.AppInsightsTimespan, "appinsights-timespan", 0, "timespan the application insights metrics are aggregated over (default 5m)")
+	flag.Parse()
+	// Keep the key out of the command line.
+	opts.AppInsightsAPIKey = os.Getenv("APPINSIGHTS_API_KEY")
+
+	a, err := adapter.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(a.Run())
+}
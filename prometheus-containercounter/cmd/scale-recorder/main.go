@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/recorder"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	var (
+		opts   recorder.RecorderOpts
+		output string
+	)
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.Namespace, "namespace", "", "namespace to watch; all namespaces if empty")
+	flag.StringVar(&opts.PodLabel, "pod-label-selector", "app=online-store", "label selector of the pods to follow")
+	flag.StringVar(&opts.NodeLabel, "node-label", "type", "node label key identifying virtual nodes")
+	flag.StringVar(&opts.NodeLabelValue, "node-label-value", "virtual-kubelet", "node label value identifying virtual nodes")
+	flag.StringVar(&output, "output", "", "file to append the timeline to; standard output if empty")
+	flag.Parse()
+
+	opts.Output = os.Stdout
+	if output != "" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		opts.Output = f
+	}
+
+	r, err := recorder.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(r.Run())
+}
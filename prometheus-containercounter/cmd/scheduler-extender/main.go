@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path/filepath"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/extender"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func main() {
+	// Find home directory.
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatalf("couldn't read home directory for kubeconf")
+	}
+
+	var opts extender.ExtenderOpts
+	flag.StringVar(&opts.KubeConfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig file, used if it exists instead of the in-cluster config")
+	flag.StringVar(&opts.NodeLabel, "node-label", "type", "node label key identifying virtual nodes")
+	flag.StringVar(&opts.NodeLabelValue, "node-label-value", "virtual-kubelet", "node label value identifying virtual nodes")
+	flag.StringVar(&opts.ListenAddress, "listen-address", ":8888", "address to serve the extender on")
+	flag.Parse()
+
+	e, err := extender.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(e.Run())
+}
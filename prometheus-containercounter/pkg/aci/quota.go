@@ -0,0 +1,183 @@
+// Package aci reads the quota of Azure Container Instances in a region: how
+// many container groups and cores the subscription runs there, and how many
+// it may. The virtual node runs each pod as a container group, so once the
+// quota is used up, the pods scheduled onto it stay Pending.
+package aci
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+)
+
+// requestTimeout bounds a read of the quota, token included.
+const requestTimeout = 10 * time.Second
+
+// The names of the usages of the quota.
+const (
+	containerGroupsUsage = "ContainerGroups"
+	coresUsage           = "StandardCores"
+)
+
+// QuotaOpts configures a quota reader.
+type QuotaOpts struct {
+	// SubscriptionID and Location are the subscription and the region the
+	// virtual node creates its container groups in, as westeurope.
+	SubscriptionID string
+	Location       string
+	// TenantID, ClientID and ClientSecret are the credentials of a service
+	// principal that may read the subscription. Without a ClientSecret, the
+	// managed identity of the node is used, the one of ClientID if set.
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	// CacheFor is how long a quota read is used for before it is read again.
+	CacheFor time.Duration
+}
+
+// Usage is how much of a quota is used, out of its limit.
+type Usage struct {
+	Current float64 `json:"current"`
+	Limit   float64 `json:"limit"`
+}
+
+// Free returns how much of the quota is left.
+func (u Usage) Free() float64 {
+	if u.Current >= u.Limit {
+		return 0
+	}
+	return u.Limit - u.Current
+}
+
+// Quota is the use of the container groups and cores of a region.
+type Quota struct {
+	ContainerGroups Usage     `json:"containerGroups"`
+	Cores           Usage     `json:"cores"`
+	ReadAt          time.Time `json:"readAt"`
+}
+
+// Headroom returns how many more pods of cpu cores fit in the quota, each
+// as a container group.
+func (q Quota) Headroom(cpu float64) int32 {
+	headroom := q.ContainerGroups.Free()
+	if cpu > 0 {
+		headroom = math.Min(headroom, math.Floor(q.Cores.Free()/cpu))
+	}
+	if headroom > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(headroom)
+}
+
+// QuotaReader reads the quota from the Azure Resource Manager API, and keeps
+// it for the cache period.
+type QuotaReader struct {
+	opts   QuotaOpts
+	client *armcontainerinstance.LocationClient
+
+	mu     sync.Mutex
+	cached *Quota
+}
+
+// NewQuotaReader returns a quota reader.
+func NewQuotaReader(opts QuotaOpts) (*QuotaReader, error) {
+	if opts.SubscriptionID == "" || opts.Location == "" {
+		return nil, fmt.Errorf("the subscription and the location of the container instances are needed to read their quota")
+	}
+	if opts.ClientSecret != "" && (opts.TenantID == "" || opts.ClientID == "") {
+		return nil, fmt.Errorf("the tenant and the client ID of the service principal are needed with its secret")
+	}
+	// Default to 1m if not set
+	if opts.CacheFor <= 0 {
+		opts.CacheFor = time.Minute
+	}
+	// The location is written without spaces, in lower case, in the API.
+	opts.Location = strings.ToLower(strings.Replace(opts.Location, " ", "", -1))
+
+	clientOpts := policy.ClientOptions{Transport: &http.Client{Timeout: requestTimeout}}
+	cred, err := credential(opts, clientOpts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := armcontainerinstance.NewLocationClient(opts.SubscriptionID, cred, &arm.ClientOptions{ClientOptions: clientOpts})
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaReader{opts: opts, client: client}, nil
+}
+
+// credential returns the service principal of opts, or the managed
+// identity of the node, the one of opts.ClientID if set. Both keep their
+// token until shortly before it expires.
+func credential(opts QuotaOpts, clientOpts policy.ClientOptions) (azcore.TokenCredential, error) {
+	if opts.ClientSecret != "" {
+		return azidentity.NewClientSecretCredential(opts.TenantID, opts.ClientID, opts.ClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: clientOpts})
+	}
+	identityOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: clientOpts}
+	if opts.ClientID != "" {
+		identityOpts.ID = azidentity.ClientID(opts.ClientID)
+	}
+	return azidentity.NewManagedIdentityCredential(identityOpts)
+}
+
+// Quota returns the quota, read at most once per cache period.
+func (r *QuotaReader) Quota(now time.Time) (Quota, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cached != nil && now.Sub(r.cached.ReadAt) < r.opts.CacheFor {
+		return *r.cached, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	q := Quota{ReadAt: now}
+	var groups, cores bool
+	pager := r.client.NewListUsagePager(r.opts.Location, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return Quota{}, fmt.Errorf("reading the container instance usages: %v", err)
+		}
+		for _, usage := range page.Value {
+			if usage == nil || usage.Name == nil || usage.Name.Value == nil {
+				continue
+			}
+			switch *usage.Name.Value {
+			case containerGroupsUsage:
+				q.ContainerGroups = toUsage(usage)
+				groups = true
+			case coresUsage:
+				q.Cores = toUsage(usage)
+				cores = true
+			}
+		}
+	}
+	if !groups || !cores {
+		return Quota{}, fmt.Errorf("no %s or %s usage in %s", containerGroupsUsage, coresUsage, r.opts.Location)
+	}
+	r.cached = &q
+	return q, nil
+}
+
+// toUsage converts a usage of the API.
+func toUsage(usage *armcontainerinstance.Usage) Usage {
+	var u Usage
+	if usage.CurrentValue != nil {
+		u.Current = float64(*usage.CurrentValue)
+	}
+	if usage.Limit != nil {
+		u.Limit = float64(*usage.Limit)
+	}
+	return u
+}
@@ -0,0 +1,290 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+)
+
+const (
+	groupVersion = "custom.metrics.k8s.io/v1beta1"
+	apiPrefix    = "/apis/" + groupVersion
+)
+
+// Aggregations of the pod rates for services.
+const (
+	AggregateSum     = "sum"
+	AggregateAverage = "avg"
+)
+
+type Adapter interface {
+	Run() error
+}
+
+// AdapterOpts configures the custom metrics adapter.
+type AdapterOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists.
+	KubeConfig string
+	// Namespace limits the pods scraped to one namespace; all if empty.
+	Namespace string
+	// PodLabel is the label selector of the pods to scrape.
+	PodLabel string
+	// MetricsPort and MetricsPath locate the Prometheus endpoint of a pod.
+	MetricsPort int
+	MetricsPath string
+	// Series is the counter, histogram or summary whose rate is served.
+	Series string
+	// MetricName is the name of the metric served to the HPA.
+	MetricName string
+	// ServiceAggregation is how pod rates are combined for a service,
+	// AggregateSum or AggregateAverage.
+	ServiceAggregation string
+	ScrapeInterval     time.Duration
+	// ListenAddress is the address served on. The API is served over TLS
+	// when TLSCertFile and TLSKeyFile are set, as the aggregator requires.
+	ListenAddress string
+	TLSCertFile   string
+	TLSKeyFile    string
+	// ExternalMetrics are served on external.metrics.k8s.io from the
+	// Application Insights app AppInsightsAppID, read with
+	// AppInsightsAPIKey, over the last AppInsightsTimespan.
+	ExternalMetrics     []ExternalMetric
+	AppInsightsAppID    string
+	AppInsightsAPIKey   string
+	AppInsightsTimespan time.Duration
+}
+
+type adapter struct {
+	opts        AdapterOpts
+	scraper     *scraper
+	lister      serviceLister
+	appInsights *appInsights
+}
+
+// serviceLister returns the pod selector of a service.
+type serviceLister func(namespace, name string) (labels.Selector, error)
+
+func New(opts AdapterOpts) (Adapter, error) {
+	clientset, err := kube.NewClientset(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.ServiceAggregation {
+	case "":
+		opts.ServiceAggregation = AggregateSum
+	case AggregateSum, AggregateAverage:
+	default:
+		return nil, fmt.Errorf("unknown service aggregation %q, want %q or %q",
+			opts.ServiceAggregation, AggregateSum, AggregateAverage)
+	}
+	// Default to 15s if not set
+	if opts.ScrapeInterval <= 0 {
+		opts.ScrapeInterval = 15 * time.Second
+	}
+
+	if len(opts.ExternalMetrics) > 0 && (opts.AppInsightsAppID == "" || opts.AppInsightsAPIKey == "") {
+		return nil, fmt.Errorf("external metrics need an application insights app ID and API key")
+	}
+	// Default to 5m if not set
+	if opts.AppInsightsTimespan <= 0 {
+		opts.AppInsightsTimespan = 5 * time.Minute
+	}
+
+	a := &adapter{
+		opts: opts,
+		scraper: &scraper{
+			k8sClient: clientset,
+			http:      &http.Client{Timeout: opts.ScrapeInterval},
+			namespace: opts.Namespace,
+			podLabel:  opts.PodLabel,
+			port:      opts.MetricsPort,
+			path:      opts.MetricsPath,
+			series:    opts.Series,
+			interval:  opts.ScrapeInterval,
+			samples:   make(map[string]*podSample),
+		},
+		appInsights: &appInsights{
+			http:     &http.Client{Timeout: 10 * time.Second},
+			appID:    opts.AppInsightsAppID,
+			apiKey:   opts.AppInsightsAPIKey,
+			timespan: opts.AppInsightsTimespan,
+			cacheFor: opts.ScrapeInterval,
+			cached:   make(map[string]cachedValue),
+		},
+	}
+	a.lister = func(namespace, name string) (labels.Selector, error) {
+		svc, err := clientset.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if len(svc.Spec.Selector) == 0 {
+			return nil, fmt.Errorf("service %s/%s has no selector", namespace, name)
+		}
+		return labels.SelectorFromSet(svc.Spec.Selector), nil
+	}
+	return a, nil
+}
+
+func (a *adapter) Run() error {
+	go a.scraper.run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix, a.serveResources)
+	mux.HandleFunc(apiPrefix+"/", a.serveMetric)
+	if len(a.opts.ExternalMetrics) > 0 {
+		mux.HandleFunc(externalAPIPrefix, a.serveExternalResources)
+		mux.HandleFunc(externalAPIPrefix+"/", a.serveExternalMetric)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	log.Printf("serving %s for %s on %s", a.opts.MetricName, groupVersion, a.opts.ListenAddress)
+	if a.opts.TLSCertFile != "" && a.opts.TLSKeyFile != "" {
+		return http.ListenAndServeTLS(a.opts.ListenAddress, a.opts.TLSCertFile, a.opts.TLSKeyFile, mux)
+	}
+	return http.ListenAndServe(a.opts.ListenAddress, mux)
+}
+
+// serveResources answers discovery, listing the metric for pods and
+// services.
+func (a *adapter) serveResources(w http.ResponseWriter, r *http.Request) {
+	list := metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: groupVersion,
+	}
+	for _, kind := range []string{"pods", "services"} {
+		list.APIResources = append(list.APIResources, metav1.APIResource{
+			Name:       kind + "/" + a.opts.MetricName,
+			Namespaced: true,
+			Kind:       "MetricValueList",
+			Verbs:      []string{"get"},
+		})
+	}
+	writeJSON(w, list)
+}
+
+// serveMetric serves
+//
+//	/namespaces/{namespace}/pods/{name or *}/{metric}
+//	/namespaces/{namespace}/services/{name}/{metric}
+func (a *adapter) serveMetric(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix+"/"), "/")
+	if len(parts) != 5 || parts[0] != "namespaces" {
+		http.NotFound(w, r)
+		return
+	}
+	namespace, kind, name, metric := parts[1], parts[2], parts[3], parts[4]
+	if metric != a.opts.MetricName {
+		http.Error(w, fmt.Sprintf("unknown metric %q", metric), http.StatusNotFound)
+		return
+	}
+
+	var items []metricValue
+	switch kind {
+	case "pods":
+		selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, sample := range a.scraper.podRates(namespace, selector) {
+			if name != "*" && sample.name != name {
+				continue
+			}
+			items = append(items, a.value("Pod", sample.namespace, sample.name, sample.rate, sample.scraped))
+		}
+		if name != "*" && len(items) == 0 {
+			http.Error(w, fmt.Sprintf("no %s for pod %s/%s", metric, namespace, name), http.StatusNotFound)
+			return
+		}
+	case "services":
+		if name == "*" {
+			http.Error(w, "services must be asked for by name", http.StatusBadRequest)
+			return
+		}
+		selector, err := a.lister(namespace, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		samples := a.scraper.podRates(namespace, selector)
+		if len(samples) == 0 {
+			http.Error(w, fmt.Sprintf("no %s for service %s/%s", metric, namespace, name), http.StatusNotFound)
+			return
+		}
+		total, latest := 0.0, time.Time{}
+		for _, sample := range samples {
+			total += sample.rate
+			if sample.scraped.After(latest) {
+				latest = sample.scraped
+			}
+		}
+		if a.opts.ServiceAggregation == AggregateAverage {
+			total /= float64(len(samples))
+		}
+		items = append(items, a.value("Service", namespace, name, total, latest))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DescribedObject.Name < items[j].DescribedObject.Name
+	})
+	writeJSON(w, metricValueList{
+		TypeMeta: metav1.TypeMeta{Kind: "MetricValueList", APIVersion: groupVersion},
+		ListMeta: metav1.ListMeta{SelfLink: r.URL.Path},
+		Items:    items,
+	})
+}
+
+func (a *adapter) value(kind, namespace, name string, v float64, at time.Time) metricValue {
+	return metricValue{
+		DescribedObject: objectReference{Kind: kind, Namespace: namespace, Name: name, APIVersion: "/v1"},
+		MetricName:      a.opts.MetricName,
+		Timestamp:       metav1.NewTime(at),
+		Value:           *resource.NewMilliQuantity(int64(v*1000), resource.DecimalSI),
+	}
+}
+
+// metricValueList and its items mirror the custom.metrics.k8s.io/v1beta1
+// types, which aren't vendored.
+type metricValueList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []metricValue `json:"items"`
+}
+
+type metricValue struct {
+	DescribedObject objectReference   `json:"describedObject"`
+	MetricName      string            `json:"metricName"`
+	Timestamp       metav1.Time       `json:"timestamp"`
+	Value           resource.Quantity `json:"value"`
+}
+
+type objectReference struct {
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response: %s", err)
+	}
+}
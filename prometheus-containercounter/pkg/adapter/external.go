@@ -0,0 +1,188 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	externalGroupVersion = "external.metrics.k8s.io/v1beta1"
+	externalAPIPrefix    = "/apis/" + externalGroupVersion
+
+	appInsightsAPI = "https://api.applicationinsights.io/v1/apps/"
+)
+
+// ExternalMetric is an external metric served from an Application Insights
+// metric, such as requests/rate or dependencies/duration.
+type ExternalMetric struct {
+	// Name is the name of the metric served to the HPA.
+	Name string
+	// MetricID is the Application Insights metric, and Aggregation how its
+	// values over the timespan are combined: avg, sum, min, max or count.
+	MetricID    string
+	Aggregation string
+}
+
+// ParseExternalMetric parses name=metricID[:aggregation]; the aggregation
+// defaults to avg.
+func ParseExternalMetric(s string) (ExternalMetric, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ExternalMetric{}, fmt.Errorf("bad external metric %q, want name=metricID[:aggregation]", s)
+	}
+	m := ExternalMetric{Name: parts[0], MetricID: parts[1], Aggregation: "avg"}
+	if i := strings.LastIndex(m.MetricID, ":"); i >= 0 {
+		m.MetricID, m.Aggregation = m.MetricID[:i], m.MetricID[i+1:]
+	}
+	return m, nil
+}
+
+// appInsights reads metrics from the Application Insights REST API, and
+// keeps them for the cache period so the HPA doesn't use up the API quota.
+type appInsights struct {
+	http     *http.Client
+	appID    string
+	apiKey   string
+	timespan time.Duration
+	cacheFor time.Duration
+
+	mu     sync.Mutex
+	cached map[string]cachedValue
+}
+
+type cachedValue struct {
+	value float64
+	at    time.Time
+}
+
+// metricsResponse is the body of GET /v1/apps/{app}/metrics/{metric}.
+type metricsResponse struct {
+	Value map[string]json.RawMessage `json:"value"`
+}
+
+func (a *appInsights) get(m ExternalMetric, now time.Time) (float64, time.Time, error) {
+	a.mu.Lock()
+	cached, ok := a.cached[m.Name]
+	a.mu.Unlock()
+	if ok && now.Sub(cached.at) < a.cacheFor {
+		return cached.value, cached.at, nil
+	}
+
+	query := url.Values{}
+	query.Set("timespan", fmt.Sprintf("PT%dS", int(a.timespan/time.Second)))
+	query.Set("aggregation", m.Aggregation)
+	u := appInsightsAPI + url.PathEscape(a.appID) + "/metrics/" + m.MetricID + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	req.Header.Set("x-api-key", a.apiKey)
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("application insights returned %s for %s", resp.Status, m.MetricID)
+	}
+
+	var body metricsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, time.Time{}, err
+	}
+	// The value is under the metric, by aggregation:
+	// {"value": {"start": ..., "end": ..., "requests/rate": {"avg": 1.5}}}
+	raw, ok := body.Value[m.MetricID]
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("no %s in the response of application insights", m.MetricID)
+	}
+	var aggregations map[string]*float64
+	if err := json.Unmarshal(raw, &aggregations); err != nil {
+		return 0, time.Time{}, err
+	}
+	value := aggregations[m.Aggregation]
+	if value == nil {
+		// No data over the timespan.
+		zero := 0.0
+		value = &zero
+	}
+
+	a.mu.Lock()
+	a.cached[m.Name] = cachedValue{value: *value, at: now}
+	a.mu.Unlock()
+	return *value, now, nil
+}
+
+// serveExternalResources answers discovery, listing the external metrics.
+func (a *adapter) serveExternalResources(w http.ResponseWriter, r *http.Request) {
+	list := metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: externalGroupVersion,
+	}
+	for _, m := range a.opts.ExternalMetrics {
+		list.APIResources = append(list.APIResources, metav1.APIResource{
+			Name:       m.Name,
+			Namespaced: true,
+			Kind:       "ExternalMetricValueList",
+			Verbs:      []string{"get"},
+		})
+	}
+	writeJSON(w, list)
+}
+
+// serveExternalMetric serves /namespaces/{namespace}/{metric}. The metrics
+// are the same in every namespace, and have no labels to select on.
+func (a *adapter) serveExternalMetric(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, externalAPIPrefix+"/"), "/")
+	if len(parts) != 3 || parts[0] != "namespaces" {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[2]
+
+	for _, m := range a.opts.ExternalMetrics {
+		if m.Name != name {
+			continue
+		}
+		value, at, err := a.appInsights.get(m, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, externalMetricValueList{
+			TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: externalGroupVersion},
+			ListMeta: metav1.ListMeta{SelfLink: r.URL.Path},
+			Items: []externalMetricValue{{
+				MetricName:   m.Name,
+				MetricLabels: map[string]string{},
+				Timestamp:    metav1.NewTime(at),
+				Value:        *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI),
+			}},
+		})
+		return
+	}
+	http.Error(w, fmt.Sprintf("unknown external metric %q", name), http.StatusNotFound)
+}
+
+// externalMetricValueList and its items mirror the
+// external.metrics.k8s.io/v1beta1 types, which aren't vendored.
+type externalMetricValueList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []externalMetricValue `json:"items"`
+}
+
+type externalMetricValue struct {
+	MetricName   string            `json:"metricName"`
+	MetricLabels map[string]string `json:"metricLabels"`
+	Timestamp    metav1.Time       `json:"timestamp"`
+	Value        resource.Quantity `json:"value"`
+}
@@ -0,0 +1,178 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podSample is the last value of the scraped counter for a pod, and the
+// rate it grew at since the scrape before.
+type podSample struct {
+	namespace string
+	name      string
+	labels    map[string]string
+	counter   float64
+	rate      float64
+	hasRate   bool
+	scraped   time.Time
+}
+
+// scraper periodically reads a counter from the Prometheus endpoint of every
+// pod matching a label selector, and keeps its per-second rate.
+type scraper struct {
+	k8sClient *kubernetes.Clientset
+	http      *http.Client
+	namespace string
+	podLabel  string
+	port      int
+	path      string
+	series    string
+	interval  time.Duration
+
+	mu      sync.RWMutex
+	samples map[string]*podSample
+}
+
+func (s *scraper) run() {
+	tickChan := time.NewTicker(s.interval).C
+	for {
+		s.scrape()
+		<-tickChan
+	}
+}
+
+func (s *scraper) scrape() {
+	listOpts := metav1.ListOptions{
+		LabelSelector: s.podLabel,
+	}
+	pods, err := s.k8sClient.CoreV1().Pods(s.namespace).List(context.Background(), listOpts)
+	if err != nil {
+		log.Printf("got an error trying to fetch pods: %s", err)
+		return
+	}
+
+	seen := make(map[string]bool, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+		key := pod.Namespace + "/" + pod.Name
+		seen[key] = true
+
+		value, err := s.scrapePod(pod)
+		if err != nil {
+			log.Printf("scraping pod %s: %s", key, err)
+			continue
+		}
+		s.record(key, pod, value, time.Now())
+	}
+
+	// Forget the pods that went away, so they don't count towards services.
+	s.mu.Lock()
+	for key := range s.samples {
+		if !seen[key] {
+			delete(s.samples, key)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *scraper) record(key string, pod *corev1.Pod, value float64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.samples[key]
+	sample := &podSample{
+		namespace: pod.Namespace,
+		name:      pod.Name,
+		labels:    pod.Labels,
+		counter:   value,
+		scraped:   now,
+	}
+	// A counter going down means the process restarted; wait for the next
+	// scrape rather than report a negative rate.
+	if ok && value >= prev.counter {
+		if elapsed := now.Sub(prev.scraped).Seconds(); elapsed > 0 {
+			sample.rate = (value - prev.counter) / elapsed
+			sample.hasRate = true
+		}
+	}
+	s.samples[key] = sample
+}
+
+// scrapePod returns the value of the scraped series in pod, summed over all
+// of its label sets. Histograms and summaries count their observations.
+func (s *scraper) scrapePod(pod *corev1.Pod) (float64, error) {
+	url := fmt.Sprintf("http://%s:%d%s", pod.Status.PodIP, s.port, s.path)
+	resp, err := s.http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	family, ok := families[s.series]
+	if !ok {
+		return 0, fmt.Errorf("no series %q at %s", s.series, url)
+	}
+
+	var total float64
+	for _, m := range family.GetMetric() {
+		total += sampleValue(m)
+	}
+	return total, nil
+}
+
+func sampleValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	case m.Summary != nil:
+		return float64(m.Summary.GetSampleCount())
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	}
+	return 0
+}
+
+// podRates returns the rates of the pods in namespace matching selector.
+func (s *scraper) podRates(namespace string, selector labels.Selector) []podSample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rates []podSample
+	for _, sample := range s.samples {
+		if sample.namespace != namespace || !sample.hasRate {
+			continue
+		}
+		if !selector.Matches(labels.Set(sample.labels)) {
+			continue
+		}
+		rates = append(rates, *sample)
+	}
+	return rates
+}
@@ -0,0 +1,131 @@
+package annotator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+)
+
+// DeletionCostAnnotation tells the ReplicaSet controller which pods to
+// remove first on scale-down: the ones with the lowest cost.
+const DeletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+
+// OverBurstCost is the deletion cost the autoscale controller gives the
+// replicas on the virtual node over the burst percentage of their policy,
+// for them to go before any other. The annotator leaves it as it is, until
+// the controller clears it once they are within the percentage again.
+const OverBurstCost = -1000000
+
+type Annotator interface {
+	Run() error
+}
+
+// AnnotatorOpts configures the deletion cost annotator.
+type AnnotatorOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists.
+	KubeConfig string
+	PodLabel   string
+	Namespace  string
+	// NodeLabel and NodeLabelValue identify the virtual nodes.
+	NodeLabel      string
+	NodeLabelValue string
+	// VMCost and VirtualCost are the deletion costs of the pods on the
+	// regular nodes and on the virtual node. VirtualCost should be the
+	// lower, so the virtual node empties first.
+	VMCost      int
+	VirtualCost int
+	Interval    time.Duration
+	Logger      *zerolog.Logger
+}
+
+type annotator struct {
+	opts      AnnotatorOpts
+	log       *zerolog.Logger
+	k8sClient *kubernetes.Clientset
+}
+
+func New(opts AnnotatorOpts) (Annotator, error) {
+	clientset, err := kube.NewClientset(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Default to 5s if not set
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	// Default to JSON on stderr if not set
+	if opts.Logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		opts.Logger = &logger
+	}
+
+	return &annotator{opts: opts, log: opts.Logger, k8sClient: clientset}, nil
+}
+
+func (a *annotator) Run() error {
+	tickChan := time.NewTicker(a.opts.Interval).C
+	for {
+		a.annotate()
+		<-tickChan
+	}
+}
+
+func (a *annotator) annotate() {
+	nodes, err := a.k8sClient.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{
+		LabelSelector: a.opts.NodeLabel + "=" + a.opts.NodeLabelValue,
+	})
+	if err != nil {
+		a.log.Warn().Err(err).Msg("listing the virtual nodes")
+		return
+	}
+	virtualNodes := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		virtualNodes[node.Name] = true
+	}
+
+	pods, err := a.k8sClient.CoreV1().Pods(a.opts.Namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: a.opts.PodLabel,
+	})
+	if err != nil {
+		a.log.Warn().Err(err).Str("namespace", a.opts.Namespace).Msg("listing the pods")
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		// Unscheduled pods have no cost yet; they are the first to go anyway.
+		if pod.Spec.NodeName == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		cost := a.opts.VMCost
+		if virtualNodes[pod.Spec.NodeName] {
+			cost = a.opts.VirtualCost
+		}
+		if err := a.setCost(pod, cost); err != nil {
+			a.log.Warn().Err(err).Str("namespace", pod.Namespace).Str("pod", pod.Name).Int("cost", cost).Msg("annotating the deletion cost")
+		}
+	}
+}
+
+// setCost sets the deletion cost of pod, unless it already has it, or the
+// autoscale controller marked it to go first.
+func (a *annotator) setCost(pod *corev1.Pod, cost int) error {
+	value := strconv.Itoa(cost)
+	current := pod.Annotations[DeletionCostAnnotation]
+	if current == value || current == strconv.Itoa(OverBurstCost) {
+		return nil
+	}
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, DeletionCostAnnotation, value)
+	_, err := a.k8sClient.CoreV1().Pods(pod.Namespace).Patch(context.Background(), pod.Name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/logging"
+)
+
+// SchemeGroupVersion is the group and version of the policies.
+var SchemeGroupVersion = schema.GroupVersion{Group: Group, Version: Version}
+
+var (
+	schemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme registers the policies with a scheme.
+	AddToScheme = schemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion,
+		&VirtualNodeAutoscalePolicy{},
+		&VirtualNodeAutoscalePolicyList{},
+	)
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
+
+// newManager returns the controller-runtime manager of the controller. Its
+// client reads the policies from its cache, which watches them, and the
+// Deployments, autoscalers and pods that set off their reconciles, in the
+// namespace of opts, or all of them. Its metrics aren't served: the
+// controller serves its own.
+func newManager(config *rest.Config, opts ControllerOpts) (manager.Manager, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	logger := logging.Logr(opts.Logger)
+	log.SetLogger(logger)
+	mgrOpts := manager.Options{
+		Scheme:  scheme,
+		Logger:  logger,
+		Metrics: metricsserver.Options{BindAddress: "0"},
+	}
+	if opts.Namespace != "" {
+		mgrOpts.Cache.DefaultNamespaces = map[string]cache.Config{opts.Namespace: {}}
+	}
+	return manager.New(config, mgrOpts)
+}
@@ -0,0 +1,981 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/aci"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/annotator"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/cost"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/election"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/grafana"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/logging"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/notify"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/predict"
+)
+
+type Controller interface {
+	Run() error
+}
+
+// ControllerOpts configures the autoscale controller.
+type ControllerOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists.
+	KubeConfig string
+	// Namespace limits the policies reconciled to one namespace; all if
+	// empty.
+	Namespace string
+	// NodeLabel and NodeLabelValue identify the virtual nodes.
+	NodeLabel      string
+	NodeLabelValue string
+	// Interval is the most time between two reconciles of a policy, which
+	// are otherwise set off by the changes to the policy, its Deployment,
+	// autoscaler and pods.
+	Interval time.Duration
+	// Pricing is used to estimate the cost of the replicas.
+	Pricing cost.Pricing
+	// ListenAddress is the address /cost and /metrics are served on; they
+	// aren't served if empty.
+	ListenAddress string
+	// LeaderElect runs the controller with several replicas, of which only
+	// the leader reconciles. Election configures it.
+	LeaderElect bool
+	Election    election.ElectorOpts
+	// Predict raises the autoscaler's minimum ahead of the traffic the
+	// Deployments had at the same time in the periods before. Prediction
+	// configures it.
+	Predict    bool
+	Prediction predict.PredictorOpts
+	// ACIQuota holds the autoscaler's maximum to the replicas the container
+	// instance quota of the region has room for, once the regular nodes are
+	// full, rather than leave more Pending. Quota configures it.
+	ACIQuota bool
+	Quota    aci.QuotaOpts
+	// Notify posts to Slack, Teams or a webhook when a policy starts or
+	// stops bursting to the virtual node. Notification configures where.
+	Notify       bool
+	Notification notify.NotifierOpts
+	// Annotate writes the scale decisions and the starts and ends of the
+	// bursts as annotations to Grafana. Annotations configures where.
+	Annotate    bool
+	Annotations grafana.AnnotatorOpts
+	// DryRun logs the decisions the controller would make, without
+	// changing the autoscalers, pods or policy statuses.
+	DryRun bool
+	// Logger gets the logs of the controller.
+	Logger *zerolog.Logger
+}
+
+type controller struct {
+	opts      ControllerOpts
+	log       *zerolog.Logger
+	k8sClient *kubernetes.Clientset
+	mgr       manager.Manager
+	policies  client.Client
+	costs     *cost.Tracker
+	elector   *election.Elector
+	predictor *predict.Predictor
+	latency   *latencyTracker
+	quota     *aci.QuotaReader
+	notifier  *notify.Notifier
+	annotator *grafana.Annotator
+	ready     *readyTracker
+	decisions *decisionLog
+	// dryRunStatus holds the status of each policy in a dry run, in place
+	// of the one it would be updated to, so that cooldowns still apply.
+	dryRunStatus map[string]PolicyStatus
+}
+
+func New(opts ControllerOpts) (Controller, error) {
+	config, err := kube.NewConfig(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Default to 15s if not set
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Second
+	}
+	// Default to JSON on stderr if not set
+	if opts.Logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		opts.Logger = &logger
+	}
+	mgr, err := newManager(config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controller{
+		opts:      opts,
+		log:       opts.Logger,
+		k8sClient: clientset,
+		mgr:       mgr,
+		policies:  mgr.GetClient(),
+		costs:     cost.NewTracker(),
+		latency:   newLatencyTracker(),
+		ready:     newReadyTracker(),
+		decisions: newDecisionLog(500),
+	}
+	if opts.DryRun {
+		c.dryRunStatus = map[string]PolicyStatus{}
+	}
+	if opts.Predict {
+		c.predictor, err = predict.NewPredictor(opts.Prediction)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ACIQuota {
+		c.quota, err = aci.NewQuotaReader(opts.Quota)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Notify {
+		if opts.Notification.OnError == nil {
+			opts.Notification.OnError = func(sink string, err error) {
+				c.log.Warn().Err(err).Str("sink", sink).Msg("sending a burst notification")
+			}
+		}
+		c.notifier, err = notify.NewNotifier(opts.Notification)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Annotate {
+		if opts.Annotations.OnError == nil {
+			opts.Annotations.OnError = func(err error) {
+				c.log.Warn().Err(err).Msg("writing a grafana annotation")
+			}
+		}
+		c.annotator, err = grafana.NewAnnotator(opts.Annotations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.LeaderElect {
+		if opts.Election.Logger == nil {
+			opts.Election.Logger = opts.Logger
+		}
+		c.elector, err = election.NewElector(clientset, opts.Election)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.watch(); err != nil {
+		return nil, err
+	}
+	if c.predictor != nil {
+		if err := mgr.Add(manager.RunnableFunc(c.saveRates)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *controller) Run() error {
+	if c.opts.ListenAddress != "" {
+		go c.serve()
+	}
+	if c.elector == nil {
+		return c.mgr.Start(context.Background())
+	}
+
+	identity := c.opts.Election.Identity
+	leaderGauge.WithLabelValues(identity).Set(0)
+	c.elector.Run(func(stop <-chan struct{}) {
+		leaderGauge.WithLabelValues(identity).Set(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-stop
+			cancel()
+		}()
+		if err := c.mgr.Start(ctx); err != nil {
+			c.log.Error().Err(err).Msg("running the manager")
+		}
+	})
+	leaderGauge.WithLabelValues(identity).Set(0)
+	// Another replica may be leading by now; restart to stand by again.
+	return fmt.Errorf("%s lost the leadership", identity)
+}
+
+// Reconcile reconciles the policy of req, and has it reconciled again after
+// the interval at the latest, as the time moves the cooldowns, schedules,
+// predictions and shifts on without anything changing in the cluster.
+func (c *controller) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	key := req.Namespace + "/" + req.Name
+	policy := &VirtualNodeAutoscalePolicy{}
+	if err := c.policies.Get(ctx, req.NamespacedName, policy); err != nil {
+		if errors.IsNotFound(err) {
+			// The policy was deleted.
+			forgetPolicyMetrics(req.Namespace, req.Name)
+			c.ready.forget(key)
+			delete(c.dryRunStatus, key)
+			return reconcile.Result{}, nil
+		}
+		c.log.Error().Err(err).Str("policy", key).Msg("got an error trying to fetch the policy")
+		return reconcile.Result{}, err
+	}
+	virtualNodes, err := c.virtualNodes()
+	if err != nil {
+		c.log.Error().Err(err).Msg("got an error trying to fetch nodes")
+		return reconcile.Result{}, err
+	}
+	if err := c.reconcile(policy, virtualNodes, time.Now()); err != nil {
+		c.log.Error().Err(err).Str("policy", key).Msg("reconciling the policy")
+	}
+	return reconcile.Result{RequeueAfter: c.opts.Interval}, nil
+}
+
+// saveRates saves the request rates the predictor recorded every interval,
+// and once more when the manager stops.
+func (c *controller) saveRates(ctx context.Context) error {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.predictor.Save(); err != nil {
+				c.log.Error().Err(err).Msg("saving the recorded rates")
+			}
+			return nil
+		case <-ticker.C:
+			if err := c.predictor.Save(); err != nil {
+				c.log.Error().Err(err).Msg("saving the recorded rates")
+			}
+		}
+	}
+}
+
+// virtualNodes returns the names of the virtual nodes.
+func (c *controller) virtualNodes() (map[string]bool, error) {
+	listOpts := metav1.ListOptions{
+		LabelSelector: c.opts.NodeLabel + "=" + c.opts.NodeLabelValue,
+	}
+	nodes, err := c.k8sClient.CoreV1().Nodes().List(context.Background(), listOpts)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		names[node.Name] = true
+	}
+	return names, nil
+}
+
+// placement counts where the replicas of a Deployment are.
+type placement struct {
+	vm      int32
+	virtual int32
+	pending int32
+	// unschedulable are the pending replicas the scheduler found no room
+	// for, rather than those not yet looked at.
+	unschedulable int32
+	// virtualPods are the replicas running on the virtual node, and running
+	// all of the replicas running.
+	virtualPods []corev1.Pod
+	running     []corev1.Pod
+}
+
+func (c *controller) placement(namespace string, selector *metav1.LabelSelector, virtualNodes map[string]bool) (placement, error) {
+	var p placement
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return p, err
+	}
+	pods, err := c.k8sClient.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return p, err
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		switch {
+		case pod.Spec.NodeName == "" && pod.Status.Phase == corev1.PodPending:
+			p.pending++
+			if unschedulable(&pod) {
+				p.unschedulable++
+			}
+		case pod.Status.Phase != corev1.PodPending && pod.Status.Phase != corev1.PodRunning:
+		case virtualNodes[pod.Spec.NodeName]:
+			p.virtual++
+			p.virtualPods = append(p.virtualPods, pod)
+			p.running = append(p.running, pod)
+		default:
+			p.vm++
+			p.running = append(p.running, pod)
+		}
+	}
+	return p, nil
+}
+
+// atCapacity tells whether the regular nodes are full: replicas burst to
+// the virtual node, or the scheduler found no node for some.
+func (p placement) atCapacity() bool {
+	return p.virtual > 0 || p.unschedulable > 0
+}
+
+// unschedulable tells whether the scheduler tried pod and found no node
+// for it.
+func unschedulable(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled {
+			return c.Status == corev1.ConditionFalse && c.Reason == corev1.PodReasonUnschedulable
+		}
+	}
+	return false
+}
+
+// burstLimit returns the autoscaler's maximum keeping the share of replicas
+// on the virtual node within the policy, once the regular nodes are full.
+func burstLimit(spec *PolicySpec, p placement) int32 {
+	limit := spec.MaxReplicas
+	if p.atCapacity() && spec.MaxBurstPercentage < 100 {
+		burst := spec.MaxBurstPercentage
+		if burst < 0 {
+			burst = 0
+		}
+		// vm replicas are (100 - burst)% of the most allowed.
+		if allowed := p.vm * 100 / (100 - burst); allowed < limit {
+			limit = allowed
+		}
+	}
+	if spec.MinReplicas != nil && limit < *spec.MinReplicas {
+		limit = *spec.MinReplicas
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// quotaLimit lowers limit to the replicas that fit, once the regular nodes
+// are full: those running, and headroom more on the virtual node. It returns
+// whether it did.
+func quotaLimit(spec *PolicySpec, p placement, limit, headroom int32) (int32, bool) {
+	fit := p.vm + p.virtual + headroom
+	if !p.atCapacity() || fit >= limit {
+		return limit, false
+	}
+	if spec.MinReplicas != nil && fit < *spec.MinReplicas {
+		fit = *spec.MinReplicas
+	}
+	if fit < 1 {
+		fit = 1
+	}
+	return fit, fit < limit
+}
+
+// overBurst returns how many replicas run on the virtual node beyond the
+// policy's share of all the running replicas.
+func overBurst(spec *PolicySpec, p placement) int32 {
+	burst := spec.MaxBurstPercentage
+	if burst < 0 {
+		burst = 0
+	}
+	if burst >= 100 {
+		return 0
+	}
+	allowed := (p.vm + p.virtual) * burst / 100
+	if p.virtual <= allowed {
+		return 0
+	}
+	return p.virtual - allowed
+}
+
+// markOverBurst gives n of the replicas on the virtual node, the newest
+// first, the lowest deletion cost, so the ReplicaSet removes them first as
+// the autoscaler's maximum comes down. Evicting them instead would only have
+// the ReplicaSet create them again, on the virtual node still. The other
+// replicas there marked before lose the mark, once fewer are over, and get
+// back the cost of the virtual node from the annotator. It returns how many
+// it marked.
+func (c *controller) markOverBurst(policy *VirtualNodeAutoscalePolicy, pods []corev1.Pod, n int32, d *decision) int32 {
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[j].CreationTimestamp.Before(&pods[i].CreationTimestamp)
+	})
+	value := strconv.Itoa(annotator.OverBurstCost)
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, annotator.DeletionCostAnnotation, value))
+	var marked int32
+	for i := range pods {
+		pod := &pods[i]
+		if marked >= n {
+			if pod.Annotations[annotator.DeletionCostAnnotation] == value {
+				c.unmarkOverBurst(pod, d)
+			}
+			continue
+		}
+		if pod.Annotations[annotator.DeletionCostAnnotation] == value {
+			marked++
+			continue
+		}
+		d.act("mark %s to leave the virtual node first", pod.Name)
+		if c.opts.DryRun {
+			marked++
+			continue
+		}
+		if _, err := c.k8sClient.CoreV1().Pods(pod.Namespace).Patch(context.Background(), pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			c.log.Warn().Err(err).Str("policy", d.Policy).Str("pod", pod.Name).Msg("marking a replica over the burst percentage")
+			continue
+		}
+		c.log.Info().Str("policy", d.Policy).Str("pod", pod.Name).Int32("maxBurstPercentage", policy.Spec.MaxBurstPercentage).
+			Msg("marked to leave the virtual node, over the burst percentage")
+		overBurstCounter.WithLabelValues(policy.Namespace, policy.Name).Inc()
+		marked++
+	}
+	return marked
+}
+
+// unmarkOverBurst removes the deletion cost markOverBurst gave pod, for the
+// annotator to set the cost of the virtual node again.
+func (c *controller) unmarkOverBurst(pod *corev1.Pod, d *decision) {
+	d.act("clear the mark of %s, within the burst percentage again", pod.Name)
+	if c.opts.DryRun {
+		return
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, annotator.DeletionCostAnnotation))
+	if _, err := c.k8sClient.CoreV1().Pods(pod.Namespace).Patch(context.Background(), pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Str("pod", pod.Name).Msg("clearing the mark of a replica back within the burst percentage")
+		return
+	}
+	c.log.Info().Str("policy", d.Policy).Str("pod", pod.Name).Msg("cleared the mark, back within the burst percentage")
+}
+
+// reconcile reconciles the policy, and records and explains the decision.
+func (c *controller) reconcile(policy *VirtualNodeAutoscalePolicy, virtualNodes map[string]bool, now time.Time) error {
+	key := policy.Namespace + "/" + policy.Name
+	d := &decision{Time: now, Policy: key, DryRun: c.opts.DryRun, Actions: []string{}}
+	if status, ok := c.dryRunStatus[key]; ok {
+		policy.Status = status
+	}
+	start := time.Now()
+	err := c.decide(policy, virtualNodes, now, d)
+	reconcileHistogram.WithLabelValues(policy.Namespace, policy.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		d.Error = err.Error()
+		reconcileErrorsCounter.WithLabelValues(policy.Namespace, policy.Name).Inc()
+	}
+	c.decisions.add(*d)
+	// Every decision is logged at the debug level, and those that change
+	// something, or would in a dry run, at the info level.
+	level := zerolog.DebugLevel
+	if c.opts.DryRun || len(d.Actions) > 0 {
+		level = zerolog.InfoLevel
+	}
+	c.log.WithLevel(level).
+		Str("policy", d.Policy).
+		Str("deployment", d.Deployment).
+		Bool("dryRun", d.DryRun).
+		Int32("vmReplicas", d.VMReplicas).
+		Int32("virtualReplicas", d.VirtualReplicas).
+		Int32("pendingReplicas", d.PendingReplicas).
+		Int32("warmReplicas", d.WarmReplicas).
+		Float64("latency", d.Latency).
+		Int32("latencyReplicas", d.LatencyReplicas).
+		Int32("burstLimit", d.BurstLimit).
+		Int32("max", d.Max).
+		Bool("coolingDown", d.CoolingDown).
+		Bool("quotaLimited", d.QuotaLimited).
+		Strs("actions", d.Actions).
+		Msg(d.String())
+	return err
+}
+
+// decide reconciles the policy, filling in d as it goes.
+func (c *controller) decide(policy *VirtualNodeAutoscalePolicy, virtualNodes map[string]bool, now time.Time, d *decision) error {
+	window := activeWindow(policy, now, c.log)
+	spec := scheduledSpec(&policy.Spec, window)
+	d.Deployment = spec.Deployment
+	d.MinReplicas = spec.MinReplicas
+	d.MaxReplicas = spec.MaxReplicas
+	d.MaxBurstPercentage = spec.MaxBurstPercentage
+	deployment, err := c.k8sClient.AppsV1().Deployments(policy.Namespace).Get(context.Background(), spec.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	p, err := c.placement(policy.Namespace, deployment.Spec.Selector, virtualNodes)
+	if err != nil {
+		return err
+	}
+	warm, err := c.warmPool(policy, deployment, spec, &p, d)
+	if err != nil {
+		return err
+	}
+	d.VMReplicas, d.VirtualReplicas, d.PendingReplicas, d.WarmReplicas = p.vm, p.virtual, p.pending, warm
+	cpu, memoryGB := cost.PodSize(&deployment.Spec.Template.Spec)
+	// The warm replicas cost as much as the others on the virtual node.
+	c.costs.Observe(policy.Namespace+"/"+spec.Deployment, c.opts.Pricing.Estimate(p.vm, p.virtual+warm, cpu, memoryGB), now)
+
+	hpas := c.k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(policy.Namespace)
+	hpa, err := hpas.Get(context.Background(), spec.Deployment, metav1.GetOptions{})
+	exists := err == nil
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if exists {
+		current := hpa.Spec.MaxReplicas
+		d.CurrentMax = &current
+	}
+
+	excess := overBurst(spec, p)
+	d.OverBurst = excess
+	// A split policy keeps to the burst percentage as it divides the
+	// replicas.
+	scaleOverBurst := excess > 0 && spec.ScaleDownOverBurst && !spec.Split
+	marks := int32(0)
+	if scaleOverBurst {
+		marks = excess
+	}
+	// Marking none clears the marks left from when replicas were over.
+	c.markOverBurst(policy, p.virtualPods, marks, d)
+
+	status := &policy.Status
+	desired := burstLimit(spec, p)
+	quotaLimited := false
+	if c.quota != nil && p.atCapacity() {
+		// The quota is of the whole region, so the policies reconciled
+		// before may have used some of the headroom; the next read tells.
+		if q, err := c.quota.Quota(now); err != nil {
+			c.log.Warn().Err(err).Str("policy", d.Policy).Msg("reading the container instance quota")
+		} else {
+			headroom := q.Headroom(cpu)
+			d.QuotaHeadroom = &headroom
+			desired, quotaLimited = quotaLimit(spec, p, desired, headroom)
+		}
+	}
+	max := desired
+	coolingDown := false
+	// Replicas over the quota can't start anyway, so the scale down cooldown
+	// doesn't hold them.
+	// Nor does it hold the replicas over the burst percentage, when they
+	// are to be removed.
+	quotaCut := quotaLimited && exists && desired < hpa.Spec.MaxReplicas
+	burstCut := scaleOverBurst && exists && desired < hpa.Spec.MaxReplicas
+	if exists && hpa.Spec.MaxReplicas != desired && status.LastScaleTime != nil && !quotaCut && !burstCut {
+		cooldown := spec.ScaleUpCooldown.Duration
+		if desired < hpa.Spec.MaxReplicas {
+			cooldown = spec.ScaleDownCooldown.Duration
+		}
+		if now.Sub(status.LastScaleTime.Time) < cooldown {
+			max = hpa.Spec.MaxReplicas
+			coolingDown = true
+		}
+	}
+
+	minReplicas := spec.MinReplicas
+	status.PredictedReplicas = 0
+	if c.predictor != nil && exists {
+		if rate, target, ok := podsMetricRate(hpa); ok {
+			key := policy.Namespace + "/" + spec.Deployment
+			c.predictor.Record(key, rate, now)
+			d.Rate, d.Target = rate, target
+			if predicted, ok := c.predictor.Predict(key, now); ok {
+				replicas := int32(math.Ceil(predicted / target))
+				if replicas > max {
+					replicas = max
+				}
+				status.PredictedReplicas = replicas
+				if minReplicas == nil || replicas > *minReplicas {
+					minReplicas = &replicas
+				}
+			}
+		}
+	}
+
+	latencyOver := false
+	if spec.LatencySLO == nil {
+		status.LatencySeconds, status.LatencyReplicas = 0, 0
+	} else if latency, ok := c.latency.percentile(p.running, spec.LatencySLO); ok {
+		status.LatencySeconds = latency
+		status.LatencyReplicas, latencyOver = c.latency.latencyFloor(d.Policy, spec.LatencySLO, latency,
+			status.LatencyReplicas, p.vm+p.virtual+p.pending, now)
+	}
+	if status.LatencyReplicas > max {
+		status.LatencyReplicas = max
+	}
+	d.Latency, d.LatencyReplicas = status.LatencySeconds, status.LatencyReplicas
+	if floor := status.LatencyReplicas; floor > 0 && (minReplicas == nil || floor > *minReplicas) {
+		minReplicas = &floor
+	}
+
+	if !exists {
+		hpa = &autoscalingv2beta1.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      spec.Deployment,
+				Namespace: policy.Namespace,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: Group + "/" + Version,
+					Kind:       Kind,
+					Name:       policy.Name,
+					UID:        policy.UID,
+				}},
+			},
+		}
+	}
+	target := autoscalingv2beta1.CrossVersionObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       spec.Deployment,
+	}
+	if spec.Split {
+		target = autoscalingv2beta1.CrossVersionObjectReference{
+			APIVersion: Group + "/" + Version,
+			Kind:       Kind,
+			Name:       policy.Name,
+		}
+	}
+	want := autoscalingv2beta1.HorizontalPodAutoscalerSpec{
+		ScaleTargetRef: target,
+		MinReplicas:    minReplicas,
+		MaxReplicas:    max,
+		Metrics:        spec.Metrics,
+	}
+	d.BurstLimit = desired
+	d.Max = max
+	d.Min = minReplicas
+	d.CoolingDown = coolingDown
+	d.QuotaLimited = quotaLimited
+	d.PredictedReplicas = status.PredictedReplicas
+	if !exists {
+		hpa.Spec = want
+		d.act("create the autoscaler with min %s, max %d", replicas(want.MinReplicas), want.MaxReplicas)
+		if !c.opts.DryRun {
+			if _, err := hpas.Create(context.Background(), hpa, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+		}
+	} else if !reflect.DeepEqual(hpa.Spec.ScaleTargetRef, want.ScaleTargetRef) ||
+		!reflect.DeepEqual(hpa.Spec.MinReplicas, want.MinReplicas) ||
+		hpa.Spec.MaxReplicas != want.MaxReplicas ||
+		(len(want.Metrics) > 0 && !reflect.DeepEqual(hpa.Spec.Metrics, want.Metrics)) {
+		d.act("update the autoscaler from min %s, max %d to min %s, max %d",
+			replicas(hpa.Spec.MinReplicas), hpa.Spec.MaxReplicas, replicas(want.MinReplicas), want.MaxReplicas)
+		direction := scaleDirection(&hpa.Spec, &want)
+		hpa.Spec = want
+		if len(want.Metrics) == 0 {
+			hpa.Spec.Metrics = nil
+		}
+		// In a dry run the autoscaler stays as it is, so the same decision
+		// would be counted at every reconcile.
+		if !c.opts.DryRun {
+			if _, err := hpas.Update(context.Background(), hpa, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			if direction != "" {
+				scaleDecisionsCounter.WithLabelValues(policy.Namespace, policy.Name, direction).Inc()
+				c.annotate(p, "scale-"+direction, fmt.Sprintf("%s scaled %s: autoscaler min %s, max %d", d.Policy, direction,
+					replicas(want.MinReplicas), want.MaxReplicas), d)
+			}
+			if direction == "up" {
+				c.ready.scaleUp(d.Policy, now)
+			}
+		}
+	}
+	if status.MaxReplicas != max {
+		t := metav1.NewTime(now)
+		status.LastScaleTime = &t
+	}
+	status.VirtualTrafficPercent = 0
+	if spec.Split {
+		if err := c.split(policy, deployment, spec, now, d); err != nil {
+			return err
+		}
+		if spec.Traffic != nil {
+			if err := c.shiftTraffic(policy, spec.Traffic, p, virtualNodes, d); err != nil {
+				return err
+			}
+		}
+	}
+
+	status.ObservedGeneration = policy.Generation
+	status.VMReplicas = p.vm
+	status.VirtualReplicas = p.virtual
+	status.PendingReplicas = p.pending
+	status.Replicas = p.vm + p.virtual + p.pending
+	if selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector); err == nil {
+		status.Selector = selector.String()
+	}
+	status.WarmReplicas = warm
+	status.MaxReplicas = max
+	recordReplicas(policy.Namespace, policy.Name, p, warm, max)
+	c.ready.observe(policy.Namespace, policy.Name, p.running, virtualNodes)
+	if conditionTrue(status, Bursting) != (p.virtual > 0) {
+		if c.notifier != nil {
+			c.notifyBurst(policy, hpa, p, max, now, d)
+		}
+		if p.virtual > 0 {
+			c.annotate(p, "burst-start", d.Policy+" started bursting to the virtual node", d)
+		} else {
+			c.annotate(p, "burst-end", d.Policy+" stopped bursting to the virtual node", d)
+		}
+	}
+	setCondition(status, Bursting, p.virtual > 0, now, "ReplicasOnVirtualNode",
+		fmt.Sprintf("%d of %d replicas run on the virtual node", p.virtual, p.vm+p.virtual))
+	setCondition(status, AtVMCapacity, p.atCapacity(), now, "RegularNodesFull",
+		fmt.Sprintf("%d replicas burst and %d are unschedulable", p.virtual, p.unschedulable))
+	setCondition(status, CoolingDown, coolingDown, now, "CooldownActive",
+		fmt.Sprintf("the autoscaler maximum stays at %d rather than %d until the cooldown ends", max, desired))
+	status.ActiveSchedule = ""
+	if window != nil {
+		status.ActiveSchedule = window.Name
+		if status.ActiveSchedule == "" {
+			status.ActiveSchedule = window.Schedule
+		}
+	}
+	d.Schedule = status.ActiveSchedule
+	setCondition(status, Scheduled, window != nil, now, "ScheduleWindowOpen",
+		fmt.Sprintf("schedule %s sets the bounds", status.ActiveSchedule))
+	if spec.LatencySLO != nil {
+		setCondition(status, LatencyOverTarget, latencyOver, now, "LatencySLOMissed",
+			fmt.Sprintf("the request latency is %.3fs, over the target of %s; the autoscaler minimum is at least %d",
+				status.LatencySeconds, spec.LatencySLO.Target.Duration, status.LatencyReplicas))
+	}
+	setCondition(status, OverBurst, excess > 0, now, "MaxBurstPercentageExceeded",
+		fmt.Sprintf("%d replicas on the virtual node are over %d%% of the replicas", excess, spec.MaxBurstPercentage))
+	if quotaLimited && !conditionTrue(status, QuotaExceeded) {
+		c.warnQuotaExceeded(policy, *d.QuotaHeadroom, max, now, d)
+	}
+	setCondition(status, QuotaExceeded, quotaLimited, now, "ACIQuotaExceeded",
+		fmt.Sprintf("the container instance quota of the region has room for %s more replicas, so the autoscaler maximum is %d", replicas(d.QuotaHeadroom), max))
+
+	if c.opts.DryRun {
+		saved := *status
+		saved.Conditions = append([]PolicyCondition(nil), status.Conditions...)
+		c.dryRunStatus[d.Policy] = saved
+		return nil
+	}
+	return c.policies.Status().Update(context.Background(), policy)
+}
+
+// warnQuotaExceeded records a warning event on the policy, as its autoscaler
+// maximum is first held to the container instance quota.
+func (c *controller) warnQuotaExceeded(policy *VirtualNodeAutoscalePolicy, headroom, max int32, now time.Time, d *decision) {
+	message := fmt.Sprintf("The container instance quota of the region has room for %d more replicas of %s on the virtual node; "+
+		"the autoscaler maximum is held to %d rather than leave replicas Pending", headroom, d.Deployment, max)
+	d.act("warn that the container instance quota is used up")
+	c.log.Warn().Str("policy", d.Policy).Int32("headroom", headroom).Int32("max", max).Msg("the container instance quota holds the autoscaler back")
+	if c.opts.DryRun {
+		return
+	}
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: policy.Name + ".", Namespace: policy.Namespace},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      Group + "/" + Version,
+			Kind:            Kind,
+			Name:            policy.Name,
+			Namespace:       policy.Namespace,
+			UID:             policy.UID,
+			ResourceVersion: policy.ResourceVersion,
+		},
+		Type:           corev1.EventTypeWarning,
+		Reason:         "ACIQuotaExceeded",
+		Message:        message,
+		Source:         corev1.EventSource{Component: "autoscale-controller"},
+		FirstTimestamp: metav1.NewTime(now),
+		LastTimestamp:  metav1.NewTime(now),
+		Count:          1,
+	}
+	if _, err := c.k8sClient.CoreV1().Events(policy.Namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Msg("recording the quota event")
+	}
+}
+
+// notifyBurst notifies that the policy started or stopped bursting to the
+// virtual node.
+func (c *controller) notifyBurst(policy *VirtualNodeAutoscalePolicy, hpa *autoscalingv2beta1.HorizontalPodAutoscaler, p placement, max int32, now time.Time, d *decision) {
+	event := notify.Event{
+		Time:            now,
+		Policy:          d.Policy,
+		Deployment:      d.Deployment,
+		Bursting:        p.virtual > 0,
+		VMReplicas:      p.vm,
+		VirtualReplicas: p.virtual,
+		PendingReplicas: p.pending,
+		MaxReplicas:     max,
+	}
+	event.Metric, event.MetricValue, event.MetricTarget, _ = currentMetric(hpa)
+	d.act("notify that %s", event.Title())
+	if c.opts.DryRun {
+		return
+	}
+	c.notifier.Notify(event)
+}
+
+// annotate writes an annotation of kind to Grafana, if the controller
+// annotates, saying what happened, summary, and where the replicas are. The
+// annotations are tagged autoscale, their kind and the policy.
+func (c *controller) annotate(p placement, kind, summary string, d *decision) {
+	if c.annotator == nil {
+		return
+	}
+	d.act("annotate %s on grafana", kind)
+	if c.opts.DryRun {
+		return
+	}
+	c.annotator.Annotate(grafana.Annotation{
+		Time: d.Time,
+		Tags: []string{"autoscale", kind, "policy:" + d.Policy},
+		Text: fmt.Sprintf("%s; %d replicas on the regular nodes, %d on the virtual node and %d pending",
+			summary, p.vm, p.virtual, p.pending),
+	})
+}
+
+// currentMetric returns the first metric of the autoscaler it has read,
+// with its current value and target, per replica, or as a percentage of the
+// requests for a resource utilization.
+func currentMetric(hpa *autoscalingv2beta1.HorizontalPodAutoscaler) (name string, value, target float64, ok bool) {
+	for _, metric := range hpa.Spec.Metrics {
+		for _, current := range hpa.Status.CurrentMetrics {
+			switch {
+			case metric.Pods != nil && current.Pods != nil && current.Pods.MetricName == metric.Pods.MetricName:
+				return metric.Pods.MetricName, float64(current.Pods.CurrentAverageValue.MilliValue()) / 1000,
+					float64(metric.Pods.TargetAverageValue.MilliValue()) / 1000, true
+			case metric.Resource != nil && current.Resource != nil && current.Resource.Name == metric.Resource.Name &&
+				metric.Resource.TargetAverageUtilization != nil && current.Resource.CurrentAverageUtilization != nil:
+				return string(metric.Resource.Name) + " utilization", float64(*current.Resource.CurrentAverageUtilization),
+					float64(*metric.Resource.TargetAverageUtilization), true
+			}
+		}
+	}
+	return "", 0, 0, false
+}
+
+// podsMetricRate returns the total rate of the first Pods metric the
+// autoscaler scales on, over all the replicas, and its target per replica.
+func podsMetricRate(hpa *autoscalingv2beta1.HorizontalPodAutoscaler) (rate, target float64, ok bool) {
+	for _, metric := range hpa.Spec.Metrics {
+		if metric.Type != autoscalingv2beta1.PodsMetricSourceType || metric.Pods == nil {
+			continue
+		}
+		target = float64(metric.Pods.TargetAverageValue.MilliValue()) / 1000
+		if target <= 0 {
+			continue
+		}
+		for _, current := range hpa.Status.CurrentMetrics {
+			if current.Pods == nil || current.Pods.MetricName != metric.Pods.MetricName {
+				continue
+			}
+			average := float64(current.Pods.CurrentAverageValue.MilliValue()) / 1000
+			return average * float64(hpa.Status.CurrentReplicas), target, true
+		}
+	}
+	return 0, 0, false
+}
+
+// costReport is the response of /cost.
+type costReport struct {
+	Deployments   map[string]cost.Total `json:"deployments"`
+	TotalHourly   float64               `json:"totalHourly"`
+	VirtualHourly float64               `json:"virtualHourly"`
+	Total         float64               `json:"total"`
+	Virtual       float64               `json:"virtual"`
+}
+
+// serve serves the cost of the Deployments under policy on /cost; POST
+// /cost/reset starts adding it up again, as at the start of a demo run.
+// The last decisions are served on /decisions, the newest first, those about
+// one policy with ?policy=namespace/name. The metrics are served on
+// /metrics.
+func (c *controller) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cost", func(w http.ResponseWriter, r *http.Request) {
+		report := costReport{Deployments: c.costs.Totals()}
+		for _, total := range report.Deployments {
+			report.TotalHourly += total.Current.TotalHourly
+			report.VirtualHourly += total.Current.VirtualHourly
+			report.Total += total.Total
+			report.Virtual += total.Virtual
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			c.log.Warn().Err(err).Msg("writing response")
+		}
+	})
+	mux.HandleFunc("/cost/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		c.costs.Reset(time.Now())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/decisions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.decisions.list(r.URL.Query().Get("policy"))); err != nil {
+			c.log.Warn().Err(err).Msg("writing response")
+		}
+	})
+	mux.Handle("/loglevel", logging.LevelHandler(c.log))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c.log.Info().Str("addr", c.opts.ListenAddress).Msg("serving the cost estimate")
+	err := http.ListenAndServe(c.opts.ListenAddress, mux)
+	c.log.Fatal().Err(err).Msg("serving the cost estimate")
+}
+
+// conditionTrue returns whether the condition of type t is true.
+func conditionTrue(status *PolicyStatus, t PolicyConditionType) bool {
+	for _, cond := range status.Conditions {
+		if cond.Type == t {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// setCondition sets the condition of type t, keeping its transition time if
+// its status doesn't change. The reason and message only apply while the
+// condition is true.
+func setCondition(status *PolicyStatus, t PolicyConditionType, value bool, now time.Time, reason, message string) {
+	cond := PolicyCondition{Type: t, Status: corev1.ConditionFalse}
+	if value {
+		cond.Status = corev1.ConditionTrue
+		cond.Reason = reason
+		cond.Message = message
+	}
+	for i := range status.Conditions {
+		existing := &status.Conditions[i]
+		if existing.Type != t {
+			continue
+		}
+		cond.LastTransitionTime = existing.LastTransitionTime
+		if existing.Status != cond.Status {
+			cond.LastTransitionTime = metav1.NewTime(now)
+		}
+		*existing = cond
+		return
+	}
+	cond.LastTransitionTime = metav1.NewTime(now)
+	status.Conditions = append(status.Conditions, cond)
+}
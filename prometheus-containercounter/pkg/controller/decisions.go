@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decision explains a reconcile of a policy: what the controller saw, the
+// bounds that applied, and what it did, or would have done in a dry run.
+type decision struct {
+	Time       time.Time `json:"time"`
+	Policy     string    `json:"policy"`
+	Deployment string    `json:"deployment"`
+	DryRun     bool      `json:"dryRun,omitempty"`
+	// Schedule is the schedule window setting the bounds, if one is open.
+	Schedule string `json:"schedule,omitempty"`
+
+	VMReplicas      int32 `json:"vmReplicas"`
+	VirtualReplicas int32 `json:"virtualReplicas"`
+	PendingReplicas int32 `json:"pendingReplicas"`
+	// WarmReplicas are the warm replicas ready, after any promoted.
+	WarmReplicas int32 `json:"warmReplicas,omitempty"`
+
+	// The bounds of the policy, or of its schedule window.
+	MinReplicas        *int32 `json:"minReplicas,omitempty"`
+	MaxReplicas        int32  `json:"maxReplicas"`
+	MaxBurstPercentage int32  `json:"maxBurstPercentage"`
+
+	// Rate is the autoscaler's metric over all the replicas, and Target
+	// its target per replica, that the prediction is made from.
+	Rate              float64 `json:"rate,omitempty"`
+	Target            float64 `json:"target,omitempty"`
+	PredictedReplicas int32   `json:"predictedReplicas,omitempty"`
+	// Latency is the percentile of the request latency of the latency SLO,
+	// and LatencyReplicas the minimum kept for it.
+	Latency         float64 `json:"latency,omitempty"`
+	LatencyReplicas int32   `json:"latencyReplicas,omitempty"`
+
+	// CurrentMax is the autoscaler's maximum, if it exists, BurstLimit the
+	// maximum keeping to the burst percentage and the quota, and Max the one
+	// set, which stays at CurrentMax while CoolingDown.
+	CurrentMax  *int32 `json:"currentMax,omitempty"`
+	BurstLimit  int32  `json:"burstLimit"`
+	Max         int32  `json:"max"`
+	Min         *int32 `json:"min,omitempty"`
+	CoolingDown bool   `json:"coolingDown,omitempty"`
+	// QuotaHeadroom is how many more replicas the container instance quota
+	// has room for, when it was read, and QuotaLimited whether it lowered
+	// BurstLimit.
+	QuotaHeadroom *int32 `json:"quotaHeadroom,omitempty"`
+	QuotaLimited  bool   `json:"quotaLimited,omitempty"`
+	// SplitVM and SplitVirtual are the replicas given to the two
+	// Deployments of a split policy.
+	SplitVM      *int32 `json:"splitVM,omitempty"`
+	SplitVirtual *int32 `json:"splitVirtual,omitempty"`
+	// VirtualTraffic is the percentage of the requests of the Ingress of a
+	// policy shifting its traffic sent to the virtual node.
+	VirtualTraffic *int32 `json:"virtualTraffic,omitempty"`
+	// OverBurst is how many replicas on the virtual node are over the
+	// burst percentage.
+	OverBurst int32 `json:"overBurst,omitempty"`
+
+	// Actions are the changes made to the cluster, or that would have been.
+	Actions []string `json:"actions"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func (d *decision) act(format string, args ...interface{}) {
+	d.Actions = append(d.Actions, fmt.Sprintf(format, args...))
+}
+
+func (d *decision) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "policy %s: vm %d, virtual %d, pending %d", d.Policy, d.VMReplicas, d.VirtualReplicas, d.PendingReplicas)
+	if d.WarmReplicas > 0 {
+		fmt.Fprintf(&b, ", warm %d", d.WarmReplicas)
+	}
+	fmt.Fprintf(&b, "; bounds min %s, max %d, burst %d%%", replicas(d.MinReplicas), d.MaxReplicas, d.MaxBurstPercentage)
+	if d.Schedule != "" {
+		fmt.Fprintf(&b, " from schedule %s", d.Schedule)
+	}
+	if d.PredictedReplicas > 0 {
+		fmt.Fprintf(&b, "; predicted %d replicas from %.2f at %.2f per replica", d.PredictedReplicas, d.Rate, d.Target)
+	}
+	if d.Latency > 0 || d.LatencyReplicas > 0 {
+		fmt.Fprintf(&b, "; latency %.3fs, keeping %d replicas for it", d.Latency, d.LatencyReplicas)
+	}
+	if d.QuotaHeadroom != nil {
+		fmt.Fprintf(&b, "; quota room for %d more", *d.QuotaHeadroom)
+		if d.QuotaLimited {
+			b.WriteString(" (holding the limit)")
+		}
+	}
+	fmt.Fprintf(&b, "; burst limit %d, autoscaler max %s -> %d, min %s", d.BurstLimit, replicas(d.CurrentMax), d.Max, replicas(d.Min))
+	if d.CoolingDown {
+		b.WriteString(" (cooling down)")
+	}
+	if d.SplitVM != nil && d.SplitVirtual != nil {
+		fmt.Fprintf(&b, "; split %d on vm, %d on virtual", *d.SplitVM, *d.SplitVirtual)
+	}
+	if d.VirtualTraffic != nil {
+		fmt.Fprintf(&b, "; %d%% of the requests to virtual", *d.VirtualTraffic)
+	}
+	if d.OverBurst > 0 {
+		fmt.Fprintf(&b, "; %d over the burst percentage", d.OverBurst)
+	}
+	switch {
+	case d.Error != "":
+		fmt.Fprintf(&b, "; failed: %s", d.Error)
+	case len(d.Actions) == 0:
+		b.WriteString("; nothing to do")
+	case d.DryRun:
+		fmt.Fprintf(&b, "; would %s", strings.Join(d.Actions, ", "))
+	default:
+		fmt.Fprintf(&b, "; %s", strings.Join(d.Actions, ", "))
+	}
+	return b.String()
+}
+
+// replicas formats an optional count of replicas.
+func replicas(n *int32) string {
+	if n == nil {
+		return "none"
+	}
+	return fmt.Sprint(*n)
+}
+
+// decisionLog keeps the last decisions, for /decisions.
+type decisionLog struct {
+	mu        sync.Mutex
+	size      int
+	decisions []decision
+}
+
+func newDecisionLog(size int) *decisionLog {
+	return &decisionLog{size: size}
+}
+
+func (l *decisionLog) add(d decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions = append(l.decisions, d)
+	if len(l.decisions) > l.size {
+		l.decisions = l.decisions[len(l.decisions)-l.size:]
+	}
+}
+
+// list returns the decisions about policy, namespace/name, or about all the
+// policies if it is empty, the newest first.
+func (l *decisionLog) list(policy string) []decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []decision{}
+	for i := len(l.decisions) - 1; i >= 0; i-- {
+		if policy == "" || l.decisions[i].Policy == policy {
+			list = append(list, l.decisions[i])
+		}
+	}
+	return list
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// The policies are runtime.Objects, for the controller-runtime client to
+// read and write them.
+
+// DeepCopyInto copies the policy into out.
+func (in *VirtualNodeAutoscalePolicy) DeepCopyInto(out *VirtualNodeAutoscalePolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy returns a copy of the policy.
+func (in *VirtualNodeAutoscalePolicy) DeepCopy() *VirtualNodeAutoscalePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualNodeAutoscalePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a copy of the policy.
+func (in *VirtualNodeAutoscalePolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the list into out.
+func (in *VirtualNodeAutoscalePolicyList) DeepCopyInto(out *VirtualNodeAutoscalePolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]VirtualNodeAutoscalePolicy, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a copy of the list.
+func (in *VirtualNodeAutoscalePolicyList) DeepCopy() *VirtualNodeAutoscalePolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualNodeAutoscalePolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a copy of the list.
+func (in *VirtualNodeAutoscalePolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the spec into out.
+func (in *PolicySpec) DeepCopyInto(out *PolicySpec) {
+	*out = *in
+	out.MinReplicas = copyInt32(in.MinReplicas)
+	if in.Metrics != nil {
+		out.Metrics = make([]autoscalingv2beta1.MetricSpec, len(in.Metrics))
+		for i := range in.Metrics {
+			in.Metrics[i].DeepCopyInto(&out.Metrics[i])
+		}
+	}
+	out.Replicas = copyInt32(in.Replicas)
+	if in.Traffic != nil {
+		traffic := *in.Traffic
+		traffic.VirtualReplicaWeight = copyInt32(in.Traffic.VirtualReplicaWeight)
+		out.Traffic = &traffic
+	}
+	if in.LatencySLO != nil {
+		slo := *in.LatencySLO
+		out.LatencySLO = &slo
+	}
+	if in.Schedules != nil {
+		out.Schedules = make([]ScheduleWindow, len(in.Schedules))
+		for i, w := range in.Schedules {
+			w.MinReplicas = copyInt32(w.MinReplicas)
+			w.MaxReplicas = copyInt32(w.MaxReplicas)
+			w.MaxBurstPercentage = copyInt32(w.MaxBurstPercentage)
+			out.Schedules[i] = w
+		}
+	}
+}
+
+// DeepCopyInto copies the status into out.
+func (in *PolicyStatus) DeepCopyInto(out *PolicyStatus) {
+	*out = *in
+	if in.LastShiftTime != nil {
+		out.LastShiftTime = in.LastShiftTime.DeepCopy()
+	}
+	if in.LastScaleTime != nil {
+		out.LastScaleTime = in.LastScaleTime.DeepCopy()
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]PolicyCondition, len(in.Conditions))
+		copy(out.Conditions, in.Conditions)
+	}
+}
+
+func copyInt32(p *int32) *int32 {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// histogram is the cumulative count of a histogram's observations, by the
+// upper bound of its buckets; count is that of the +Inf bucket.
+type histogram struct {
+	buckets map[float64]float64
+	count   float64
+}
+
+// sub returns the observations of h made since prev.
+func (h histogram) sub(prev histogram) histogram {
+	diff := histogram{buckets: make(map[float64]float64, len(h.buckets)), count: h.count - prev.count}
+	for bound, n := range h.buckets {
+		diff.buckets[bound] = n - prev.buckets[bound]
+	}
+	return diff
+}
+
+// add adds the observations of other to h.
+func (h *histogram) add(other histogram) {
+	for bound, n := range other.buckets {
+		h.buckets[bound] += n
+	}
+	h.count += other.count
+}
+
+// quantile estimates the q quantile, between 0 and 1, interpolating linearly
+// within the bucket it falls in, as Prometheus' histogram_quantile does. It
+// returns false without observations.
+func (h histogram) quantile(q float64) (float64, bool) {
+	if h.count <= 0 {
+		return 0, false
+	}
+	bounds := make([]float64, 0, len(h.buckets))
+	for bound := range h.buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+
+	rank := q * h.count
+	lower, below := 0.0, 0.0
+	for _, bound := range bounds {
+		n := h.buckets[bound]
+		if n >= rank {
+			if n == below {
+				return bound, true
+			}
+			return lower + (bound-lower)*(rank-below)/(n-below), true
+		}
+		lower, below = bound, n
+	}
+	// In the +Inf bucket: the highest bound is all that is known.
+	return lower, true
+}
+
+// latencyTracker scrapes the latency histograms of the replicas, and keeps
+// the last one of each to tell the observations made since.
+type latencyTracker struct {
+	http *http.Client
+
+	mu   sync.Mutex
+	last map[string]histogram
+	// since is when the latency went over, or under, the tolerance, by
+	// policy, and over whether it is over.
+	since map[string]time.Time
+	over  map[string]bool
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		http:  &http.Client{Timeout: 5 * time.Second},
+		last:  make(map[string]histogram),
+		since: make(map[string]time.Time),
+		over:  make(map[string]bool),
+	}
+}
+
+// percentile returns the percentile of the latency of the requests the pods
+// served since the last call, or false if they served none.
+func (t *latencyTracker) percentile(pods []corev1.Pod, slo *LatencySLO) (float64, bool) {
+	name := slo.Histogram
+	if name == "" {
+		name = "http_request_duration_seconds"
+	}
+	port := slo.MetricsPort
+	if port == 0 {
+		port = 8080
+	}
+	path := slo.MetricsPath
+	if path == "" {
+		path = "/metrics"
+	}
+	percentile := slo.Percentile
+	if percentile <= 0 || percentile >= 100 {
+		percentile = 95
+	}
+
+	scraped := make([]*histogram, len(pods))
+	var wg sync.WaitGroup
+	for i := range pods {
+		if pods[i].Status.PodIP == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("http://%s:%d%s", pods[i].Status.PodIP, port, path)
+			if h, err := t.scrape(url, name); err == nil {
+				scraped[i] = &h
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := histogram{buckets: make(map[float64]float64)}
+	seen := make(map[string]bool, len(pods))
+	for i, h := range scraped {
+		if h == nil {
+			continue
+		}
+		key := pods[i].Namespace + "/" + pods[i].Name
+		seen[key] = true
+		prev, ok := t.last[key]
+		t.last[key] = *h
+		// A new replica, or one whose process restarted, has no
+		// observations to tell yet.
+		if !ok || h.count < prev.count {
+			continue
+		}
+		total.add(h.sub(prev))
+	}
+	for key := range t.last {
+		if !seen[key] {
+			delete(t.last, key)
+		}
+	}
+	return total.quantile(percentile / 100)
+}
+
+// scrape reads the histogram name from url, summed over its labels.
+func (t *latencyTracker) scrape(url, name string) (histogram, error) {
+	h := histogram{buckets: make(map[float64]float64)}
+	resp, err := t.http.Get(url)
+	if err != nil {
+		return h, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return h, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return h, err
+	}
+	family, ok := families[name]
+	if !ok {
+		return h, fmt.Errorf("no histogram %q at %s", name, url)
+	}
+	for _, m := range family.GetMetric() {
+		if m.Histogram == nil {
+			continue
+		}
+		for _, b := range m.Histogram.GetBucket() {
+			if !math.IsInf(b.GetUpperBound(), 1) {
+				h.buckets[b.GetUpperBound()] += float64(b.GetCumulativeCount())
+			}
+		}
+		h.count += float64(m.Histogram.GetSampleCount())
+	}
+	return h, nil
+}
+
+// latencyFloor returns the minimum of replicas kept for the latency SLO,
+// from the one before, floor, and the current replicas. The minimum is raised
+// above the current replicas once the latency has stayed over the tolerance
+// above the target for the scale up window, in proportion to how far over it
+// is, and lowered by one once it has stayed under the tolerance below for the
+// scale down window; each change starts the window again. It returns whether
+// the latency is over the tolerance.
+func (t *latencyTracker) latencyFloor(key string, slo *LatencySLO, latency float64, floor, current int32, now time.Time) (int32, bool) {
+	tolerance := slo.Tolerance
+	if tolerance <= 0 {
+		tolerance = 10
+	}
+	upWindow := slo.ScaleUpWindow.Duration
+	if upWindow <= 0 {
+		upWindow = 30 * time.Second
+	}
+	downWindow := slo.ScaleDownWindow.Duration
+	if downWindow <= 0 {
+		downWindow = 3 * time.Minute
+	}
+	target := slo.Target.Seconds()
+	over := latency > target*(1+float64(tolerance)/100)
+	under := latency < target*(1-float64(tolerance)/100)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !over && !under {
+		delete(t.since, key)
+		return floor, false
+	}
+	since, ok := t.since[key]
+	if !ok || t.over[key] != over {
+		t.since[key], t.over[key] = now, over
+		return floor, over
+	}
+
+	switch {
+	case over && now.Sub(since) >= upWindow:
+		// As many more replicas than the current ones as the latency is
+		// over the target, up to twice as many, and not more while they
+		// start.
+		step := int32(math.Ceil(float64(current) * (latency/target - 1)))
+		if step < 1 {
+			step = 1
+		}
+		if step > current && current > 0 {
+			step = current
+		}
+		if current+step > floor {
+			floor = current + step
+		}
+		t.since[key] = now
+	case under && now.Sub(since) >= downWindow && floor > 0:
+		floor--
+		t.since[key] = now
+	}
+	return floor, over
+}
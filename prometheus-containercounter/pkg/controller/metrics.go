@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+	prometheus.MustRegister(overBurstCounter)
+	prometheus.MustRegister(warmPromotionsCounter)
+	prometheus.MustRegister(scaleDecisionsCounter)
+	prometheus.MustRegister(replicasGauge)
+	prometheus.MustRegister(maxReplicasGauge)
+	prometheus.MustRegister(reconcileHistogram)
+	prometheus.MustRegister(reconcileErrorsCounter)
+	prometheus.MustRegister(readyHistogram)
+	prometheus.MustRegister(virtualTrafficGauge)
+}
+
+var leaderGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "autoscale_controller_leader",
+		Help: "Whether the replica, by identity, is the leader reconciling the policies",
+	},
+	[]string{"identity"},
+)
+
+var overBurstCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "autoscale_controller_burst_removals_total",
+		Help: "Replicas on the virtual node marked to be removed first, to keep to the maximum burst percentage, by policy",
+	},
+	[]string{"namespace", "policy"},
+)
+
+var warmPromotionsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "autoscale_controller_warm_promotions_total",
+		Help: "Warm replicas on the virtual node promoted in place of pending ones, by policy",
+	},
+	[]string{"namespace", "policy"},
+)
+
+var scaleDecisionsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "autoscale_controller_scale_decisions_total",
+		Help: "Changes of the autoscaler bounds, by policy and direction, up or down",
+	},
+	[]string{"namespace", "policy", "direction"},
+)
+
+var replicasGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "autoscale_controller_replicas",
+		Help: "Replicas of the Deployment of a policy, by node type: vm, virtual, pending or warm",
+	},
+	[]string{"namespace", "policy", "node_type"},
+)
+
+var maxReplicasGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "autoscale_controller_max_replicas",
+		Help: "Maximum of the autoscaler of a policy, as the controller set it",
+	},
+	[]string{"namespace", "policy"},
+)
+
+var reconcileHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "autoscale_controller_reconcile_duration_seconds",
+		Help:    "Time to reconcile a policy, in Seconds, by policy",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"namespace", "policy"},
+)
+
+var reconcileErrorsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "autoscale_controller_reconcile_errors_total",
+		Help: "Reconciles of a policy that failed, by policy",
+	},
+	[]string{"namespace", "policy"},
+)
+
+var readyHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "autoscale_controller_decision_to_ready_seconds",
+		Help:    "Time from a scale up decision to the replicas it brought being ready, in Seconds, by policy and node type",
+		Buckets: []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+	},
+	[]string{"namespace", "policy", "node_type"},
+)
+
+var virtualTrafficGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "autoscale_controller_virtual_traffic_percent",
+		Help: "Percentage of the requests of the Ingress of a policy shifting its traffic sent to the virtual node, by policy",
+	},
+	[]string{"namespace", "policy"},
+)
+
+// readyWindow is how long after a scale up decision the replicas created are
+// taken to be brought by it.
+const readyWindow = 10 * time.Minute
+
+// scaleDirection returns whether the autoscaler bounds from current to want
+// scale up or down, or "" if neither. Raising either bound scales up.
+func scaleDirection(current, want *autoscalingv2beta1.HorizontalPodAutoscalerSpec) string {
+	currentMin, wantMin := int32(1), int32(1)
+	if current.MinReplicas != nil {
+		currentMin = *current.MinReplicas
+	}
+	if want.MinReplicas != nil {
+		wantMin = *want.MinReplicas
+	}
+	switch {
+	case want.MaxReplicas > current.MaxReplicas || wantMin > currentMin:
+		return "up"
+	case want.MaxReplicas < current.MaxReplicas || wantMin < currentMin:
+		return "down"
+	}
+	return ""
+}
+
+// readyTracker times the replicas created after a scale up decision, from
+// the decision to their being ready.
+type readyTracker struct {
+	mu sync.Mutex
+	// scaledUp is the time of the last scale up decision, by policy, and
+	// timed the replicas timed since, by policy.
+	scaledUp map[string]time.Time
+	timed    map[string]map[types.UID]bool
+}
+
+func newReadyTracker() *readyTracker {
+	return &readyTracker{
+		scaledUp: make(map[string]time.Time),
+		timed:    make(map[string]map[types.UID]bool),
+	}
+}
+
+// scaleUp records a scale up decision of the policy key.
+func (t *readyTracker) scaleUp(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scaledUp[key] = now
+}
+
+// observe times the running pods of the policy key that were created after
+// its last scale up decision, and are ready, once each.
+func (t *readyTracker) observe(namespace, name string, running []corev1.Pod, virtualNodes map[string]bool) {
+	key := namespace + "/" + name
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	decided, ok := t.scaledUp[key]
+	if !ok {
+		return
+	}
+	timed := t.timed[key]
+	current := make(map[types.UID]bool, len(timed))
+	for i := range running {
+		pod := &running[i]
+		created := pod.CreationTimestamp.Time
+		if created.Before(decided) || created.Sub(decided) > readyWindow {
+			continue
+		}
+		if timed[pod.UID] {
+			current[pod.UID] = true
+			continue
+		}
+		readyAt, ok := readyTime(pod)
+		if !ok {
+			continue
+		}
+		nodeType := nodeTypeVM
+		if virtualNodes[pod.Spec.NodeName] {
+			nodeType = nodeTypeVirtual
+		}
+		readyHistogram.WithLabelValues(namespace, name, nodeType).Observe(readyAt.Sub(decided).Seconds())
+		current[pod.UID] = true
+	}
+	// Only the pods still running are kept, for the map not to grow.
+	t.timed[key] = current
+}
+
+// forget drops what is tracked of the policy key.
+func (t *readyTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.scaledUp, key)
+	delete(t.timed, key)
+}
+
+// readyTime returns when pod last turned ready, or false if it isn't.
+func readyTime(pod *corev1.Pod) (time.Time, bool) {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.LastTransitionTime.Time, c.Status == corev1.ConditionTrue
+		}
+	}
+	return time.Time{}, false
+}
+
+// recordReplicas exports the replicas of a policy by node type, and the
+// maximum of its autoscaler.
+func recordReplicas(namespace, name string, p placement, warm, max int32) {
+	replicasGauge.WithLabelValues(namespace, name, nodeTypeVM).Set(float64(p.vm))
+	replicasGauge.WithLabelValues(namespace, name, nodeTypeVirtual).Set(float64(p.virtual))
+	replicasGauge.WithLabelValues(namespace, name, "pending").Set(float64(p.pending))
+	replicasGauge.WithLabelValues(namespace, name, "warm").Set(float64(warm))
+	maxReplicasGauge.WithLabelValues(namespace, name).Set(float64(max))
+}
+
+// forgetPolicyMetrics drops the series of a policy that was deleted.
+func forgetPolicyMetrics(namespace, name string) {
+	for _, nodeType := range []string{nodeTypeVM, nodeTypeVirtual, "pending", "warm"} {
+		replicasGauge.DeleteLabelValues(namespace, name, nodeType)
+	}
+	maxReplicasGauge.DeleteLabelValues(namespace, name)
+	virtualTrafficGauge.DeleteLabelValues(namespace, name)
+}
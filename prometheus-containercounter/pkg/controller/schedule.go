@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/rs/zerolog"
+)
+
+// activeWindow returns the first schedule window of the policy open at now,
+// or nil if none is. Windows with a bad schedule are skipped, and logged to
+// logger.
+func activeWindow(policy *VirtualNodeAutoscalePolicy, now time.Time, logger *zerolog.Logger) *ScheduleWindow {
+	for i := range policy.Spec.Schedules {
+		window := &policy.Spec.Schedules[i]
+		schedule, err := cron.ParseStandard(window.Schedule)
+		if err != nil {
+			logger.Warn().Err(err).Str("policy", policy.Namespace+"/"+policy.Name).Str("schedule", window.Schedule).
+				Msg("skipping the schedule")
+			continue
+		}
+		// The window is open if it started within its duration before now.
+		if !schedule.Next(now.Add(-window.Duration.Duration)).After(now) {
+			return window
+		}
+	}
+	return nil
+}
+
+// scheduledSpec returns the spec of the policy with the bounds of window, if
+// any, in place of its own.
+func scheduledSpec(spec *PolicySpec, window *ScheduleWindow) *PolicySpec {
+	if window == nil {
+		return spec
+	}
+	scheduled := *spec
+	if window.MinReplicas != nil {
+		scheduled.MinReplicas = window.MinReplicas
+	}
+	if window.MaxReplicas != nil {
+		scheduled.MaxReplicas = *window.MaxReplicas
+	}
+	if window.MaxBurstPercentage != nil {
+		scheduled.MaxBurstPercentage = *window.MaxBurstPercentage
+	}
+	if scheduled.MinReplicas != nil && *scheduled.MinReplicas > scheduled.MaxReplicas {
+		max := scheduled.MaxReplicas
+		scheduled.MinReplicas = &max
+	}
+	return &scheduled
+}
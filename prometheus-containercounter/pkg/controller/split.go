@@ -0,0 +1,319 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// nodeTypeLabel tells the replicas of the two Deployments of a split
+	// policy apart, in their selectors.
+	nodeTypeLabel = Group + "/node-type"
+	// sourceTemplateAnnotation is the hash of the template a split
+	// Deployment was copied from.
+	sourceTemplateAnnotation = Group + "/source-template"
+
+	nodeTypeVM      = "vm"
+	nodeTypeVirtual = "virtual"
+
+	// defaultShiftBackAfter is the least time between two replicas moved
+	// back to the regular nodes, without a scale down cooldown.
+	defaultShiftBackAfter = time.Minute
+)
+
+// splitReplicas divides total replicas between the regular nodes and the
+// virtual node. Replicas of the VM Deployment the scheduler found no node
+// for move to the virtual one; while none are, one replica moves back per
+// shift period, the scale down cooldown or a minute; a scale down takes
+// replicas off the virtual node first; and no more than the burst
+// percentage of total run there. vmScheduled and vmPending count the
+// replicas of the VM Deployment scheduled, or about to be, and
+// unschedulable, and virtual the replicas of the virtual one. It returns the
+// replicas of each, and whether one moved back.
+func splitReplicas(spec *PolicySpec, total, vmScheduled, vmPending, virtual int32, shiftBack bool) (int32, int32, bool) {
+	virtual += vmPending
+	shifted := false
+	if vmPending == 0 && virtual > 0 && shiftBack {
+		virtual--
+		shifted = true
+	}
+	if room := total - vmScheduled; virtual > room {
+		virtual = room
+	}
+	burst := spec.MaxBurstPercentage
+	if burst < 0 {
+		burst = 0
+	}
+	if allowed := total * burst / 100; virtual > allowed {
+		virtual = allowed
+	}
+	if virtual < 0 {
+		virtual = 0
+	}
+	return total - virtual, virtual, shifted
+}
+
+// split runs the replicas of a split policy in two Deployments copied from
+// the policy's: one kept off the virtual node, and one on it. Both have the
+// labels of the template, so the Services selecting them front both, with a
+// node type label added to their selectors so they don't adopt each other's
+// replicas. The autoscaler scales the policy, through its scale subresource,
+// and split divides its replicas. The policy's Deployment is scaled to zero
+// once the two have as many replicas available.
+func (c *controller) split(policy *VirtualNodeAutoscalePolicy, source *appsv1.Deployment, spec *PolicySpec, now time.Time, d *decision) error {
+	deployments := c.k8sClient.AppsV1().Deployments(policy.Namespace)
+	vmName, virtualName := source.Name+"-"+nodeTypeVM, source.Name+"-"+nodeTypeVirtual
+	vmDeployment, err := c.splitDeployment(policy.Namespace, vmName)
+	if err != nil {
+		return err
+	}
+	virtualDeployment, err := c.splitDeployment(policy.Namespace, virtualName)
+	if err != nil {
+		return err
+	}
+
+	vmScheduled, vmPending, err := c.splitPods(source, nodeTypeVM)
+	if err != nil {
+		return err
+	}
+	var total int32
+	switch {
+	case policy.Spec.Replicas != nil:
+		total = *policy.Spec.Replicas
+	default:
+		// Until the autoscaler scales the policy, keep the replicas there
+		// are.
+		total = replicasOf(source) + replicasOf(vmDeployment) + replicasOf(virtualDeployment)
+		if total == 0 && spec.MinReplicas != nil {
+			total = *spec.MinReplicas
+		}
+	}
+
+	status := &policy.Status
+	shiftAfter := spec.ScaleDownCooldown.Duration
+	if shiftAfter <= 0 {
+		shiftAfter = defaultShiftBackAfter
+	}
+	shiftBack := status.LastShiftTime == nil || now.Sub(status.LastShiftTime.Time) >= shiftAfter
+	vm, virtual, shifted := splitReplicas(spec, total, vmScheduled, vmPending, replicasOf(virtualDeployment), shiftBack)
+	if shifted || vmPending > 0 {
+		t := metav1.NewTime(now)
+		status.LastShiftTime = &t
+	}
+	d.SplitVM, d.SplitVirtual = &vm, &virtual
+
+	if err := c.applySplit(policy, source, vmDeployment, vmName, nodeTypeVM, vm, d); err != nil {
+		return err
+	}
+	if err := c.applySplit(policy, source, virtualDeployment, virtualName, nodeTypeVirtual, virtual, d); err != nil {
+		return err
+	}
+
+	// The policy's Deployment is only the template of the two once they
+	// took over its replicas.
+	if replicasOf(source) > 0 && vmDeployment != nil && virtualDeployment != nil &&
+		vmDeployment.Status.AvailableReplicas+virtualDeployment.Status.AvailableReplicas >= replicasOf(source) {
+		d.act("scale %s to 0, its replicas run in %s and %s", source.Name, vmName, virtualName)
+		if !c.opts.DryRun {
+			zero := int32(0)
+			source.Spec.Replicas = &zero
+			if _, err := deployments.Update(context.Background(), source, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitDeployment returns the split Deployment name, or nil if it doesn't
+// exist yet.
+func (c *controller) splitDeployment(namespace, name string) (*appsv1.Deployment, error) {
+	deployment, err := c.k8sClient.AppsV1().Deployments(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return deployment, err
+}
+
+// splitPods counts the replicas of the split Deployment of nodeType the
+// scheduler found no node for, as pending, and the others as scheduled.
+func (c *controller) splitPods(source *appsv1.Deployment, nodeType string) (scheduled, pending int32, err error) {
+	selector := splitSelector(source.Spec.Selector, nodeType)
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return 0, 0, err
+	}
+	pods, err := c.k8sClient.CoreV1().Pods(source.Namespace).List(context.Background(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, pod := range pods.Items {
+		switch {
+		case pod.DeletionTimestamp != nil:
+		case pod.Spec.NodeName == "" && pod.Status.Phase == corev1.PodPending && unschedulable(&pod):
+			pending++
+		case pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning:
+			scheduled++
+		}
+	}
+	return scheduled, pending, nil
+}
+
+// applySplit creates or updates the split Deployment of nodeType, existing
+// if not nil, to replicas and the template of source.
+func (c *controller) applySplit(policy *VirtualNodeAutoscalePolicy, source, existing *appsv1.Deployment, name, nodeType string, replicas int32, d *decision) error {
+	deployments := c.k8sClient.AppsV1().Deployments(policy.Namespace)
+	hash, err := templateHash(&source.Spec.Template)
+	if err != nil {
+		return err
+	}
+	if existing != nil && replicasOf(existing) == replicas && existing.Annotations[sourceTemplateAnnotation] == hash {
+		return nil
+	}
+
+	deployment := existing
+	if deployment == nil {
+		deployment = &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: policy.Namespace,
+				Labels:    source.Labels,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: Group + "/" + Version,
+					Kind:       Kind,
+					Name:       policy.Name,
+					UID:        policy.UID,
+					Controller: &controllerRef,
+				}},
+			},
+		}
+	}
+	if deployment.Annotations == nil {
+		deployment.Annotations = map[string]string{}
+	}
+	if deployment.Annotations[sourceTemplateAnnotation] != hash {
+		deployment.Annotations[sourceTemplateAnnotation] = hash
+		// The selector of a Deployment can't change, so only the
+		// template and the strategy are copied again.
+		if existing == nil {
+			deployment.Spec = *source.Spec.DeepCopy()
+			deployment.Spec.Selector = splitSelector(source.Spec.Selector, nodeType)
+		}
+		deployment.Spec.Strategy = source.Spec.Strategy
+		deployment.Spec.Template = c.splitTemplate(&source.Spec.Template, nodeType)
+	}
+	deployment.Spec.Replicas = &replicas
+
+	if existing == nil {
+		d.act("create %s with %d replicas", name, replicas)
+		if c.opts.DryRun {
+			return nil
+		}
+		_, err = deployments.Create(context.Background(), deployment, metav1.CreateOptions{})
+		return err
+	}
+	if replicasOf(existing) != replicas {
+		d.act("scale %s from %d to %d", name, replicasOf(existing), replicas)
+	} else {
+		d.act("update the template of %s", name)
+	}
+	if c.opts.DryRun {
+		return nil
+	}
+	_, err = deployments.Update(context.Background(), deployment, metav1.UpdateOptions{})
+	return err
+}
+
+// templateHash returns a hash of template.
+func templateHash(template *corev1.PodTemplateSpec) (string, error) {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New32a()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum32()), nil
+}
+
+// controllerRef marks the policy as the controller of its split Deployments.
+var controllerRef = true
+
+// splitSelector returns selector with the node type label added.
+func splitSelector(selector *metav1.LabelSelector, nodeType string) *metav1.LabelSelector {
+	split := selector.DeepCopy()
+	if split.MatchLabels == nil {
+		split.MatchLabels = map[string]string{}
+	}
+	split.MatchLabels[nodeTypeLabel] = nodeType
+	return split
+}
+
+// splitTemplate returns template labeled with the node type, and kept off
+// the virtual node, or pinned to it.
+func (c *controller) splitTemplate(template *corev1.PodTemplateSpec, nodeType string) corev1.PodTemplateSpec {
+	split := *template.DeepCopy()
+	labels := map[string]string{nodeTypeLabel: nodeType}
+	for k, v := range split.Labels {
+		labels[k] = v
+	}
+	split.Labels = labels
+
+	if nodeType == nodeTypeVirtual {
+		nodeSelector := map[string]string{c.opts.NodeLabel: c.opts.NodeLabelValue}
+		for k, v := range split.Spec.NodeSelector {
+			nodeSelector[k] = v
+		}
+		split.Spec.NodeSelector = nodeSelector
+		for _, t := range split.Spec.Tolerations {
+			if t.Key == virtualNodeToleration.Key {
+				return split
+			}
+		}
+		split.Spec.Tolerations = append(split.Spec.Tolerations, virtualNodeToleration)
+		return split
+	}
+
+	notVirtual := corev1.NodeSelectorRequirement{
+		Key:      c.opts.NodeLabel,
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{c.opts.NodeLabelValue},
+	}
+	if split.Spec.Affinity == nil {
+		split.Spec.Affinity = &corev1.Affinity{}
+	}
+	if split.Spec.Affinity.NodeAffinity == nil {
+		split.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := split.Spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil ||
+		len(nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0 {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{}},
+		}
+	}
+	// The terms are ORed, so each keeps off the virtual node.
+	terms := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for i := range terms {
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, notVirtual)
+	}
+	return split
+}
+
+// replicasOf returns the replicas of a Deployment, 0 if it is nil.
+func replicasOf(deployment *appsv1.Deployment) int32 {
+	if deployment == nil {
+		return 0
+	}
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return *deployment.Spec.Replicas
+}
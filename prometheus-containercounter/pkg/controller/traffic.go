@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// canaryAnnotation makes an Ingress of the NGINX ingress controller a
+	// canary of the Ingress with the same hosts and paths, taking
+	// canaryWeightAnnotation percent of its requests.
+	canaryAnnotation       = "nginx.ingress.kubernetes.io/canary"
+	canaryWeightAnnotation = "nginx.ingress.kubernetes.io/canary-weight"
+
+	// defaultVirtualReplicaWeight is the weight of a replica on the virtual
+	// node, in percent of a replica on the regular nodes, unless the policy
+	// says otherwise.
+	defaultVirtualReplicaWeight = 50
+)
+
+// trafficWeight returns the weight, in percent, of the canary sending the
+// requests to the ready replicas on the regular nodes only, for a replica
+// on the virtual node to get weight percent of the requests of one on the
+// regular nodes. The rest of the requests go to the Service of all the
+// replicas, and are spread evenly. vmService counts the ready replicas of
+// the VM Deployment, and vm and virtual all the ready replicas on the
+// regular nodes and on the virtual node. It also returns the percentage of
+// the requests the virtual node gets.
+func trafficWeight(weight, vmService, vm, virtual int32) (canary, virtualPercent int32) {
+	ready := vm + virtual
+	switch {
+	case ready == 0:
+		return 0, 0
+	case vmService == 0:
+		// Nothing would answer the canary's requests.
+		return 0, virtual * 100 / ready
+	case virtual == 0:
+		return 100, 0
+	}
+	if weight < 0 {
+		weight = 0
+	}
+	if weight > 100 {
+		weight = 100
+	}
+	// The virtual node gets s = virtual*r / (vm + virtual*r) of the
+	// requests, and virtual/ready of those of the Service, so the canary
+	// takes 1 - s*ready/virtual of them.
+	r := float64(weight) / 100
+	share := 1 - r*float64(ready)/(float64(vm)+float64(virtual)*r)
+	canary = int32(math.Floor(share*100 + 0.5))
+	return canary, (100 - canary) * virtual / ready
+}
+
+// shiftTraffic weights the requests of the Ingress of a split policy toward
+// its replicas on the regular nodes, so that the virtual node, with its
+// higher network latency, mostly takes the overflow. It keeps a copy of the
+// Service selecting the replicas of the VM Deployment only, <service>-vm,
+// and a copy of the Ingress sending part of the requests there,
+// <ingress>-vm, as a canary of the NGINX ingress controller. The Service
+// and Ingress of the Deployment stay as they are.
+func (c *controller) shiftTraffic(policy *VirtualNodeAutoscalePolicy, traffic *TrafficSpec, p placement, virtualNodes map[string]bool, d *decision) error {
+	serviceName := traffic.Service
+	if serviceName == "" {
+		serviceName = policy.Spec.Deployment
+	}
+	service, err := c.k8sClient.CoreV1().Services(policy.Namespace).Get(context.Background(), serviceName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	ingress, err := c.k8sClient.ExtensionsV1beta1().Ingresses(policy.Namespace).Get(context.Background(), traffic.Ingress, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var vmService, vm, virtual int32
+	for i := range p.running {
+		pod := &p.running[i]
+		if _, ok := readyTime(pod); !ok {
+			continue
+		}
+		switch {
+		case virtualNodes[pod.Spec.NodeName]:
+			virtual++
+		case pod.Labels[nodeTypeLabel] == nodeTypeVM:
+			vmService++
+			vm++
+		default:
+			vm++
+		}
+	}
+	weight := int32(defaultVirtualReplicaWeight)
+	if traffic.VirtualReplicaWeight != nil {
+		weight = *traffic.VirtualReplicaWeight
+	}
+	canary, virtualPercent := trafficWeight(weight, vmService, vm, virtual)
+	d.VirtualTraffic = &virtualPercent
+	policy.Status.VirtualTrafficPercent = virtualPercent
+	virtualTrafficGauge.WithLabelValues(policy.Namespace, policy.Name).Set(float64(virtualPercent))
+
+	vmServiceName := service.Name + "-" + nodeTypeVM
+	if err := c.applyTrafficService(policy, service, vmServiceName, d); err != nil {
+		return err
+	}
+	return c.applyTrafficIngress(policy, ingress, service.Name, vmServiceName, canary, d)
+}
+
+// applyTrafficService creates or updates name, a copy of service selecting
+// the replicas of the VM Deployment only.
+func (c *controller) applyTrafficService(policy *VirtualNodeAutoscalePolicy, service *corev1.Service, name string, d *decision) error {
+	services := c.k8sClient.CoreV1().Services(policy.Namespace)
+	selector := map[string]string{nodeTypeLabel: nodeTypeVM}
+	for k, v := range service.Spec.Selector {
+		selector[k] = v
+	}
+	ports := make([]corev1.ServicePort, len(service.Spec.Ports))
+	for i, port := range service.Spec.Ports {
+		port.NodePort = 0
+		ports[i] = port
+	}
+
+	existing, err := services.Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		d.act("create %s for the replicas of %s on the regular nodes", name, service.Name)
+		if c.opts.DryRun {
+			return nil
+		}
+		_, err = services.Create(context.Background(), &corev1.Service{
+			// The labels of the Service aren't copied, for the
+			// ServiceMonitors selecting it not to scrape the replicas twice.
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: policy.Namespace,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: Group + "/" + Version,
+					Kind:       Kind,
+					Name:       policy.Name,
+					UID:        policy.UID,
+					Controller: &controllerRef,
+				}},
+			},
+			Spec: corev1.ServiceSpec{
+				Type:     corev1.ServiceTypeClusterIP,
+				Ports:    ports,
+				Selector: selector,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(existing.Spec.Selector, selector) && reflect.DeepEqual(existing.Spec.Ports, ports) {
+		return nil
+	}
+	d.act("update %s to the ports and selector of %s", name, service.Name)
+	if c.opts.DryRun {
+		return nil
+	}
+	existing.Spec.Selector = selector
+	existing.Spec.Ports = ports
+	_, err = services.Update(context.Background(), existing, metav1.UpdateOptions{})
+	return err
+}
+
+// applyTrafficIngress creates or updates the canary of ingress, sending
+// canary percent of the requests to service to vmService instead.
+func (c *controller) applyTrafficIngress(policy *VirtualNodeAutoscalePolicy, ingress *extensionsv1beta1.Ingress, service, vmService string, canary int32, d *decision) error {
+	ingresses := c.k8sClient.ExtensionsV1beta1().Ingresses(policy.Namespace)
+	name := ingress.Name + "-" + nodeTypeVM
+	annotations := map[string]string{}
+	for k, v := range ingress.Annotations {
+		if k != corev1.LastAppliedConfigAnnotation {
+			annotations[k] = v
+		}
+	}
+	annotations[canaryAnnotation] = "true"
+	annotations[canaryWeightAnnotation] = strconv.Itoa(int(canary))
+	spec := *ingress.Spec.DeepCopy()
+	if spec.Backend != nil && spec.Backend.ServiceName == service {
+		spec.Backend.ServiceName = vmService
+	}
+	for _, rule := range spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			if rule.HTTP.Paths[i].Backend.ServiceName == service {
+				rule.HTTP.Paths[i].Backend.ServiceName = vmService
+			}
+		}
+	}
+
+	existing, err := ingresses.Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		d.act("create %s sending %d%% of the requests of %s to %s", name, canary, ingress.Name, vmService)
+		if c.opts.DryRun {
+			return nil
+		}
+		_, err = ingresses.Create(context.Background(), &extensionsv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   policy.Namespace,
+				Annotations: annotations,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: Group + "/" + Version,
+					Kind:       Kind,
+					Name:       policy.Name,
+					UID:        policy.UID,
+					Controller: &controllerRef,
+				}},
+			},
+			Spec: spec,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(existing.Annotations, annotations) && reflect.DeepEqual(existing.Spec, spec) {
+		return nil
+	}
+	if current := existing.Annotations[canaryWeightAnnotation]; current != annotations[canaryWeightAnnotation] {
+		d.act("send %d%% of the requests of %s to %s, from %s%%", canary, ingress.Name, vmService, current)
+	} else {
+		d.act("update %s to the rules of %s", name, ingress.Name)
+	}
+	if c.opts.DryRun {
+		return nil
+	}
+	existing.Annotations = annotations
+	existing.Spec = spec
+	_, err = ingresses.Update(context.Background(), existing, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The VirtualNodeAutoscalePolicy custom resource.
+const (
+	Group    = "autoscale.virtual-node.io"
+	Version  = "v1alpha1"
+	Kind     = "VirtualNodeAutoscalePolicy"
+	Resource = "virtualnodeautoscalepolicies"
+)
+
+// VirtualNodeAutoscalePolicy declares how a Deployment scales, and how much
+// of it may burst onto the virtual node.
+type VirtualNodeAutoscalePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PolicySpec   `json:"spec"`
+	Status PolicyStatus `json:"status,omitempty"`
+}
+
+// VirtualNodeAutoscalePolicyList is a list of policies.
+type VirtualNodeAutoscalePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []VirtualNodeAutoscalePolicy `json:"items"`
+}
+
+// PolicySpec is the desired scaling of a Deployment.
+type PolicySpec struct {
+	// Deployment is the name of the Deployment, in the policy's namespace.
+	Deployment string `json:"deployment"`
+	// MinReplicas and MaxReplicas bound the HorizontalPodAutoscaler.
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	MaxReplicas int32  `json:"maxReplicas"`
+	// MaxBurstPercentage is the largest share of the replicas, from 0 to
+	// 100, that may run on the virtual node once the regular nodes are
+	// full. The autoscaler's maximum is lowered to keep to it.
+	MaxBurstPercentage int32 `json:"maxBurstPercentage"`
+	// ScaleDownOverBurst lowers the autoscaler's maximum past the scale
+	// down cooldown while more than MaxBurstPercentage of the replicas run
+	// on the virtual node, as when replicas on the regular nodes went away,
+	// or a cooldown held the maximum up. The newest replicas there over the
+	// share get the lowest pod deletion cost, for the ReplicaSet to remove
+	// them first as it scales down; none are evicted.
+	ScaleDownOverBurst bool `json:"scaleDownOverBurst,omitempty"`
+	// WarmReplicas are kept running idle on the virtual node, out of the
+	// Services, and promoted into the Deployment in place of replicas left
+	// pending when the regular nodes are full, so a burst doesn't wait for
+	// ACI to start container groups.
+	WarmReplicas int32 `json:"warmReplicas,omitempty"`
+	// ScaleUpCooldown and ScaleDownCooldown are the least time between two
+	// raises, or two cuts, of the autoscaler's maximum.
+	ScaleUpCooldown   metav1.Duration `json:"scaleUpCooldown,omitempty"`
+	ScaleDownCooldown metav1.Duration `json:"scaleDownCooldown,omitempty"`
+	// Metrics are the target metrics of the HorizontalPodAutoscaler.
+	Metrics []autoscalingv2beta1.MetricSpec `json:"metrics,omitempty"`
+	// Split runs the replicas in two Deployments copied from Deployment,
+	// one kept off the virtual node and one on it, with the autoscaler
+	// scaling the policy, and the controller dividing its Replicas between
+	// the two.
+	Split bool `json:"split,omitempty"`
+	// Replicas are the replicas of a split policy, set by the autoscaler
+	// through the scale subresource.
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Traffic weights the requests of an Ingress toward the replicas on
+	// the regular nodes, when set, for the virtual node to take the
+	// overflow. Only split policies shift their traffic.
+	Traffic *TrafficSpec `json:"traffic,omitempty"`
+	// LatencySLO raises the autoscaler's minimum while the request latency
+	// of the replicas is over a target, when set.
+	LatencySLO *LatencySLO `json:"latencySLO,omitempty"`
+	// Schedules override the bounds above while they are open, to warm up
+	// before a planned launch or to scale down overnight. The first open
+	// window applies.
+	Schedules []ScheduleWindow `json:"schedules,omitempty"`
+}
+
+// ScheduleWindow is a recurring time during which the autoscaler gets other
+// bounds.
+type ScheduleWindow struct {
+	Name string `json:"name,omitempty"`
+	// Schedule is a standard five-field cron expression, in UTC, for when
+	// the window opens.
+	Schedule string `json:"schedule"`
+	// Duration is how long the window stays open.
+	Duration metav1.Duration `json:"duration"`
+	// MinReplicas, MaxReplicas and MaxBurstPercentage replace those of the
+	// policy while the window is open, when set.
+	MinReplicas        *int32 `json:"minReplicas,omitempty"`
+	MaxReplicas        *int32 `json:"maxReplicas,omitempty"`
+	MaxBurstPercentage *int32 `json:"maxBurstPercentage,omitempty"`
+}
+
+// TrafficSpec is how the requests of a split policy are weighted between
+// its replicas on the regular nodes and those on the virtual node, through
+// a canary Ingress of the NGINX ingress controller.
+type TrafficSpec struct {
+	// Ingress is the Ingress, in the policy's namespace, routing the
+	// requests to Service.
+	Ingress string `json:"ingress"`
+	// Service is the Service of the Deployment, the Deployment's name by
+	// default.
+	Service string `json:"service,omitempty"`
+	// VirtualReplicaWeight is the share of the requests a replica on the
+	// virtual node gets, in percent of what a replica on the regular nodes
+	// gets, 50 by default: 100 spreads the requests evenly, and 0 sends
+	// the virtual node none while replicas on the regular nodes are ready.
+	VirtualReplicaWeight *int32 `json:"virtualReplicaWeight,omitempty"`
+}
+
+// LatencySLO is a target for a percentile of the request latency of a
+// Deployment, read from a Prometheus histogram its replicas export. The
+// controller keeps a minimum of replicas for it, raised while the latency
+// stays over the tolerance above the target, and lowered one replica at a
+// time while it stays under the tolerance below, so that small blips don't
+// move replicas on and off the virtual node.
+type LatencySLO struct {
+	// Target is the latency the percentile should stay under.
+	Target metav1.Duration `json:"target"`
+	// Percentile is the percentile kept under the target, 95 by default.
+	Percentile float64 `json:"percentile,omitempty"`
+	// Tolerance is how far, in percent of the target, the latency may be
+	// above or below it before the minimum changes, 10 by default.
+	Tolerance int32 `json:"tolerance,omitempty"`
+	// ScaleUpWindow and ScaleDownWindow are how long the latency stays
+	// over, or under, the tolerance before each raise, or cut, of the
+	// minimum; 30s and 3m by default.
+	ScaleUpWindow   metav1.Duration `json:"scaleUpWindow,omitempty"`
+	ScaleDownWindow metav1.Duration `json:"scaleDownWindow,omitempty"`
+	// Histogram is the histogram of the request durations, in seconds,
+	// summed over its labels; http_request_duration_seconds by default.
+	Histogram string `json:"histogram,omitempty"`
+	// MetricsPort and MetricsPath locate the Prometheus endpoint of the
+	// replicas, 8080 and /metrics by default.
+	MetricsPort int32  `json:"metricsPort,omitempty"`
+	MetricsPath string `json:"metricsPath,omitempty"`
+}
+
+// PolicyStatus is the observed state of the Deployment.
+type PolicyStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// VMReplicas and VirtualReplicas count the running replicas on the
+	// regular nodes and on the virtual node, promoted warm replicas among
+	// them; PendingReplicas those not scheduled yet.
+	VMReplicas      int32 `json:"vmReplicas"`
+	VirtualReplicas int32 `json:"virtualReplicas"`
+	PendingReplicas int32 `json:"pendingReplicas"`
+	// WarmReplicas counts the warm replicas ready to be promoted.
+	WarmReplicas int32 `json:"warmReplicas,omitempty"`
+	// MaxReplicas is the maximum currently given to the autoscaler.
+	MaxReplicas int32 `json:"maxReplicas"`
+	// PredictedReplicas is the minimum given to the autoscaler for the
+	// traffic predicted, when prediction is on and has a prediction.
+	PredictedReplicas int32 `json:"predictedReplicas,omitempty"`
+	// Replicas and Selector are those of the scale subresource: the
+	// replicas of the Deployment, or of the two of a split policy, and
+	// their label selector.
+	Replicas int32  `json:"replicas"`
+	Selector string `json:"selector,omitempty"`
+	// LastShiftTime is when replicas of a split policy last moved between
+	// the regular nodes and the virtual node.
+	LastShiftTime *metav1.Time `json:"lastShiftTime,omitempty"`
+	// VirtualTrafficPercent is the percentage of the requests of the
+	// Ingress sent to the virtual node, when the policy shifts its traffic.
+	VirtualTrafficPercent int32 `json:"virtualTrafficPercent,omitempty"`
+	// LatencySeconds is the percentile of the request latency over the
+	// last interval, and LatencyReplicas the minimum kept for the target.
+	LatencySeconds  float64 `json:"latencySeconds,omitempty"`
+	LatencyReplicas int32   `json:"latencyReplicas,omitempty"`
+	// ActiveSchedule is the name, or else the schedule, of the window open.
+	ActiveSchedule string `json:"activeSchedule,omitempty"`
+	// LastScaleTime is when MaxReplicas last changed.
+	LastScaleTime *metav1.Time      `json:"lastScaleTime,omitempty"`
+	Conditions    []PolicyCondition `json:"conditions,omitempty"`
+}
+
+// PolicyConditionType is the type of a PolicyCondition.
+type PolicyConditionType string
+
+const (
+	// Bursting is true while replicas run on the virtual node.
+	Bursting PolicyConditionType = "Bursting"
+	// AtVMCapacity is true while the regular nodes can't take more
+	// replicas, as shown by replicas bursting or left unschedulable.
+	AtVMCapacity PolicyConditionType = "AtVMCapacity"
+	// CoolingDown is true while a cooldown holds back a change of the
+	// autoscaler's maximum.
+	CoolingDown PolicyConditionType = "CoolingDown"
+	// Scheduled is true while a schedule window sets the bounds.
+	Scheduled PolicyConditionType = "Scheduled"
+	// LatencyOverTarget is true while the request latency is over the
+	// tolerance above the target of the latency SLO.
+	LatencyOverTarget PolicyConditionType = "LatencyOverTarget"
+	// OverBurst is true while more than MaxBurstPercentage of the replicas
+	// run on the virtual node.
+	OverBurst PolicyConditionType = "OverBurst"
+	// QuotaExceeded is true while the autoscaler's maximum is held to the
+	// replicas the container instance quota of the region has room for.
+	QuotaExceeded PolicyConditionType = "QuotaExceeded"
+)
+
+// PolicyCondition is a condition of a policy.
+type PolicyCondition struct {
+	Type               PolicyConditionType    `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
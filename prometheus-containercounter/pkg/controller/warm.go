@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// warmLabel marks the warm replicas of a policy, by its name.
+	warmLabel = Group + "/warm-for"
+	// parkedLabelsAnnotation keeps the labels of the template a warm
+	// replica was made from, which it gets back when promoted.
+	parkedLabelsAnnotation = Group + "/parked-labels"
+	// revisionAnnotation is the revision of a Deployment and of its
+	// ReplicaSets.
+	revisionAnnotation = "deployment.kubernetes.io/revision"
+)
+
+// virtualNodeToleration lets the warm replicas be scheduled on the virtual
+// node.
+var virtualNodeToleration = corev1.Toleration{Key: "virtual-kubelet.io/provider", Operator: corev1.TolerationOpExists}
+
+// warmPool keeps spec.WarmReplicas replicas of the Deployment running idle on
+// the virtual node, so a burst doesn't wait for ACI to start a container
+// group. A warm replica is a pod of the Deployment's current template with
+// its labels parked in an annotation, so neither the ReplicaSet nor the
+// Services select it. While replicas are pending, ready warm replicas are
+// promoted: they get their labels back, the ReplicaSet adopts them, and
+// deletes as many of its pending pods, which it removes first. The pool is
+// then filled up again. It returns the warm replicas ready, and updates p
+// with those promoted.
+func (c *controller) warmPool(policy *VirtualNodeAutoscalePolicy, deployment *appsv1.Deployment, spec *PolicySpec, p *placement, d *decision) (int32, error) {
+	pods := c.k8sClient.CoreV1().Pods(policy.Namespace)
+	list, err := pods.List(context.Background(), metav1.ListOptions{LabelSelector: warmLabel + "=" + policy.Name})
+	if err != nil {
+		return 0, err
+	}
+	if len(list.Items) == 0 && spec.WarmReplicas <= 0 {
+		return 0, nil
+	}
+	rs, err := c.currentReplicaSet(deployment)
+	if err != nil {
+		return 0, err
+	}
+
+	// Replicas of an older template, or that stopped, are replaced.
+	var ready, starting []corev1.Pod
+	for _, pod := range list.Items {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		stale := rs == nil || parkedLabels(&pod)[appsv1.DefaultDeploymentUniqueLabelKey] != rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+		switch {
+		case stale || pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded:
+			c.deleteWarm(&pod, d)
+		case podReady(&pod):
+			ready = append(ready, pod)
+		default:
+			starting = append(starting, pod)
+		}
+	}
+
+	// Promote the oldest first, as they have been ready longest.
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].CreationTimestamp.Before(&ready[j].CreationTimestamp)
+	})
+	var promoted int
+	for promoted < len(ready) && p.pending > 0 {
+		after := placement{vm: p.vm, virtual: p.virtual + 1}
+		if overBurst(spec, after) > 0 {
+			break
+		}
+		if !c.promoteWarm(policy, &ready[promoted], d) {
+			break
+		}
+		p.virtual++
+		p.pending--
+		if p.unschedulable > p.pending {
+			p.unschedulable = p.pending
+		}
+		p.virtualPods = append(p.virtualPods, ready[promoted])
+		p.running = append(p.running, ready[promoted])
+		promoted++
+	}
+	ready = ready[promoted:]
+
+	// Fill the pool up, or shrink it, deleting the replicas not ready
+	// first, then the newest.
+	have := int32(len(ready) + len(starting))
+	if rs != nil {
+		for ; have < spec.WarmReplicas; have++ {
+			c.createWarm(policy, deployment, rs, d)
+		}
+	}
+	for ; have > spec.WarmReplicas && len(starting) > 0; have-- {
+		c.deleteWarm(&starting[0], d)
+		starting = starting[1:]
+	}
+	for ; have > spec.WarmReplicas && len(ready) > 0; have-- {
+		c.deleteWarm(&ready[len(ready)-1], d)
+		ready = ready[:len(ready)-1]
+	}
+	return int32(len(ready)), nil
+}
+
+// currentReplicaSet returns the ReplicaSet of the Deployment's current
+// revision, or nil while the Deployment controller hasn't made it yet.
+func (c *controller) currentReplicaSet(deployment *appsv1.Deployment) (*appsv1.ReplicaSet, error) {
+	s, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.k8sClient.AppsV1().ReplicaSets(deployment.Namespace).List(context.Background(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return nil, err
+	}
+	revision := deployment.Annotations[revisionAnnotation]
+	for i := range list.Items {
+		rs := &list.Items[i]
+		if metav1.IsControlledBy(rs, deployment) && rs.Annotations[revisionAnnotation] == revision {
+			return rs, nil
+		}
+	}
+	return nil, nil
+}
+
+// createWarm creates a warm replica from the template of rs, pinned to the
+// virtual node.
+func (c *controller) createWarm(policy *VirtualNodeAutoscalePolicy, deployment *appsv1.Deployment, rs *appsv1.ReplicaSet, d *decision) {
+	d.act("create a warm replica")
+	if c.opts.DryRun {
+		return
+	}
+	template := rs.Spec.Template.DeepCopy()
+	parked, err := json.Marshal(template.Labels)
+	if err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Msg("parking the labels of a warm replica")
+		return
+	}
+	annotations := map[string]string{parkedLabelsAnnotation: string(parked)}
+	for k, v := range template.Annotations {
+		annotations[k] = v
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: deployment.Name + "-warm-",
+			Namespace:    policy.Namespace,
+			Labels:       map[string]string{warmLabel: policy.Name},
+			Annotations:  annotations,
+			// Not as its controller, so the ReplicaSet can adopt it.
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: Group + "/" + Version,
+				Kind:       Kind,
+				Name:       policy.Name,
+				UID:        policy.UID,
+			}},
+		},
+		Spec: template.Spec,
+	}
+	nodeSelector := map[string]string{c.opts.NodeLabel: c.opts.NodeLabelValue}
+	for k, v := range pod.Spec.NodeSelector {
+		nodeSelector[k] = v
+	}
+	pod.Spec.NodeSelector = nodeSelector
+	tolerated := false
+	for _, t := range pod.Spec.Tolerations {
+		if t.Key == virtualNodeToleration.Key {
+			tolerated = true
+		}
+	}
+	if !tolerated {
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, virtualNodeToleration)
+	}
+	if _, err := c.k8sClient.CoreV1().Pods(policy.Namespace).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Msg("creating a warm replica")
+	}
+}
+
+// promoteWarm gives a warm replica its labels back, and drops the policy as
+// its owner, so the ReplicaSet adopts it and the Services send it traffic.
+// It returns whether it did.
+func (c *controller) promoteWarm(policy *VirtualNodeAutoscalePolicy, pod *corev1.Pod, d *decision) bool {
+	labels := map[string]interface{}{warmLabel: nil}
+	for k, v := range parkedLabels(pod) {
+		labels[k] = v
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":          labels,
+			"annotations":     map[string]interface{}{parkedLabelsAnnotation: nil},
+			"ownerReferences": nil,
+		},
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Str("pod", pod.Name).Msg("promoting a warm replica")
+		return false
+	}
+	d.act("promote warm replica %s", pod.Name)
+	if c.opts.DryRun {
+		return true
+	}
+	if _, err := c.k8sClient.CoreV1().Pods(pod.Namespace).Patch(context.Background(), pod.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Str("pod", pod.Name).Msg("promoting a warm replica")
+		return false
+	}
+	c.log.Info().Str("policy", d.Policy).Str("pod", pod.Name).Msg("promoted a warm replica for a pending one")
+	warmPromotionsCounter.WithLabelValues(policy.Namespace, policy.Name).Inc()
+	return true
+}
+
+// deleteWarm deletes a warm replica.
+func (c *controller) deleteWarm(pod *corev1.Pod, d *decision) {
+	d.act("delete warm replica %s", pod.Name)
+	if c.opts.DryRun {
+		return
+	}
+	if err := c.k8sClient.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{}); err != nil {
+		c.log.Warn().Err(err).Str("policy", d.Policy).Str("pod", pod.Name).Msg("deleting a warm replica")
+	}
+}
+
+// parkedLabels returns the labels a warm replica was made with.
+func parkedLabels(pod *corev1.Pod) map[string]string {
+	var labels map[string]string
+	json.Unmarshal([]byte(pod.Annotations[parkedLabelsAnnotation]), &labels)
+	return labels
+}
+
+// podReady returns whether the pod is scheduled and ready.
+func podReady(pod *corev1.Pod) bool {
+	if pod.Spec.NodeName == "" {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// watch has the manager reconcile a policy as it changes, and as its
+// Deployment, the split Deployments, its autoscaler and its pods do. The
+// reconciles are one at a time, as the controller keeps state across them.
+func (c *controller) watch() error {
+	ctrl, err := ctrlcontroller.New("autoscale", c.mgr, ctrlcontroller.Options{Reconciler: c})
+	if err != nil {
+		return err
+	}
+	cache := c.mgr.GetCache()
+	watches := []source.Source{
+		// The controller updates the status of the policies itself, which
+		// leaves their generation as it is.
+		source.Kind(cache, &VirtualNodeAutoscalePolicy{},
+			&handler.TypedEnqueueRequestForObject[*VirtualNodeAutoscalePolicy]{},
+			predicate.TypedGenerationChangedPredicate[*VirtualNodeAutoscalePolicy]{}),
+		// The autoscalers the controller creates are owned by their
+		// policy.
+		source.Kind(cache, &autoscalingv2beta1.HorizontalPodAutoscaler{},
+			handler.TypedEnqueueRequestForOwner[*autoscalingv2beta1.HorizontalPodAutoscaler](
+				c.mgr.GetScheme(), c.mgr.GetRESTMapper(), &VirtualNodeAutoscalePolicy{})),
+		source.Kind(cache, &appsv1.Deployment{},
+			handler.TypedEnqueueRequestsFromMapFunc(c.deploymentPolicies)),
+		source.Kind(cache, &corev1.Pod{},
+			handler.TypedEnqueueRequestsFromMapFunc(c.podPolicies)),
+	}
+	for _, w := range watches {
+		if err := ctrl.Watch(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deploymentPolicies returns the policies naming the Deployment, or whose
+// split Deployment it is.
+func (c *controller) deploymentPolicies(ctx context.Context, deployment *appsv1.Deployment) []reconcile.Request {
+	return c.policiesOf(ctx, deployment.Namespace, func(policy *VirtualNodeAutoscalePolicy) bool {
+		name := policy.Spec.Deployment
+		return deployment.Name == name ||
+			deployment.Name == name+"-"+nodeTypeVM ||
+			deployment.Name == name+"-"+nodeTypeVirtual
+	})
+}
+
+// podPolicies returns the policies whose Deployment selects the pod, which
+// also selects the pods of its split Deployments.
+func (c *controller) podPolicies(ctx context.Context, pod *corev1.Pod) []reconcile.Request {
+	return c.policiesOf(ctx, pod.Namespace, func(policy *VirtualNodeAutoscalePolicy) bool {
+		deployment := &appsv1.Deployment{}
+		key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Spec.Deployment}
+		if err := c.policies.Get(ctx, key, deployment); err != nil {
+			return false
+		}
+		selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil {
+			return false
+		}
+		return selector.Matches(labels.Set(pod.Labels))
+	})
+}
+
+// policiesOf returns the policies in namespace that match.
+func (c *controller) policiesOf(ctx context.Context, namespace string, match func(*VirtualNodeAutoscalePolicy) bool) []reconcile.Request {
+	policies := &VirtualNodeAutoscalePolicyList{}
+	if err := c.policies.List(ctx, policies, client.InNamespace(namespace)); err != nil {
+		c.log.Warn().Err(err).Str("namespace", namespace).Msg("listing the policies to reconcile")
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+		if match(policy) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,160 @@
+// Package cost estimates what the replicas of a Deployment cost per hour, on
+// the regular nodes and on the virtual node, and what they cost over time.
+package cost
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Pricing is what the regular nodes and the virtual node charge. The defaults
+// are the pay-as-you-go prices of a Standard_D2s_v3 node and of Linux
+// container groups.
+type Pricing struct {
+	// NodeHourly is the price of a regular node per hour, and NodeCPU and
+	// NodeMemoryGB its allocatable resources. A replica on a regular node
+	// costs the share of the node its requests take.
+	NodeHourly   float64
+	NodeCPU      float64
+	NodeMemoryGB float64
+	// VCPUSecond and GBSecond are what the virtual node charges per second
+	// for a vCPU and a GB of memory of a container group.
+	VCPUSecond float64
+	GBSecond   float64
+}
+
+// DefaultPricing returns the default prices.
+func DefaultPricing() Pricing {
+	return Pricing{
+		NodeHourly:   0.096,
+		NodeCPU:      2,
+		NodeMemoryGB: 8,
+		VCPUSecond:   0.0000135,
+		GBSecond:     0.0000015,
+	}
+}
+
+// The virtual node gives container groups without requests 1 vCPU and 1.5GB.
+const (
+	defaultPodCPU      = 1
+	defaultPodMemoryGB = 1.5
+)
+
+// PodSize returns the CPU, in cores, and memory, in GB, requested by the
+// containers of spec.
+func PodSize(spec *corev1.PodSpec) (cpu, memoryGB float64) {
+	for _, c := range spec.Containers {
+		if q, ok := c.Resources.Requests[corev1.ResourceCPU]; ok {
+			cpu += float64(q.MilliValue()) / 1000
+		}
+		if q, ok := c.Resources.Requests[corev1.ResourceMemory]; ok {
+			memoryGB += float64(q.Value()) / (1 << 30)
+		}
+	}
+	if cpu == 0 {
+		cpu = defaultPodCPU
+	}
+	if memoryGB == 0 {
+		memoryGB = defaultPodMemoryGB
+	}
+	return cpu, memoryGB
+}
+
+// Estimate is the cost per hour of the replicas of a Deployment.
+type Estimate struct {
+	VMReplicas      int32   `json:"vmReplicas"`
+	VirtualReplicas int32   `json:"virtualReplicas"`
+	VMHourly        float64 `json:"vmHourly"`
+	VirtualHourly   float64 `json:"virtualHourly"`
+	TotalHourly     float64 `json:"totalHourly"`
+}
+
+// Estimate returns the cost per hour of vm replicas on the regular nodes and
+// virtual ones on the virtual node, each requesting cpu cores and memoryGB.
+func (p Pricing) Estimate(vm, virtual int32, cpu, memoryGB float64) Estimate {
+	share := 0.0
+	if p.NodeCPU > 0 {
+		share = cpu / p.NodeCPU
+	}
+	if p.NodeMemoryGB > 0 && memoryGB/p.NodeMemoryGB > share {
+		share = memoryGB / p.NodeMemoryGB
+	}
+	e := Estimate{
+		VMReplicas:      vm,
+		VirtualReplicas: virtual,
+		VMHourly:        float64(vm) * share * p.NodeHourly,
+		VirtualHourly:   float64(virtual) * (cpu*p.VCPUSecond + memoryGB*p.GBSecond) * 3600,
+	}
+	e.TotalHourly = e.VMHourly + e.VirtualHourly
+	return e
+}
+
+// Total is the cost of a Deployment since the tracker started, or was reset.
+type Total struct {
+	Current Estimate `json:"current"`
+	VM      float64  `json:"vm"`
+	Virtual float64  `json:"virtual"`
+	Total   float64  `json:"total"`
+	// Since is when the costs started to add up.
+	Since time.Time `json:"since"`
+}
+
+// Tracker adds up the estimates of Deployments over time.
+type Tracker struct {
+	mu     sync.Mutex
+	totals map[string]*Total
+	seen   map[string]time.Time
+}
+
+// NewTracker returns an empty tracker.
+func NewTracker() *Tracker {
+	return &Tracker{
+		totals: make(map[string]*Total),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Observe records the estimate of the Deployment named key at now. The
+// estimate before it is taken to have held since it was observed.
+func (t *Tracker) Observe(key string, e Estimate, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total, ok := t.totals[key]
+	if !ok {
+		total = &Total{Since: now}
+		t.totals[key] = total
+	} else if hours := now.Sub(t.seen[key]).Hours(); hours > 0 {
+		total.VM += total.Current.VMHourly * hours
+		total.Virtual += total.Current.VirtualHourly * hours
+		total.Total = total.VM + total.Virtual
+	}
+	total.Current = e
+	t.seen[key] = now
+}
+
+// Totals returns a copy of the totals, by Deployment.
+func (t *Tracker) Totals() map[string]Total {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := make(map[string]Total, len(t.totals))
+	for key, total := range t.totals {
+		totals[key] = *total
+	}
+	return totals
+}
+
+// Reset starts adding up costs again from now, keeping the current
+// estimates, as at the start of a demo run.
+func (t *Tracker) Reset(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, total := range t.totals {
+		*total = Total{Current: total.Current, Since: now}
+		t.seen[key] = now
+	}
+}
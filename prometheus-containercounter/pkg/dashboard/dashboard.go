@@ -0,0 +1,403 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+)
+
+// Snapshot is the state of the demo at a point in time, as sent on the
+// feed.
+type Snapshot struct {
+	Time time.Time `json:"time"`
+	// VMReplicas and VirtualReplicas count the running pods on the regular
+	// nodes and on the virtual nodes, ReadyReplicas those of them ready, and
+	// PendingReplicas the pods not scheduled yet.
+	VMReplicas      int `json:"vmReplicas"`
+	VirtualReplicas int `json:"virtualReplicas"`
+	ReadyReplicas   int `json:"readyReplicas"`
+	PendingReplicas int `json:"pendingReplicas"`
+	// Nodes are the nodes running pods, with how many each runs.
+	Nodes       []NodeReplicas `json:"nodes"`
+	Autoscalers []Autoscaler   `json:"autoscalers"`
+}
+
+// NodeReplicas is the number of pods running on a node.
+type NodeReplicas struct {
+	Name     string `json:"name"`
+	Virtual  bool   `json:"virtual"`
+	Replicas int    `json:"replicas"`
+}
+
+// Autoscaler is the status of a HorizontalPodAutoscaler.
+type Autoscaler struct {
+	Namespace       string   `json:"namespace"`
+	Name            string   `json:"name"`
+	MinReplicas     int32    `json:"minReplicas"`
+	MaxReplicas     int32    `json:"maxReplicas"`
+	CurrentReplicas int32    `json:"currentReplicas"`
+	DesiredReplicas int32    `json:"desiredReplicas"`
+	Metrics         []Metric `json:"metrics"`
+}
+
+// Metric is the current value of a metric an autoscaler scales on, and its
+// target. Resource metrics with a target utilization are in percent.
+type Metric struct {
+	Type    string  `json:"type"`
+	Name    string  `json:"name"`
+	Current float64 `json:"current"`
+	Target  float64 `json:"target,omitempty"`
+}
+
+type Dashboard interface {
+	Run() error
+}
+
+// DashboardOpts configures the dashboard backend.
+type DashboardOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists.
+	KubeConfig string
+	// Namespace limits the pods and autoscalers shown to one namespace; all
+	// if empty.
+	Namespace string
+	PodLabel  string
+	// NodeLabel and NodeLabelValue identify the virtual nodes.
+	NodeLabel      string
+	NodeLabelValue string
+	// Interval is the time between two looks at the cluster.
+	Interval time.Duration
+	// ListenAddress is the address the feed is served on.
+	ListenAddress string
+	// AllowOrigin is sent as Access-Control-Allow-Origin, for a demo UI
+	// served from elsewhere; not sent if empty.
+	AllowOrigin string
+}
+
+type dashboard struct {
+	opts      DashboardOpts
+	k8sClient *kubernetes.Clientset
+
+	mu          sync.Mutex
+	last        *Snapshot
+	subscribers map[chan *Snapshot]bool
+}
+
+func New(opts DashboardOpts) (Dashboard, error) {
+	clientset, err := kube.NewClientset(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Default to 2s if not set
+	if opts.Interval <= 0 {
+		opts.Interval = 2 * time.Second
+	}
+
+	return &dashboard{
+		opts:        opts,
+		k8sClient:   clientset,
+		subscribers: make(map[chan *Snapshot]bool),
+	}, nil
+}
+
+func (d *dashboard) Run() error {
+	go d.pollLoop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", d.serveEvents)
+	mux.HandleFunc("/snapshot", d.serveSnapshot)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	log.Printf("serving the scaling feed on %s", d.opts.ListenAddress)
+	return http.ListenAndServe(d.opts.ListenAddress, mux)
+}
+
+// pollLoop takes a snapshot each interval, and publishes it if anything
+// but its time changed.
+func (d *dashboard) pollLoop() {
+	tickChan := time.NewTicker(d.opts.Interval).C
+	for {
+		snapshot, err := d.snapshot()
+		if err != nil {
+			log.Printf("got an error trying to take a snapshot: %s", err)
+		} else {
+			d.publish(snapshot)
+		}
+		<-tickChan
+	}
+}
+
+func (d *dashboard) publish(snapshot *Snapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.last != nil {
+		unchanged := *snapshot
+		unchanged.Time = d.last.Time
+		if reflect.DeepEqual(&unchanged, d.last) {
+			return
+		}
+	}
+	d.last = snapshot
+	for sub := range d.subscribers {
+		// A client too slow to keep up skips snapshots rather than hold up
+		// the others; the next one it gets is up to date.
+		select {
+		case sub <- snapshot:
+		default:
+		}
+	}
+}
+
+func (d *dashboard) subscribe() (chan *Snapshot, *Snapshot) {
+	sub := make(chan *Snapshot, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscribers[sub] = true
+	return sub, d.last
+}
+
+func (d *dashboard) unsubscribe(sub chan *Snapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.subscribers, sub)
+}
+
+func (d *dashboard) snapshot() (*Snapshot, error) {
+	nodes, err := d.k8sClient.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{
+		LabelSelector: d.opts.NodeLabel + "=" + d.opts.NodeLabelValue,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the virtual nodes: %v", err)
+	}
+	virtual := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		virtual[node.Name] = true
+	}
+	pods, err := d.k8sClient.CoreV1().Pods(d.opts.Namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: d.opts.PodLabel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the pods: %v", err)
+	}
+	hpas, err := d.k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(d.opts.Namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing the autoscalers: %v", err)
+	}
+
+	// Empty lists are sent as such rather than null, for the UI.
+	s := &Snapshot{
+		Time:        time.Now().UTC(),
+		Nodes:       []NodeReplicas{},
+		Autoscalers: []Autoscaler{},
+	}
+	perNode := make(map[string]int)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		switch {
+		case pod.Spec.NodeName == "" && pod.Status.Phase == corev1.PodPending:
+			s.PendingReplicas++
+			continue
+		case pod.Status.Phase != corev1.PodPending && pod.Status.Phase != corev1.PodRunning:
+			continue
+		case virtual[pod.Spec.NodeName]:
+			s.VirtualReplicas++
+		default:
+			s.VMReplicas++
+		}
+		perNode[pod.Spec.NodeName]++
+		if podReady(pod) {
+			s.ReadyReplicas++
+		}
+	}
+	for name, replicas := range perNode {
+		s.Nodes = append(s.Nodes, NodeReplicas{Name: name, Virtual: virtual[name], Replicas: replicas})
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Name < s.Nodes[j].Name })
+
+	for i := range hpas.Items {
+		s.Autoscalers = append(s.Autoscalers, autoscaler(&hpas.Items[i]))
+	}
+	sort.Slice(s.Autoscalers, func(i, j int) bool {
+		if s.Autoscalers[i].Namespace != s.Autoscalers[j].Namespace {
+			return s.Autoscalers[i].Namespace < s.Autoscalers[j].Namespace
+		}
+		return s.Autoscalers[i].Name < s.Autoscalers[j].Name
+	})
+	return s, nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func autoscaler(hpa *autoscalingv2beta1.HorizontalPodAutoscaler) Autoscaler {
+	a := Autoscaler{
+		Namespace:       hpa.Namespace,
+		Name:            hpa.Name,
+		MinReplicas:     1,
+		MaxReplicas:     hpa.Spec.MaxReplicas,
+		CurrentReplicas: hpa.Status.CurrentReplicas,
+		DesiredReplicas: hpa.Status.DesiredReplicas,
+	}
+	if hpa.Spec.MinReplicas != nil {
+		a.MinReplicas = *hpa.Spec.MinReplicas
+	}
+	for _, status := range hpa.Status.CurrentMetrics {
+		m := Metric{Type: string(status.Type)}
+		switch {
+		case status.Pods != nil:
+			m.Name, m.Current = status.Pods.MetricName, value(status.Pods.CurrentAverageValue)
+		case status.Object != nil:
+			m.Name, m.Current = status.Object.MetricName, value(status.Object.CurrentValue)
+		case status.External != nil:
+			m.Name, m.Current = status.External.MetricName, value(status.External.CurrentValue)
+			if status.External.CurrentAverageValue != nil {
+				m.Current = value(*status.External.CurrentAverageValue)
+			}
+		case status.Resource != nil:
+			m.Name, m.Current = string(status.Resource.Name), value(status.Resource.CurrentAverageValue)
+			if status.Resource.CurrentAverageUtilization != nil {
+				m.Current = float64(*status.Resource.CurrentAverageUtilization)
+			}
+		default:
+			continue
+		}
+		m.Target = target(hpa.Spec.Metrics, m)
+		a.Metrics = append(a.Metrics, m)
+	}
+	return a
+}
+
+// target returns the target of the metric m in the autoscaler's spec.
+func target(specs []autoscalingv2beta1.MetricSpec, m Metric) float64 {
+	for _, spec := range specs {
+		switch {
+		case spec.Pods != nil && spec.Pods.MetricName == m.Name:
+			return value(spec.Pods.TargetAverageValue)
+		case spec.Object != nil && spec.Object.MetricName == m.Name:
+			return value(spec.Object.TargetValue)
+		case spec.External != nil && spec.External.MetricName == m.Name:
+			if spec.External.TargetAverageValue != nil {
+				return value(*spec.External.TargetAverageValue)
+			}
+			if spec.External.TargetValue != nil {
+				return value(*spec.External.TargetValue)
+			}
+		case spec.Resource != nil && string(spec.Resource.Name) == m.Name:
+			if spec.Resource.TargetAverageUtilization != nil {
+				return float64(*spec.Resource.TargetAverageUtilization)
+			}
+			if spec.Resource.TargetAverageValue != nil {
+				return value(*spec.Resource.TargetAverageValue)
+			}
+		}
+	}
+	return 0
+}
+
+func value(q resource.Quantity) float64 {
+	return float64(q.MilliValue()) / 1000
+}
+
+// serveSnapshot serves the last snapshot, for clients that poll.
+func (d *dashboard) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	last := d.last
+	d.mu.Unlock()
+	if last == nil {
+		http.Error(w, "no snapshot yet", http.StatusServiceUnavailable)
+		return
+	}
+	d.allowOrigin(w)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(last); err != nil {
+		log.Printf("writing response: %s", err)
+	}
+}
+
+// keepAlive is how often a comment is sent on a quiet feed, so proxies
+// don't close it.
+const keepAlive = 15 * time.Second
+
+// serveEvents streams the snapshots as server-sent events, starting with
+// the last one.
+func (d *dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sub, last := d.subscribe()
+	defer d.unsubscribe(sub)
+
+	d.allowOrigin(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(s *Snapshot) bool {
+		data, err := json.Marshal(s)
+		if err != nil {
+			log.Printf("encoding a snapshot: %s", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if last != nil && !send(last) {
+		return
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case s := <-sub:
+			if !send(s) {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (d *dashboard) allowOrigin(w http.ResponseWriter) {
+	if d.opts.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", d.opts.AllowOrigin)
+	}
+}
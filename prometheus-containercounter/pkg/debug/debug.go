@@ -0,0 +1,144 @@
+// Package debug serves the profiles of the controllers, and exports how much
+// CPU the Go runtime thinks it has against how much its cgroup lets it use.
+package debug
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Serve serves the profiles of net/http/pprof on addr, apart from the
+// controller's own endpoints, and registers the runtime collector with
+// Prometheus.
+func Serve(addr string) error {
+	prometheus.MustRegister(newRuntimeCollector())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return http.ListenAndServe(addr, mux)
+}
+
+// runtimeCollector exports the CPUs the Go runtime schedules on, next to the
+// CPU quota of the cgroup and how often the cgroup was throttled. A runtime
+// seeing the cores of the whole host while its cgroup has a fraction of them
+// runs more threads than it can be given, and spends its quota spinning.
+type runtimeCollector struct {
+	gomaxprocs        *prometheus.Desc
+	numCPU            *prometheus.Desc
+	quota             *prometheus.Desc
+	periods           *prometheus.Desc
+	throttledPeriods  *prometheus.Desc
+	throttledDuration *prometheus.Desc
+}
+
+func newRuntimeCollector() prometheus.Collector {
+	return &runtimeCollector{
+		gomaxprocs: prometheus.NewDesc("runtime_gomaxprocs",
+			"Threads running Go code at once, GOMAXPROCS", nil, nil),
+		numCPU: prometheus.NewDesc("runtime_num_cpu",
+			"CPUs the Go runtime sees", nil, nil),
+		quota: prometheus.NewDesc("cgroup_cpu_quota_cores",
+			"CPU the cgroup may use, in cores; absent if unlimited", nil, nil),
+		periods: prometheus.NewDesc("cgroup_cpu_periods_total",
+			"Enforcement periods of the cgroup's CPU quota", nil, nil),
+		throttledPeriods: prometheus.NewDesc("cgroup_cpu_throttled_periods_total",
+			"Periods in which the cgroup used up its CPU quota", nil, nil),
+		throttledDuration: prometheus.NewDesc("cgroup_cpu_throttled_seconds_total",
+			"Time the cgroup was throttled for, in Seconds", nil, nil),
+	}
+}
+
+func (c *runtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.gomaxprocs
+	ch <- c.numCPU
+	ch <- c.quota
+	ch <- c.periods
+	ch <- c.throttledPeriods
+	ch <- c.throttledDuration
+}
+
+func (c *runtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.gomaxprocs, prometheus.GaugeValue, float64(runtime.GOMAXPROCS(0)))
+	ch <- prometheus.MustNewConstMetric(c.numCPU, prometheus.GaugeValue, float64(runtime.NumCPU()))
+	if quota, ok := cpuQuota(); ok {
+		ch <- prometheus.MustNewConstMetric(c.quota, prometheus.GaugeValue, quota)
+	}
+	stat, ok := cpuStat()
+	if !ok {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.periods, prometheus.CounterValue, stat["nr_periods"])
+	ch <- prometheus.MustNewConstMetric(c.throttledPeriods, prometheus.CounterValue, stat["nr_throttled"])
+	// cgroup v2 counts in microseconds, v1 in nanoseconds.
+	throttled := stat["throttled_usec"] / 1e6
+	if ns, ok := stat["throttled_time"]; ok {
+		throttled = ns / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(c.throttledDuration, prometheus.CounterValue, throttled)
+}
+
+// cpuQuota returns the cores the cgroup of the process may use, if it is
+// limited, from cgroup v2 or v1.
+func cpuQuota() (float64, bool) {
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		// "max 100000" when unlimited, or "<quota> <period>".
+		f := strings.Fields(string(b))
+		if len(f) != 2 || f[0] == "max" {
+			return 0, false
+		}
+		quota, err1 := strconv.ParseFloat(f[0], 64)
+		period, err2 := strconv.ParseFloat(f[1], 64)
+		if err1 != nil || err2 != nil || period <= 0 {
+			return 0, false
+		}
+		return quota / period, true
+	}
+	quota, err1 := readNumber("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, err2 := readNumber("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	// The quota is -1 when unlimited.
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0, false
+	}
+	return quota / period, true
+}
+
+// cpuStat returns the fields of the cpu.stat of the cgroup, from cgroup v2
+// or v1.
+func cpuStat() (map[string]float64, bool) {
+	b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.stat")
+	if err != nil {
+		if b, err = ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.stat"); err != nil {
+			return nil, false
+		}
+	}
+	stat := map[string]float64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(f[1], 64); err == nil {
+			stat[f[0]] = v
+		}
+	}
+	_, ok := stat["nr_periods"]
+	return stat, ok
+}
+
+func readNumber(path string) (float64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+}
@@ -0,0 +1,373 @@
+// Package e2e runs the demo end to end against a cluster: it deploys the
+// online-store, drives load at it and checks that the autoscaler scaled, that
+// the replicas the regular nodes had no room for ran on the virtual node, and
+// that the scale down took the replicas off the virtual node first.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/loadgen"
+)
+
+// HarnessOpts configures a run of the end to end test.
+type HarnessOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists.
+	KubeConfig string
+	Namespace  string
+	// Chart is the chart of the online-store, installed or upgraded with
+	// helm as Release, with the values of Set, as helm's --set, unless
+	// SkipDeploy. Cleanup deletes the release at the end of the run.
+	Chart      string
+	Release    string
+	Set        string
+	SkipDeploy bool
+	Cleanup    bool
+	// Deployment and HPA are the Deployment of the online-store and its
+	// autoscaler, the release's name by default.
+	Deployment string
+	HPA        string
+	// NodeLabel and NodeLabelValue identify the virtual nodes.
+	NodeLabel      string
+	NodeLabelValue string
+	// Load is the load driven at the online-store, through its ingress.
+	Load loadgen.LoadOpts
+	// ReadyTimeout bounds the wait for the online-store to be ready before
+	// the load, and ScaleDownTimeout the wait for its replicas to go back
+	// down after it.
+	ReadyTimeout     time.Duration
+	ScaleDownTimeout time.Duration
+	// Interval is the time between two looks at the replicas.
+	Interval time.Duration
+	// Output receives the progress of the run, and the output of helm.
+	Output io.Writer
+}
+
+// Result is what a run saw.
+type Result struct {
+	// BaselineReplicas are the replicas of the autoscaler before the load,
+	// and PeakReplicas the most it had during it.
+	BaselineReplicas int32
+	PeakReplicas     int32
+	// PeakVirtual is the most replicas running on the virtual node at once.
+	PeakVirtual int32
+	// VMRemovedFirst are the replicas on the regular nodes the scale down
+	// removed while replicas still ran on the virtual node.
+	VMRemovedFirst []string
+	// VirtualLeft counts the replicas still on the virtual node when the
+	// scale down timed out.
+	VirtualLeft int32
+	Load        loadgen.Summary
+}
+
+// Failures returns the checks the run didn't pass, none if it passed.
+func (r *Result) Failures() []string {
+	var failures []string
+	if r.PeakReplicas <= r.BaselineReplicas {
+		failures = append(failures, fmt.Sprintf("the autoscaler stayed at %d replicas under the load", r.BaselineReplicas))
+	}
+	if r.PeakVirtual == 0 {
+		failures = append(failures, "no replica ran on the virtual node")
+	}
+	if len(r.VMRemovedFirst) > 0 {
+		failures = append(failures, fmt.Sprintf("the scale down removed %s from the regular nodes while replicas ran on the virtual node",
+			strings.Join(r.VMRemovedFirst, ", ")))
+	}
+	if r.VirtualLeft > 0 {
+		failures = append(failures, fmt.Sprintf("%d replicas were still on the virtual node when the scale down timed out", r.VirtualLeft))
+	}
+	return failures
+}
+
+type Harness interface {
+	// Run runs the test until it is over or ctx is done, and returns what
+	// it saw, or an error if it couldn't run it.
+	Run(ctx context.Context) (*Result, error)
+}
+
+type harness struct {
+	opts      HarnessOpts
+	k8sClient *kubernetes.Clientset
+}
+
+// New returns a harness running the end to end test of opts.
+func New(opts HarnessOpts) (Harness, error) {
+	if opts.Load.URL == "" {
+		return nil, fmt.Errorf("the URL of the online-store is needed to load it")
+	}
+	// Default to the release if not set
+	if opts.Deployment == "" {
+		opts.Deployment = opts.Release
+	}
+	if opts.HPA == "" {
+		opts.HPA = opts.Deployment
+	}
+	// Default to 5m if not set
+	if opts.ReadyTimeout <= 0 {
+		opts.ReadyTimeout = 5 * time.Minute
+	}
+	// Default to 15m if not set
+	if opts.ScaleDownTimeout <= 0 {
+		opts.ScaleDownTimeout = 15 * time.Minute
+	}
+	// Default to 5s if not set
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.Output == nil {
+		opts.Output = ioutil.Discard
+	}
+	clientset, err := kube.NewClientset(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &harness{opts: opts, k8sClient: clientset}, nil
+}
+
+func (h *harness) Run(ctx context.Context) (*Result, error) {
+	if !h.opts.SkipDeploy {
+		if err := h.deploy(ctx); err != nil {
+			return nil, err
+		}
+		if h.opts.Cleanup {
+			// The release is deleted even once ctx is done.
+			defer func() {
+				if err := h.helm(context.Background(), "delete", "--purge", h.opts.Release); err != nil {
+					h.logf("deleting the release %s: %v", h.opts.Release, err)
+				}
+			}()
+		}
+	}
+	baseline, err := h.waitReady(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{BaselineReplicas: baseline.replicas, PeakReplicas: baseline.replicas}
+	h.logf("ready: %s; loading %s for %s", baseline, h.opts.Load.URL, h.opts.Load.Duration)
+
+	if err := h.load(ctx, result); err != nil {
+		return nil, err
+	}
+	h.logf("load over: %d requests, %d errors, %d skipped; p50 %s, p99 %s", result.Load.Requests, result.Load.Errors,
+		result.Load.Skipped, result.Load.P50.Round(time.Millisecond), result.Load.P99.Round(time.Millisecond))
+	if err := h.scaleDown(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// deploy installs or upgrades the release of the online-store, and waits
+// for it to be ready.
+func (h *harness) deploy(ctx context.Context) error {
+	args := []string{"upgrade", "--install", h.opts.Release, h.opts.Chart, "--namespace", h.opts.Namespace,
+		"--wait", "--timeout", strconv.Itoa(int(h.opts.ReadyTimeout.Seconds()))}
+	if h.opts.Set != "" {
+		args = append(args, "--set", h.opts.Set)
+	}
+	h.logf("deploying %s as %s", h.opts.Chart, h.opts.Release)
+	if err := h.helm(ctx, args...); err != nil {
+		return fmt.Errorf("deploying the online-store: %v", err)
+	}
+	return nil
+}
+
+func (h *harness) helm(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "helm", args...)
+	cmd.Stdout, cmd.Stderr = h.opts.Output, h.opts.Output
+	return cmd.Run()
+}
+
+// waitReady waits for the Deployment to be available and the autoscaler to
+// have read its replicas, and returns the replicas then.
+func (h *harness) waitReady(ctx context.Context) (snapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.ReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+	for {
+		s, err := h.look()
+		if err == nil && s.replicas > 0 && s.pending == 0 && s.ready == s.vm+s.virtual {
+			return s, nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("%s", s)
+			}
+			return s, fmt.Errorf("the online-store wasn't ready within %s: %v", h.opts.ReadyTimeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// load drives the load, recording the most replicas the autoscaler and the
+// virtual node had meanwhile.
+func (h *harness) load(ctx context.Context, result *Result) error {
+	done := make(chan loadgen.Summary, 1)
+	go func() {
+		done <- loadgen.Run(ctx, h.opts.Load, nil)
+	}()
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result.Load = <-done:
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		s, err := h.look()
+		if err != nil {
+			h.logf("looking at the replicas: %v", err)
+			continue
+		}
+		h.logf("%s", s)
+		if s.replicas > result.PeakReplicas {
+			result.PeakReplicas = s.replicas
+		}
+		if s.virtual > result.PeakVirtual {
+			result.PeakVirtual = s.virtual
+		}
+	}
+}
+
+// scaleDown waits for the replicas to go back down, recording the replicas
+// on the regular nodes removed while some still ran on the virtual node.
+func (h *harness) scaleDown(ctx context.Context, result *Result) error {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.ScaleDownTimeout)
+	defer cancel()
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+	var last *snapshot
+	for {
+		s, err := h.look()
+		switch {
+		case err != nil:
+			h.logf("looking at the replicas: %v", err)
+		default:
+			h.logf("%s", s)
+			if last != nil && s.virtual > 0 {
+				var removed []string
+				for name, virtual := range last.pods {
+					if _, running := s.pods[name]; !running && !virtual {
+						removed = append(removed, name)
+					}
+				}
+				sort.Strings(removed)
+				result.VMRemovedFirst = append(result.VMRemovedFirst, removed...)
+			}
+			last = &s
+			if s.virtual == 0 && s.replicas <= result.BaselineReplicas {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if last != nil {
+				result.VirtualLeft = last.virtual
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot is where the replicas of the online-store are at a time.
+type snapshot struct {
+	// replicas are those of the autoscaler.
+	replicas int32
+	// vm, virtual and pending count the replicas running on the regular
+	// nodes and on the virtual node, and those not scheduled yet, and
+	// ready those of the running ones that are ready.
+	vm, virtual, pending, ready int32
+	// pods are the running replicas, and whether they are on the virtual
+	// node, by name.
+	pods map[string]bool
+}
+
+func (s snapshot) String() string {
+	return fmt.Sprintf("autoscaler at %d replicas; %d on the regular nodes, %d on the virtual node, %d pending, %d ready",
+		s.replicas, s.vm, s.virtual, s.pending, s.ready)
+}
+
+// look takes a snapshot of the replicas. Replicas being deleted are no
+// longer counted.
+func (h *harness) look() (snapshot, error) {
+	s := snapshot{pods: make(map[string]bool)}
+	hpa, err := h.k8sClient.AutoscalingV1().HorizontalPodAutoscalers(h.opts.Namespace).Get(context.Background(), h.opts.HPA, metav1.GetOptions{})
+	if err != nil {
+		return s, err
+	}
+	s.replicas = hpa.Status.CurrentReplicas
+
+	deployment, err := h.k8sClient.AppsV1().Deployments(h.opts.Namespace).Get(context.Background(), h.opts.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return s, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return s, err
+	}
+	nodes, err := h.k8sClient.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{
+		LabelSelector: h.opts.NodeLabel + "=" + h.opts.NodeLabelValue,
+	})
+	if err != nil {
+		return s, err
+	}
+	virtualNodes := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		virtualNodes[node.Name] = true
+	}
+	pods, err := h.k8sClient.CoreV1().Pods(h.opts.Namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return s, err
+	}
+	for _, pod := range pods.Items {
+		switch {
+		case pod.DeletionTimestamp != nil:
+			continue
+		case pod.Spec.NodeName == "" && pod.Status.Phase == corev1.PodPending:
+			s.pending++
+			continue
+		case pod.Status.Phase != corev1.PodPending && pod.Status.Phase != corev1.PodRunning:
+			continue
+		case virtualNodes[pod.Spec.NodeName]:
+			s.virtual++
+		default:
+			s.vm++
+		}
+		s.pods[pod.Name] = virtualNodes[pod.Spec.NodeName]
+		if podReady(&pod) {
+			s.ready++
+		}
+	}
+	return s, nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (h *harness) logf(format string, args ...interface{}) {
+	fmt.Fprintf(h.opts.Output, "%s %s\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+}
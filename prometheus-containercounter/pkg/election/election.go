@@ -0,0 +1,119 @@
+// Package election elects a leader among the replicas of a controller, so
+// that only one of them acts while the others stand by.
+//
+// It runs client-go's leader election on a Lease lock.
+package election
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// ElectorOpts configures an elector.
+type ElectorOpts struct {
+	// Namespace and Name are those of the lock Lease.
+	Namespace string
+	Name      string
+	// Identity tells the replicas apart, such as the pod name.
+	Identity string
+	// LeaseDuration is how long the others wait, once the leader stops
+	// renewing the lock, before they take it.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps trying to renew the lock
+	// before it gives up leading.
+	RenewDeadline time.Duration
+	// RetryPeriod is the time between two attempts to take or renew the
+	// lock.
+	RetryPeriod time.Duration
+	// Logger logs who takes and loses the lock.
+	Logger *zerolog.Logger
+}
+
+// Elector takes and renews the lock.
+type Elector struct {
+	opts    ElectorOpts
+	elector *leaderelection.LeaderElector
+	lead    func(stop <-chan struct{})
+}
+
+// NewElector returns an elector for opts.
+func NewElector(client *kubernetes.Clientset, opts ElectorOpts) (*Elector, error) {
+	// Default to 15s, 10s and 2s if not set
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = 15 * time.Second
+	}
+	if opts.RenewDeadline <= 0 {
+		opts.RenewDeadline = 10 * time.Second
+	}
+	if opts.RetryPeriod <= 0 {
+		opts.RetryPeriod = 2 * time.Second
+	}
+	// Default to JSON on stderr if not set
+	if opts.Logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		opts.Logger = &logger
+	}
+
+	e := &Elector{opts: opts}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: opts.Namespace, Name: opts.Name},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: opts.Identity},
+	}
+	var err error
+	e.elector, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		Name:          opts.Name,
+		LeaseDuration: opts.LeaseDuration,
+		RenewDeadline: opts.RenewDeadline,
+		RetryPeriod:   opts.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startedLeading,
+			OnStoppedLeading: e.stoppedLeading,
+			OnNewLeader:      e.newLeader,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// IsLeader reports whether this replica holds the lock.
+func (e *Elector) IsLeader() bool {
+	return e.elector.IsLeader()
+}
+
+// Run waits to take the lock, then calls lead, and renews the lock until it
+// can't anymore. It then closes the channel given to lead and returns.
+func (e *Elector) Run(lead func(stop <-chan struct{})) {
+	e.lead = lead
+	e.elector.Run(context.Background())
+}
+
+// startedLeading runs lead until ctx, which the leader election cancels as
+// it stops renewing the lock, is done.
+func (e *Elector) startedLeading(ctx context.Context) {
+	e.opts.Logger.Info().Str("identity", e.opts.Identity).Str("namespace", e.opts.Namespace).Str("lock", e.opts.Name).
+		Msg("took the lock")
+	e.lead(ctx.Done())
+}
+
+func (e *Elector) stoppedLeading() {
+	e.opts.Logger.Info().Str("identity", e.opts.Identity).Str("namespace", e.opts.Namespace).Str("lock", e.opts.Name).
+		Msg("lost the lock")
+}
+
+func (e *Elector) newLeader(identity string) {
+	if identity == e.opts.Identity {
+		return
+	}
+	e.opts.Logger.Info().Str("identity", e.opts.Identity).Str("leader", identity).Msg("another replica leads")
+}
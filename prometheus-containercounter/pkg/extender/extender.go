@@ -0,0 +1,172 @@
+package extender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+)
+
+type Extender interface {
+	Run() error
+}
+
+// ExtenderOpts configures the scheduler extender.
+type ExtenderOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists. The
+	// API server is only used when the scheduler sends node names alone.
+	KubeConfig string
+	// NodeLabel and NodeLabelValue identify the virtual nodes.
+	NodeLabel      string
+	NodeLabelValue string
+	ListenAddress  string
+}
+
+// extender keeps pods off the virtual nodes while any regular node can
+// take them. The scheduler only passes the extender the nodes that fit the
+// pod, so a virtual node is only kept once no regular node is left.
+type extender struct {
+	opts      ExtenderOpts
+	k8sClient *kubernetes.Clientset
+}
+
+func New(opts ExtenderOpts) (Extender, error) {
+	clientset, err := kube.NewClientset(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &extender{opts: opts, k8sClient: clientset}, nil
+}
+
+func (e *extender) Run() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/filter", e.serveFilter)
+	mux.HandleFunc("/prioritize", e.servePrioritize)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	log.Printf("serving the scheduler extender on %s, virtual nodes are labelled %s=%s",
+		e.opts.ListenAddress, e.opts.NodeLabel, e.opts.NodeLabelValue)
+	return http.ListenAndServe(e.opts.ListenAddress, mux)
+}
+
+// isVirtual reports whether node is a virtual node.
+func (e *extender) isVirtual(node *corev1.Node) bool {
+	return node.Labels[e.opts.NodeLabel] == e.opts.NodeLabelValue
+}
+
+// nodes returns the candidate nodes in args, fetching them if the
+// scheduler only sent their names.
+func (e *extender) nodes(args *ExtenderArgs) ([]corev1.Node, error) {
+	if args.Nodes != nil {
+		return args.Nodes.Items, nil
+	}
+	if args.NodeNames == nil {
+		return nil, nil
+	}
+	nodes := make([]corev1.Node, 0, len(*args.NodeNames))
+	for _, name := range *args.NodeNames {
+		node, err := e.k8sClient.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, *node)
+	}
+	return nodes, nil
+}
+
+func (e *extender) filter(args *ExtenderArgs) *ExtenderFilterResult {
+	nodes, err := e.nodes(args)
+	if err != nil {
+		return &ExtenderFilterResult{Error: err.Error()}
+	}
+
+	regular := 0
+	for i := range nodes {
+		if !e.isVirtual(&nodes[i]) {
+			regular++
+		}
+	}
+
+	var kept []corev1.Node
+	failed := make(map[string]string)
+	for i := range nodes {
+		node := &nodes[i]
+		if regular > 0 && e.isVirtual(node) {
+			failed[node.Name] = fmt.Sprintf("%d regular nodes can still take the pod", regular)
+			continue
+		}
+		kept = append(kept, *node)
+	}
+
+	result := &ExtenderFilterResult{FailedNodes: failed}
+	if args.Nodes != nil {
+		result.Nodes = &corev1.NodeList{Items: kept}
+	} else {
+		names := make([]string, 0, len(kept))
+		for _, node := range kept {
+			names = append(names, node.Name)
+		}
+		result.NodeNames = &names
+	}
+	return result
+}
+
+func (e *extender) prioritize(args *ExtenderArgs) (HostPriorityList, error) {
+	nodes, err := e.nodes(args)
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := make(HostPriorityList, 0, len(nodes))
+	for i := range nodes {
+		score := MaxPriority
+		if e.isVirtual(&nodes[i]) {
+			score = 0
+		}
+		priorities = append(priorities, HostPriority{Host: nodes[i].Name, Score: score})
+	}
+	return priorities, nil
+}
+
+func (e *extender) serveFilter(w http.ResponseWriter, r *http.Request) {
+	var args ExtenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		writeJSON(w, &ExtenderFilterResult{Error: err.Error()})
+		return
+	}
+	result := e.filter(&args)
+	if args.Pod != nil && len(result.FailedNodes) > 0 {
+		log.Printf("keeping pod %s/%s off %d virtual nodes", args.Pod.Namespace, args.Pod.Name, len(result.FailedNodes))
+	}
+	writeJSON(w, result)
+}
+
+func (e *extender) servePrioritize(w http.ResponseWriter, r *http.Request) {
+	var args ExtenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priorities, err := e.prioritize(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, priorities)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response: %s", err)
+	}
+}
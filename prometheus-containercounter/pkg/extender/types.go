@@ -0,0 +1,37 @@
+package extender
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The types below mirror the scheduler extender API of
+// k8s.io/kubernetes/pkg/scheduler/api/v1, which isn't vendored.
+
+// ExtenderArgs is what the scheduler sends to the filter and prioritize
+// verbs. Nodes is set unless the extender is configured as
+// nodeCacheCapable, in which case only NodeNames is.
+type ExtenderArgs struct {
+	Pod       *corev1.Pod      `json:"pod"`
+	Nodes     *corev1.NodeList `json:"nodes,omitempty"`
+	NodeNames *[]string        `json:"nodenames,omitempty"`
+}
+
+// ExtenderFilterResult is the answer to the filter verb.
+type ExtenderFilterResult struct {
+	Nodes       *corev1.NodeList  `json:"nodes,omitempty"`
+	NodeNames   *[]string         `json:"nodenames,omitempty"`
+	FailedNodes map[string]string `json:"failedNodes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// HostPriority is the score of one node, from 0 to MaxPriority.
+type HostPriority struct {
+	Host  string `json:"host"`
+	Score int    `json:"score"`
+}
+
+// HostPriorityList is the answer to the prioritize verb.
+type HostPriorityList []HostPriority
+
+// MaxPriority is the highest score a node can get.
+const MaxPriority = 10
@@ -0,0 +1,117 @@
+// Package grafana writes annotations to Grafana through its HTTP API, so
+// that the scaling events of the autoscale controller show on the panels of
+// the dashboards, next to the latency and the request rate.
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Annotation is an event marked on the graphs of Grafana. Annotations
+// without a dashboard show on the dashboards with an annotation query of
+// their tags.
+type Annotation struct {
+	Time time.Time
+	Tags []string
+	Text string
+}
+
+// AnnotatorOpts configures an annotator.
+type AnnotatorOpts struct {
+	// URL is the root URL of Grafana, as http://grafana.default.
+	URL string
+	// APIKey is an API key of Grafana with the Editor role.
+	APIKey string
+	// Tags are added to every annotation.
+	Tags []string
+	// Timeout bounds the time writing an annotation may take.
+	Timeout time.Duration
+	// OnError is called with the errors writing an annotation, which is
+	// then dropped.
+	OnError func(error)
+}
+
+// Annotator writes annotations, in the background and in order.
+type Annotator struct {
+	opts        AnnotatorOpts
+	http        *http.Client
+	annotations chan Annotation
+}
+
+// NewAnnotator returns an annotator writing to the Grafana of opts until the
+// process exits.
+func NewAnnotator(opts AnnotatorOpts) (*Annotator, error) {
+	if opts.URL == "" || opts.APIKey == "" {
+		return nil, fmt.Errorf("the URL and an API key of grafana are needed to write annotations")
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	// Default to 5s if not set
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(error) {}
+	}
+	a := &Annotator{
+		opts:        opts,
+		http:        &http.Client{Timeout: opts.Timeout},
+		annotations: make(chan Annotation, 100),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Annotate queues an annotation to be written. Annotations past a full
+// queue, as while Grafana can't be reached, are dropped rather than hold the
+// controller up.
+func (a *Annotator) Annotate(annotation Annotation) {
+	select {
+	case a.annotations <- annotation:
+	default:
+		a.opts.OnError(fmt.Errorf("the queue is full, dropping the annotation %q", annotation.Text))
+	}
+}
+
+func (a *Annotator) run() {
+	for annotation := range a.annotations {
+		if err := a.write(annotation); err != nil {
+			a.opts.OnError(err)
+		}
+	}
+}
+
+// write posts an annotation to /api/annotations.
+func (a *Annotator) write(annotation Annotation) error {
+	body, err := json.Marshal(struct {
+		Time int64    `json:"time"`
+		Tags []string `json:"tags"`
+		Text string   `json:"text"`
+	}{
+		Time: annotation.Time.UnixNano() / int64(time.Millisecond),
+		Tags: append(append([]string{}, a.opts.Tags...), annotation.Tags...),
+		Text: annotation.Text,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.opts.URL+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.opts.APIKey)
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("writing the annotation to grafana: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("grafana returned %s for the annotation %q", resp.Status, annotation.Text)
+	}
+	return nil
+}
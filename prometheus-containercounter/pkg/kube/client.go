@@ -0,0 +1,31 @@
+package kube
+
+import (
+	"os"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewClientset returns a clientset using the kubeconfig at kubeConfig if the
+// file exists, and the in-cluster config otherwise.
+func NewClientset(kubeConfig string) (*kubernetes.Clientset, error) {
+	config, err := NewConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// NewConfig returns the config of the kubeconfig at kubeConfig if the file
+// exists, and the in-cluster config otherwise.
+func NewConfig(kubeConfig string) (*rest.Config, error) {
+	// Check if the kubeConfig file exists.
+	if _, err := os.Stat(kubeConfig); !os.IsNotExist(err) {
+		// Get the kubeconfig from the filepath.
+		return clientcmd.BuildConfigFromFlags("", kubeConfig)
+	}
+	// Set to in-cluster config.
+	return rest.InClusterConfig()
+}
@@ -0,0 +1,190 @@
+package loadgen
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoadOpts configures a run of the load generator.
+type LoadOpts struct {
+	URL     string
+	Method  string
+	Profile Profile
+	// Concurrency is the most requests in flight. Once it is reached,
+	// requests are skipped rather than queued, so a slow server shows up
+	// as a lower rate rather than as a backlog.
+	Concurrency int
+	Duration    time.Duration
+	Timeout     time.Duration
+}
+
+// Second is what happened during one second of a run.
+type Second struct {
+	// Elapsed is the end of the second, since the start of the run.
+	Elapsed   time.Duration
+	TargetRPS float64
+	Requests  int
+	Errors    int
+	Skipped   int
+	P50       time.Duration
+	P90       time.Duration
+	P99       time.Duration
+}
+
+// Summary is what happened during a whole run.
+type Summary struct {
+	Requests int
+	Errors   int
+	Skipped  int
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+}
+
+// window collects the results of the requests completed in a period.
+type window struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	skipped   int
+}
+
+func (w *window) add(latency time.Duration, failed bool) {
+	w.mu.Lock()
+	w.latencies = append(w.latencies, latency)
+	if failed {
+		w.errors++
+	}
+	w.mu.Unlock()
+}
+
+func (w *window) skip() {
+	w.mu.Lock()
+	w.skipped++
+	w.mu.Unlock()
+}
+
+// take returns the results so far and starts over.
+func (w *window) take() (latencies []time.Duration, errors, skipped int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	latencies, errors, skipped = w.latencies, w.errors, w.skipped
+	w.latencies, w.errors, w.skipped = nil, 0, 0
+	return latencies, errors, skipped
+}
+
+// Run sends requests following opts.Profile until opts.Duration has passed
+// or ctx is done, calls report after every second, and returns the
+// summary of the run.
+func Run(ctx context.Context, opts LoadOpts, report func(Second)) Summary {
+	if opts.Method == "" {
+		opts.Method = http.MethodGet
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: opts.Concurrency,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var (
+		current, total window
+		wg             sync.WaitGroup
+		slots          = make(chan struct{}, opts.Concurrency)
+	)
+	send := func() {
+		defer wg.Done()
+		defer func() { <-slots }()
+
+		start := time.Now()
+		failed := false
+		req, err := http.NewRequest(opts.Method, opts.URL, nil)
+		if err == nil {
+			var resp *http.Response
+			resp, err = client.Do(req.WithContext(ctx))
+			if err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				failed = resp.StatusCode >= 500
+			}
+		}
+		// Requests cut short by the end of the run don't count.
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		latency := time.Since(start)
+		current.add(latency, failed || err != nil)
+		total.add(latency, failed || err != nil)
+	}
+
+	const tick = 10 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	start := time.Now()
+	lastReport := start
+	credit := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			latencies, errors, skipped := total.take()
+			summary := Summary{Requests: len(latencies), Errors: errors, Skipped: skipped}
+			summary.P50, summary.P90, summary.P99 = percentiles(latencies)
+			return summary
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			rate := opts.Profile.Rate(elapsed)
+			credit += rate * tick.Seconds()
+			for ; credit >= 1; credit-- {
+				select {
+				case slots <- struct{}{}:
+					wg.Add(1)
+					go send()
+				default:
+					current.skip()
+					total.skip()
+				}
+			}
+
+			if now.Sub(lastReport) >= time.Second {
+				lastReport = now
+				latencies, errors, skipped := current.take()
+				s := Second{
+					Elapsed:   elapsed.Truncate(time.Second),
+					TargetRPS: rate,
+					Requests:  len(latencies),
+					Errors:    errors,
+					Skipped:   skipped,
+				}
+				s.P50, s.P90, s.P99 = percentiles(latencies)
+				if report != nil {
+					report(s)
+				}
+			}
+		}
+	}
+}
+
+// percentiles returns the 50th, 90th and 99th percentiles of latencies,
+// which it sorts.
+func percentiles(latencies []time.Duration) (p50, p90, p99 time.Duration) {
+	if len(latencies) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	return at(0.5), at(0.9), at(0.99)
+}
@@ -0,0 +1,89 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Profile is the request rate to generate over time.
+type Profile interface {
+	// Rate returns the requests per second to send at elapsed.
+	Rate(elapsed time.Duration) float64
+}
+
+// ProfileFunc adapts a function to a Profile.
+type ProfileFunc func(elapsed time.Duration) float64
+
+func (f ProfileFunc) Rate(elapsed time.Duration) float64 { return f(elapsed) }
+
+// Constant sends rps requests per second throughout.
+func Constant(rps float64) Profile {
+	return ProfileFunc(func(time.Duration) float64 { return rps })
+}
+
+// Ramp goes linearly from from to to requests per second over d, then
+// stays at to.
+func Ramp(from, to float64, d time.Duration) Profile {
+	return ProfileFunc(func(elapsed time.Duration) float64 {
+		if d <= 0 || elapsed >= d {
+			return to
+		}
+		return from + (to-from)*float64(elapsed)/float64(d)
+	})
+}
+
+// Spike sends base requests per second, except for peak during the length
+// after at.
+func Spike(base, peak float64, at, length time.Duration) Profile {
+	return ProfileFunc(func(elapsed time.Duration) float64 {
+		if elapsed >= at && elapsed < at+length {
+			return peak
+		}
+		return base
+	})
+}
+
+// Sine oscillates around base by amplitude requests per second, over
+// period. The rate never goes below zero.
+func Sine(base, amplitude float64, period time.Duration) Profile {
+	return ProfileFunc(func(elapsed time.Duration) float64 {
+		if period <= 0 {
+			return base
+		}
+		rate := base + amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(period))
+		return math.Max(rate, 0)
+	})
+}
+
+// ProfileOpts holds the settings of every profile, as taken from flags.
+type ProfileOpts struct {
+	// RPS is the constant rate, the start of a ramp, the base of a spike
+	// and the middle of a sine wave.
+	RPS float64
+	// PeakRPS is the end of a ramp, the height of a spike and the top of a
+	// sine wave.
+	PeakRPS float64
+	// Ramp is how long a ramp lasts.
+	Ramp time.Duration
+	// SpikeAt and SpikeLength place the spike.
+	SpikeAt     time.Duration
+	SpikeLength time.Duration
+	// Period is the period of a sine wave.
+	Period time.Duration
+}
+
+// NewProfile returns the profile named name: constant, ramp, spike or sine.
+func NewProfile(name string, opts ProfileOpts) (Profile, error) {
+	switch name {
+	case "constant":
+		return Constant(opts.RPS), nil
+	case "ramp":
+		return Ramp(opts.RPS, opts.PeakRPS, opts.Ramp), nil
+	case "spike":
+		return Spike(opts.RPS, opts.PeakRPS, opts.SpikeAt, opts.SpikeLength), nil
+	case "sine":
+		return Sine(opts.RPS, opts.PeakRPS-opts.RPS, opts.Period), nil
+	}
+	return nil, fmt.Errorf("unknown profile %q, want constant, ramp, spike or sine", name)
+}
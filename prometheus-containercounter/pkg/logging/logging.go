@@ -0,0 +1,69 @@
+// Package logging sets up the structured, leveled logs of the controllers.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// New returns a logger writing JSON lines at level and above, each with the
+// pod and node from $POD_NAME and $NODE_NAME, so that the logs of every
+// replica can be told apart in Log Analytics. What is written to the
+// standard logger, as by the packages that don't take a logger, goes
+// through it too.
+func New(level string) (*zerolog.Logger, error) {
+	l, err := zerolog.ParseLevel(level)
+	if err != nil || level == "" {
+		return nil, fmt.Errorf("bad log level %q", level)
+	}
+	zerolog.SetGlobalLevel(l)
+
+	logger := zerolog.New(os.Stderr).With().
+		Timestamp().
+		Str("pod", os.Getenv("POD_NAME")).
+		Str("node", os.Getenv("NODE_NAME")).
+		Logger()
+	log.SetFlags(0)
+	log.SetOutput(logger)
+	return &logger, nil
+}
+
+// levelBody is the body of the level endpoint.
+type levelBody struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler serves the log level: GET returns it, as {"level": "info"},
+// and PUT sets it, such as to debug while looking into a decision, without
+// restarting.
+func LevelHandler(logger *zerolog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body levelBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, fmt.Sprintf("bad level: %s", err), http.StatusBadRequest)
+				return
+			}
+			level, err := zerolog.ParseLevel(body.Level)
+			if err != nil || body.Level == "" {
+				http.Error(w, fmt.Sprintf("bad level: %q", body.Level), http.StatusBadRequest)
+				return
+			}
+			zerolog.SetGlobalLevel(level)
+			logger.Info().Str("newLevel", level.String()).Msg("log level changed")
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(levelBody{Level: zerolog.GlobalLevel().String()})
+	})
+}
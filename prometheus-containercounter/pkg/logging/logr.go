@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/rs/zerolog"
+)
+
+// Logr returns a logr.Logger writing to logger, for the libraries that log
+// through logr, such as controller-runtime. Their info logs of verbosity 0
+// are logged at the info level, and the more verbose ones at the debug
+// level.
+func Logr(logger *zerolog.Logger) logr.Logger {
+	return logr.New(&logSink{logger: *logger})
+}
+
+// logSink is a logr.LogSink writing to a zerolog logger.
+type logSink struct {
+	logger zerolog.Logger
+	name   string
+}
+
+func (s *logSink) Init(logr.RuntimeInfo) {}
+
+func (s *logSink) Enabled(level int) bool {
+	return s.level(level) >= zerolog.GlobalLevel()
+}
+
+func (s *logSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.event(s.logger.WithLevel(s.level(level)), keysAndValues).Msg(msg)
+}
+
+func (s *logSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.event(s.logger.Error().Err(err), keysAndValues).Msg(msg)
+}
+
+func (s *logSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &logSink{logger: s.logger.With().Fields(fields(keysAndValues)).Logger(), name: s.name}
+}
+
+func (s *logSink) WithName(name string) logr.LogSink {
+	if s.name != "" {
+		name = s.name + "." + name
+	}
+	return &logSink{logger: s.logger, name: name}
+}
+
+func (s *logSink) level(level int) zerolog.Level {
+	if level > 0 {
+		return zerolog.DebugLevel
+	}
+	return zerolog.InfoLevel
+}
+
+func (s *logSink) event(e *zerolog.Event, keysAndValues []interface{}) *zerolog.Event {
+	if s.name != "" {
+		e = e.Str("logger", s.name)
+	}
+	return e.Fields(fields(keysAndValues))
+}
+
+// fields pairs up the keys and values logr is given.
+func fields(keysAndValues []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		m[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	return m
+}
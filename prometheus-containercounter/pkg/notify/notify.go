@@ -0,0 +1,232 @@
+// Package notify posts the burst events of the autoscale controller, a
+// policy starting or stopping to burst to the virtual node, to Slack,
+// Microsoft Teams or any webhook, so that they are seen without watching the
+// dashboards.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"time"
+)
+
+// Event is a policy starting or stopping to burst to the virtual node.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Policy is the policy, as namespace/name, and Deployment the one it
+	// scales.
+	Policy     string `json:"policy"`
+	Deployment string `json:"deployment"`
+	// Bursting is whether replicas run on the virtual node since.
+	Bursting bool `json:"bursting"`
+
+	VMReplicas      int32 `json:"vmReplicas"`
+	VirtualReplicas int32 `json:"virtualReplicas"`
+	PendingReplicas int32 `json:"pendingReplicas"`
+	MaxReplicas     int32 `json:"maxReplicas"`
+
+	// Metric is the metric the autoscaler scales on, if it has read it,
+	// with its current value and its target, per replica or as a
+	// utilization percentage.
+	Metric       string  `json:"metric,omitempty"`
+	MetricValue  float64 `json:"metricValue,omitempty"`
+	MetricTarget float64 `json:"metricTarget,omitempty"`
+}
+
+// Title returns a line saying what happened.
+func (e Event) Title() string {
+	if e.Bursting {
+		return fmt.Sprintf("%s started bursting to the virtual node", e.Policy)
+	}
+	return fmt.Sprintf("%s stopped bursting to the virtual node", e.Policy)
+}
+
+// Text returns the replicas of the event, and the metric if known.
+func (e Event) Text() string {
+	text := fmt.Sprintf("%s has %d replicas on the regular nodes, %d on the virtual node and %d pending, out of at most %d.",
+		e.Deployment, e.VMReplicas, e.VirtualReplicas, e.PendingReplicas, e.MaxReplicas)
+	if e.Metric != "" {
+		text += fmt.Sprintf(" %s is at %g against a target of %g.", e.Metric, e.MetricValue, e.MetricTarget)
+	}
+	return text
+}
+
+// Sink sends events somewhere.
+type Sink interface {
+	// Name names the sink in the errors.
+	Name() string
+	Send(e Event) error
+}
+
+// SlackSink posts events to a Slack incoming webhook.
+type SlackSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *SlackSink) Name() string { return "slack" }
+
+func (s *SlackSink) Send(e Event) error {
+	return post(s.Client, s.URL, map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", e.Title(), e.Text()),
+	})
+}
+
+// TeamsSink posts events to a Microsoft Teams incoming webhook, as message
+// cards.
+type TeamsSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *TeamsSink) Name() string { return "teams" }
+
+// The colors of the cards, orange for a burst and green once it is over.
+const (
+	burstingColor = "E8A33D"
+	settledColor  = "2EB886"
+)
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (s *TeamsSink) Send(e Event) error {
+	color := settledColor
+	if e.Bursting {
+		color = burstingColor
+	}
+	facts := []teamsFact{
+		{Name: "Regular nodes", Value: fmt.Sprint(e.VMReplicas)},
+		{Name: "Virtual node", Value: fmt.Sprint(e.VirtualReplicas)},
+		{Name: "Pending", Value: fmt.Sprint(e.PendingReplicas)},
+		{Name: "Maximum", Value: fmt.Sprint(e.MaxReplicas)},
+	}
+	if e.Metric != "" {
+		facts = append(facts, teamsFact{Name: e.Metric, Value: fmt.Sprintf("%g (target %g)", e.MetricValue, e.MetricTarget)})
+	}
+	return post(s.Client, s.URL, map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    e.Title(),
+		"themeColor": color,
+		"title":      e.Title(),
+		"text":       e.Text(),
+		"sections":   []interface{}{map[string]interface{}{"facts": facts}},
+	})
+}
+
+// WebhookSink posts events as JSON to any URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Send(e Event) error {
+	return post(s.Client, s.URL, e)
+}
+
+// post posts body as JSON to url.
+func post(client *http.Client, url string, body interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		// The URL of a webhook is its secret, so it is left out of the
+		// error.
+		if urlErr, ok := err.(*neturl.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("posting the event: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// NotifierOpts configures a notifier.
+type NotifierOpts struct {
+	// SlackURL, TeamsURL and WebhookURL are the incoming webhooks of Slack
+	// and Teams, and a URL the events are posted to as JSON. The events are
+	// sent to those that are set.
+	SlackURL   string
+	TeamsURL   string
+	WebhookURL string
+	// Sinks are sinks of other kinds the events are sent to as well.
+	Sinks []Sink
+	// Timeout bounds the time a post may take.
+	Timeout time.Duration
+	// OnError is called with the errors sending an event to a sink, which
+	// is then dropped.
+	OnError func(sink string, err error)
+}
+
+// Notifier sends the events to its sinks, in the background and in order.
+type Notifier struct {
+	sinks   []Sink
+	events  chan Event
+	onError func(sink string, err error)
+}
+
+// NewNotifier returns a notifier of the sinks set in opts, sending until
+// the process exits.
+func NewNotifier(opts NotifierOpts) (*Notifier, error) {
+	// Default to 10s if not set
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(string, error) {}
+	}
+	client := &http.Client{Timeout: opts.Timeout}
+	var sinks []Sink
+	if opts.SlackURL != "" {
+		sinks = append(sinks, &SlackSink{URL: opts.SlackURL, Client: client})
+	}
+	if opts.TeamsURL != "" {
+		sinks = append(sinks, &TeamsSink{URL: opts.TeamsURL, Client: client})
+	}
+	if opts.WebhookURL != "" {
+		sinks = append(sinks, &WebhookSink{URL: opts.WebhookURL, Client: client})
+	}
+	sinks = append(sinks, opts.Sinks...)
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no Slack, Teams or webhook URL, or other sink, to notify")
+	}
+	n := &Notifier{sinks: sinks, events: make(chan Event, 100), onError: opts.OnError}
+	go n.run()
+	return n, nil
+}
+
+// Notify queues e to be sent. Events past a full queue, as while the sinks
+// can't be reached, are dropped rather than hold the controller up.
+func (n *Notifier) Notify(e Event) {
+	select {
+	case n.events <- e:
+	default:
+		n.onError("all", fmt.Errorf("the queue is full, dropping %q", e.Title()))
+	}
+}
+
+func (n *Notifier) run() {
+	for e := range n.events {
+		for _, sink := range n.sinks {
+			if err := sink.Send(e); err != nil {
+				n.onError(sink.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package predict records the request rate of Deployments over time, and
+// predicts it from the same time in the periods before, so recurring
+// traffic, such as a nightly sale, can be scaled for ahead of time.
+package predict
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// PredictorOpts configures a predictor.
+type PredictorOpts struct {
+	// Period is how often the traffic recurs, and Periods how many of them
+	// are kept and predicted from.
+	Period  time.Duration
+	Periods int
+	// Resolution is the length of the buckets the rates are kept in; each
+	// bucket keeps the highest rate recorded in it.
+	Resolution time.Duration
+	// Lookahead bounds how far ahead the prediction looks, and so how early
+	// a Deployment is scaled before the traffic comes.
+	Lookahead time.Duration
+	// StorePath is the file the rates are saved to, and loaded from, so
+	// they survive restarts; they are only kept in memory if empty.
+	StorePath string
+}
+
+// Predictor records and predicts rates, by Deployment.
+type Predictor struct {
+	opts PredictorOpts
+
+	mu sync.Mutex
+	// series are the rates of each Deployment, by bucket: the time they were
+	// recorded at divided by the resolution.
+	series map[string]map[int64]float64
+}
+
+// NewPredictor returns a predictor, with the rates saved at StorePath if
+// there are any.
+func NewPredictor(opts PredictorOpts) (*Predictor, error) {
+	// Default to 24h, 7 periods and 1m if not set
+	if opts.Period <= 0 {
+		opts.Period = 24 * time.Hour
+	}
+	if opts.Periods <= 0 {
+		opts.Periods = 7
+	}
+	if opts.Resolution <= 0 {
+		opts.Resolution = time.Minute
+	}
+
+	p := &Predictor{opts: opts, series: make(map[string]map[int64]float64)}
+	if opts.StorePath == "" {
+		return p, nil
+	}
+	data, err := ioutil.ReadFile(opts.StorePath)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.series); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Predictor) bucket(t time.Time) int64 {
+	return t.UnixNano() / int64(p.opts.Resolution)
+}
+
+// Record records the rate of the Deployment named key at now, and forgets
+// the rates older than the periods kept.
+func (p *Predictor) Record(key string, rate float64, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buckets, ok := p.series[key]
+	if !ok {
+		buckets = make(map[int64]float64)
+		p.series[key] = buckets
+	}
+	b := p.bucket(now)
+	if rate > buckets[b] {
+		buckets[b] = rate
+	}
+
+	oldest := p.bucket(now.Add(-time.Duration(p.opts.Periods) * p.opts.Period))
+	for b := range buckets {
+		if b < oldest {
+			delete(buckets, b)
+		}
+	}
+}
+
+// Predict returns the highest rate the Deployment named key had, in any of
+// the periods kept, from now to Lookahead later. It reports false if none
+// was recorded then.
+func (p *Predictor) Predict(key string, now time.Time) (float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buckets := p.series[key]
+	var (
+		predicted float64
+		found     bool
+	)
+	for k := 1; k <= p.opts.Periods; k++ {
+		from := now.Add(-time.Duration(k) * p.opts.Period)
+		for b, last := p.bucket(from), p.bucket(from.Add(p.opts.Lookahead)); b <= last; b++ {
+			rate, ok := buckets[b]
+			if !ok {
+				continue
+			}
+			if !found || rate > predicted {
+				predicted = rate
+			}
+			found = true
+		}
+	}
+	return predicted, found
+}
+
+// Save writes the rates to StorePath, if set.
+func (p *Predictor) Save() error {
+	if p.opts.StorePath == "" {
+		return nil
+	}
+	p.mu.Lock()
+	data, err := json.Marshal(p.series)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write then rename, so a crash doesn't leave half a file.
+	tmp := p.opts.StorePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.opts.StorePath)
+}
@@ -0,0 +1,262 @@
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
+)
+
+// The kinds of Entry.
+const (
+	KindRescale    = "rescale"
+	KindPodCreated = "pod-created"
+	KindScheduled  = "pod-scheduled"
+	KindReady      = "pod-ready"
+	KindPodDeleted = "pod-deleted"
+)
+
+// Entry is one line of the timeline.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	// Name is the autoscaler's for a rescale, the pod's otherwise.
+	Name        string `json:"name"`
+	Node        string `json:"node,omitempty"`
+	VirtualNode bool   `json:"virtualNode,omitempty"`
+	// Since is the time, in seconds, since the pod was created, for pods
+	// scheduled, ready or deleted.
+	Since   float64 `json:"sinceCreatedSeconds,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+	Message string  `json:"message,omitempty"`
+}
+
+type Recorder interface {
+	Run() error
+}
+
+// RecorderOpts configures the scale event recorder.
+type RecorderOpts struct {
+	// KubeConfig is the path of a kubeconfig file, used if it exists.
+	KubeConfig string
+	Namespace  string
+	PodLabel   string
+	// NodeLabel and NodeLabelValue identify the virtual nodes.
+	NodeLabel      string
+	NodeLabelValue string
+	// Output receives the timeline, as JSON lines.
+	Output io.Writer
+}
+
+type recorder struct {
+	opts      RecorderOpts
+	k8sClient *kubernetes.Clientset
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	// nodes caches whether each node is virtual.
+	nodes map[string]bool
+	// pods is what is known about each pod, to only record each step once.
+	pods map[string]*podState
+}
+
+type podState struct {
+	scheduled bool
+	ready     bool
+}
+
+func New(opts RecorderOpts) (Recorder, error) {
+	clientset, err := kube.NewClientset(opts.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{
+		opts:      opts,
+		k8sClient: clientset,
+		enc:       json.NewEncoder(opts.Output),
+		nodes:     make(map[string]bool),
+		pods:      make(map[string]*podState),
+	}, nil
+}
+
+func (r *recorder) Run() error {
+	go r.watchLoop("events", r.watchEvents)
+	r.watchLoop("pods", r.watchPods)
+	return nil
+}
+
+// watchLoop runs watch again whenever it ends, as watches time out.
+func (r *recorder) watchLoop(what string, watch func() error) {
+	for {
+		if err := watch(); err != nil {
+			log.Printf("watching %s: %s", what, err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func (r *recorder) record(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		log.Printf("writing the timeline: %s", err)
+	}
+}
+
+// watchEvents records the rescales of the autoscalers.
+func (r *recorder) watchEvents() error {
+	w, err := r.k8sClient.CoreV1().Events(r.opts.Namespace).Watch(context.Background(), metav1.ListOptions{
+		FieldSelector: "involvedObject.kind=HorizontalPodAutoscaler",
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	// Events from before the watch started are replayed; skip them.
+	started := time.Now()
+	for ev := range w.ResultChan() {
+		if ev.Type != watch.Added {
+			continue
+		}
+		event, ok := ev.Object.(*corev1.Event)
+		if !ok || event.Reason != "SuccessfulRescale" {
+			continue
+		}
+		at := event.LastTimestamp.Time
+		if at.IsZero() {
+			at = event.FirstTimestamp.Time
+		}
+		if at.Before(started.Add(-time.Second)) {
+			continue
+		}
+		r.record(Entry{
+			Time:      at,
+			Kind:      KindRescale,
+			Namespace: event.InvolvedObject.Namespace,
+			Name:      event.InvolvedObject.Name,
+			Reason:    event.Reason,
+			Message:   event.Message,
+		})
+	}
+	return nil
+}
+
+// watchPods records when pods are created, scheduled, ready and deleted,
+// and on which nodes.
+func (r *recorder) watchPods() error {
+	w, err := r.k8sClient.CoreV1().Pods(r.opts.Namespace).Watch(context.Background(), metav1.ListOptions{
+		LabelSelector: r.opts.PodLabel,
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for ev := range w.ResultChan() {
+		pod, ok := ev.Object.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		r.observePod(ev.Type, pod, time.Now())
+	}
+	return nil
+}
+
+func (r *recorder) observePod(t watch.EventType, pod *corev1.Pod, now time.Time) {
+	key := pod.Namespace + "/" + pod.Name
+	created := pod.CreationTimestamp.Time
+	entry := Entry{
+		Time:        now,
+		Namespace:   pod.Namespace,
+		Name:        pod.Name,
+		Node:        pod.Spec.NodeName,
+		VirtualNode: r.isVirtual(pod.Spec.NodeName),
+		Since:       now.Sub(created).Seconds(),
+	}
+
+	r.mu.Lock()
+	state, known := r.pods[key]
+	if !known {
+		state = &podState{}
+		r.pods[key] = state
+	}
+	if t == watch.Deleted {
+		delete(r.pods, key)
+	}
+	r.mu.Unlock()
+
+	switch {
+	case t == watch.Deleted:
+		entry.Kind = KindPodDeleted
+		r.record(entry)
+		return
+	case !known && now.Sub(created) < time.Minute:
+		// Pods that existed before the recorder started aren't new.
+		createdEntry := entry
+		createdEntry.Kind, createdEntry.Time, createdEntry.Since = KindPodCreated, created, 0
+		createdEntry.Node, createdEntry.VirtualNode = "", false
+		r.record(createdEntry)
+	case !known:
+		// Don't replay the history of pods that existed before.
+		state.scheduled = pod.Spec.NodeName != ""
+		state.ready = podReady(pod)
+		return
+	}
+
+	if !state.scheduled && pod.Spec.NodeName != "" {
+		state.scheduled = true
+		scheduled := entry
+		scheduled.Kind = KindScheduled
+		r.record(scheduled)
+	}
+	if !state.ready && podReady(pod) {
+		state.ready = true
+		ready := entry
+		ready.Kind = KindReady
+		r.record(ready)
+	}
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// isVirtual reports whether the node named name is a virtual node.
+func (r *recorder) isVirtual(name string) bool {
+	if name == "" {
+		return false
+	}
+	r.mu.Lock()
+	virtual, ok := r.nodes[name]
+	r.mu.Unlock()
+	if ok {
+		return virtual
+	}
+
+	node, err := r.k8sClient.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("got an error trying to fetch node %s: %s", name, err)
+		return false
+	}
+	virtual = node.Labels[r.opts.NodeLabel] == r.opts.NodeLabelValue
+	r.mu.Lock()
+	r.nodes[name] = virtual
+	r.mu.Unlock()
+	return virtual
+}
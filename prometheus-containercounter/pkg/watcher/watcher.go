@@ -1,8 +1,8 @@
 package watcher
 
 import (
+	"context"
 	"log"
-	"os"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -10,8 +10,8 @@ import (
 	//corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/jeremyrickard/prometheus-containercounter/pkg/kube"
 )
 
 func init() {
@@ -59,7 +59,7 @@ func (w *watcher) sendUpdatedMetrics() {
 	listOpts := metav1.ListOptions{
 		LabelSelector: w.podLabel,
 	}
-	pods, err := w.k8sClient.CoreV1().Pods(w.namespace).List(listOpts)
+	pods, err := w.k8sClient.CoreV1().Pods(w.namespace).List(context.Background(), listOpts)
 	if err != nil {
 		log.Printf("got an error trying to fetch pods: %s", err)
 		return
@@ -89,23 +89,7 @@ type WatcherOpts struct {
 }
 
 func New(opts WatcherOpts) (Watcher, error) {
-	var config *rest.Config
-	// Check if the kubeConfig file exists.
-	if _, err := os.Stat(opts.KubeConfig); !os.IsNotExist(err) {
-		// Get the kubeconfig from the filepath.
-		config, err = clientcmd.BuildConfigFromFlags("", opts.KubeConfig)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		// Set to in-cluster config.
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kube.NewClientset(opts.KubeConfig)
 	if err != nil {
 		return nil, err
 	}